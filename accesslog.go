@@ -0,0 +1,259 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessLogEntry describes a request served by the frontend.
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Code       int           `json:"code"`
+	Duration   time.Duration `json:"duration"`
+	RemoteAddr string        `json:"remote_addr"`
+	// ClientIP is the IP of the client, per X-Forwarded-For if
+	// RemoteAddr is one of the TrustedProxies, else that of RemoteAddr.
+	ClientIP string `json:"client_ip"`
+
+	// Route is the route prefix that the request matched and
+	// Backend, the backend that it was last forwarded to.
+	Route   string `json:"route,omitempty"`
+	Backend string `json:"backend,omitempty"`
+
+	// URI and Proto complete the request line, along with Method.
+	URI   string `json:"uri"`
+	Proto string `json:"proto"`
+	// Bytes is the size of the response body sent to the client.
+	Bytes     int64  `json:"bytes"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// AccessLogFormat is the format of the access logs
+// written to AccessLogWriter, or otherwise via Logf.
+type AccessLogFormat string
+
+const (
+	// AccessLogJSON, the default, marshals entries as JSON.
+	AccessLogJSON AccessLogFormat = "json"
+	// CommonLogFormat is the Common Log Format of Apache.
+	CommonLogFormat AccessLogFormat = "common"
+	// CombinedLogFormat is the Common Log Format
+	// followed by the Referer and the User-Agent.
+	CombinedLogFormat AccessLogFormat = "combined"
+)
+
+func (alf AccessLogFormat) validate() error {
+	switch alf {
+	case "", AccessLogJSON, CommonLogFormat, CombinedLogFormat:
+		return nil
+	}
+	return fmt.Errorf("unknown access log format %q", alf)
+}
+
+// format returns the line that entry is logged as.
+func (alf AccessLogFormat) format(entry *AccessLogEntry) string {
+	switch alf {
+	case CommonLogFormat:
+		return entry.CommonLogFormat()
+	case CombinedLogFormat:
+		return entry.CombinedLogFormat()
+	}
+	blob, _ := json.Marshal(entry)
+	return string(blob)
+}
+
+// clfTimeLayout is the layout of the timestamps of the Common Log Format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// CommonLogFormat returns entry in the Common Log Format, e.g.
+//
+//	192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.1" 200 2326
+func (entry *AccessLogEntry) CommonLogFormat() string {
+	client := entry.ClientIP
+	if client == "" {
+		var err error
+		if client, _, err = net.SplitHostPort(entry.RemoteAddr); err != nil {
+			client = entry.RemoteAddr
+		}
+	}
+	if client == "" {
+		client = "-"
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	requestLine := entry.Method + " " + entry.URI + " " + entry.Proto
+	return fmt.Sprintf("%s - - [%s] \"%s\" %d %s",
+		client, entry.Time.Format(clfTimeLayout), clfEscape(requestLine), entry.Code, bytes)
+}
+
+// CombinedLogFormat returns entry in the Combined Log Format, that
+// is the Common Log Format followed by the Referer and User-Agent.
+func (entry *AccessLogEntry) CombinedLogFormat() string {
+	return fmt.Sprintf("%s \"%s\" \"%s\"",
+		entry.CommonLogFormat(), clfEscape(orDash(entry.Referer)), clfEscape(orDash(entry.UserAgent)))
+}
+
+// clfEscaper escapes the quoted fields of the Common Log Format.
+var clfEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+func clfEscape(s string) string {
+	return clfEscaper.Replace(s)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogEnabled reports whether requests are access logged.
+func (lp *livelyProxy) accessLogEnabled() bool {
+	return lp.accessLog != nil || lp.accessLogWriter != nil || lp.accessLogSamplePercent > 0
+}
+
+// shouldAccessLog reports whether the request that got a response
+// with code is logged: responses with 5XX codes always are, the
+// others only for the sampled percentage of requests.
+func (lp *livelyProxy) shouldAccessLog(code int) bool {
+	if code >= 500 {
+		return true
+	}
+	pct := lp.accessLogSamplePercent
+	if pct <= 0 {
+		// Only AccessLog was set, log everything.
+		return true
+	}
+	return rand.Float64()*100 < pct
+}
+
+// serveAccessLogged serves r, then access logs it if sampled.
+func (lp *livelyProxy) serveAccessLogged(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	start := lp.clock.Now()
+	// Before serving, which rewrites the path and the host.
+	path, host, uri, client := r.URL.Path, r.Host, r.RequestURI, clientIP(r, lp.trustedProxies, lp.trustedHops)
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	forwarded := new(forwarding)
+	serve(sw, r.WithContext(context.WithValue(r.Context(), forwardingKey{}, forwarded)))
+
+	code := sw.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if !lp.shouldAccessLog(code) {
+		return
+	}
+	lp.logAccess(&AccessLogEntry{
+		Time:       start,
+		Method:     r.Method,
+		Host:       host,
+		Path:       path,
+		Code:       code,
+		Duration:   lp.clock.Now().Sub(start),
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   client,
+		URI:        uri,
+		Proto:      r.Proto,
+		Bytes:      sw.bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Route:      forwarded.route,
+		Backend:    forwarded.backend,
+	})
+}
+
+// forwarding is where the route and the backend that a request
+// is forwarded to are noted down, for it to be access logged.
+type forwarding struct {
+	route, backend string
+}
+
+type forwardingKey struct{}
+
+// noteForwarding notes down, if the request of ctx is access
+// logged, that it is being forwarded to backend of route.
+func noteForwarding(ctx context.Context, route, backend string) {
+	if f, ok := ctx.Value(forwardingKey{}).(*forwarding); ok {
+		f.route, f.backend = route, backend
+	}
+}
+
+func (lp *livelyProxy) logAccess(entry *AccessLogEntry) {
+	switch {
+	case lp.accessLog != nil:
+		lp.accessLog(entry)
+	case lp.accessLogWriter != nil:
+		line := lp.accessLogFormat.format(entry) + "\n"
+		// Lines are written whole, one at a time.
+		lp.accessLogMu.Lock()
+		io.WriteString(lp.accessLogWriter, line)
+		lp.accessLogMu.Unlock()
+	default:
+		lp.logf("frontender: access: %s", lp.accessLogFormat.format(entry))
+	}
+}
+
+// statusWriter records the status code written
+// through it and the number of bytes of the body.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// http.ResponseWriter, for instance to hijack connections.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,203 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			http.Error(rw, "failed", http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	var entries []*AccessLogEntry
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.accessLog = func(entry *AccessLogEntry) { entries = append(entries, entry) }
+	lp.accessLogSamplePercent = 10
+
+	const n, failures = 2000, 50
+	for i := 0; i < n; i++ {
+		lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	}
+	for i := 0; i < failures; i++ {
+		lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	}
+
+	var oks, fails int
+	for _, entry := range entries {
+		switch entry.Code {
+		case http.StatusOK:
+			oks += 1
+		case http.StatusInternalServerError:
+			fails += 1
+			if entry.Path != "/fail" {
+				t.Errorf("5XX entry for the wrong path: %q", entry.Path)
+			}
+		default:
+			t.Errorf("unexpected code in %+v", entry)
+		}
+	}
+	// 10% of 2000 is 200, allow for plenty of variance.
+	if oks < 120 || oks > 280 {
+		t.Errorf("sampled %d of %d successful requests, want about 10%%", oks, n)
+	}
+	if fails != failures {
+		t.Errorf("logged %d of %d 5XX responses, want all", fails, failures)
+	}
+}
+
+func TestAccessLogDefaults(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	// Without a sample percentage, AccessLog gets every request.
+	var entries []*AccessLogEntry
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.accessLog = func(entry *AccessLogEntry) { entries = append(entries, entry) }
+	for i := 0; i < 10; i++ {
+		lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if got, want := len(entries), 10; got != want {
+		t.Errorf("entries got=%d want=%d", got, want)
+	}
+
+	// Without AccessLog, the entries are logged as JSON.
+	var logs []string
+	lp = makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.accessLogSamplePercent = 100
+	lp.logfFn = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	if len(logs) != 1 || !strings.Contains(logs[0], `"path":"/users"`) || !strings.Contains(logs[0], `"code":200`) {
+		t.Errorf("unexpected logs: %q", logs)
+	}
+}
+
+func TestAccessLogCommonLogFormat(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte("hello, world"))
+	}))
+	defer backend.Close()
+
+	clf := regexp.MustCompile(`^(\S+) - - \[(\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\] "([^"]*)" (\d{3}) (\d+|-)$`)
+
+	tests := [...]struct {
+		format AccessLogFormat
+		want   string
+	}{
+		0: {format: CommonLogFormat, want: ""},
+		1: {format: CombinedLogFormat, want: ` "https://example.org/" "curl/8.0 \"quoted\""`},
+	}
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		lp := makeTestProxy(map[string][]string{"/api": {backend.URL}})
+		lp.accessLogWriter = &buf
+		lp.accessLogFormat = tt.format
+
+		req := httptest.NewRequest("POST", "/api/items?page=2", nil)
+		req.RemoteAddr = "192.0.2.7:51234"
+		req.Header.Set("Referer", "https://example.org/")
+		req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+		start := time.Now()
+		lp.ServeHTTP(httptest.NewRecorder(), req)
+
+		line := strings.TrimSuffix(buf.String(), "\n")
+		if strings.Contains(line, "\n") {
+			t.Fatalf("#%d: expected a single line, got %q", i, buf.String())
+		}
+		if !strings.HasSuffix(line, tt.want) {
+			t.Fatalf("#%d: %q doesn't end with %q", i, line, tt.want)
+		}
+		m := clf.FindStringSubmatch(strings.TrimSuffix(line, tt.want))
+		if m == nil {
+			t.Fatalf("#%d: %q isn't in the Common Log Format", i, line)
+		}
+		if got, want := m[1], "192.0.2.7"; got != want {
+			t.Errorf("#%d: client got=%q want=%q", i, got, want)
+		}
+		when, err := time.Parse(clfTimeLayout, m[2])
+		if err != nil || when.Sub(start) > time.Minute || start.Sub(when) > time.Minute {
+			t.Errorf("#%d: unexpected timestamp %q, err=%v", i, m[2], err)
+		}
+		if got, want := m[3], "POST /api/items?page=2 HTTP/1.1"; got != want {
+			t.Errorf("#%d: request line got=%q want=%q", i, got, want)
+		}
+		if got, want := m[4], "201"; got != want {
+			t.Errorf("#%d: status got=%q want=%q", i, got, want)
+		}
+		if got, want := m[5], "12"; got != want {
+			t.Errorf("#%d: bytes got=%q want=%q", i, got, want)
+		}
+	}
+
+	if err := AccessLogFormat("apache").validate(); err == nil {
+		t.Error("expected an error for an unknown access log format")
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("queued"))
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	lp := makeTestProxy(map[string][]string{"/jobs": {backend.URL}})
+	lp.accessLogWriter = &buf
+	lp.accessLogFormat = AccessLogJSON
+	lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/jobs/1", nil))
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%q isn't a JSON line: %v", buf.String(), err)
+	}
+	want := AccessLogEntry{
+		Method:  "PUT",
+		Path:    "/jobs/1",
+		Route:   "/jobs",
+		Backend: backend.URL,
+		Code:    http.StatusAccepted,
+		Bytes:   int64(len("queued")),
+	}
+	got := AccessLogEntry{
+		Method:  entry.Method,
+		Path:    entry.Path,
+		Route:   entry.Route,
+		Backend: entry.Backend,
+		Code:    entry.Code,
+		Bytes:   entry.Bytes,
+	}
+	if got != want {
+		t.Errorf("\ngot:  %+v\nwant: %+v", got, want)
+	}
+	if entry.Duration <= 0 {
+		t.Errorf("expected a positive duration, got %v", entry.Duration)
+	}
+}
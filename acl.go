@@ -0,0 +1,115 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ACL restricts the clients that can reach a route by their IP, that
+// of the connection, as X-Forwarded-For is only trusted from the
+// TrustedProxies of the Request.
+// Entries are either CIDRs e.g "10.0.0.0/8" or single IPs.
+type ACL struct {
+	// Allow if set, lists the only clients allowed.
+	Allow []string `json:"allow"`
+
+	// Deny lists the clients denied, even if allowed.
+	Deny []string `json:"deny"`
+}
+
+// parseACLEntry parses entry as either a CIDR or an IP.
+func parseACLEntry(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (acl *ACL) validate() error {
+	for _, entries := range [][]string{acl.Allow, acl.Deny} {
+		for _, entry := range entries {
+			if _, err := parseACLEntry(entry); err != nil {
+				return fmt.Errorf("acl: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (req *Request) validateACLs() error {
+	for route, opts := range req.Routes {
+		if opts == nil || opts.ACL == nil {
+			continue
+		}
+		if err := opts.ACL.validate(); err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+	}
+	return nil
+}
+
+// aclContains reports whether any of entries contains addr.
+func aclContains(entries []string, addr netip.Addr) bool {
+	for _, entry := range entries {
+		if prefix, err := parseACLEntry(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a client at remoteAddr can reach the route.
+// Clients whose IP can't be told are only allowed by an empty ACL.
+func (acl *ACL) allows(remoteAddr string) bool {
+	if acl == nil || (len(acl.Allow) == 0 && len(acl.Deny) == 0) {
+		return true
+	}
+	addr, ok := remoteIP(remoteAddr)
+	if !ok {
+		return false
+	}
+	if aclContains(acl.Deny, addr) {
+		return false
+	}
+	return len(acl.Allow) == 0 || aclContains(acl.Allow, addr)
+}
+
+// remoteIP returns the IP of the client at remoteAddr, with
+// IPv4 addresses mapped to IPv6 unmapped, and whether it could.
+func remoteIP(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
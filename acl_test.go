@@ -0,0 +1,146 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteACL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{
+		"/":      {backend.URL},
+		"/admin": {backend.URL},
+	})
+	lp.routeOptions = map[string]*RouteOptions{
+		"/admin": {ACL: &ACL{
+			Allow: []string{"203.0.113.0/24", "2001:db8::1"},
+			Deny:  []string{"203.0.113.66"},
+		}},
+	}
+
+	tests := [...]struct {
+		path       string
+		remoteAddr string
+		wantCode   int
+	}{
+		0: {"/admin/users", "203.0.113.7:4567", http.StatusOK},
+		1: {"/admin/users", "[2001:db8::1]:4567", http.StatusOK},
+		// IPv4 clients connected over IPv6.
+		2: {"/admin/users", "[::ffff:203.0.113.7]:4567", http.StatusOK},
+		3: {"/admin/users", "198.51.100.9:4567", http.StatusForbidden},
+		4: {"/admin/users", "[2001:db8::2]:4567", http.StatusForbidden},
+		// Denied even though allowed.
+		5: {"/admin/users", "203.0.113.66:4567", http.StatusForbidden},
+		6: {"/admin/users", "not-an-ip", http.StatusForbidden},
+		// The other routes remain public.
+		7: {"/users", "198.51.100.9:4567", http.StatusOK},
+		8: {"/", "203.0.113.66:4567", http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: %s from %s: code got=%d want=%d", i, tt.path, tt.remoteAddr, got, tt.wantCode)
+		}
+	}
+}
+
+func TestValidateACLs(t *testing.T) {
+	req := &Request{
+		HTTP1: true,
+		Routes: map[string]*RouteOptions{
+			"/admin": {
+				Backends: []string{"http://localhost:7000"},
+				ACL:      &ACL{Allow: []string{"10.0.0.0/8", "192.168.1.1"}, Deny: []string{"::1"}},
+			},
+		},
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range []string{"10.0.0.0/33", "office", "10.0.0.0/8/8"} {
+		req.Routes["/admin"].ACL.Deny = []string{entry}
+		if err := req.Validate(); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
+
+func TestRouteACLCoalescedGETs(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		rw.Write([]byte("admin report"))
+	}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/admin": {backend.URL}})
+	lp.coalesceGETs = true
+	lp.routeOptions = map[string]*RouteOptions{
+		"/admin": {ACL: &ACL{Allow: []string{"203.0.113.0/24"}}},
+	}
+
+	allowed := httptest.NewRequest("GET", "/admin/report", nil)
+	allowed.RemoteAddr = "203.0.113.7:4567"
+	allowedRec := httptest.NewRecorder()
+	allowedDone := make(chan struct{})
+	go func() {
+		defer close(allowedDone)
+		lp.ServeHTTP(allowedRec, allowed)
+	}()
+	<-arrived
+
+	// The same GET from a denied client, while the allowed one is in
+	// flight, mustn't be coalesced with it and get its response.
+	denied := httptest.NewRequest("GET", "/admin/report", nil)
+	denied.RemoteAddr = "198.51.100.9:4567"
+	deniedRec := httptest.NewRecorder()
+	deniedDone := make(chan struct{})
+	go func() {
+		defer close(deniedDone)
+		lp.ServeHTTP(deniedRec, denied)
+	}()
+	select {
+	case <-deniedDone:
+	case <-time.After(time.Second):
+	}
+	close(release)
+	<-deniedDone
+	<-allowedDone
+
+	if got, want := allowedRec.Code, http.StatusOK; got != want {
+		t.Errorf("allowed: code got=%d want=%d", got, want)
+	}
+	if got, want := deniedRec.Code, http.StatusForbidden; got != want {
+		t.Errorf("denied: code got=%d want=%d", got, want)
+	}
+	if strings.Contains(deniedRec.Body.String(), "admin report") {
+		t.Errorf("denied: got the response of the allowed client %q", deniedRec.Body.String())
+	}
+}
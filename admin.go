@@ -0,0 +1,108 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// sideServers are the HTTP servers that the frontend runs
+// besides the proxy, each on its own address, if configured.
+type sideServers struct {
+	status  net.Listener
+	admin   net.Listener
+	servers []*http.Server
+}
+
+// listenSideServers binds the StatusAddr and the AdminAddr of req.
+func (req *Request) listenSideServers() (*sideServers, error) {
+	ss := new(sideServers)
+	var err error
+	if ss.status, err = listenSide("status", req.StatusAddr); err != nil {
+		return nil, err
+	}
+	if ss.admin, err = listenSide("admin", req.AdminAddr); err != nil {
+		ss.close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+func listenSide(what, addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("frontender: %s address %q: %v", what, addr, err)
+	}
+	return ln, nil
+}
+
+// serve serves handler on ln unless it is nil.
+func (ss *sideServers) serve(ln net.Listener, handler http.Handler) {
+	if ln == nil {
+		return
+	}
+	server := &http.Server{Handler: handler}
+	ss.servers = append(ss.servers, server)
+	go server.Serve(ln)
+}
+
+func (ss *sideServers) close() {
+	for _, server := range ss.servers {
+		server.Close()
+	}
+	for _, ln := range []net.Listener{ss.status, ss.admin} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+}
+
+// adminHandler serves the admin endpoints alone, never the proxy.
+func (lc *ListenConfirmation) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", lc.lproxy.serveStatus)
+	mux.HandleFunc("/metrics", lc.lproxy.serveMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !lc.Ready() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// StatusAddr returns the address that the status of the
+// backends is served at, or nil if StatusAddr wasn't set.
+func (lc *ListenConfirmation) StatusAddr() net.Addr {
+	if lc.side.status == nil {
+		return nil
+	}
+	return lc.side.status.Addr()
+}
+
+// AdminAddr returns the address that the admin endpoints
+// are served at, or nil if AdminAddr wasn't set.
+func (lc *ListenConfirmation) AdminAddr() net.Addr {
+	if lc.side.admin == nil {
+		return nil
+	}
+	return lc.side.admin.Addr()
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/odeke-em/go-uuid"
+)
+
+// SessionAffinity is how clients are pinned to the backends of
+// a route, for backends that keep the state of users in memory.
+// A client stays on its backend for as long as it is live. When
+// it isn't anymore, its clients are spread among the live ones,
+// on which they stay in turn, while the other clients don't move.
+type SessionAffinity string
+
+const (
+	// NoSessionAffinity, the default, doesn't pin the clients.
+	NoSessionAffinity SessionAffinity = "none"
+
+	// ClientIPAffinity pins the clients by their IP, as told
+	// by X-Forwarded-For from the TrustedProxies.
+	ClientIPAffinity SessionAffinity = "client_ip"
+
+	// CookieAffinity pins the clients by the value of the cookie
+	// named by SessionAffinityCookie, which the frontend sets to
+	// a random value for the clients without it.
+	CookieAffinity SessionAffinity = "cookie"
+)
+
+// DefaultSessionAffinityCookie is the name of the cookie
+// that CookieAffinity pins clients by, unless set otherwise.
+const DefaultSessionAffinityCookie = "frontender_affinity"
+
+func (sa SessionAffinity) validate() error {
+	switch sa {
+	case "", NoSessionAffinity, ClientIPAffinity, CookieAffinity:
+		return nil
+	}
+	return fmt.Errorf("unknown session affinity %q", sa)
+}
+
+func (req *Request) validateSessionAffinity() error {
+	if err := req.SessionAffinity.validate(); err != nil {
+		return err
+	}
+	if strings.IndexFunc(req.SessionAffinityCookie, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return fmt.Errorf("invalid session affinity cookie name %q", req.SessionAffinityCookie)
+	}
+	return nil
+}
+
+// affinityKey returns what r is pinned to its backend by, or ""
+// if it isn't. Clients without the affinity cookie are set one.
+func (lp *livelyProxy) affinityKey(w http.ResponseWriter, r *http.Request) string {
+	switch lp.sessionAffinity {
+	case ClientIPAffinity:
+		return clientIP(r, lp.trustedProxies, lp.trustedHops)
+
+	case CookieAffinity:
+		name := lp.sessionAffinityCookie
+		if name == "" {
+			name = DefaultSessionAffinityCookie
+		}
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+		value := uuid.NewRandom().String()
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return value
+	}
+	return ""
+}
+
+// affinityAddress returns the live backend of route that key is
+// pinned to, or "" if there is none, by consistent hashing.
+func (lp *livelyProxy) affinityAddress(route, key string) string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.tooFewLiveLocked(route) {
+		return ""
+	}
+	// The ring is only rebuilt when the live backends change.
+	generation := lp.generation[route]
+	ring := lp.affinityRings[route]
+	if ring == nil || ring.generation != generation {
+		ring = newHashRing(distinctSorted(lp.liveAddresses[route]), generation)
+		if lp.affinityRings == nil {
+			lp.affinityRings = make(map[string]*hashRing)
+		}
+		lp.affinityRings[route] = ring
+	}
+	// The keys of ejected or draining backends, which round
+	// robin skips over too, go to the next ones on the ring.
+	candidates := make(map[string]bool)
+	for _, addr := range lp.candidatesLocked(lp.liveAddresses[route], lp.clock.Now()) {
+		candidates[addr] = true
+	}
+	return ring.lookup(key, func(addr string) bool { return candidates[addr] })
+}
+
+// hashRingReplicas is the number of points of each backend on
+// a hashRing, enough for the keys to be spread evenly among them.
+const hashRingReplicas = 128
+
+type ringPoint struct {
+	hash uint64
+	addr string
+}
+
+// hashRing maps keys to the backends that own the first point of
+// the ring at or after their hash. Adding or removing a backend
+// thus only moves the keys of the points that it takes or gives up.
+type hashRing struct {
+	generation uint64
+	points     []ringPoint
+}
+
+func newHashRing(addrs []string, generation uint64) *hashRing {
+	ring := &hashRing{generation: generation, points: make([]ringPoint, 0, len(addrs)*hashRingReplicas)}
+	for _, addr := range addrs {
+		for i := 0; i < hashRingReplicas; i++ {
+			ring.points = append(ring.points, ringPoint{hash: hash64(addr + "#" + strconv.Itoa(i)), addr: addr})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		pi, pj := ring.points[i], ring.points[j]
+		if pi.hash != pj.hash {
+			return pi.hash < pj.hash
+		}
+		return pi.addr < pj.addr
+	})
+	return ring
+}
+
+// lookup returns the backend that owns key among those that
+// admit accepts, or "" if the ring has none of them.
+func (hr *hashRing) lookup(key string, admit func(addr string) bool) string {
+	n := len(hr.points)
+	h := hash64(key)
+	i := sort.Search(n, func(i int) bool { return hr.points[i].hash >= h })
+	for j := 0; j < n; j++ {
+		if addr := hr.points[(i+j)%n].addr; admit(addr) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// hash64 hashes s with FNV-1a, whose bits are then mixed as
+// SplitMix64 does, since the FNV hashes of similar strings
+// such as those of the points of a backend are close together.
+// Unlike hash/maphash, the hashes are the same across processes
+// so that the replicas of the frontend pin clients alike.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIPAffinity(t *testing.T) {
+	const a, b, c = "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"
+	lp := makeTestProxy(map[string][]string{"/": {a, b, c}})
+	lp.sessionAffinity = ClientIPAffinity
+
+	pick := func(ip string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":4711"
+		return lp.pickAddress("/", nil, httptest.NewRecorder(), r)
+	}
+
+	pinned := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		ip := fmt.Sprintf("192.0.2.%d", i%250+1)
+		if i >= 250 {
+			ip = fmt.Sprintf("198.51.100.%d", i-249)
+		}
+		addr := pick(ip)
+		pinned[ip] = addr
+		counts[addr] += 1
+	}
+	// The clients are spread among all the backends.
+	for _, addr := range []string{a, b, c} {
+		if counts[addr] < 50 {
+			t.Errorf("only %d of 300 clients pinned to %q: %v", counts[addr], addr, counts)
+		}
+	}
+	// And they stay on their backend.
+	for round := 0; round < 3; round++ {
+		for ip, want := range pinned {
+			if got := pick(ip); got != want {
+				t.Fatalf("round #%d: %s moved from %q to %q", round, ip, want, got)
+			}
+		}
+	}
+
+	// Once c is no longer live, only its clients move.
+	lp.mu.Lock()
+	lp.liveAddresses["/"] = []string{a, b}
+	lp.generation["/"] += 1
+	lp.mu.Unlock()
+	for ip, before := range pinned {
+		got := pick(ip)
+		switch {
+		case before != c && got != before:
+			t.Errorf("%s moved from live %q to %q", ip, before, got)
+		case got == c:
+			t.Errorf("%s still pinned to %q which isn't live", ip, c)
+		}
+		pinned[ip] = got
+	}
+	for ip, want := range pinned {
+		if got := pick(ip); got != want {
+			t.Errorf("%s wasn't re-pinned: moved from %q to %q", ip, want, got)
+		}
+	}
+}
+
+func TestAffinitySkipsDrainingBackends(t *testing.T) {
+	const a, b, c = "http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"
+	lp := makeTestProxy(map[string][]string{"/": {a, b, c}})
+	clock := newFakeClock()
+	lp.clock = clock
+	lp.sessionAffinity = ClientIPAffinity
+
+	pick := func(ip string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":4711"
+		return lp.pickAddress("/", nil, httptest.NewRecorder(), r)
+	}
+
+	pinned := make(map[string]string)
+	for i := 1; i <= 100; i++ {
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		pinned[ip] = pick(ip)
+	}
+
+	// While b drains, its clients go to the others, and only they move.
+	lp.markDraining(b)
+	for ip, before := range pinned {
+		got := pick(ip)
+		switch {
+		case got == b:
+			t.Errorf("%s still pinned to the draining %q", ip, b)
+		case before != b && got != before:
+			t.Errorf("%s moved from %q to %q", ip, before, got)
+		}
+	}
+
+	// They are pinned back once it is done draining.
+	clock.Advance(drainingPeriod + time.Second)
+	for ip, want := range pinned {
+		if got := pick(ip); got != want {
+			t.Errorf("%s wasn't pinned back: got=%q want=%q", ip, got, want)
+		}
+	}
+}
+
+func TestCookieAffinity(t *testing.T) {
+	backends := []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"}
+	lp := makeTestProxy(map[string][]string{"/": backends})
+	lp.sessionAffinity = CookieAffinity
+	lp.sessionAffinityCookie = "sticky"
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		rec := httptest.NewRecorder()
+		addr := lp.pickAddress("/", nil, rec, httptest.NewRequest("GET", "/", nil))
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "sticky" || cookies[0].Value == "" {
+			t.Fatalf("#%d: expected the affinity cookie to be set, got %v", i, cookies)
+		}
+		counts[addr] += 1
+
+		// With the cookie, the client sticks to its backend
+		// and isn't set another cookie.
+		for j := 0; j < 5; j++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "sticky", Value: cookies[0].Value})
+			rec := httptest.NewRecorder()
+			if got := lp.pickAddress("/", nil, rec, r); got != addr {
+				t.Fatalf("#%d.%d: moved from %q to %q", i, j, addr, got)
+			}
+			if got := rec.Header().Get("Set-Cookie"); got != "" {
+				t.Errorf("#%d.%d: unexpectedly set a cookie %q", i, j, got)
+			}
+		}
+	}
+	if len(counts) < 2 {
+		t.Errorf("all the clients were pinned to the same backend: %v", counts)
+	}
+
+	if err := (&Request{SessionAffinity: "sticky"}).validateSessionAffinity(); err == nil {
+		t.Error("expected an error for an unknown session affinity")
+	}
+	if err := (&Request{SessionAffinity: CookieAffinity, SessionAffinityCookie: "a b"}).validateSessionAffinity(); err == nil {
+		t.Error("expected an error for an invalid cookie name")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"time"
+)
+
+// CanaryOptions sends a share of the traffic of a route to a pool
+// of canary backends, and automatically rolls the canary back to 0%
+// once its error rate exceeds MaxErrorRate.
+//
+// Canary backends aren't health checked and requests sent
+// to them aren't retried, so that all their failures count.
+// A rolled back canary stays at 0% until a Reload changes
+// its options.
+type CanaryOptions struct {
+	Backends []string `json:"backends"`
+
+	// Percent is the share, from 0 to 100, of
+	// the requests of the route sent to the canary.
+	Percent int `json:"percent"`
+
+	// MaxErrorRate is the fraction, from 0 to 1, of canary
+	// requests within a window that may fail with a 5XX
+	// status or fail to reach the canary, before rollback.
+	MaxErrorRate float64 `json:"max_error_rate"`
+
+	// Window is the period over which the error
+	// rate is measured. It defaults to a minute.
+	Window time.Duration `json:"window"`
+
+	// MinRequests is the number of canary requests needed in a
+	// window before its error rate is considered. It defaults to 10.
+	MinRequests int `json:"min_requests"`
+}
+
+const (
+	defaultCanaryWindow      = time.Minute
+	defaultCanaryMinRequests = 10
+)
+
+func (co *CanaryOptions) validate() error {
+	if co.Percent < 0 || co.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got: %d", co.Percent)
+	}
+	if co.MaxErrorRate < 0 || co.MaxErrorRate > 1 {
+		return fmt.Errorf("canary max error rate must be between 0 and 1, got: %v", co.MaxErrorRate)
+	}
+	if co.Percent > 0 && len(normalizeAddresses(co.Backends)) == 0 {
+		return fmt.Errorf("canary of %d%% has no backends", co.Percent)
+	}
+	return nil
+}
+
+func (co *CanaryOptions) window() time.Duration {
+	if co.Window > 0 {
+		return co.Window
+	}
+	return defaultCanaryWindow
+}
+
+func (co *CanaryOptions) minRequests() int {
+	if co.MinRequests > 0 {
+		return co.MinRequests
+	}
+	return defaultCanaryMinRequests
+}
+
+func (req *Request) validateCanaries() error {
+	for route, opts := range req.Routes {
+		if opts == nil || opts.Canary == nil {
+			continue
+		}
+		if err := opts.Canary.validate(); err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+	}
+	return nil
+}
+
+// canaryState tracks the traffic sent to, and
+// the errors returned by the canary of a route.
+type canaryState struct {
+	// sent counts all the requests of the route,
+	// to deterministically pick which go to the canary.
+	sent uint64
+	next int
+
+	windowStart time.Time
+	requests    int
+	errors      int
+
+	rolledBack bool
+}
+
+// canaryAddress returns the canary backend that the request
+// should be sent to, or "" if it should go to the usual backends.
+func (lp *livelyProxy) canaryAddress(route string, co *CanaryOptions) string {
+	if co == nil || co.Percent <= 0 {
+		return ""
+	}
+	backends := normalizeAddresses(co.Backends)
+	if len(backends) == 0 {
+		return ""
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	cs := lp.canaryStateLocked(route)
+	if cs.rolledBack {
+		return ""
+	}
+	n := cs.sent % 100
+	cs.sent += 1
+	if n >= uint64(co.Percent) {
+		return ""
+	}
+	addr := backends[cs.next%len(backends)]
+	cs.next += 1
+	return addr
+}
+
+func (lp *livelyProxy) canaryStateLocked(route string) *canaryState {
+	if lp.canaries == nil {
+		lp.canaries = make(map[string]*canaryState)
+	}
+	cs := lp.canaries[route]
+	if cs == nil {
+		cs = new(canaryState)
+		lp.canaries[route] = cs
+	}
+	return cs
+}
+
+// recordCanaryResult counts the outcome of a request sent
+// to the canary of route and rolls the canary back if its
+// error rate within the current window is too high.
+func (lp *livelyProxy) recordCanaryResult(route string, co *CanaryOptions, failed bool) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	cs := lp.canaryStateLocked(route)
+	if cs.rolledBack {
+		return
+	}
+	now := lp.clock.Now()
+	if now.Sub(cs.windowStart) >= co.window() {
+		cs.windowStart = now
+		cs.requests, cs.errors = 0, 0
+	}
+	cs.requests += 1
+	if failed {
+		cs.errors += 1
+	}
+	if cs.requests < co.minRequests() {
+		return
+	}
+	if rate := float64(cs.errors) / float64(cs.requests); rate > co.MaxErrorRate {
+		cs.rolledBack = true
+		lp.logf("frontender: rolled back the canary of route %q: error rate %.2f exceeds %.2f", route, rate, co.MaxErrorRate)
+	}
+}
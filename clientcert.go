@@ -0,0 +1,42 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// setClientCertHeaders replaces any client supplied client certificate
+// headers of r with the subject and SHA-256 fingerprint of the client
+// certificate of its connection, but only if that certificate was verified.
+func setClientCertHeaders(r *http.Request) {
+	r.Header.Del(clientCertSubjectHeader)
+	r.Header.Del(clientCertFingerprintHeader)
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set(clientCertSubjectHeader, cert.Subject.String())
+	r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/orijtech/frontender"
+)
+
+func selfSignedCert(t *testing.T, commonName string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"orijtech"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestForwardClientCert(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ping" {
+			received <- req.Header
+		}
+	}))
+	defer backend.Close()
+
+	serverCert, serverX509 := selfSignedCert(t, "frontend", x509.ExtKeyUsageServerAuth)
+	clientCert, clientX509 := selfSignedCert(t, "alice", x509.ExtKeyUsageClientAuth)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	tlsLn := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    clientCAs,
+	})
+
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return tlsLn },
+		PrefixRouter:      map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod: 10 * time.Millisecond,
+		ForwardClientCert: true,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverX509)
+	get := func(certs []tls.Certificate) http.Header {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: certs},
+		}}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/", nil)
+			req.Header.Set("X-Client-Cert-Subject", "CN=mallory")
+			res, err := client.Do(req)
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode == http.StatusOK {
+					return <-received
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("frontend never became ready: %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	header := get([]tls.Certificate{clientCert})
+	if got, want := header.Get("X-Client-Cert-Subject"), "CN=alice,O=orijtech"; got != want {
+		t.Errorf("subject got=%q want=%q", got, want)
+	}
+	fingerprint := sha256.Sum256(clientX509.Raw)
+	if got, want := header.Get("X-Client-Cert-Fingerprint"), hex.EncodeToString(fingerprint[:]); got != want {
+		t.Errorf("fingerprint got=%q want=%q", got, want)
+	}
+
+	// Without a client certificate, the spoofed header must be dropped.
+	header = get(nil)
+	if got := header.Get("X-Client-Cert-Subject"); got != "" {
+		t.Errorf("unverified client: unexpected subject %q", got)
+	}
+}
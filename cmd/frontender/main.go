@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -12,35 +13,69 @@ import (
 )
 
 func main() {
+	fReq, err := parseRequest(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	confirmation, err := frontender.Listen(fReq)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer confirmation.Close()
+
+	if err := confirmation.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseRequest parses the command line args into a frontender.Request.
+func parseRequest(args []string) (*frontender.Request, error) {
 	var http1 bool
 	var csvBackendAddresses string
 	var nonHTTPSAddr string
 	var backendPingPeriodStr string
 	var csvDomains string
 	var noAutoWWW bool
+	var csvNoAutoWWWFor string
 	var nonHTTPSRedirectURL string
 	var routeFile string
+	var acmeEmail string
+	var configFile string
 
-	flag.StringVar(&csvBackendAddresses, "csv-backends", "", "the comma separated addresses of the backend servers")
-	flag.StringVar(&csvDomains, "domains", "", "the comma separated domains that the frontend will be representing")
-	flag.BoolVar(&http1, "http1", false, "if true signals that the server should run as an http1 server locally")
-	flag.StringVar(&nonHTTPSAddr, "non-https-addr", ":8877", "the non-https address")
-	flag.StringVar(&nonHTTPSRedirectURL, "non-https-redirect", "", "the URL to which all non-HTTPS traffic will be redirected")
-	flag.BoolVar(&noAutoWWW, "no-auto-www", false, "if set, explicits tells the frontend service NOT to make equivalent www CNAMEs of domains, if the www CNAMEs haven't yet been set")
-	flag.StringVar(&backendPingPeriodStr, "backend-ping-period", "3m", `the period for which the frontend should ping the backend servers. Please enter this value with the form <DIGIT><UNIT> where <UNIT> could be  "ns", "us" (or "µs"), "ms", "s", "m", "h"`)
-	flag.StringVar(&routeFile, "route-file", "", "the file containing the routing")
-	flag.Parse()
-	f, err := os.Open(routeFile)
-	if err != nil && false {
-		log.Fatalf("route-file: %v\n", err)
+	fs := flag.NewFlagSet("frontender", flag.ExitOnError)
+	fs.StringVar(&csvBackendAddresses, "csv-backends", "", "the comma separated addresses of the backend servers")
+	fs.StringVar(&csvDomains, "domains", "", "the comma separated domains that the frontend will be representing")
+	fs.BoolVar(&http1, "http1", false, "if true signals that the server should run as an http1 server locally")
+	fs.StringVar(&nonHTTPSAddr, "non-https-addr", ":8877", "the non-https address")
+	fs.StringVar(&nonHTTPSRedirectURL, "non-https-redirect", "", "the URL to which all non-HTTPS traffic will be redirected")
+	fs.BoolVar(&noAutoWWW, "no-auto-www", false, "if set, explicits tells the frontend service NOT to make equivalent www CNAMEs of domains, if the www CNAMEs haven't yet been set")
+	fs.StringVar(&csvNoAutoWWWFor, "no-auto-www-for", "", "the comma separated domains for which the frontend should NOT make equivalent www CNAMEs, explicitly listed www domains are kept")
+	fs.StringVar(&backendPingPeriodStr, "backend-ping-period", "3m", `the period for which the frontend should ping the backend servers. Please enter this value with the form <DIGIT><UNIT> where <UNIT> could be  "ns", "us" (or "µs"), "ms", "s", "m", "h"`)
+	fs.StringVar(&routeFile, "route-file", "", "the file containing the routing")
+	fs.StringVar(&acmeEmail, "acme-email", "", "the contact email of the ACME account that certificates are obtained with")
+	fs.StringVar(&configFile, "config", "", "the YAML or JSON file containing the configuration, if set the other flags are ignored")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
-	if f != nil {
-		defer f.Close()
+
+	if configFile != "" {
+		return frontender.LoadRequestFromFile(configFile)
 	}
 
-	ns, err := namespace.ParseWithHeaderDelimiter(f, ",")
-	if err != nil {
-		log.Fatalf("namespace: %v", err)
+	ns := make(map[string][]string)
+	var routes map[string]*frontender.RouteOptions
+	if routeFile != "" {
+		f, err := os.Open(routeFile)
+		if err != nil {
+			return nil, fmt.Errorf("route-file: %v", err)
+		}
+		defer f.Close()
+
+		ns, routes, err = parseRouteFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("route-file: %v", err)
+		}
 	}
 
 	var pingPeriod time.Duration
@@ -55,28 +90,27 @@ func main() {
 		}
 	}
 
+	var noAutoWWWFor []string
+	if csvNoAutoWWWFor != "" {
+		noAutoWWWFor = splitAndTrimAddresses(csvNoAutoWWWFor)
+	}
+
 	fReq := &frontender.Request{
 		HTTP1:   http1,
 		Domains: splitAndTrimAddresses(csvDomains),
 
 		NoAutoWWW:           noAutoWWW,
+		NoAutoWWWFor:        noAutoWWWFor,
 		NonHTTPSAddr:        nonHTTPSAddr,
 		NonHTTPSRedirectURL: nonHTTPSRedirectURL,
+		ACMEEmail:           acmeEmail,
 
 		BackendPingPeriod: pingPeriod,
-		PrefixRouter:      (map[string][]string)(ns),
+		PrefixRouter:      ns,
+		Routes:            routes,
 		ProxyAddresses:    proxyAddresses,
 	}
-
-	confirmation, err := frontender.Listen(fReq)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer confirmation.Close()
-
-	if err := confirmation.Wait(); err != nil {
-		log.Fatal(err)
-	}
+	return fReq, nil
 }
 
 func splitAndTrimAddresses(csvOfAddresses string) []string {
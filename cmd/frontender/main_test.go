@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseNoAutoWWWFor(t *testing.T) {
+	tests := [...]struct {
+		args             []string
+		wantNoAutoWWW    bool
+		wantNoAutoWWWFor []string
+		wantDomains      []string
+	}{
+		0: {
+			args:        []string{"-domains", "foo.com,bar.com"},
+			wantDomains: []string{"bar.com", "foo.com", "www.bar.com", "www.foo.com"},
+		},
+		1: {
+			args:          []string{"-domains", "foo.com,bar.com", "-no-auto-www"},
+			wantNoAutoWWW: true,
+			wantDomains:   []string{"bar.com", "foo.com"},
+		},
+		2: {
+			args:             []string{"-domains", "foo.com,bar.com,www.baz.com", "-no-auto-www-for", "foo.com, www.baz.com"},
+			wantNoAutoWWWFor: []string{"foo.com", "www.baz.com"},
+			wantDomains:      []string{"bar.com", "foo.com", "www.bar.com", "www.baz.com"},
+		},
+	}
+
+	for i, tt := range tests {
+		req, err := parseRequest(tt.args)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if got, want := req.NoAutoWWW, tt.wantNoAutoWWW; got != want {
+			t.Errorf("#%d: NoAutoWWW got=%v want=%v", i, got, want)
+		}
+		if got, want := req.NoAutoWWWFor, tt.wantNoAutoWWWFor; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: NoAutoWWWFor got=%q want=%q", i, got, want)
+		}
+		gotDomains := req.SynthesizeDomains()
+		sort.Strings(gotDomains)
+		if !reflect.DeepEqual(gotDomains, tt.wantDomains) {
+			t.Errorf("#%d: domains got=%q want=%q", i, gotDomains, tt.wantDomains)
+		}
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frontender.yaml")
+	config := "domains: [foo.com]\nno_auto_www: true\nrouting:\n  /: [http://localhost:8889]\n"
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file takes precedence over the other flags.
+	req, err := parseRequest([]string{"-domains", "bar.com", "-config", path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := req.Domains, []string{"foo.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Domains got=%q want=%q", got, want)
+	}
+	if !req.NoAutoWWW {
+		t.Error("expected NoAutoWWW to be set")
+	}
+
+	if _, err := parseRequest([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+}
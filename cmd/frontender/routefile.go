@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/orijtech/frontender"
+	"github.com/orijtech/namespace"
+)
+
+// parseRouteFile parses a route file in the namespace format, extended
+// with option lines that configure the route of a prefix. An option
+// line starts with "@", followed by the prefix and space separated
+// key=value options e.g
+//
+//	@/api retries=2 timeout=5s no_strip_prefix=true
+//	@/api weight=http://localhost:8999=3 weight=http://localhost:9000=1
+//
+// The recognized options are:
+//   - timeout: a duration such as "5s", see RouteOptions.Timeout
+//   - retries: an integer, see RouteOptions.Retries
+//   - no_strip_prefix: a boolean, see RouteOptions.NoStripPrefix
+//   - rewrite_prefix: see RouteOptions.RewritePrefix
+//   - shard_header: see RouteOptions.ShardHeader
+//   - min_live_backends: an integer, see RouteOptions.MinLiveBackends
+//   - weight: <backend address>=<integer>, which can be repeated
+//
+// Option lines for the same prefix are combined and all
+// the other lines are parsed by the namespace package.
+func parseRouteFile(r io.Reader) (map[string][]string, map[string]*frontender.RouteOptions, error) {
+	nsBuf := new(bytes.Buffer)
+	routes := make(map[string]*frontender.RouteOptions)
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "@") {
+			nsBuf.WriteString(line)
+			nsBuf.WriteString("\n")
+			continue
+		}
+		if err := parseRouteOptionsLine(routes, strings.TrimPrefix(trimmed, "@")); err != nil {
+			return nil, nil, fmt.Errorf("line #%d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	pr := make(map[string][]string)
+	parsed, err := namespace.ParseWithHeaderDelimiter(nsBuf, ",")
+	if err != nil {
+		return nil, nil, err
+	}
+	for prefix, addresses := range parsed {
+		pr[prefix] = addresses
+	}
+	return pr, routes, nil
+}
+
+func parseRouteOptionsLine(routes map[string]*frontender.RouteOptions, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return fmt.Errorf("missing the route prefix")
+	}
+	prefix := fields[0]
+	opts := routes[prefix]
+	if opts == nil {
+		opts = new(frontender.RouteOptions)
+		routes[prefix] = opts
+	}
+
+	for _, field := range fields[1:] {
+		splits := strings.SplitN(field, "=", 2)
+		if len(splits) != 2 {
+			return fmt.Errorf("%q: expecting key=value", field)
+		}
+		key, value := splits[0], splits[1]
+		var err error
+		switch key {
+		case "timeout":
+			opts.Timeout, err = time.ParseDuration(value)
+		case "retries":
+			opts.Retries, err = strconv.Atoi(value)
+		case "no_strip_prefix":
+			opts.NoStripPrefix, err = strconv.ParseBool(value)
+		case "rewrite_prefix":
+			opts.RewritePrefix = value
+		case "shard_header":
+			opts.ShardHeader = value
+		case "min_live_backends":
+			opts.MinLiveBackends, err = strconv.Atoi(value)
+		case "weight":
+			// The address itself can contain "=" so
+			// the weight is after the last one.
+			i := strings.LastIndex(value, "=")
+			if i < 0 {
+				return fmt.Errorf("%q: expecting weight=<address>=<weight>", field)
+			}
+			var weight int
+			weight, err = strconv.Atoi(value[i+1:])
+			if err == nil {
+				if opts.Weights == nil {
+					opts.Weights = make(map[string]int)
+				}
+				opts.Weights[value[:i]] = weight
+			}
+		default:
+			return fmt.Errorf("%q: unknown option %q", field, key)
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v", field, err)
+		}
+	}
+	return nil
+}
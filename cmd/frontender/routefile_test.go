@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/orijtech/frontender"
+)
+
+func TestParseRouteFileOptions(t *testing.T) {
+	routeFile := `
+@/api retries=2 timeout=5s no_strip_prefix=true
+@/api weight=http://localhost:8999=3 weight=http://localhost:9000=1
+@/static rewrite_prefix=/assets shard_header=X-Shard min_live_backends=2
+`
+	_, routes, err := parseRouteFile(strings.NewReader(routeFile))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := map[string]*frontender.RouteOptions{
+		"/api": {
+			Retries:       2,
+			Timeout:       5 * time.Second,
+			NoStripPrefix: true,
+			Weights: map[string]int{
+				"http://localhost:8999": 3,
+				"http://localhost:9000": 1,
+			},
+		},
+		"/static": {
+			RewritePrefix:   "/assets",
+			ShardHeader:     "X-Shard",
+			MinLiveBackends: 2,
+		},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes:\ngot:  %#v\nwant: %#v", routes, want)
+	}
+}
+
+func TestParseRouteFileOptionsErrors(t *testing.T) {
+	tests := [...]string{
+		0: "@",
+		1: "@/api retries",
+		2: "@/api retries=two",
+		3: "@/api timeout=5",
+		4: "@/api weight=http://localhost:8999",
+		5: "@/api colour=blue",
+	}
+
+	for i, routeFile := range tests {
+		if _, _, err := parseRouteFile(strings.NewReader(routeFile)); err == nil {
+			t.Errorf("#%d: %q: expected an error", i, routeFile)
+		}
+	}
+}
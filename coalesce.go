@@ -0,0 +1,219 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// flight is an upstream GET request whose
+// response is shared by identical requests.
+type flight struct {
+	done    chan struct{}
+	waiters int
+	res     *capturedResponse
+	// header is that of the request in flight, to
+	// tell the waiters that its response varies for.
+	header http.Header
+}
+
+// capturedResponse is a response buffered for later replay.
+type capturedResponse struct {
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (cr *capturedResponse) replay(w http.ResponseWriter) {
+	for key, values := range cr.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	code := cr.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	w.Write(cr.body.Bytes())
+}
+
+// variesFor reports whether the response, to a request with header
+// requested, could have been different for a request with header.
+func (cr *capturedResponse) variesFor(requested, header http.Header) bool {
+	for _, value := range cr.header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return true
+			}
+			if name != "" && strings.Join(requested.Values(name), ",") != strings.Join(header.Values(name), ",") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// private reports whether the response is meant for the client
+// that requested it alone, as it sets cookies or asks not to be
+// shared or stored, and so mustn't be replayed to others.
+func (cr *capturedResponse) private() bool {
+	if len(cr.header.Values("Set-Cookie")) > 0 {
+		return true
+	}
+	for _, value := range cr.header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flightWriter writes the response of a flight through to the
+// ResponseWriter of the request that made it, only buffering it
+// for replay if other requests are waiting on it by then.
+type flightWriter struct {
+	lp  *livelyProxy
+	key string
+	f   *flight
+	w   http.ResponseWriter
+
+	started   bool
+	buffering bool
+}
+
+var _ http.Flusher = (*flightWriter)(nil)
+
+func (fw *flightWriter) Header() http.Header { return fw.w.Header() }
+
+func (fw *flightWriter) WriteHeader(code int) {
+	if fw.started {
+		return
+	}
+	fw.started = true
+
+	// The requests arriving from now on can't share
+	// the response, as its start would be missing.
+	fw.lp.mu.Lock()
+	fw.lp.endFlightLocked(fw.key, fw.f)
+	fw.buffering = fw.f.waiters > 0
+	fw.lp.mu.Unlock()
+
+	if fw.buffering {
+		fw.f.res.code = code
+		fw.f.res.header = fw.w.Header().Clone()
+	}
+	fw.w.WriteHeader(code)
+}
+
+func (fw *flightWriter) Write(b []byte) (int, error) {
+	if !fw.started {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if fw.buffering {
+		fw.f.res.body.Write(b)
+	}
+	return fw.w.Write(b)
+}
+
+func (fw *flightWriter) Flush() {
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (fw *flightWriter) Unwrap() http.ResponseWriter { return fw.w }
+
+// coalescable reports whether r can share its response with
+// identical requests: only GETs that carry no credentials, be
+// they headers or a client certificate, nor ask for a range, a
+// stream of events or to upgrade the connection, are.
+func coalescable(r *http.Request) bool {
+	if r.Method != "GET" || isUpgrade(r) {
+		return false
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return false
+	}
+	for _, name := range [...]string{"Authorization", "Cookie", "Range"} {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return !httpguts.HeaderValuesContainsToken(r.Header.Values("Accept"), "text/event-stream")
+}
+
+// coalescingKey returns the key of the flights that r can join.
+// Requests that accept different encodings get different responses.
+func coalescingKey(r *http.Request) string {
+	key := r.Host + " " + r.URL.RequestURI()
+	if encodings := r.Header.Values("Accept-Encoding"); len(encodings) > 0 {
+		key += " " + strings.Join(encodings, ",")
+	}
+	return key
+}
+
+func (lp *livelyProxy) endFlightLocked(key string, f *flight) {
+	if lp.flights[key] == f {
+		delete(lp.flights, key)
+	}
+}
+
+// serveCoalesced serves r such that identical concurrent requests,
+// those with the same host, URI and accepted encodings, are coalesced
+// into a single upstream request, made with forward, whose response
+// is shared by those that arrived before it started, unless it varies
+// for them or is private. The others make their own requests.
+func (lp *livelyProxy) serveCoalesced(w http.ResponseWriter, r *http.Request, forward func(http.ResponseWriter)) {
+	key := coalescingKey(r)
+
+	lp.mu.Lock()
+	if f, ok := lp.flights[key]; ok {
+		f.waiters += 1
+		lp.mu.Unlock()
+
+		select {
+		case <-f.done:
+			if f.res.private() || f.res.variesFor(f.header, r.Header) {
+				forward(w)
+			} else {
+				f.res.replay(w)
+			}
+		case <-r.Context().Done():
+			http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if lp.flights == nil {
+		lp.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{}), res: new(capturedResponse), header: r.Header.Clone()}
+	lp.flights[key] = f
+	lp.mu.Unlock()
+
+	fw := &flightWriter{lp: lp, key: key, f: f, w: w}
+	defer close(f.done)
+	forward(fw)
+	if !fw.started {
+		fw.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// requestFields has the fields of Request without its UnmarshalJSON
+// method, which would otherwise be promoted to the types embedding it.
+type requestFields Request
+
+// legacyRequestKeys has the keys of the fields of Request
+// that were known by other names before they were tagged.
+type legacyRequestKeys struct {
+	LegacyBackendPingPeriod *time.Duration `json:"BackendPingPeriod"`
+}
+
+func (lk *legacyRequestKeys) apply(req *Request) {
+	if lk.LegacyBackendPingPeriod != nil && req.BackendPingPeriod == 0 {
+		req.BackendPingPeriod = *lk.LegacyBackendPingPeriod
+	}
+}
+
+// UnmarshalJSON decodes the Request from JSON, also accepting
+// the "BackendPingPeriod" key of the configurations written
+// before it was renamed "backend_ping_period".
+func (req *Request) UnmarshalJSON(blob []byte) error {
+	aux := struct {
+		*requestFields
+		legacyRequestKeys
+	}{requestFields: (*requestFields)(req)}
+	if err := json.Unmarshal(blob, &aux); err != nil {
+		return err
+	}
+	aux.legacyRequestKeys.apply(req)
+	return nil
+}
+
+// requestFile is the layout of the configuration files
+// loaded by LoadRequestFromFile.
+type requestFile struct {
+	*requestFields
+	legacyRequestKeys
+
+	// CertFile and KeyFile if set, are the paths of the TLS
+	// certificate and private key to serve with, see CertKeyFiler.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// LoadRequestFromFile loads a Request from the configuration file at
+// path, in YAML for the ".yaml" and ".yml" extensions or in JSON for
+// ".json". The keys are the JSON names of the fields of Request, e.g
+//
+//	domains: [orijtech.com]
+//	routing:
+//	  /api: [http://localhost:8999, http://localhost:9000]
+//	routes:
+//	  /api:
+//	    timeout: 5s
+//	idle_timeout: 2m
+//	cert_file: /etc/frontender/cert.pem
+//	key_file: /etc/frontender/key.pem
+//
+// Durations can be written as strings such as "5s", or as integers
+// in nanoseconds. cert_file and key_file set CertKeyFiler. The
+// loaded Request is validated before it is returned.
+func LoadRequestFromFile(path string) (*Request, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(blob, &doc)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(blob))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file extension %q, expecting .yaml, .yml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	rf := &requestFile{requestFields: new(requestFields)}
+	if doc != nil {
+		doc, err = normalizeConfigValue(doc, reflect.TypeOf(rf))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		normalized, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(normalized))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(rf); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	req := (*Request)(rf.requestFields)
+	rf.legacyRequestKeys.apply(req)
+	if rf.CertFile != "" || rf.KeyFile != "" {
+		if rf.CertFile == "" || rf.KeyFile == "" {
+			return nil, fmt.Errorf("%s: expecting both cert_file and key_file to be set", path)
+		}
+		certFile, keyFile := rf.CertFile, rf.KeyFile
+		req.CertKeyFiler = func() (string, string) { return certFile, keyFile }
+	}
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return req, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// normalizeConfigValue converts the decoded configuration value v,
+// destined for a value of type t, into a form that encoding/json can
+// decode into t: YAML maps get string keys and durations written
+// as strings such as "5s" are converted to nanoseconds.
+func normalizeConfigValue(v interface{}, t reflect.Type) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		return int64(d), nil
+	}
+
+	switch vt := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(vt))
+		for key, value := range vt {
+			m[fmt.Sprint(key)] = value
+		}
+		return normalizeConfigValue(m, t)
+
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFieldTypes(t)
+			for key, value := range vt {
+				ft, ok := fields[key]
+				if !ok {
+					// Left for the decoder to report.
+					continue
+				}
+				nv, err := normalizeConfigValue(value, ft)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+				vt[key] = nv
+			}
+		case reflect.Map:
+			for key, value := range vt {
+				nv, err := normalizeConfigValue(value, t.Elem())
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+				vt[key] = nv
+			}
+		}
+		return vt, nil
+
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			// e.g. RouteOptions written as a list of backends.
+			return vt, nil
+		}
+		for i, value := range vt {
+			nv, err := normalizeConfigValue(value, t.Elem())
+			if err != nil {
+				return nil, fmt.Errorf("#%d: %v", i, err)
+			}
+			vt[i] = nv
+		}
+		return vt, nil
+
+	default:
+		return v, nil
+	}
+}
+
+// jsonFieldTypes returns the types of the fields of the struct
+// type t, including the promoted ones, keyed by their JSON names.
+func jsonFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for _, field := range reflect.VisibleFields(t) {
+		if field.Anonymous || !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRequestFromFile(t *testing.T) {
+	yamlConfig := `
+domains: [orijtech.com, code.orijtech.com]
+acme_email: admin@orijtech.com
+strict_sni: true
+backend_ping_period: 2m
+idle_timeout: 90s
+routing:
+  /: [http://localhost:8889]
+routes:
+  /api:
+    backends: [http://localhost:8999, http://localhost:9000]
+    timeout: 5s
+    retries: 2
+  /static: [http://localhost:9001]
+cert_file: /etc/frontender/cert.pem
+key_file: /etc/frontender/key.pem
+`
+	jsonConfig := `{
+  "domains": ["orijtech.com", "code.orijtech.com"],
+  "acme_email": "admin@orijtech.com",
+  "strict_sni": true,
+  "backend_ping_period": "2m",
+  "idle_timeout": 90000000000,
+  "routing": {"/": ["http://localhost:8889"]},
+  "routes": {
+    "/api": {"backends": ["http://localhost:8999", "http://localhost:9000"], "timeout": "5s", "retries": 2},
+    "/static": ["http://localhost:9001"]
+  },
+  "cert_file": "/etc/frontender/cert.pem",
+  "key_file": "/etc/frontender/key.pem"
+}`
+
+	for _, tt := range []struct{ name, content string }{
+		{"frontender.yaml", yamlConfig},
+		{"frontender.yml", yamlConfig},
+		{"frontender.json", jsonConfig},
+	} {
+		req, err := LoadRequestFromFile(writeConfigFile(t, tt.name, tt.content))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got, want := req.Domains, []string{"orijtech.com", "code.orijtech.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Domains got=%q want=%q", tt.name, got, want)
+		}
+		if got, want := req.ACMEEmail, "admin@orijtech.com"; got != want {
+			t.Errorf("%s: ACMEEmail got=%q want=%q", tt.name, got, want)
+		}
+		if !req.StrictSNI {
+			t.Errorf("%s: expected StrictSNI to be set", tt.name)
+		}
+		if got, want := req.BackendPingPeriod, 2*time.Minute; got != want {
+			t.Errorf("%s: BackendPingPeriod got=%v want=%v", tt.name, got, want)
+		}
+		if got, want := req.IdleTimeout, 90*time.Second; got != want {
+			t.Errorf("%s: IdleTimeout got=%v want=%v", tt.name, got, want)
+		}
+		if got, want := req.PrefixRouter, map[string][]string{"/": {"http://localhost:8889"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: PrefixRouter got=%q want=%q", tt.name, got, want)
+		}
+		wantRoutes := map[string]*RouteOptions{
+			"/api": {
+				Backends: []string{"http://localhost:8999", "http://localhost:9000"},
+				Timeout:  5 * time.Second,
+				Retries:  2,
+			},
+			"/static": {Backends: []string{"http://localhost:9001"}},
+		}
+		if got := req.Routes; !reflect.DeepEqual(got, wantRoutes) {
+			t.Errorf("%s: Routes got=%+v want=%+v", tt.name, got, wantRoutes)
+		}
+		if req.CertKeyFiler == nil {
+			t.Errorf("%s: expected CertKeyFiler to be set", tt.name)
+		} else if cert, key := req.CertKeyFiler(); cert != "/etc/frontender/cert.pem" || key != "/etc/frontender/key.pem" {
+			t.Errorf("%s: CertKeyFiler got=(%q, %q)", tt.name, cert, key)
+		}
+	}
+}
+
+func TestLoadRequestFromFileErrors(t *testing.T) {
+	tests := [...]struct {
+		name, content string
+		wantErr       string
+	}{
+		0: {"frontender.toml", "http1 = true", "unsupported config file extension"},
+		1: {"frontender.yaml", "http1: true\nrouting:\n  /: [http://localhost:8889]\nbogus: 1\n", "unknown field"},
+		2: {"frontender.yaml", "http1: true\nidle_timeout: soon\nrouting:\n  /: [http://localhost:8889]\n", "idle_timeout"},
+		3: {"frontender.json", `{"http1": true}`, errEmptyProxyAddress.Error()},
+		4: {"frontender.yaml", "routing:\n  /: [http://localhost:8889]\n", errEmptyDomains.Error()},
+		5: {"frontender.yaml", "http1: true\nrouting:\n  /: [http://localhost:8889]\ncert_file: cert.pem\n", "key_file"},
+		6: {"frontender.json", `{"http1": true,`, "frontender.json"},
+	}
+
+	for i, tt := range tests {
+		_, err := LoadRequestFromFile(writeConfigFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("#%d: got err=%v want it to contain %q", i, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLegacyBackendPingPeriodKey(t *testing.T) {
+	for _, blob := range []string{`{"BackendPingPeriod": 120000000000}`, `{"backend_ping_period": 120000000000}`} {
+		req := new(Request)
+		if err := json.Unmarshal([]byte(blob), req); err != nil {
+			t.Errorf("%s: unexpected error: %v", blob, err)
+			continue
+		}
+		if got, want := req.BackendPingPeriod, 2*time.Minute; got != want {
+			t.Errorf("%s: BackendPingPeriod got=%v want=%v", blob, got, want)
+		}
+	}
+
+	// The configuration files accept it too.
+	path := writeConfigFile(t, "frontender.yaml", "BackendPingPeriod: 2m\nproxy_addresses: [http://localhost:8080]\nhttp1: true\ncert_file: cert.pem\nkey_file: key.pem\n")
+	req, err := LoadRequestFromFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := req.BackendPingPeriod, 2*time.Minute; got != want {
+		t.Errorf("BackendPingPeriod got=%v want=%v", got, want)
+	}
+	certFile, keyFile := req.CertKeyFiler()
+	if certFile != "cert.pem" || keyFile != "key.pem" {
+		t.Errorf("cert and key files got=(%q, %q)", certFile, keyFile)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures how the frontend answers CORS
+// preflight requests on behalf of the backends.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to make
+	// cross-origin requests. "*" allows any origin, unless
+	// AllowCredentials is set, with which it is refused.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	// AllowedMethods defaults to "GET", "HEAD" and "POST".
+	// Preflights requesting any other method are refused.
+	AllowedMethods []string `json:"allowed_methods"`
+
+	AllowedHeaders []string `json:"allowed_headers"`
+
+	AllowCredentials bool `json:"allow_credentials"`
+
+	// MaxAge if set, is how long browsers may
+	// cache the results of a preflight request.
+	MaxAge time.Duration `json:"max_age"`
+}
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+func (cc *CORSConfig) validate() error {
+	if cc == nil || !cc.AllowCredentials {
+		return nil
+	}
+	for _, origin := range cc.AllowedOrigins {
+		if origin == "*" {
+			// Any site could then make credentialed requests.
+			return fmt.Errorf("cors allowed origin %q can't be combined with allow credentials", origin)
+		}
+	}
+	return nil
+}
+
+var defaultServerWideAllow = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// isServerWideOptions reports whether r is an "OPTIONS *"
+// request, which is about the server rather than any path.
+func isServerWideOptions(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.RequestURI == "*"
+}
+
+func (lp *livelyProxy) serveServerWideOptions(w http.ResponseWriter) {
+	allow := lp.serverWideAllow
+	if len(allow) == 0 {
+		allow = defaultServerWideAllow
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (cc *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range cc.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *CORSConfig) methods() []string {
+	if len(cc.AllowedMethods) > 0 {
+		return cc.AllowedMethods
+	}
+	return defaultCORSMethods
+}
+
+// allowsMethod reports whether method is allowed, comparing
+// case-sensitively as methods are, per the Fetch standard.
+func (cc *CORSConfig) allowsMethod(method string) bool {
+	for _, allowed := range cc.methods() {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errOriginNotAllowed = errors.New("origin not allowed")
+	errMethodNotAllowed = errors.New("method not allowed")
+)
+
+// servePreflight answers the CORS preflight request r with a 204 No
+// Content and the Access-Control-* headers if its origin and requested
+// method are allowed, otherwise it returns errOriginNotAllowed or
+// errMethodNotAllowed, for the caller to answer.
+func (cc *CORSConfig) servePreflight(w http.ResponseWriter, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	hdr := w.Header()
+	hdr.Add("Vary", "Origin")
+	if !cc.allowsOrigin(origin) {
+		return errOriginNotAllowed
+	}
+	if !cc.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+		return errMethodNotAllowed
+	}
+
+	hdr.Set("Access-Control-Allow-Origin", origin)
+	hdr.Set("Access-Control-Allow-Methods", strings.Join(cc.methods(), ", "))
+	if len(cc.AllowedHeaders) > 0 {
+		hdr.Set("Access-Control-Allow-Headers", strings.Join(cc.AllowedHeaders, ", "))
+	}
+	if cc.AllowCredentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if cc.MaxAge > 0 {
+		hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(cc.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
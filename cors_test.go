@@ -0,0 +1,126 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Backend", req.Method)
+	}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.cors = &CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		MaxAge:         10 * time.Minute,
+	}
+
+	tests := [...]struct {
+		method      string
+		headers     map[string]string
+		wantCode    int
+		wantHeaders map[string]string
+	}{
+		0: {
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "PUT",
+			},
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Allow-Headers": "Content-Type, Authorization",
+				"Access-Control-Max-Age":       "600",
+				"X-Backend":                    "",
+			},
+		},
+		1: {
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://evil.example.com",
+				"Access-Control-Request-Method": "PUT",
+			},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "X-Backend": ""},
+		},
+		// Not a preflight hence forwarded to the backend.
+		2: {
+			method:      "OPTIONS",
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"X-Backend": "OPTIONS"},
+		},
+		3: {
+			method:      "GET",
+			headers:     map[string]string{"Origin": "https://app.example.com"},
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"X-Backend": "GET", "Access-Control-Allow-Methods": ""},
+		},
+		// An allowed origin requesting a method that isn't.
+		4: {
+			method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			wantCode:    http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "X-Backend": ""},
+		},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		for key, want := range tt.wantHeaders {
+			if got := rec.Header().Get(key); got != want {
+				t.Errorf("#%d: %s got=%q want=%q", i, key, got, want)
+			}
+		}
+	}
+}
+
+func TestValidateCORS(t *testing.T) {
+	tests := [...]struct {
+		cc      *CORSConfig
+		wantErr bool
+	}{
+		0: {cc: nil},
+		1: {cc: &CORSConfig{AllowedOrigins: []string{"*"}}},
+		2: {cc: &CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}},
+		3: {cc: &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, wantErr: true},
+	}
+	for i, tt := range tests {
+		err := tt.cc.validate()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("#%d: err=%v wantErr=%t", i, err, tt.wantErr)
+		}
+	}
+}
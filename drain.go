@@ -0,0 +1,97 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import "time"
+
+// DefaultRouteDrainTimeout is how long Reload waits, by default,
+// for the in-flight requests of the routes that it removes.
+const DefaultRouteDrainTimeout = 10 * time.Second
+
+// enterRouteLocked counts a request in flight on route.
+// lp.mu must be held.
+func (lp *livelyProxy) enterRouteLocked(route string) {
+	if lp.inFlight == nil {
+		lp.inFlight = make(map[string]int)
+	}
+	lp.inFlight[route] += 1
+}
+
+// leaveRoute marks a request in flight on route, as counted
+// by match, as done, waking up those waiting for route to drain.
+func (lp *livelyProxy) leaveRoute(route string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.inFlight[route] -= 1
+	if lp.inFlight[route] > 0 {
+		return
+	}
+	delete(lp.inFlight, route)
+	if drained, ok := lp.drained[route]; ok {
+		close(drained)
+		delete(lp.drained, route)
+	}
+}
+
+// waitRoutesDrained waits up to timeout for the requests in flight
+// on routes to complete, all of them against the same deadline, and
+// returns the routes whose requests didn't.
+func (lp *livelyProxy) waitRoutesDrained(routes []string, timeout time.Duration) (undrained []string) {
+	if len(routes) == 0 {
+		return nil
+	}
+	expired, stop := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-lp.clock.After(timeout):
+			close(expired)
+		case <-stop:
+		}
+	}()
+	for _, route := range routes {
+		if !lp.waitDrained(route, expired) {
+			undrained = append(undrained, route)
+		}
+	}
+	return undrained
+}
+
+// waitDrained waits until expired is closed for the requests
+// in flight on route to complete. It reports whether they did.
+func (lp *livelyProxy) waitDrained(route string, expired <-chan struct{}) bool {
+	lp.mu.Lock()
+	if lp.inFlight[route] == 0 {
+		lp.mu.Unlock()
+		return true
+	}
+	if lp.drained == nil {
+		lp.drained = make(map[string]chan struct{})
+	}
+	drained, ok := lp.drained[route]
+	if !ok {
+		drained = make(chan struct{})
+		lp.drained[route] = drained
+	}
+	lp.mu.Unlock()
+
+	select {
+	case <-drained:
+		return true
+	case <-expired:
+		return false
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+)
+
+func (lp *livelyProxy) logf(format string, args ...interface{}) {
+	if lp.logfFn != nil {
+		lp.logfFn(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// logf is the counterpart of livelyProxy.logf for
+// logging before the proxy is made, such as while
+// listening.
+func (req *Request) logf(format string, args ...interface{}) {
+	if req.Logf != nil {
+		req.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (lp *livelyProxy) shouldDump() bool {
+	pct := lp.dumpSamplePercent
+	return pct > 0 && rand.Float64()*100 < pct
+}
+
+// redactedHeaders are the headers whose values
+// carry credentials, hence aren't dumped verbatim.
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// redactHeader returns a copy of hdr with the
+// values of the redactedHeaders masked.
+func redactHeader(hdr http.Header) http.Header {
+	redacted := hdr.Clone()
+	for _, key := range redactedHeaders {
+		for i := range redacted[key] {
+			redacted[key][i] = "[REDACTED]"
+		}
+	}
+	return redacted
+}
+
+// dumpRequest logs the headers of req and if dumpMaxBodyBytes
+// is set, up to that many bytes of its body, which is then
+// restored so that it can still be forwarded to the backend.
+// The values of the redactedHeaders are masked.
+func (lp *livelyProxy) dumpRequest(req *http.Request) {
+	masked := *req
+	masked.Header = redactHeader(req.Header)
+	dump, err := httputil.DumpRequest(&masked, false)
+	if err != nil {
+		lp.logf("frontender: dumping request: %v", err)
+		return
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		var prefix []byte
+		prefix, req.Body = peekBody(req.Body, lp.dumpMaxBodyBytes)
+		dump = append(dump, prefix...)
+	}
+	lp.logf("frontender: request dump:\n%s", dump)
+}
+
+// dumpResponse is the response counterpart of dumpRequest.
+// Note that peeking at the body delays streaming it to the
+// client until dumpMaxBodyBytes have arrived.
+func (lp *livelyProxy) dumpResponse(res *http.Response) {
+	masked := *res
+	masked.Header = redactHeader(res.Header)
+	dump, err := httputil.DumpResponse(&masked, false)
+	if err != nil {
+		lp.logf("frontender: dumping response: %v", err)
+		return
+	}
+	if res.Body != nil && res.Body != http.NoBody {
+		var prefix []byte
+		prefix, res.Body = peekBody(res.Body, lp.dumpMaxBodyBytes)
+		dump = append(dump, prefix...)
+	}
+	lp.logf("frontender: response dump:\n%s", dump)
+}
+
+// peekBody reads up to n bytes from rc and returns them along with
+// a ReadCloser that yields the entire original content of rc.
+func peekBody(rc io.ReadCloser, n int64) ([]byte, io.ReadCloser) {
+	if n <= 0 {
+		return nil, rc
+	}
+	prefix, _ := io.ReadAll(io.LimitReader(rc, n))
+	return prefix, &prefixedReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(prefix), rc),
+		Closer: rc,
+	}
+}
+
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
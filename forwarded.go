@@ -0,0 +1,123 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// setForwardedHeader appends to the RFC 7239 Forwarded header of r an
+// element with the for, proto and host directives of this hop. Any
+// Forwarded values set by earlier proxies are preserved before it.
+func setForwardedHeader(r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	var pairs []string
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			// IPv6 addresses are bracketed and thus quoted.
+			ip = "[" + ip + "]"
+		}
+		pairs = append(pairs, "for="+forwardedValue(ip))
+	}
+	pairs = append(pairs, "proto="+proto)
+	if r.Host != "" {
+		pairs = append(pairs, "host="+forwardedValue(r.Host))
+	}
+	element := strings.Join(pairs, ";")
+
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	r.Header.Set("Forwarded", element)
+}
+
+// clientIP returns the IP of the client of r. It is the IP of the
+// connection, unless that is one of the trustedProxies, each of which
+// appends the IP of its own client to X-Forwarded-For. With trustedHops
+// proxies in front of the frontend, it is then the entry trustedHops
+// from the right, or the leftmost entry if there are fewer, or the IP
+// of the connection if that entry isn't an IP. Without trustedHops, the
+// entries are walked from the right, past those of the trustedProxies.
+// Either way the entries further left could be spoofed by the client.
+// If an entry walked past isn't an IP, the IP of the last trusted proxy
+// is returned.
+func clientIP(r *http.Request, trustedProxies []string, trustedHops int) string {
+	connIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		connIP = r.RemoteAddr
+	}
+	addr, ok := remoteIP(r.RemoteAddr)
+	if !ok || !aclContains(trustedProxies, addr) {
+		return connIP
+	}
+
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if trustedHops > 0 {
+		if len(entries) == 0 {
+			return connIP
+		}
+		i := len(entries) - trustedHops
+		if i < 0 {
+			i = 0
+		}
+		hop, ok := remoteIP(entries[i])
+		if !ok {
+			return connIP
+		}
+		return hop.String()
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		next, ok := remoteIP(entries[i])
+		if !ok {
+			break
+		}
+		addr = next
+		if !aclContains(trustedProxies, addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// forwardedValue returns v as is if it is a token,
+// otherwise as a quoted string, per RFC 7239.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetForwardedHeader(t *testing.T) {
+	tests := [...]struct {
+		remoteAddr string
+		host       string
+		tls        bool
+		prior      []string
+		want       string
+	}{
+		0: {
+			remoteAddr: "192.0.2.60:4711", host: "example.com",
+			want: "for=192.0.2.60;proto=http;host=example.com",
+		},
+		1: {
+			remoteAddr: "192.0.2.60:4711", host: "example.com", tls: true,
+			want: "for=192.0.2.60;proto=https;host=example.com",
+		},
+		// IPv6 addresses and hosts with ports need quoting.
+		2: {
+			remoteAddr: "[2001:db8:cafe::17]:4711", host: "example.com:8443",
+			want: `for="[2001:db8:cafe::17]";proto=http;host="example.com:8443"`,
+		},
+		// Elements from earlier proxies are kept.
+		3: {
+			remoteAddr: "198.51.100.17:4711", host: "example.com",
+			prior: []string{"for=192.0.2.43"},
+			want:  "for=192.0.2.43, for=198.51.100.17;proto=http;host=example.com",
+		},
+		4: {
+			remoteAddr: "198.51.100.17:4711", host: "example.com",
+			prior: []string{"for=192.0.2.43", "for=192.0.2.44;proto=https"},
+			want:  "for=192.0.2.43, for=192.0.2.44;proto=https, for=198.51.100.17;proto=http;host=example.com",
+		},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Host = tt.host
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for _, value := range tt.prior {
+			req.Header.Add("Forwarded", value)
+		}
+		setForwardedHeader(req)
+		if got := req.Header.Values("Forwarded"); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("#%d:\ngot:  %q\nwant: %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.7"}
+	tests := [...]struct {
+		remoteAddr string
+		xff        []string
+		trusted    []string
+		want       string
+	}{
+		// Without TrustedProxies, X-Forwarded-For is ignored.
+		0: {remoteAddr: "10.0.0.1:4711", xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, want: "10.0.0.1"},
+		1: {remoteAddr: "10.0.0.1:4711", xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, trusted: trusted, want: "198.51.100.1"},
+		2: {remoteAddr: "10.0.0.1:4711", xff: []string{"203.0.113.5, 192.0.2.7, 10.0.0.2"}, trusted: trusted, want: "203.0.113.5"},
+		// So is that of untrusted peers, whatever it claims.
+		3: {remoteAddr: "198.51.100.9:4711", xff: []string{"203.0.113.5"}, trusted: trusted, want: "198.51.100.9"},
+		// When every entry is trusted, the leftmost is the client.
+		4: {remoteAddr: "10.0.0.1:4711", xff: []string{"10.0.0.3, 10.0.0.2"}, trusted: trusted, want: "10.0.0.3"},
+		// Entries across several headers make up a single chain.
+		5: {remoteAddr: "10.0.0.1:4711", xff: []string{"203.0.113.5", "198.51.100.1,10.0.0.2"}, trusted: trusted, want: "198.51.100.1"},
+		6: {remoteAddr: "10.0.0.1:4711", xff: []string{"[2001:db8::1]:4711"}, trusted: trusted, want: "2001:db8::1"},
+		7: {remoteAddr: "10.0.0.1:4711", xff: []string{"::ffff:203.0.113.5"}, trusted: trusted, want: "203.0.113.5"},
+		// Without a usable entry, it is the IP of the last trusted proxy.
+		8: {remoteAddr: "10.0.0.1:4711", trusted: trusted, want: "10.0.0.1"},
+		9: {remoteAddr: "10.0.0.1:4711", xff: []string{"198.51.100.1, unknown, 10.0.0.2"}, trusted: trusted, want: "10.0.0.2"},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.xff {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIP(req, tt.trusted, 0); got != tt.want {
+			t.Errorf("#%d: got=%q want=%q", i, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPTrustedHops(t *testing.T) {
+	trusted := []string{"10.0.0.1"}
+	tests := [...]struct {
+		remoteAddr  string
+		xff         []string
+		trustedHops int
+		want        string
+	}{
+		0: {xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, trustedHops: 1, want: "10.0.0.2"},
+		1: {xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, trustedHops: 2, want: "198.51.100.1"},
+		2: {xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, trustedHops: 3, want: "203.0.113.5"},
+		// With fewer entries than hops, the leftmost is the client.
+		3: {xff: []string{"203.0.113.5, 198.51.100.1, 10.0.0.2"}, trustedHops: 5, want: "203.0.113.5"},
+		// Entries across several headers make up a single chain.
+		4: {xff: []string{"203.0.113.5", "198.51.100.1,10.0.0.2"}, trustedHops: 2, want: "198.51.100.1"},
+		5: {xff: []string{"[2001:db8::1]:4711, 198.51.100.1"}, trustedHops: 2, want: "2001:db8::1"},
+		6: {xff: []string{"::ffff:203.0.113.5"}, trustedHops: 1, want: "203.0.113.5"},
+		// Without a usable entry, it is the IP of the connection.
+		7: {trustedHops: 1, want: "10.0.0.1"},
+		8: {xff: []string{"unknown, 198.51.100.1"}, trustedHops: 2, want: "10.0.0.1"},
+		// The hops aren't trusted from peers that aren't trusted proxies.
+		9:  {remoteAddr: "198.51.100.9:4711", xff: []string{"203.0.113.5, 10.0.0.2"}, trustedHops: 2, want: "198.51.100.9"},
+		10: {remoteAddr: "198.51.100.9:4711", xff: []string{"203.0.113.5"}, trustedHops: 1, want: "198.51.100.9"},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:4711"
+		if tt.remoteAddr != "" {
+			req.RemoteAddr = tt.remoteAddr
+		}
+		for _, value := range tt.xff {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIP(req, trusted, tt.trustedHops); got != tt.want {
+			t.Errorf("#%d: got=%q want=%q", i, got, tt.want)
+		}
+	}
+}
+
+func TestTrustedHopsACL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.routeOptions = map[string]*RouteOptions{"/": {ACL: &ACL{Allow: []string{"203.0.113.0/24"}}}}
+	lp.trustedProxies = []string{"10.0.0.1"}
+	lp.trustedHops = 2
+
+	tests := [...]struct {
+		remoteAddr string
+		xff        string
+		wantCode   int
+	}{
+		0: {remoteAddr: "10.0.0.1:4711", xff: "203.0.113.5, 10.0.0.2", wantCode: http.StatusOK},
+		// The client can't get in by prepending an allowed IP.
+		1: {remoteAddr: "10.0.0.1:4711", xff: "203.0.113.5, 198.51.100.1, 10.0.0.2", wantCode: http.StatusForbidden},
+		// Nor by reaching the frontend directly.
+		2: {remoteAddr: "198.51.100.1:4711", xff: "203.0.113.5, 10.0.0.2", wantCode: http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", tt.xff)
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: code got=%d want=%d", i, got, tt.wantCode)
+		}
+	}
+}
+
+func TestTrustedProxiesACL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.routeOptions = map[string]*RouteOptions{"/": {ACL: &ACL{Allow: []string{"203.0.113.0/24"}}}}
+	lp.trustedProxies = []string{"10.0.0.1"}
+
+	tests := [...]struct {
+		remoteAddr string
+		xff        string
+		wantCode   int
+	}{
+		0: {remoteAddr: "10.0.0.1:4711", xff: "203.0.113.5", wantCode: http.StatusOK},
+		// The client can't get in by prepending an allowed IP.
+		1: {remoteAddr: "10.0.0.1:4711", xff: "203.0.113.5, 198.51.100.1", wantCode: http.StatusForbidden},
+		2: {remoteAddr: "10.0.0.1:4711", wantCode: http.StatusForbidden},
+		// Nor by reaching the frontend directly.
+		3: {remoteAddr: "198.51.100.1:4711", xff: "203.0.113.5", wantCode: http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: code got=%d want=%d", i, got, tt.wantCode)
+		}
+	}
+}
+
+func TestForwardedHeaderProxied(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("Forwarded")))
+	}))
+	defer backend.Close()
+
+	for _, enabled := range []bool{false, true} {
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.forwardedHeader = enabled
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.60:4711"
+		req.Header.Set("Forwarded", "for=192.0.2.43")
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+
+		want := "for=192.0.2.43"
+		if enabled {
+			want += ", for=192.0.2.60;proto=http;host=example.com"
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("enabled=%v: got=%q want=%q", enabled, got, want)
+		}
+	}
+}
+
+func TestValidateTrustedHops(t *testing.T) {
+	tests := [...]struct {
+		req     *Request
+		wantErr bool
+	}{
+		0: {req: &Request{TrustedHops: 1, TrustedProxies: []string{"10.0.0.0/8"}}},
+		1: {req: &Request{TrustedHops: -1, TrustedProxies: []string{"10.0.0.0/8"}}, wantErr: true},
+		// Hops would otherwise be trusted from any client.
+		2: {req: &Request{TrustedHops: 1}, wantErr: true},
+	}
+	for i, tt := range tests {
+		tt.req.HTTP1 = true
+		tt.req.ProxyAddresses = []string{"http://localhost:8080"}
+		err := tt.req.Validate()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("#%d: err=%v wantErr=%t", i, err, tt.wantErr)
+		}
+	}
+}
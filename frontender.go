@@ -15,24 +15,27 @@
 package frontender
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
-
 	"github.com/orijtech/frontender/lively"
 	"github.com/orijtech/otils"
 
 	"github.com/odeke-em/go-uuid"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Request struct {
@@ -45,22 +48,58 @@ type Request struct {
 
 	NoAutoWWW bool `json:"no_auto_www"`
 
+	// NoAutoWWWFor lists the domains for which the www
+	// equivalent should not be synthesized, even when
+	// NoAutoWWW isn't set. Explicit www domains are kept.
+	NoAutoWWWFor []string `json:"no_auto_www_for"`
+
+	// ProxyAddresses are the backends of the catch-all route "/"
+	// when neither PrefixRouter nor Routes are set. They are
+	// ignored otherwise, so list them under "/" there instead.
+	// Like in PrefixRouter, they can carry weights.
 	ProxyAddresses []string `json:"proxy_addresses"`
 
 	NonHTTPSRedirectURL string `json:"non_https_redirect_url"`
 	NonHTTPSAddr        string `json:"non_https_addr"`
 
-	DomainsListener func(domains ...string) net.Listener
+	// NonHTTPSRedirectHosts maps hosts to the HTTPS URL that
+	// their non-HTTPS traffic is redirected to, with the path
+	// and query preserved, e.g
+	//	{"foo.com": "https://foo.com", "bar.org": "https://www.bar.org"}
+	// Hosts not in it are redirected to NonHTTPSRedirectURL.
+	NonHTTPSRedirectHosts map[string]string `json:"non_https_redirect_hosts"`
+
+	// TrustedProxies lists the CIDRs e.g "10.0.0.0/8", or the IPs,
+	// of the proxies in front of the frontend, such as TLS terminators,
+	// whose X-Forwarded-Proto and X-Forwarded-For are trusted. Their
+	// requests forwarded from HTTPS to the NonHTTPSAddr, as told by the
+	// last X-Forwarded-Proto value or per TrustedHops, are served, not
+	// redirected, and the IP of clients, for the ACLs of the routes and
+	// the logs, is told by X-Forwarded-For past their entries, or per
+	// TrustedHops. Requests from other peers are told by the IP of
+	// their connection.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// TrustedHops if set, is the number of proxies in front of the
+	// frontend whose X-Forwarded-For entries are trusted: the client
+	// is the entry TrustedHops from the right, as those further left
+	// could have been made up by the clients. It is only honored for
+	// requests from the TrustedProxies, lest clients reaching the
+	// frontend directly make up all the entries.
+	TrustedHops int `json:"trusted_hops"`
+
+	DomainsListener func(domains ...string) net.Listener `json:"-"`
 
 	Environ    []string `json:"environ"`
 	TargetGOOS string   `json:"target_goos"`
 
-	CertKeyFiler func() (string, string)
+	CertKeyFiler func() (string, string) `json:"-"`
 
 	// BackendPingPeriod if set, defines the period
 	// between which the frontend service will check
-	// for the liveliness of the backends.
-	BackendPingPeriod time.Duration
+	// for the liveliness of the backends. If unset,
+	// DefaultBackendPingPeriod is used.
+	BackendPingPeriod time.Duration `json:"backend_ping_period"`
 
 	// PrefixRouter if set helps route traffic depending on
 	// the route prefix e.g
@@ -70,7 +109,393 @@ type Request struct {
 	// }
 	// if it gets traffic with a URL prefix "/foo" will distribute traffic
 	// between "http://localhost:8999" and "http://localhost:8877".
+	// An address can carry a weight for its backend to get a
+	// proportional share of the traffic, e.g
+	// "http://localhost:8999|weight=3" gets thrice as much
+	// as the backends without one.
 	PrefixRouter map[string][]string `json:"routing"`
+
+	// Routes is the richer form of PrefixRouter which besides
+	// the backends, allows configuring per-route options. Both
+	// can be used together and if a prefix is present in both,
+	// its backends are combined.
+	Routes map[string]*RouteOptions `json:"routes"`
+
+	// ExactRootRoute if set, makes the "/" route only match
+	// requests for exactly "/" instead of being the catch-all
+	// for paths that no other route matches. Requests that
+	// don't match any route get a 404 Not Found.
+	ExactRootRoute bool `json:"exact_root_route"`
+
+	// MaxResponseBodyBytes if set, caps the number of bytes
+	// of a backend's response body that will be streamed
+	// back to the client. Responses that declare a larger
+	// Content-Length are rejected with a 502 Bad Gateway
+	// while streamed responses are cut off at the limit.
+	MaxResponseBodyBytes int64 `json:"max_response_body_bytes"`
+
+	// ServerTiming if set, adds a "Server-Timing: upstream;dur=<ms>"
+	// header to responses, measuring how long the backend took to
+	// respond, to help with debugging frontend performance.
+	ServerTiming bool `json:"server_timing"`
+
+	// VersionHeader if set, adds an "X-Frontender-Version" header
+	// with the Version of frontender to proxied responses, to tell
+	// which frontends of a fleet run which version.
+	VersionHeader bool `json:"version_header"`
+
+	// PreflightDNS if set, makes Listen check that every domain
+	// resolves to this host before requesting any certificates.
+	PreflightDNS bool `json:"preflight_dns"`
+
+	// PublicIPs are the IP addresses that the domains are
+	// expected to resolve to when PreflightDNS is set. If
+	// unset, the IPs of the network interfaces are used.
+	PublicIPs []string `json:"public_ips"`
+
+	// DumpSamplePercent if set, is the percentage, between 0 and
+	// 100, of requests whose request and response headers will be
+	// dumped to the log, for debugging backend interactions. The
+	// values of the Authorization, Proxy-Authorization, Cookie and
+	// Set-Cookie headers are redacted.
+	DumpSamplePercent float64 `json:"dump_sample_percent"`
+
+	// DumpMaxBodyBytes if set, also includes up to
+	// that many bytes of the bodies in the dumps.
+	DumpMaxBodyBytes int64 `json:"dump_max_body_bytes"`
+
+	// DisableKeepAlives if set, makes the frontend close
+	// client connections after serving each request.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+
+	// IdleTimeout if set, is the maximum amount of time that
+	// the frontend waits for the next request on a keep-alive
+	// client connection.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	// StrictSNI if set, rejects with 421 Misdirected Request HTTP/2
+	// requests whose Host doesn't match the TLS server name (SNI) of
+	// their connection. This prevents clients from coalescing requests
+	// for different tenants onto one connection.
+	StrictSNI bool `json:"strict_sni"`
+
+	// Logf if set, is used for logging instead of log.Printf.
+	Logf func(format string, args ...interface{}) `json:"-"`
+
+	// RejectionLog if set, is passed every request that is
+	// refused, such as misdirected requests or CORS preflights
+	// from disallowed origins, separately from other logs.
+	// Otherwise rejections are logged as JSON via Logf.
+	RejectionLog func(*Rejection) `json:"-"`
+
+	// AccessLog if set, is passed an entry for every
+	// request that is served, subject to sampling by
+	// AccessLogSamplePercent, which when unset logs all.
+	AccessLog func(*AccessLogEntry) `json:"-"`
+
+	// AccessLogSamplePercent if set, is the percentage, between
+	// 0 and 100, of requests that are access logged, to AccessLog
+	// if set, otherwise to AccessLogWriter or via Logf. Requests
+	// whose responses have 5XX status codes are always logged.
+	AccessLogSamplePercent float64 `json:"access_log_sample_percent"`
+
+	// AccessLogWriter if set, and AccessLog isn't, is written
+	// a line in AccessLogFormat for every request that is served,
+	// subject to sampling by AccessLogSamplePercent.
+	AccessLogWriter io.Writer `json:"-"`
+
+	// AccessLogFormat is the format of the access logs written to
+	// AccessLogWriter or via Logf, JSON by default. CommonLogFormat
+	// and CombinedLogFormat suit the pipelines made for Apache logs.
+	AccessLogFormat AccessLogFormat `json:"access_log_format"`
+
+	// WarmingUpStatusCode is the status code of responses to
+	// requests that arrive before the liveliness of the backends
+	// of their route was ever checked. It defaults to 503 and
+	// unlike the response for when all the backends are down,
+	// it includes a Retry-After header.
+	WarmingUpStatusCode int `json:"warming_up_status_code"`
+
+	// WarmingUpRetryAfter is the Retry-After of the warming
+	// up responses. It defaults to 1 second.
+	WarmingUpRetryAfter time.Duration `json:"warming_up_retry_after"`
+
+	// RetryAfter if set, is sent as the Retry-After header of the
+	// 503 Service Unavailable responses for routes whose backends
+	// are all down, or too few are live. By default those responses
+	// have no Retry-After. Warming up responses use WarmingUpRetryAfter.
+	RetryAfter time.Duration `json:"retry_after"`
+
+	// CORS if set, makes the frontend answer CORS preflight
+	// requests itself instead of forwarding them to the backends.
+	CORS *CORSConfig `json:"cors"`
+
+	// TransportForBackend if set, supplies the transport used
+	// to forward requests to the backend at addr, for example
+	// to use mTLS or an outbound proxy for some backends. It is
+	// consulted once per backend and if it returns nil, or is
+	// unset, http.DefaultTransport is used. The health checks
+	// of the backend go through the same transport.
+	TransportForBackend func(addr string) http.RoundTripper `json:"-"`
+
+	// HealthCheckUserAgent if set, is the User-Agent of the
+	// liveliness pings sent to the backends, instead of
+	// lively.DefaultUserAgent.
+	HealthCheckUserAgent string `json:"health_check_user_agent"`
+
+	// StrictHealthCheckJSON if set, treats backends whose
+	// successful /ping responses aren't valid JSON as not live.
+	StrictHealthCheckJSON bool `json:"strict_health_check_json"`
+
+	// HealthCheckBody and HealthCheckContentType if set, are the
+	// body and Content-Type of the liveliness pings sent to the
+	// backends, for backends that validate health check payloads.
+	// The body otherwise is the JSON encoded lively.Ping.
+	HealthCheckBody        string `json:"health_check_body"`
+	HealthCheckContentType string `json:"health_check_content_type"`
+
+	// HealthCheckPath and HealthCheckMethod if set, are the path and
+	// HTTP method of the liveliness pings instead of "POST /ping",
+	// for instance "GET /healthz" for backends that don't accept
+	// POST. Any response still counts as live, like for /ping.
+	HealthCheckPath   string `json:"health_check_path"`
+	HealthCheckMethod string `json:"health_check_method"`
+
+	// ReadinessPath if set, is the path at which backends are health
+	// checked instead of /ping, to decide whether they get traffic.
+	// Unlike with /ping, only 2XX responses count as ready. It takes
+	// precedence over HealthCheckPath. It is requested with GET,
+	// unless HealthCheckMethod is set.
+	ReadinessPath string `json:"readiness_path"`
+
+	// LivenessPath if set, is a path at which backends are also
+	// checked, only to track whether they are alive, as reported
+	// by the metrics, for instance to alert on backends that are
+	// up but not ready. It doesn't affect which get traffic. Like
+	// ReadinessPath, it is requested with GET unless
+	// HealthCheckMethod is set.
+	LivenessPath string `json:"liveness_path"`
+
+	// GlobalPingConcurrency if set, caps the number of liveliness
+	// pings in flight at once across all the routes combined, so
+	// that many routes cycling together can't exhaust the
+	// frontend's file descriptors.
+	GlobalPingConcurrency int `json:"global_ping_concurrency"`
+
+	// BackendResolver if set, dynamically supplies
+	// more backends for the routes, for example from
+	// Kubernetes endpoints. See EnvBackendResolver.
+	BackendResolver BackendResolver `json:"-"`
+
+	// OnBackendRemoved if set, is invoked for every backend
+	// that a Reload removes from a route, for example to
+	// deregister it from service discovery.
+	OnBackendRemoved func(route, addr string) `json:"-"`
+
+	// ForwardClientCert if set, forwards the subject and SHA-256
+	// fingerprint of verified TLS client certificates to the backends
+	// in the X-Client-Cert-Subject and X-Client-Cert-Fingerprint
+	// headers. Those headers are always stripped from the requests
+	// of clients without a verified certificate, so that they
+	// can't be spoofed. Verifying client certificates requires
+	// a DomainsListener whose TLS config asks for them.
+	ForwardClientCert bool `json:"forward_client_cert"`
+
+	// ForwardedHeader if set, appends an element with the for, proto
+	// and host directives to the RFC 7239 Forwarded header of the
+	// requests sent to the backends, in addition to X-Forwarded-For.
+	ForwardedHeader bool `json:"forwarded_header"`
+
+	// MetricsPath if set, e.g "/metrics", is the path at which
+	// the frontend itself serves JSON metrics: request counts,
+	// live backend counts, the goroutine count and memory stats.
+	// Requests for it are never forwarded to the backends.
+	MetricsPath string `json:"metrics_path"`
+
+	// StatusAddr if set, e.g "127.0.0.1:9090", is the address of
+	// a separate HTTP server that serves, as JSON, the live and dead
+	// backends of every route, along with the number and the error
+	// of its last liveliness cycle, for operators to introspect.
+	StatusAddr string `json:"status_addr"`
+
+	// AdminAddr if set, e.g "10.0.0.2:9000" on a private interface,
+	// is the address of a separate HTTP server for the admin endpoints
+	// alone, never proxying: "/status" serves what StatusAddr does,
+	// "/metrics" what MetricsPath does and "/healthz" answers 200 OK
+	// until the frontend starts shutting down, then 503.
+	AdminAddr string `json:"admin_addr"`
+
+	// PriorityDomains are domains whose certificates are
+	// provisioned eagerly, in order, by Listen before it
+	// returns, so that critical domains are ready first.
+	// That happens once the HTTPS listener is served, for
+	// the ACME challenges to be answered on it.
+	// The certificates of the other domains are provisioned
+	// lazily, on their first TLS handshake. Each priority
+	// domain must be one of the synthesized domains.
+	PriorityDomains []string `json:"priority_domains"`
+
+	// ACMEEmail if set, is the contact email of the ACME
+	// account that the certificates are obtained with, to
+	// which notices such as upcoming expiries are sent.
+	ACMEEmail string `json:"acme_email"`
+
+	// H2C if set in HTTP1 mode, makes the frontend also speak
+	// HTTP/2 over cleartext (h2c) besides HTTP/1.1, for local
+	// testing with h2c and gRPC-web clients.
+	H2C bool `json:"h2c"`
+
+	// NotFoundHandler if set, serves the requests whose path
+	// matches no route, for example with a branded 404 page.
+	// It defaults to http.NotFoundHandler.
+	NotFoundHandler http.Handler `json:"-"`
+
+	// CoalesceGETs if set, coalesces identical concurrent GET
+	// requests, those for the same host, URI and Accept-Encoding,
+	// into a single upstream request whose response is shared by
+	// all of them, unless its Vary headers differ for some, or it
+	// sets cookies or is Cache-Control private or no-store.
+	// It is meant for expensive cacheable responses, which is why
+	// requests with an Authorization, a Cookie or a Range header, or
+	// a client certificate, are never coalesced, nor are any when
+	// ForwardClientCert is set. Responses are only buffered in memory if other
+	// requests wait on them, otherwise they are streamed.
+	CoalesceGETs bool `json:"coalesce_gets"`
+
+	// DialAddresses maps backend addresses, as given in the
+	// routing, to the "host:port" to actually connect to, e.g
+	//	{"https://api.internal": "10.0.0.7:443"}
+	// The backend address still determines the TLS server name
+	// and is sent as the Host header. It applies to the health
+	// checks too but not to backends with a TransportForBackend.
+	DialAddresses map[string]string `json:"dial_addresses"`
+
+	// HealthWebhookURL if set, is POSTed a JSON HealthTransition
+	// whenever a backend goes from live to non-live or back. Each
+	// delivery is retried a few times, with a backoff, before the
+	// next one is made, so that they arrive in order.
+	HealthWebhookURL string `json:"health_webhook_url"`
+
+	// MaxBackendResponseHeaderBytes if set, caps the size of
+	// the response headers accepted from backends. Responses
+	// with larger headers are answered with 502 Bad Gateway.
+	// It doesn't apply to backends with a TransportForBackend.
+	MaxBackendResponseHeaderBytes int64 `json:"max_backend_response_header_bytes"`
+
+	// ServerWideAllow is the list of methods sent in the Allow
+	// header of the 204 No Content answer to "OPTIONS *" requests,
+	// which are never proxied. It defaults to defaultServerWideAllow.
+	ServerWideAllow []string `json:"server_wide_allow"`
+
+	// RouteDrainTimeout bounds how long Reload waits for the
+	// requests in flight on the routes that it removes, all of
+	// them together, before reporting their backends as removed.
+	// Removed routes stop getting new requests right away. It
+	// defaults to DefaultRouteDrainTimeout.
+	RouteDrainTimeout time.Duration `json:"route_drain_timeout"`
+
+	// RemovedBackendGracePeriod is how long after Reload or
+	// PromoteStaged removes a backend from every route, that its
+	// cached reverse proxy and transport are discarded and the idle
+	// connections to it are closed, unless its transport came from
+	// TransportForBackend. It defaults to DefaultRemovedBackendGracePeriod.
+	RemovedBackendGracePeriod time.Duration `json:"removed_backend_grace_period"`
+
+	// TCPRoutes forward raw TCP connections, accepted on
+	// their own addresses, to health checked backends.
+	TCPRoutes []*TCPRoute `json:"tcp_routes"`
+
+	// LoadBalanceStrategy is how the backends of each route are
+	// picked, either RoundRobin, the default, or LeastConnections.
+	LoadBalanceStrategy LoadBalanceStrategy `json:"load_balance_strategy"`
+
+	// ShutdownGracePeriod if set, makes Close shut down gracefully like
+	// Shutdown does: it stops accepting connections then waits, for up
+	// to ShutdownGracePeriod, for the requests in flight to complete
+	// before closing the connections left, and only then returns.
+	// Otherwise Close stops accepting connections and returns at once.
+	ShutdownGracePeriod time.Duration `json:"shutdown_grace_period"`
+
+	// SelectBackend if set, picks the backend of route that r is
+	// forwarded to, from the addresses of its live backends that the
+	// OutlierDetection hasn't ejected, instead of the LoadBalanceStrategy
+	// or the ShardHeader of the route, for instance to route by
+	// geography or tenant. If it returns ""
+	// or an address that isn't live, the built-in strategy picks.
+	// Routes without live backends don't invoke it.
+	SelectBackend func(route string, liveAddrs []string, r *http.Request) string `json:"-"`
+
+	// SessionAffinity if set, pins clients to the backends of
+	// their routes, by their IP or by a cookie, for as long as
+	// those backends are live. The clients of the backends that
+	// are ejected or draining go to others meanwhile, unless all
+	// are. SelectBackend takes precedence.
+	SessionAffinity SessionAffinity `json:"session_affinity"`
+
+	// SessionAffinityCookie is the name of the cookie that
+	// CookieAffinity pins clients by, which defaults to
+	// DefaultSessionAffinityCookie.
+	SessionAffinityCookie string `json:"session_affinity_cookie"`
+
+	// MaxRetries is the number of additional attempts made for
+	// the idempotent requests, by their method or an Idempotency-Key
+	// header, of the routes without Retries of their own. Each is
+	// made against the next live backend, when a backend can't be
+	// reached or when it responds with one of the RetryableStatusCodes.
+	// Request bodies of up to 1MiB are buffered to be replayed, larger
+	// ones never are.
+	MaxRetries int `json:"max_retries"`
+
+	// RetryableStatusCodes are the status codes, such as 502 and
+	// 503, of the responses to idempotent requests that are retried
+	// per MaxRetries. Only the response of the last attempt is sent.
+	RetryableStatusCodes []int `json:"retryable_status_codes"`
+
+	// OutlierDetection if set, ejects the backends whose requests
+	// fail too often from rotation for a while, independently of
+	// the health checks.
+	OutlierDetection *OutlierDetection `json:"outlier_detection"`
+
+	// BackendResponseTimeout if set, bounds how long a request to
+	// a backend can take, like the Timeout of the routes, which take
+	// precedence. Requests that time out are answered with 504
+	// Gateway Timeout, unless the response had already started.
+	// Upgraded connections, such as WebSockets, aren't bounded.
+	BackendResponseTimeout time.Duration `json:"backend_response_timeout"`
+
+	// BackendDialTimeout if set, bounds how long connecting to
+	// a backend can take, instead of the default of 30 seconds,
+	// for the GRPC routes too. It doesn't apply to backends with
+	// a TransportForBackend.
+	BackendDialTimeout time.Duration `json:"backend_dial_timeout"`
+
+	// TimeoutHeader if set, e.g "X-Frontender-Timeout", names a
+	// request header with which clients can override the response
+	// timeout of their requests, for instance for long running
+	// endpoints, with a duration e.g "60s" or a number of seconds.
+	// The overrides are clamped to MaxHeaderTimeout, which must be
+	// set along, and only honored from the TrustedProxies, which set
+	// the header themselves. It isn't forwarded to the backends.
+	TimeoutHeader string `json:"timeout_header"`
+
+	// MaxHeaderTimeout bounds the timeouts set via TimeoutHeader.
+	MaxHeaderTimeout time.Duration `json:"max_header_timeout"`
+
+	// ServeStaleOnError if set, keeps the last successful response
+	// to the GET requests of each URL, and serves it with a "Warning:
+	// 110" header instead of a 503 when all the backends of its route
+	// are down. The responses with Set-Cookie or Cache-Control no-store
+	// or private headers, to requests with credentials i.e Authorization
+	// or Cookie headers or a client certificate, or larger than 1MiB
+	// aren't kept, nor are any with ForwardClientCert set, and at most
+	// 1024 responses are.
+	ServeStaleOnError bool `json:"serve_stale_on_error"`
+
+	// OnShutdownPhase if set, is invoked as Shutdown goes through
+	// each of its phases, in order: ShutdownStoppedAccepting,
+	// ShutdownUnready, ShutdownDrained and ShutdownHealthChecksStopped,
+	// the latter only if the health checks stopped before the deadline.
+	OnShutdownPhase func(ShutdownPhase) `json:"-"`
 }
 
 var (
@@ -78,23 +503,44 @@ var (
 	errAlreadyClosed = errors.New("already closed")
 
 	errEmptyProxyAddress = errors.New("expecting a non-empty proxy server address")
+
+	errNilDomainsListener = errors.New("expecting DomainsListener to return a non-nil net.Listener")
+
+	errResponseBodyTooLarge = errors.New("backend response body too large")
 )
 
 func (req *Request) hasAtLeastOneProxy() bool {
 	if req == nil {
 		return false
 	}
-	if len(req.PrefixRouter) == 0 {
+	if req.BackendResolver != nil {
+		// The backends will be resolved dynamically.
+		return true
+	}
+	routes := req.routes()
+	if len(routes) == 0 {
 		return otils.FirstNonEmptyString(req.ProxyAddresses...) != ""
 	}
-	for _, proxyAddresses := range req.PrefixRouter {
-		if otils.FirstNonEmptyString(proxyAddresses...) != "" {
+	for _, opts := range routes {
+		if len(opts.Backends) > 0 {
 			return true
 		}
 	}
 	return false
 }
 
+// DefaultBackendPingPeriod is the period between liveliness
+// checks of the backends if BackendPingPeriod is unset.
+const DefaultBackendPingPeriod = 3 * time.Minute
+
+// Normalize fills in the defaults for unset fields
+// of the request so that the effective values are explicit.
+func (req *Request) Normalize() {
+	if req.BackendPingPeriod <= 0 {
+		req.BackendPingPeriod = DefaultBackendPingPeriod
+	}
+}
+
 func (req *Request) Validate() error {
 	if !req.hasAtLeastOneProxy() {
 		return errEmptyProxyAddress
@@ -102,9 +548,96 @@ func (req *Request) Validate() error {
 	if req.needsDomains() && strings.TrimSpace(otils.FirstNonEmptyString(req.Domains...)) == "" {
 		return errEmptyDomains
 	}
+	if err := req.validateRouting(); err != nil {
+		return err
+	}
+	if err := req.validateTrustedProxies(); err != nil {
+		return err
+	}
+	if err := req.OutlierDetection.validate(); err != nil {
+		return err
+	}
+	if err := req.CORS.validate(); err != nil {
+		return err
+	}
+	if req.TimeoutHeader != "" && req.MaxHeaderTimeout <= 0 {
+		return fmt.Errorf("timeout header %q needs a positive max header timeout", req.TimeoutHeader)
+	}
+	if req.TimeoutHeader != "" && len(req.TrustedProxies) == 0 {
+		return fmt.Errorf("timeout header %q is only honored from trusted proxies, yet none are set", req.TimeoutHeader)
+	}
+	if req.TrustedHops < 0 {
+		return fmt.Errorf("negative trusted hops %d", req.TrustedHops)
+	}
+	if req.TrustedHops > 0 && len(req.TrustedProxies) == 0 {
+		return fmt.Errorf("trusted hops %d are only honored from trusted proxies, yet none are set", req.TrustedHops)
+	}
+	if req.MaxRetries < 0 {
+		return fmt.Errorf("negative max retries %d", req.MaxRetries)
+	}
+	for _, code := range req.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retryable status code %d", code)
+		}
+	}
+	if err := req.AccessLogFormat.validate(); err != nil {
+		return err
+	}
+	if err := req.validateSessionAffinity(); err != nil {
+		return err
+	}
+	if err := req.LoadBalanceStrategy.validate(); err != nil {
+		return err
+	}
+	if err := req.validateTCPRoutes(); err != nil {
+		return err
+	}
+	for _, path := range []string{req.HealthCheckPath, req.ReadinessPath, req.LivenessPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("health check path %q must start with /", path)
+		}
+	}
+	if strings.IndexFunc(req.HealthCheckMethod, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return fmt.Errorf("invalid health check method %q", req.HealthCheckMethod)
+	}
+	if len(req.PriorityDomains) > 0 {
+		known := make(map[string]bool)
+		for _, domain := range req.SynthesizeDomains() {
+			known[domain] = true
+		}
+		for _, domain := range req.PriorityDomains {
+			if !known[domain] {
+				return fmt.Errorf("priority domain %q is not one of the domains", domain)
+			}
+		}
+	}
 	return nil
 }
 
+// validateRouting validates the fields of req that make up its
+// routing, the only ones that Reload takes.
+func (req *Request) validateRouting() error {
+	if !req.hasAtLeastOneProxy() {
+		return errEmptyProxyAddress
+	}
+	if err := validateRoutePrefixes(req.normalizedPrefixRouter()); err != nil {
+		return err
+	}
+	if err := req.validateWeights(); err != nil {
+		return err
+	}
+	if err := req.validateACLs(); err != nil {
+		return err
+	}
+	if err := req.validateCanaries(); err != nil {
+		return err
+	}
+	if err := req.validateMirrors(); err != nil {
+		return err
+	}
+	return req.validateSchedules()
+}
+
 type Server struct {
 	Domains []string `json:"domains"`
 
@@ -126,7 +659,7 @@ func (req *Request) SynthesizeDomains() []string {
 		}
 
 		toAdd := []string{domain}
-		if !req.NoAutoWWW && !strings.HasPrefix(domain, "www") {
+		if !req.NoAutoWWW && !req.noAutoWWWFor(domain) && !strings.HasPrefix(domain, "www") {
 			toAdd = append(toAdd, fmt.Sprintf("www.%s", domain))
 		}
 
@@ -143,13 +676,22 @@ func (req *Request) SynthesizeDomains() []string {
 	return finalList
 }
 
-func (req *Request) runNonHTTPSRedirector() error {
+func (req *Request) noAutoWWWFor(domain string) bool {
+	for _, optedOut := range req.NoAutoWWWFor {
+		if strings.EqualFold(strings.TrimSpace(optedOut), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (req *Request) runNonHTTPSRedirector(secure http.Handler) error {
 	if req.HTTP1 {
 		return nil
 	}
 
-	redirectURL := strings.TrimSpace(req.NonHTTPSRedirectURL)
-	if redirectURL == "" {
+	redirectHandler := req.nonHTTPSRedirectHandler(secure)
+	if redirectHandler == nil {
 		return nil
 	}
 	nonHTTPSAddr := strings.TrimSpace(req.NonHTTPSAddr)
@@ -162,12 +704,218 @@ func (req *Request) runNonHTTPSRedirector() error {
 		return http.ListenAndServeTLS(nonHTTPSAddr, cert, keyfile, nil)
 	}
 
-	return http.ListenAndServe(nonHTTPSAddr, otils.RedirectAllTrafficTo(redirectURL))
+	return http.ListenAndServe(nonHTTPSAddr, redirectHandler)
 }
 
 type ListenConfirmation struct {
-	closeFn  func() error
-	errsChan <-chan error
+	closeFn    func() error
+	shutdownFn func(context.Context) (*ShutdownReport, error)
+	errsChan   <-chan error
+
+	lproxy           *livelyProxy
+	onBackendRemoved func(route, addr string)
+	side             *sideServers
+
+	// done is closed when the listener is closed.
+	done chan struct{}
+
+	// reloadMu serializes the changes of the routing, along with
+	// that of base, so that a refresh can't revert a reload.
+	reloadMu sync.Mutex
+
+	mu     sync.Mutex
+	config *EffectiveConfig
+	// base is the last applied request,
+	// before its backends were resolved.
+	base *Request
+	// staged is the router prepared by StageRouter.
+	staged *livelyProxy
+	// reportCycleErr surfaces the errors of the liveliness
+	// cycles of the routes, including those added later on.
+	reportCycleErr func(route string, feedback *cycleFeedback)
+	// unready is set once the frontend starts closing.
+	unready bool
+}
+
+// EffectiveConfig is the fully resolved configuration that
+// a running frontend is serving with, after all the defaults
+// have been filled in and the domains have been synthesized.
+type EffectiveConfig struct {
+	HTTP1 bool `json:"http1"`
+
+	Domains []string `json:"domains"`
+
+	ProxyAddresses []string `json:"proxy_addresses"`
+
+	PrefixRouter map[string][]string `json:"routing"`
+
+	Routes map[string]*RouteOptions `json:"routes"`
+
+	ExactRootRoute bool `json:"exact_root_route"`
+
+	BackendPingPeriod time.Duration `json:"backend_ping_period"`
+
+	MaxResponseBodyBytes int64 `json:"max_response_body_bytes"`
+}
+
+// EffectiveConfig returns a copy of the configuration
+// that the running frontend is actually using.
+func (lc *ListenConfirmation) EffectiveConfig() *EffectiveConfig {
+	if lc == nil {
+		return nil
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.config == nil {
+		return nil
+	}
+	cfg := *lc.config
+	cfg.Domains = append([]string(nil), cfg.Domains...)
+	cfg.ProxyAddresses = append([]string(nil), cfg.ProxyAddresses...)
+	cfg.PrefixRouter = copyPrefixRouter(cfg.PrefixRouter)
+	cfg.Routes = copyRoutes(cfg.Routes)
+	return &cfg
+}
+
+// Backends returns the sorted unique addresses of all
+// the backends being health checked, across all routes.
+func (lc *ListenConfirmation) Backends() []string {
+	if lc == nil || lc.lproxy == nil {
+		return nil
+	}
+	return lc.lproxy.backendAddresses()
+}
+
+func (lp *livelyProxy) backendAddresses() []string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	uniqs := make(map[string]bool)
+	var addresses []string
+	for _, peersMap := range lp.secondariesMap {
+		for _, secondary := range peersMap {
+			if !uniqs[secondary.Addr] {
+				uniqs[secondary.Addr] = true
+				addresses = append(addresses, secondary.Addr)
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (req *Request) effectiveConfig(domains []string) *EffectiveConfig {
+	return &EffectiveConfig{
+		HTTP1:                req.HTTP1,
+		Domains:              domains,
+		ProxyAddresses:       normalizeAddresses(req.ProxyAddresses),
+		PrefixRouter:         req.normalizedPrefixRouter(),
+		Routes:               req.routes(),
+		ExactRootRoute:       req.ExactRootRoute,
+		BackendPingPeriod:    req.BackendPingPeriod,
+		MaxResponseBodyBytes: req.MaxResponseBodyBytes,
+	}
+}
+
+// normalizedPrefixRouter returns the backends of every route
+// with their addresses trimmed of whitespace and with the blank
+// addresses removed.
+func (req *Request) normalizedPrefixRouter() map[string][]string {
+	routes := req.routes()
+	if routes == nil {
+		return nil
+	}
+	pr := make(map[string][]string, len(routes))
+	for route, opts := range routes {
+		pr[route] = opts.Backends
+	}
+	return pr
+}
+
+// validateRoutePrefixes ensures that every route prefix starts
+// with "/" since request paths always do, otherwise such a
+// route would silently never match anything.
+func validateRoutePrefixes(pr map[string][]string) error {
+	var bad []string
+	for route := range pr {
+		if !strings.HasPrefix(route, "/") {
+			bad = append(bad, route)
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	sort.Strings(bad)
+	return fmt.Errorf("route prefixes must start with \"/\", got: %q", bad)
+}
+
+func normalizeAddresses(addresses []string) []string {
+	var normalized []string
+	for _, addr := range addresses {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			normalized = append(normalized, addr)
+		}
+	}
+	return normalized
+}
+
+func copyRoutes(routes map[string]*RouteOptions) map[string]*RouteOptions {
+	if routes == nil {
+		return nil
+	}
+	copied := make(map[string]*RouteOptions, len(routes))
+	for route, opts := range routes {
+		optsCopy := *opts
+		optsCopy.Backends = append([]string(nil), opts.Backends...)
+		if opts.Weights != nil {
+			optsCopy.Weights = make(map[string]int, len(opts.Weights))
+			for addr, weight := range opts.Weights {
+				optsCopy.Weights[addr] = weight
+			}
+		}
+		if opts.ACL != nil {
+			acl := *opts.ACL
+			acl.Allow = append([]string(nil), opts.ACL.Allow...)
+			acl.Deny = append([]string(nil), opts.ACL.Deny...)
+			optsCopy.ACL = &acl
+		}
+		if opts.Canary != nil {
+			canary := *opts.Canary
+			canary.Backends = append([]string(nil), opts.Canary.Backends...)
+			optsCopy.Canary = &canary
+		}
+		if opts.Mirror != nil {
+			mirror := *opts.Mirror
+			mirror.Backends = append([]string(nil), opts.Mirror.Backends...)
+			optsCopy.Mirror = &mirror
+		}
+		if opts.Schedules != nil {
+			optsCopy.Schedules = make([]*ScheduleRule, 0, len(opts.Schedules))
+			for _, rule := range opts.Schedules {
+				if rule != nil {
+					ruleCopy := *rule
+					ruleCopy.Backends = append([]string(nil), rule.Backends...)
+					ruleCopy.Weekdays = append([]string(nil), rule.Weekdays...)
+					rule = &ruleCopy
+				}
+				optsCopy.Schedules = append(optsCopy.Schedules, rule)
+			}
+		}
+		copied[route] = &optsCopy
+	}
+	return copied
+}
+
+func copyPrefixRouter(pr map[string][]string) map[string][]string {
+	if pr == nil {
+		return nil
+	}
+	copied := make(map[string][]string, len(pr))
+	for route, addresses := range pr {
+		copied[route] = append([]string(nil), addresses...)
+	}
+	return copied
 }
 
 func (lc *ListenConfirmation) Close() error {
@@ -186,6 +934,20 @@ func (req *Request) needsDomains() bool {
 // persistent connection to each one of them and use that
 // as the weight to figure out which one to send traffic to.
 func Listen(req *Request) (*ListenConfirmation, error) {
+	if req == nil {
+		return nil, errEmptyProxyAddress
+	}
+
+	// Work on a copy so that filling in the
+	// defaults doesn't modify the caller's request.
+	normalized := *req
+	normalized.Normalize()
+	base := &normalized
+
+	req, err := base.withResolvedBackends()
+	if err != nil {
+		return nil, err
+	}
 	if err := req.Validate(); err != nil {
 		return nil, err
 	}
@@ -200,10 +962,26 @@ func Listen(req *Request) (*ListenConfirmation, error) {
 		return nil, errEmptyDomains
 	}
 
+	if req.PreflightDNS && !req.HTTP1 {
+		hostIPs, err := parseIPs(req.PublicIPs)
+		if err != nil {
+			return nil, err
+		}
+		if err := PreflightDomains(context.Background(), nil, hostIPs, madeDomains...); err != nil {
+			return nil, err
+		}
+	}
+
+	var autocertManager *autocert.Manager
 	domainsListener := req.DomainsListener
 	if domainsListener == nil {
 		if !req.HTTP1 {
-			domainsListener = autocert.NewListener
+			listener, m, err := listenAutocert(req.logf, req.ACMEEmail, madeDomains...)
+			if err != nil {
+				return nil, err
+			}
+			autocertManager = m
+			domainsListener = func(domains ...string) net.Listener { return listener }
 		} else {
 			listener, err := net.Listen("tcp", req.NonHTTPSAddr)
 			if err != nil {
@@ -213,26 +991,214 @@ func Listen(req *Request) (*ListenConfirmation, error) {
 		}
 	}
 	listener := domainsListener(madeDomains...)
+	if listener == nil {
+		return nil, errNilDomainsListener
+	}
 
-	return req.runAndCreateListener(listener)
+	lc, err := req.runAndCreateListener(listener)
+	if err != nil {
+		return nil, err
+	}
+	if autocertManager != nil {
+		// Only now that the listener is served can the
+		// ACME challenges of the priority domains be.
+		if err := provisionPriorityDomains(autocertManager, req.PriorityDomains); err != nil {
+			lc.Close()
+			return nil, err
+		}
+	}
+	lc.config = req.effectiveConfig(madeDomains)
+	lc.base = base
+	if base.BackendResolver != nil {
+		go lc.refreshBackends(req.BackendPingPeriod)
+	}
+	return lc, nil
 }
 
 type livelyProxy struct {
 	mu sync.Mutex
 
-	next map[string]int
+	// currentWeights holds, per route, the current weights
+	// of the backends for smooth weighted round robin.
+	currentWeights map[string]map[string]float64
+
+	// generation counts, per route, how many times
+	// the membership of the live backends has changed.
+	generation map[string]uint64
 
 	cycleFreq time.Duration
 
 	primariesMap   map[string]*lively.Peer
 	secondariesMap map[string]map[string]*lively.Peer
 
-	longestPrefixFirst []string
+	routePrefixes *prefixTrie
 
 	liveAddresses map[string][]string
-}
 
-const defaultCycleFrequence = time.Minute * 3
+	routeOptions map[string]*RouteOptions
+
+	exactRootRoute bool
+
+	serverTiming bool
+
+	// version if set, is added to proxied
+	// responses in the versionHeader.
+	version string
+
+	strictSNI bool
+
+	cors *CORSConfig
+
+	// drainingUntil maps backend addresses that signalled
+	// that they are closing connections, to the time until
+	// which they should not be sent new requests.
+	drainingUntil map[string]time.Time
+
+	maxResponseBodyBytes int64
+
+	dumpSamplePercent float64
+	dumpMaxBodyBytes  int64
+
+	logfFn func(format string, args ...interface{})
+
+	rejectionLog func(*Rejection)
+
+	accessLog              func(*AccessLogEntry)
+	accessLogSamplePercent float64
+	accessLogWriter        io.Writer
+	accessLogFormat        AccessLogFormat
+	// accessLogMu serializes the writes to accessLogWriter.
+	accessLogMu sync.Mutex
+
+	healthCheck healthCheckOptions
+	// livenessPath if set, is checked to track in
+	// liveness whether backends are alive at all.
+	livenessPath string
+	liveness     map[string]bool
+	// pingLimiter if set, bounds the number of
+	// simultaneous pings across all the routes.
+	pingLimiter chan struct{}
+	// pings holds the latest ping result of every
+	// backend address, to share it across routes.
+	pings map[string]*pingResult
+
+	// cycled records the routes whose liveliness
+	// has been checked at least once.
+	cycled map[string]bool
+
+	warmingUpStatusCode int
+	warmingUpRetryAfter time.Duration
+	retryAfter          time.Duration
+
+	transportForBackend func(addr string) http.RoundTripper
+	// transports caches the transport of each backend.
+	transports    map[string]http.RoundTripper
+	dialAddresses map[string]string
+	// suppliedTransports has the backends, keyed as the proxies are,
+	// whose transports transportForBackend supplied. Those may be
+	// shared, hence their idle connections are left to their owner.
+	suppliedTransports map[string]bool
+
+	// removedBackendGracePeriod is how long the cached proxies and
+	// transports of the backends removed by PromoteStaged are kept.
+	removedBackendGracePeriod time.Duration
+
+	healthWebhookURL string
+	// pendingTransitions are the health transitions yet to be
+	// POSTed, in order, by the single postHealthTransitions
+	// goroutine, which runs while postingTransitions is set.
+	pendingTransitions []*HealthTransition
+	postingTransitions bool
+
+	maxResponseHeaderBytes int64
+
+	serverWideAllow []string
+
+	// inFlight counts the requests being served by route.
+	inFlight map[string]int
+	// drained is closed once the requests
+	// in flight on a route have completed.
+	drained map[string]chan struct{}
+
+	// proxies caches the reverse proxies of backends.
+	proxies map[string]*backendProxy
+
+	// grpcTransports caches the HTTP/2 transports of gRPC backends.
+	grpcTransports map[string]http.RoundTripper
+
+	// scheduleNext round robins the backends of schedule rules.
+	scheduleNext map[string]int
+
+	// slowStarts maps routes to their backends ramping up.
+	slowStarts map[string]map[string]*slowStart
+
+	loadBalanceStrategy LoadBalanceStrategy
+
+	selectBackend func(route string, liveAddrs []string, r *http.Request) string
+
+	sessionAffinity       SessionAffinity
+	sessionAffinityCookie string
+	// affinityRings maps routes to the hash
+	// rings that pin clients to their backends.
+	affinityRings map[string]*hashRing
+
+	backendResponseTimeout time.Duration
+	backendDialTimeout     time.Duration
+	timeoutHeader          string
+	maxHeaderTimeout       time.Duration
+
+	serveStaleOnError bool
+	// staleResponses maps the keys of GET requests to the last
+	// successful responses to them, to serve when their route's
+	// backends are all down, guarded by staleMu.
+	staleMu        sync.Mutex
+	staleResponses map[string]*staleResponse
+
+	maxRetries           int
+	retryableStatusCodes map[int]bool
+
+	outlierDetection *OutlierDetection
+	// outliers maps backends to their recent outcomes.
+	outliers map[string]*outlierState
+	// backendInFlight counts the requests in flight per backend,
+	// only tracked for the LeastConnections strategy.
+	backendInFlight map[string]*atomic.Int64
+
+	// lastCycles maps routes to the outcome
+	// of their last liveliness cycle.
+	lastCycles map[string]*routeCycle
+
+	// canaries maps routes to the state of their canary.
+	canaries map[string]*canaryState
+	// mirrors maps routes to the state of their mirror.
+	mirrors          map[string]*mirrorState
+	mirroredInFlight atomic.Int64
+	// healthStates maps routes to the last
+	// known liveliness of their backends.
+	healthStates map[string]map[string]bool
+
+	forwardClientCert bool
+	forwardedHeader   bool
+	trustedProxies    []string
+	trustedHops       int
+
+	metricsPath   string
+	requestCounts requestCounts
+
+	notFoundHandler http.Handler
+
+	coalesceGETs bool
+	// flights are the in flight coalesced requests.
+	flights map[string]*flight
+
+	// stopCycling is closed to stop the health checks
+	// and cycling tracks the goroutines running them.
+	stopCycling     chan struct{}
+	stopCyclingOnce sync.Once
+	cycling         sync.WaitGroup
+
+	clock clock
+}
 
 type cycleFeedback struct {
 	cycleNumber uint64
@@ -247,190 +1213,1193 @@ func (lp *livelyProxy) run() map[string]chan *cycleFeedback {
 	lp.mu.Unlock()
 
 	if freq <= 0 {
-		freq = defaultCycleFrequence
+		freq = DefaultBackendPingPeriod
 	}
 
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
 	feedbackChanMap := make(map[string]chan *cycleFeedback)
 	for route, primary := range lp.primariesMap {
 		feedbackChan := make(chan *cycleFeedback)
-		go func(route string, primary *lively.Peer, feedbackChan chan *cycleFeedback) {
-			defer close(feedbackChan)
-			cycleNumber := uint64(0)
-
-			for {
-				cycleNumber += 1
-				livePeers, nonLivePeers, err := lp.cycle(route, primary)
-				feedbackChan <- &cycleFeedback{
-					err:          err,
-					cycleNumber:  cycleNumber,
-					livePeers:    livePeers,
-					nonLivePeers: nonLivePeers,
-				}
-				<-time.After(freq)
-			}
-		}(route, primary, feedbackChan)
+		feedbackChanMap[route] = feedbackChan
+		lp.cycling.Add(1)
+		go lp.cycleRoute(route, primary, freq, feedbackChan)
 	}
 
 	return feedbackChanMap
 }
 
-func (lp *livelyProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Firstly we need to find a primary match
-	var matchedRoute string
-	// We need to match by longest prefix first
-	// so that cases like
-	// * "/"
-	// * "/foo"
-	// * "/fo"
-	// given * "/foo"
-	// will always match "/foo" instead of "/" or "/fo"
-	// however in the absence of "/foo", "/fo" will match before "/"
-	longestPrefixFirst := lp.longestPrefixFirst
-	for _, routePrefix := range longestPrefixFirst {
-		if strings.HasPrefix(r.URL.Path, routePrefix) {
-			matchedRoute = routePrefix
-			break
-		}
-	}
-
-	proxyAddr := lp.roundRobinedAddress(matchedRoute)
-	// Now proxy the traffic to that request
-	parsedURL, err := url.Parse(proxyAddr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// cycleRoute periodically checks the liveliness of the backends of
+// route until the route is removed or replaced by a reload, or
+// the health checks are stopped.
+func (lp *livelyProxy) cycleRoute(route string, primary *lively.Peer, freq time.Duration, feedbackChan chan *cycleFeedback) {
+	defer lp.cycling.Done()
+	defer close(feedbackChan)
+	cycleNumber := uint64(0)
+
+	for lp.isCurrentPrimary(route, primary) {
+		cycleNumber += 1
+		livePeers, nonLivePeers, err := lp.cycle(route, primary)
+		lp.recordCycle(route, primary, cycleNumber, nonLivePeers, err)
+		feedback := &cycleFeedback{
+			err:          err,
+			cycleNumber:  cycleNumber,
+			livePeers:    livePeers,
+			nonLivePeers: nonLivePeers,
+		}
+		select {
+		case feedbackChan <- feedback:
+		case <-lp.stopCycling:
+			return
+		}
+		select {
+		case <-lp.clock.After(freq):
+		case <-lp.stopCycling:
+			return
+		}
 	}
+}
 
-	r.URL.Path = strings.TrimPrefix(r.URL.Path, matchedRoute)
-	if !strings.HasPrefix(r.URL.Path, "/") {
-		r.URL.Path = "/" + r.URL.Path
+// stopHealthChecks stops the cycling of all the routes.
+func (lp *livelyProxy) stopHealthChecks() {
+	lp.stopCyclingOnce.Do(func() {
+		close(lp.stopCycling)
+	})
+}
+
+// waitHealthChecks waits, until ctx is done, for the
+// health checks under way to complete once stopped.
+func (lp *livelyProxy) waitHealthChecks(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		lp.cycling.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	rproxy := httputil.NewSingleHostReverseProxy(parsedURL)
-	rproxy.ServeHTTP(w, r)
 }
 
-func (lp *livelyProxy) roundRobinedAddress(route string) string {
+// startCycling begins checking the liveliness of the
+// backends of a route that was added after run.
+func (lp *livelyProxy) startCycling(route string, primary *lively.Peer) chan *cycleFeedback {
 	lp.mu.Lock()
-	defer lp.mu.Unlock()
+	freq := lp.cycleFreq
+	lp.mu.Unlock()
 
-	liveAddresses := lp.liveAddresses[route]
-	if len(liveAddresses) == 0 {
-		return ""
-	}
-	if lp.next[route] >= len(liveAddresses) {
-		lp.next[route] = 0
+	if freq <= 0 {
+		freq = DefaultBackendPingPeriod
 	}
-	addr := liveAddresses[lp.next[route]]
-	// Now increment it
-	lp.next[route] += 1
-
-	return addr
+	feedbackChan := make(chan *cycleFeedback)
+	lp.cycling.Add(1)
+	go lp.cycleRoute(route, primary, freq, feedbackChan)
+	return feedbackChan
 }
 
-func (lp *livelyProxy) cycle(route string, primary *lively.Peer) (livePeers, nonLivePeers []*lively.Liveliness, err error) {
-	livePeers, nonLivePeers, err = primary.Liveliness(&lively.LivelyRequest{})
+// collectFeedback reports the errors of the liveliness
+// cycles of route until its feedbackChan is closed.
+func (lc *ListenConfirmation) collectFeedback(route string, feedbackChan chan *cycleFeedback) {
+	for feedback := range feedbackChan {
+		if feedback.err != nil && lc.reportCycleErr != nil {
+			lc.reportCycleErr(route, feedback)
+		}
+	}
+}
 
+func (lp *livelyProxy) isCurrentPrimary(route string, primary *lively.Peer) bool {
 	lp.mu.Lock()
 	defer lp.mu.Unlock()
 
-	var liveAddresses []string
-	for _, peer := range livePeers {
-		liveAddresses = append(liveAddresses, peer.Addr)
-	}
+	return lp.primariesMap[route] == primary
+}
 
-	// Now reset the next index.
-	lp.next[route] = 0
+// match finds the route for path along with its options and the
+// path to forward to the backend. ok is false if no route matched.
+// A matched request is counted as in flight on its route, until
+// the caller calls lp.leaveRoute.
+func (lp *livelyProxy) match(path string) (route, forwardedPath string, opts *RouteOptions, ok bool) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
 
-	// Shuffle the liveAddresses.
-	perm := rand.Perm(len(liveAddresses))
-	var shuffledAddresses []string
-	for _, i := range perm {
-		shuffledAddresses = append(shuffledAddresses, liveAddresses[i])
+	route, forwardedPath = matchRoute(path, lp.routePrefixes)
+	if route == "/" && lp.exactRootRoute && forwardedPath != "/" {
+		return "", "", nil, false
 	}
-	lp.liveAddresses[route] = shuffledAddresses
+	if _, ok = lp.primariesMap[route]; !ok {
+		return "", "", nil, false
+	}
+	opts = lp.routeOptions[route]
+	if opts != nil {
+		forwardedPath = opts.forwardedPath(route, cleanPath(path))
+	}
+	lp.enterRouteLocked(route)
+	return route, forwardedPath, opts, true
+}
 
-	return livePeers, nonLivePeers, err
+func (lp *livelyProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if lp.accessLogEnabled() {
+		lp.serveAccessLogged(w, r, lp.serveHTTP)
+		return
+	}
+	lp.serveHTTP(w, r)
 }
 
-func makeLivelyProxy(cycleFreq time.Duration, pr map[string][]string) *livelyProxy {
-	secondariesMap := make(map[string]map[string]*lively.Peer)
-	primariesMap := make(map[string]*lively.Peer)
-	for prefix, addresses := range pr {
-		primary := &lively.Peer{
-			ID:      uuid.NewRandom().String(),
-			Primary: true,
+func (lp *livelyProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if lp.strictSNI && misdirected(r) {
+		lp.reject(w, r, http.StatusMisdirectedRequest, "misdirected request")
+		return
+	}
+	if isServerWideOptions(r) {
+		lp.serveServerWideOptions(w)
+		return
+	}
+	if lp.metricsPath != "" && r.URL.Path == lp.metricsPath {
+		lp.serveMetrics(w, r)
+		return
+	}
+	if lp.cors != nil && isPreflight(r) {
+		if err := lp.cors.servePreflight(w, r); err != nil {
+			lp.reject(w, r, http.StatusForbidden, err.Error())
 		}
+		return
+	}
 
-		peersMap := make(map[string]*lively.Peer)
-		for _, addr := range addresses {
-			secondary := &lively.Peer{
-				Addr: addr,
-				ID:   uuid.NewRandom().String(),
-			}
-			_ = primary.AddPeer(secondary)
-			peersMap[secondary.ID] = secondary
+	matchedRoute, forwardedPath, opts, ok := lp.match(r.URL.Path)
+	lp.requestCounts.add(matchedRoute, ok)
+	if !ok {
+		if lp.notFoundHandler != nil {
+			lp.notFoundHandler.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
 		}
-		secondariesMap[prefix] = peersMap
-		primariesMap[prefix] = primary
+		return
 	}
-
-	routePrefixes := make([]string, 0, len(pr))
-	for routePrefix := range pr {
-		routePrefixes = append(routePrefixes, routePrefix)
+	defer lp.leaveRoute(matchedRoute)
+	if opts != nil && !opts.ACL.allows(clientIP(r, lp.trustedProxies, lp.trustedHops)) {
+		lp.reject(w, r, http.StatusForbidden, "forbidden")
+		return
 	}
 
-	sort.Slice(routePrefixes, func(i, j int) bool {
-		// Sort in reverse by length
-		si, sj := routePrefixes[i], routePrefixes[j]
-		return len(si) >= len(sj)
-	})
-	return &livelyProxy{
-		longestPrefixFirst: routePrefixes,
-		primariesMap:       primariesMap,
-		secondariesMap:     secondariesMap,
-		cycleFreq:          cycleFreq,
-
-		next:          make(map[string]int),
-		liveAddresses: make(map[string][]string),
+	// Coalescing only happens after the checks above, which
+	// are per request, so that every request goes through them.
+	forward := func(w http.ResponseWriter) {
+		lp.forward(w, r, matchedRoute, forwardedPath, opts)
+	}
+	// The responses to requests forwarded with the identity of their
+	// client certificate are that identity's alone.
+	if lp.coalesceGETs && !lp.forwardClientCert && coalescable(r) {
+		lp.serveCoalesced(w, r, forward)
+		return
 	}
+	forward(w)
+}
+
+// forward proxies r, which matched route, to one of its backends.
+func (lp *livelyProxy) forward(w http.ResponseWriter, r *http.Request, matchedRoute, forwardedPath string, opts *RouteOptions) {
+	var canary *CanaryOptions
+	var schedules []*ScheduleRule
+	if opts != nil {
+		canary, schedules = opts.Canary, opts.Schedules
+	}
+	proxyAddr := lp.scheduledAddress(matchedRoute, schedules)
+	toCanary := false
+	if proxyAddr == "" {
+		proxyAddr = lp.canaryAddress(matchedRoute, canary)
+		toCanary = proxyAddr != ""
+	}
+	if proxyAddr == "" {
+		proxyAddr = lp.pickAddress(matchedRoute, opts, w, r)
+	}
+	if proxyAddr == "" {
+		lp.serveNoLiveBackends(w, r, matchedRoute)
+		return
+	}
+	noteForwarding(r.Context(), matchedRoute, proxyAddr)
+	grpc := opts != nil && opts.GRPC
+	// Now proxy the traffic to that request
+	bp, err := lp.proxyFor(proxyAddr, grpc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	staleKey := lp.staleKey(matchedRoute, r)
+	r.URL.Path = forwardedPath
+	r.URL.RawPath = ""
+	if lp.forwardedHeader {
+		// Before the Host is rewritten below, as
+		// the backend wants the one clients used.
+		setForwardedHeader(r)
+	}
+	clientHost := r.Host
+	if _, ok := lp.dialAddresses[proxyAddr]; ok {
+		// The backend is connected to at its dial address
+		// but expects the Host of its logical address.
+		r.Host = bp.target.Host
+	}
+	if lp.forwardClientCert {
+		setClientCertHeaders(r)
+	}
+	timeout := lp.backendResponseTimeout
+	if opts != nil && opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	// Taken before mirroring, lest the shadows get the header.
+	if override, ok := lp.takeHeaderTimeout(r); ok {
+		timeout = override
+	}
+	upgrade := isUpgrade(r)
+	if opts != nil && opts.Mirror != nil && !upgrade {
+		lp.mirror(matchedRoute, opts, r, clientHost)
+	}
+	ctx := r.Context()
+	if timeout > 0 && !upgrade {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	pr := &proxiedRequest{
+		route:    matchedRoute,
+		addr:     proxyAddr,
+		path:     r.URL.Path,
+		canary:   canary,
+		toCanary: toCanary,
+		dump:     lp.shouldDump(),
+		start:    time.Now(),
+		staleKey: staleKey,
+	}
+	if !toCanary && !grpc && !upgrade {
+		pr.retries = lp.maxRetries
+		if opts != nil && opts.Retries > 0 {
+			pr.retries = opts.Retries
+		}
+	}
+	r = r.WithContext(context.WithValue(ctx, proxiedRequestKey{}, pr))
+	if pr.dump {
+		lp.dumpRequest(r)
+	}
+	leave := lp.enterBackend(proxyAddr)
+	// Deferred so that aborted requests are counted out too.
+	defer leave()
+	bp.proxy.ServeHTTP(w, r)
+}
+
+// serveNoLiveBackends responds to requests for a route without any
+// live backends, telling apart the case where the liveliness of the
+// backends hasn't yet been checked, from that where they are all down.
+func (lp *livelyProxy) serveNoLiveBackends(w http.ResponseWriter, r *http.Request, route string) {
+	if lp.serveStale(w, r, route) {
+		return
+	}
+
+	lp.mu.Lock()
+	cycled := lp.cycled[route]
+	tooFew := len(lp.liveAddresses[route]) > 0 && lp.tooFewLiveLocked(route)
+	lp.mu.Unlock()
+
+	if tooFew || cycled {
+		if lp.retryAfter > 0 {
+			setRetryAfter(w.Header(), lp.retryAfter)
+		}
+		if tooFew {
+			http.Error(w, "too few live backends for route "+route, http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "no live backends for route "+route, http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	code := lp.warmingUpStatusCode
+	if code <= 0 {
+		code = http.StatusServiceUnavailable
+	}
+	retryAfter := lp.warmingUpRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultWarmingUpRetryAfter
+	}
+	setRetryAfter(w.Header(), retryAfter)
+	http.Error(w, "warming up", code)
+}
+
+// takeHeaderTimeout returns the response timeout that r asks for via
+// the TimeoutHeader, clamped to MaxHeaderTimeout, and whether it asks
+// for a valid one from one of the TrustedProxies. The header is
+// removed, to not be forwarded.
+func (lp *livelyProxy) takeHeaderTimeout(r *http.Request) (time.Duration, bool) {
+	if lp.timeoutHeader == "" {
+		return 0, false
+	}
+	value := strings.TrimSpace(r.Header.Get(lp.timeoutHeader))
+	r.Header.Del(lp.timeoutHeader)
+	if value == "" {
+		return 0, false
+	}
+	if addr, ok := remoteIP(r.RemoteAddr); !ok || !aclContains(lp.trustedProxies, addr) {
+		return 0, false
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.ParseFloat(value, 64)
+		if serr != nil {
+			return 0, false
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, false
+	}
+	if timeout > lp.maxHeaderTimeout {
+		timeout = lp.maxHeaderTimeout
+	}
+	return timeout, true
+}
+
+func setRetryAfter(hdr http.Header, retryAfter time.Duration) {
+	// Retry-After is in whole seconds, rounded up.
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	hdr.Set("Retry-After", fmt.Sprintf("%d", seconds))
+}
+
+const defaultWarmingUpRetryAfter = time.Second
+
+// transportFor returns the transport used to reach the backend at
+// addr, consulting transportForBackend only once per backend.
+func (lp *livelyProxy) transportFor(addr string) http.RoundTripper {
+	lp.mu.Lock()
+	rt, ok := lp.transports[addr]
+	transportForBackend := lp.transportForBackend
+	lp.mu.Unlock()
+
+	if ok {
+		return rt
+	}
+	// The hook is called without lp.mu held, as it
+	// could be slow or even call back into the frontend.
+	if transportForBackend != nil {
+		rt = transportForBackend(addr)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if cached, ok := lp.transports[addr]; ok {
+		// Another request got there first.
+		return cached
+	}
+	if rt == nil {
+		rt = backendTransport(lp.dialAddresses[addr], lp.maxResponseHeaderBytes, lp.backendDialTimeout)
+	} else {
+		lp.noteSuppliedTransportLocked(addr)
+	}
+	if lp.transports == nil {
+		lp.transports = make(map[string]http.RoundTripper)
+	}
+	lp.transports[addr] = rt
+	return rt
+}
+
+// transportOptions are the options that the transports to the
+// backends, which they are also health checked over, are made with.
+type transportOptions struct {
+	forBackend             func(addr string) http.RoundTripper
+	dialAddresses          map[string]string
+	maxResponseHeaderBytes int64
+	dialTimeout            time.Duration
+}
+
+func (req *Request) transportOptions() transportOptions {
+	return transportOptions{
+		forBackend:             req.TransportForBackend,
+		dialAddresses:          req.DialAddresses,
+		maxResponseHeaderBytes: req.MaxBackendResponseHeaderBytes,
+		dialTimeout:            req.BackendDialTimeout,
+	}
+}
+
+func (lp *livelyProxy) transportOptions() transportOptions {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	return transportOptions{
+		forBackend:             lp.transportForBackend,
+		dialAddresses:          lp.dialAddresses,
+		maxResponseHeaderBytes: lp.maxResponseHeaderBytes,
+		dialTimeout:            lp.backendDialTimeout,
+	}
+}
+
+func (lp *livelyProxy) setTransportOptions(to transportOptions) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.transportForBackend = to.forBackend
+	lp.dialAddresses = to.dialAddresses
+	lp.maxResponseHeaderBytes = to.maxResponseHeaderBytes
+	lp.backendDialTimeout = to.dialTimeout
+}
+
+// backendTransport returns http.DefaultTransport unless dialAddr,
+// maxHeaderBytes or dialTimeout are set. If dialAddr is set, the
+// transport connects to it whatever the host of the request URL is.
+func backendTransport(dialAddr string, maxHeaderBytes int64, dialTimeout time.Duration) http.RoundTripper {
+	if dialAddr == "" && maxHeaderBytes <= 0 && dialTimeout <= 0 {
+		return http.DefaultTransport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if dialAddr != "" || dialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if dialTimeout > 0 {
+			dialer.Timeout = dialTimeout
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dialAddr != "" {
+				addr = dialAddr
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	if maxHeaderBytes > 0 {
+		t.MaxResponseHeaderBytes = maxHeaderBytes
+	}
+	return t
+}
+
+// backendsTransport routes the health check pings of
+// each backend through the transport of that backend.
+type backendsTransport struct {
+	lp *livelyProxy
+	// byOrigin maps "scheme://host" to backend addresses.
+	byOrigin map[string]string
+	// grpc if set, routes through the gRPC transports.
+	grpc bool
+}
+
+var _ http.RoundTripper = (*backendsTransport)(nil)
+
+func (bt *backendsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr, ok := bt.byOrigin[req.URL.Scheme+"://"+req.URL.Host]
+	if !ok {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	if bt.grpc {
+		return bt.lp.grpcTransportFor(addr).RoundTrip(req)
+	}
+	return bt.lp.transportFor(addr).RoundTrip(req)
+}
+
+// misdirected reports whether r is an HTTP/2 request whose
+// authority differs from the SNI of its TLS connection.
+func misdirected(r *http.Request) bool {
+	if r.ProtoMajor != 2 || r.TLS == nil || r.TLS.ServerName == "" {
+		return false
+	}
+	return normalizeHost(r.Host) != normalizeHost(r.TLS.ServerName)
+}
+
+// normalizeHost returns host, as from a Host header, without
+// its port or trailing dot and in lower case, for matching it
+// against bare hostnames. The Host header itself is forwarded
+// to the backends as the client sent it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// addServerTiming adds a Server-Timing metric as per
+// https://www.w3.org/TR/server-timing/ with the duration in milliseconds.
+func addServerTiming(hdr http.Header, metric string, dur time.Duration) {
+	ms := float64(dur) / float64(time.Millisecond)
+	hdr.Add("Server-Timing", fmt.Sprintf("%s;dur=%.3f", metric, ms))
+}
+
+func (lp *livelyProxy) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	lp.logf("frontender: proxy error: %v", err)
+	code := http.StatusBadGateway
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		code = http.StatusGatewayTimeout
+	}
+	w.WriteHeader(code)
+}
+
+func (lp *livelyProxy) modifyResponse(proxyAddr string, res *http.Response) error {
+	if res.Close {
+		// The backend signalled "Connection: close" which usually
+		// means that it is shutting down or shedding connections,
+		// hence prefer the other backends for a while.
+		lp.markDraining(proxyAddr)
+	}
+
+	maxBytes := lp.maxResponseBodyBytes
+	if maxBytes <= 0 || res.StatusCode == http.StatusSwitchingProtocols {
+		// The body of upgraded connections has to stay writable.
+		return nil
+	}
+	if res.ContentLength > maxBytes {
+		return errResponseBodyTooLarge
+	}
+	if res.Body != nil {
+		res.Body = &maxBytesReadCloser{rc: res.Body, remaining: maxBytes}
+	}
+	return nil
+}
+
+// maxBytesReadCloser is like http.MaxBytesReader but for
+// response bodies: it returns errResponseBodyTooLarge once
+// more than remaining bytes have been read from rc.
+type maxBytesReadCloser struct {
+	rc        io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (mrc *maxBytesReadCloser) Read(b []byte) (int, error) {
+	if mrc.err != nil {
+		return 0, mrc.err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// Read one more byte than permitted so that we
+	// can tell if the limit was actually exceeded.
+	if int64(len(b)) > mrc.remaining+1 {
+		b = b[:mrc.remaining+1]
+	}
+	n, err := mrc.rc.Read(b)
+	if int64(n) <= mrc.remaining {
+		mrc.remaining -= int64(n)
+		mrc.err = err
+		return n, err
+	}
+	n = int(mrc.remaining)
+	mrc.remaining = 0
+	mrc.err = errResponseBodyTooLarge
+	return n, mrc.err
+}
+
+func (mrc *maxBytesReadCloser) Close() error {
+	return mrc.rc.Close()
+}
+
+// pickAddress selects the live backend that r will be forwarded to,
+// setting on w the affinity cookie of the clients without it.
+func (lp *livelyProxy) pickAddress(route string, opts *RouteOptions, w http.ResponseWriter, r *http.Request) string {
+	if lp.selectBackend != nil {
+		if addr := lp.selectedAddress(route, r); addr != "" {
+			return addr
+		}
+	}
+	if opts != nil && opts.ShardHeader != "" {
+		value := strings.TrimSpace(r.Header.Get(opts.ShardHeader))
+		if shard, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if addr := lp.shardedAddress(route, shard); addr != "" {
+				return addr
+			}
+		}
+	}
+	if lp.sessionAffinity != "" && lp.sessionAffinity != NoSessionAffinity {
+		if key := lp.affinityKey(w, r); key != "" {
+			if addr := lp.affinityAddress(route, key); addr != "" {
+				return addr
+			}
+		}
+	}
+	return lp.roundRobinedAddress(route)
+}
+
+// selectedAddress returns the live backend of route that
+// SelectBackend picks for r, or "" if it picks none.
+func (lp *livelyProxy) selectedAddress(route string, r *http.Request) string {
+	lp.mu.Lock()
+	var liveAddresses []string
+	if !lp.tooFewLiveLocked(route) {
+		liveAddresses = lp.admittedLocked(distinctSorted(lp.liveAddresses[route]), lp.clock.Now())
+	}
+	lp.mu.Unlock()
+
+	if len(liveAddresses) == 0 {
+		return ""
+	}
+	// The selector gets a copy of its own and
+	// runs without holding up the others.
+	addr := lp.selectBackend(route, append([]string(nil), liveAddresses...), r)
+	for _, live := range liveAddresses {
+		if addr == live {
+			return addr
+		}
+	}
+	return ""
+}
+
+// shardedAddress deterministically maps shard to one of the live
+// backends of route, sorted so that the mapping doesn't depend on the
+// order in which they were checked, using shard modulo their count.
+// The shards of ejected backends go to the next ones after them.
+func (lp *livelyProxy) shardedAddress(route string, shard int64) string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.tooFewLiveLocked(route) {
+		return ""
+	}
+	liveAddresses := distinctSorted(lp.liveAddresses[route])
+	n := int64(len(liveAddresses))
+	if n == 0 {
+		return ""
+	}
+	admitted := make(map[string]bool)
+	for _, addr := range lp.admittedLocked(liveAddresses, lp.clock.Now()) {
+		admitted[addr] = true
+	}
+	i := ((shard % n) + n) % n
+	for !admitted[liveAddresses[i]] {
+		i = (i + 1) % n
+	}
+	return liveAddresses[i]
+}
+
+// roundRobinedAddress picks the next live backend of route
+// by weighted round robin, among the least loaded ones
+// for the LeastConnections strategy.
+func (lp *livelyProxy) roundRobinedAddress(route string) string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.tooFewLiveLocked(route) {
+		return ""
+	}
+	liveAddresses := lp.liveAddresses[route]
+	if len(liveAddresses) == 0 {
+		return ""
+	}
+
+	now := lp.clock.Now()
+	candidates := lp.candidatesLocked(liveAddresses, now)
+
+	// Those slow starting only get the part of
+	// their weight that they have ramped up to.
+	opts := lp.routeOptions[route]
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, addr := range candidates {
+		weights[i] = float64(opts.weightOf(addr)) * lp.slowStartFactorLocked(route, addr, now)
+		total += weights[i]
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = float64(len(weights))
+	}
+	if lp.loadBalanceStrategy == LeastConnections {
+		candidates, weights = lp.leastLoadedLocked(candidates, weights)
+		total = 0
+		for _, weight := range weights {
+			total += weight
+		}
+	}
+
+	// Smooth weighted round robin, as Nginx does it: each pick raises
+	// the current weight of every candidate by its weight, then takes
+	// the highest and lowers it by the total, so that the heavier
+	// backends get their share interleaved with the others' rather
+	// than in bursts. With equal weights that is plain round robin.
+	current := lp.currentWeights[route]
+	if current == nil {
+		current = make(map[string]float64)
+		lp.currentWeights[route] = current
+	}
+	best := 0
+	for i, addr := range candidates {
+		current[addr] += weights[i]
+		if current[addr] > current[candidates[best]] {
+			best = i
+		}
+	}
+	addr := candidates[best]
+	current[addr] -= total
+
+	return addr
+}
+
+// tooFewLiveLocked reports whether route has fewer distinct live
+// backends than its MinLiveBackends. lp.mu must be held.
+func (lp *livelyProxy) tooFewLiveLocked(route string) bool {
+	opts := lp.routeOptions[route]
+	if opts == nil || opts.MinLiveBackends <= 1 {
+		return false
+	}
+	distinct := make(map[string]bool)
+	for _, addr := range lp.liveAddresses[route] {
+		distinct[addr] = true
+	}
+	return len(distinct) < opts.MinLiveBackends
+}
+
+// drainingPeriod is the duration for which a backend that
+// responded with "Connection: close" will be deprioritized.
+const drainingPeriod = 10 * time.Second
+
+func (lp *livelyProxy) markDraining(addr string) {
+	lp.mu.Lock()
+	lp.drainingUntil[addr] = lp.clock.Now().Add(drainingPeriod)
+	lp.mu.Unlock()
+}
+
+// candidatesLocked returns those of the live backends addrs that
+// requests can be sent to at now, skipping over ejected backends,
+// then over draining ones, unless they all are, either way.
+func (lp *livelyProxy) candidatesLocked(addrs []string, now time.Time) []string {
+	admitted := lp.admittedLocked(addrs, now)
+	candidates := make([]string, 0, len(admitted))
+	for _, addr := range admitted {
+		if !lp.isDrainingLocked(addr, now) {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return admitted
+	}
+	return candidates
+}
+
+func (lp *livelyProxy) isDrainingLocked(addr string, now time.Time) bool {
+	until, ok := lp.drainingUntil[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(lp.drainingUntil, addr)
+		return false
+	}
+	return true
+}
+
+func (lp *livelyProxy) cycle(route string, primary *lively.Peer) (livePeers, nonLivePeers []*lively.Liveliness, err error) {
+	lp.mu.Lock()
+	peers := make([]*lively.Peer, 0, len(lp.secondariesMap[route]))
+	for _, secondary := range lp.secondariesMap[route] {
+		peers = append(peers, secondary)
+	}
+	grpc := lp.routeOptions[route] != nil && lp.routeOptions[route].GRPC
+	lp.mu.Unlock()
+
+	livePeers, nonLivePeers, err = lp.pingPeers(primary, peers, grpc)
+	if lp.livenessPath != "" {
+		lp.checkLiveness(primary, peers, grpc)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.primariesMap[route] != primary {
+		// The route was swapped out while its backends were
+		// being pinged, e.g by PromoteStaged, hence these
+		// results are stale.
+		return livePeers, nonLivePeers, err
+	}
+	wasCycled := lp.cycled[route]
+	lp.cycled[route] = true
+	if lp.healthWebhookURL != "" {
+		if transitions := lp.recordHealthLocked(route, livePeers, nonLivePeers); len(transitions) > 0 {
+			lp.queueHealthTransitionsLocked(transitions)
+		}
+	}
+
+	lp.trackSlowStartsLocked(route, lp.routeOptions[route], livePeers, wasCycled)
+	var liveAddresses []string
+	for _, peer := range livePeers {
+		liveAddresses = append(liveAddresses, peer.Addr)
+	}
+
+	// If the membership of the live set hasn't changed, keep
+	// both the order and the round robin weights as they are
+	// otherwise restarting at 0 every cycle skews traffic
+	// towards the first few backends.
+	if sameMembers(lp.liveAddresses[route], liveAddresses) {
+		return livePeers, nonLivePeers, err
+	}
+
+	// The set changed so start a new generation, forgetting
+	// only the round robin weights of the backends that left.
+	lp.generation[route] += 1
+	live := make(map[string]bool, len(liveAddresses))
+	for _, addr := range liveAddresses {
+		live[addr] = true
+	}
+	lp.pruneCurrentWeightsLocked(route, live)
+
+	// Shuffle the liveAddresses.
+	perm := rand.Perm(len(liveAddresses))
+	var shuffledAddresses []string
+	for _, i := range perm {
+		shuffledAddresses = append(shuffledAddresses, liveAddresses[i])
+	}
+	lp.liveAddresses[route] = shuffledAddresses
+
+	return livePeers, nonLivePeers, err
+}
+
+// sameMembers reports whether a and b contain
+// the same addresses regardless of their order.
+func sameMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, addr := range a {
+		counts[addr] += 1
+	}
+	for _, addr := range b {
+		if counts[addr] <= 0 {
+			return false
+		}
+		counts[addr] -= 1
+	}
+	return true
+}
+
+// healthCheckOptions configures the liveliness pings of the primaries.
+type healthCheckOptions struct {
+	userAgent   string
+	strictJSON  bool
+	body        []byte
+	contentType string
+	path        string
+	method      string
+	requireOK   bool
+}
+
+func (req *Request) healthCheckOptions() healthCheckOptions {
+	hco := healthCheckOptions{
+		userAgent:   req.HealthCheckUserAgent,
+		strictJSON:  req.StrictHealthCheckJSON,
+		contentType: req.HealthCheckContentType,
+		path:        req.HealthCheckPath,
+		method:      req.HealthCheckMethod,
+	}
+	if req.HealthCheckBody != "" {
+		hco.body = []byte(req.HealthCheckBody)
+	}
+	if req.ReadinessPath != "" {
+		hco.path = req.ReadinessPath
+		hco.requireOK = true
+		if hco.method == "" {
+			hco.method = "GET"
+		}
+	}
+	return hco
+}
+
+func (hco healthCheckOptions) apply(primary *lively.Peer) {
+	primary.UserAgent = hco.userAgent
+	primary.StrictJSON = hco.strictJSON
+	primary.PingBody = hco.body
+	primary.PingContentType = hco.contentType
+	primary.PingPath = hco.path
+	primary.PingMethod = hco.method
+	primary.RequireOK = hco.requireOK
+}
+
+func (lp *livelyProxy) setHealthCheckOptions(hco healthCheckOptions) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.healthCheck = hco
+	for _, primary := range lp.primariesMap {
+		hco.apply(primary)
+	}
+}
+
+func addSecondary(primary *lively.Peer, peersMap map[string]*lively.Peer, addr string) {
+	secondary := &lively.Peer{
+		Addr: addr,
+		ID:   uuid.NewRandom().String(),
+	}
+	_ = primary.AddPeer(secondary)
+	peersMap[secondary.ID] = secondary
+}
+
+func makeLivelyProxy(cycleFreq time.Duration, pr map[string][]string) *livelyProxy {
+	secondariesMap := make(map[string]map[string]*lively.Peer)
+	primariesMap := make(map[string]*lively.Peer)
+	for prefix, addresses := range pr {
+		primary := &lively.Peer{
+			ID:      uuid.NewRandom().String(),
+			Primary: true,
+		}
+
+		peersMap := make(map[string]*lively.Peer)
+		for _, addr := range addresses {
+			addSecondary(primary, peersMap, addr)
+		}
+		secondariesMap[prefix] = peersMap
+		primariesMap[prefix] = primary
+	}
+
+	routePrefixes := make([]string, 0, len(pr))
+	for routePrefix := range pr {
+		routePrefixes = append(routePrefixes, routePrefix)
+	}
+
+	lp := &livelyProxy{
+		routePrefixes:  newPrefixTrie(routePrefixes),
+		primariesMap:   primariesMap,
+		secondariesMap: secondariesMap,
+		cycleFreq:      cycleFreq,
+
+		currentWeights: make(map[string]map[string]float64),
+		generation:     make(map[string]uint64),
+		liveAddresses:  make(map[string][]string),
+		drainingUntil:  make(map[string]time.Time),
+		cycled:         make(map[string]bool),
+
+		stopCycling: make(chan struct{}),
+
+		clock: realClock{},
+	}
+
+	// Build the reverse proxies upfront so that even the first
+	// requests reuse them. gRPC routes still build theirs on first
+	// use, and the addresses that fail to parse fail then too.
+	for _, addresses := range pr {
+		for _, addr := range addresses {
+			_, _ = lp.proxyFor(addr, false)
+		}
+	}
+	return lp
 }
 
 func (req *Request) runAndCreateListener(listener net.Listener) (*ListenConfirmation, error) {
+	tcpForwarder, err := req.listenTCPRoutes()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	side, err := req.listenSideServers()
+	if err != nil {
+		if tcpForwarder != nil {
+			tcpForwarder.close()
+		}
+		listener.Close()
+		return nil, err
+	}
+
+	var lc *ListenConfirmation
+	var lproxy *livelyProxy
 	var closeOnce sync.Once
+	var shuttingDown bool
 	errsChan := make(chan error)
+	done := make(chan struct{})
 	closeFn := func() error {
 		err := errAlreadyClosed
 		closeOnce.Do(func() {
+			close(done)
+			lc.markUnready()
+			if tcpForwarder != nil {
+				tcpForwarder.close()
+			}
+			side.close()
+			lproxy.stopHealthChecks()
 			err = listener.Close()
 		})
 		return err
 	}
 
-	lc := &ListenConfirmation{closeFn: closeFn, errsChan: errsChan}
+	tracker := newConnTracker()
+	server := &http.Server{
+		IdleTimeout: req.IdleTimeout,
+		ConnState:   tracker.track,
+		// "OPTIONS *" is answered by livelyProxy.
+		DisableGeneralOptionsHandler: true,
+	}
+	server.SetKeepAlivesEnabled(!req.DisableKeepAlives)
+	shutdownFn := func(ctx context.Context) (report *ShutdownReport, err error) {
+		err = errAlreadyClosed
+		closeOnce.Do(func() {
+			close(done)
+			shutdownPhase := func(phase ShutdownPhase) {
+				lproxy.logf("frontender: shutdown: %s", phase)
+				if req.OnShutdownPhase != nil {
+					req.OnShutdownPhase(phase)
+				}
+			}
+
+			lc.mu.Lock()
+			shuttingDown = true
+			lc.mu.Unlock()
+			if tcpForwarder != nil {
+				tcpForwarder.closeListeners()
+			}
+			listener.Close()
+			shutdownPhase(ShutdownStoppedAccepting)
+
+			lc.markUnready()
+			shutdownPhase(ShutdownUnready)
+
+			report, err = shutdownServer(ctx, server, tracker)
+			shutdownPhase(ShutdownDrained)
+
+			lproxy.stopHealthChecks()
+			var checksErr error
+			if tcpForwarder != nil {
+				tcpForwarder.lp.stopHealthChecks()
+				checksErr = tcpForwarder.lp.waitHealthChecks(ctx)
+			}
+			if werr := lproxy.waitHealthChecks(ctx); checksErr == nil {
+				checksErr = werr
+			}
+			side.close()
+			if checksErr != nil {
+				// The health checks were still under way when
+				// ctx expired, hence they haven't yet stopped.
+				if err == nil {
+					err = checksErr
+				}
+				return
+			}
+			shutdownPhase(ShutdownHealthChecksStopped)
+		})
+		return report, err
+	}
+
+	if grace := req.ShutdownGracePeriod; grace > 0 {
+		closeFn = func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			_, err := shutdownFn(ctx)
+			return err
+		}
+	}
+
+	// Per cycle of liveliness, figure out what is lively
+	// what isn't
+	lproxy = makeLivelyProxy(req.BackendPingPeriod, req.normalizedPrefixRouter())
+	lproxy.routeOptions = req.routes()
+	lproxy.exactRootRoute = req.ExactRootRoute
+	lproxy.serverTiming = req.ServerTiming
+	if req.VersionHeader {
+		lproxy.version = Version()
+	}
+	lproxy.strictSNI = req.StrictSNI
+	lproxy.cors = req.CORS
+	lproxy.warmingUpStatusCode = req.WarmingUpStatusCode
+	lproxy.warmingUpRetryAfter = req.WarmingUpRetryAfter
+	lproxy.retryAfter = req.RetryAfter
+	lproxy.removedBackendGracePeriod = req.RemovedBackendGracePeriod
+	lproxy.forwardClientCert = req.ForwardClientCert
+	lproxy.forwardedHeader = req.ForwardedHeader
+	lproxy.trustedProxies = req.TrustedProxies
+	lproxy.trustedHops = req.TrustedHops
+	lproxy.loadBalanceStrategy = req.LoadBalanceStrategy
+	lproxy.selectBackend = req.SelectBackend
+	lproxy.sessionAffinity = req.SessionAffinity
+	lproxy.sessionAffinityCookie = req.SessionAffinityCookie
+	lproxy.backendResponseTimeout = req.BackendResponseTimeout
+	lproxy.timeoutHeader = req.TimeoutHeader
+	lproxy.maxHeaderTimeout = req.MaxHeaderTimeout
+	lproxy.serveStaleOnError = req.ServeStaleOnError
+	lproxy.maxRetries = req.MaxRetries
+	lproxy.outlierDetection = req.OutlierDetection
+	for _, code := range req.RetryableStatusCodes {
+		if lproxy.retryableStatusCodes == nil {
+			lproxy.retryableStatusCodes = make(map[int]bool)
+		}
+		lproxy.retryableStatusCodes[code] = true
+	}
+	lproxy.metricsPath = req.MetricsPath
+	lproxy.notFoundHandler = req.NotFoundHandler
+	lproxy.coalesceGETs = req.CoalesceGETs
+	lproxy.healthWebhookURL = req.HealthWebhookURL
+	lproxy.serverWideAllow = req.ServerWideAllow
+	lproxy.maxResponseBodyBytes = req.MaxResponseBodyBytes
+	lproxy.dumpSamplePercent = req.DumpSamplePercent
+	lproxy.dumpMaxBodyBytes = req.DumpMaxBodyBytes
+	lproxy.logfFn = req.Logf
+	lproxy.rejectionLog = req.RejectionLog
+	lproxy.accessLog = req.AccessLog
+	lproxy.accessLogSamplePercent = req.AccessLogSamplePercent
+	lproxy.accessLogWriter = req.AccessLogWriter
+	lproxy.accessLogFormat = req.AccessLogFormat
+	lproxy.setTransportOptions(req.transportOptions())
+	lproxy.setHealthCheckOptions(req.healthCheckOptions())
+	lproxy.livenessPath = req.LivenessPath
+	if req.GlobalPingConcurrency > 0 {
+		lproxy.pingLimiter = make(chan struct{}, req.GlobalPingConcurrency)
+	}
+	server.Handler = lproxy
+	if req.HTTP1 && req.H2C {
+		server.Handler = h2c.NewHandler(lproxy, &http2.Server{IdleTimeout: req.IdleTimeout})
+	}
+
+	lc = &ListenConfirmation{
+		closeFn:    closeFn,
+		shutdownFn: shutdownFn,
+		errsChan:   errsChan,
+
+		lproxy:           lproxy,
+		onBackendRemoved: req.OnBackendRemoved,
+		side:             side,
+		done:             done,
+	}
 
 	// Run the nonHTTPS redirector.
-	go req.runNonHTTPSRedirector()
+	go req.runNonHTTPSRedirector(server.Handler)
+
+	if tcpForwarder != nil {
+		tcpForwarder.serve()
+	}
+	side.serve(side.status, http.HandlerFunc(lproxy.serveStatus))
+	side.serve(side.admin, lc.adminHandler())
+
+	// Cycle errors are surfaced to whoever is in Wait but never
+	// hold up the health checks, and stop once errsChan is closed.
+	var errsMu sync.Mutex
+	errsClosed := false
+	reportCycleErr := func(route string, feedback *cycleFeedback) {
+		lproxy.logf("frontender: route %q: liveliness cycle #%d: %v", route, feedback.cycleNumber, feedback.err)
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		if errsClosed {
+			return
+		}
+		select {
+		case errsChan <- feedback.err:
+		default:
+		}
+	}
+	lc.reportCycleErr = reportCycleErr
 
 	// Now run the domain listener
 	go func() {
-		defer close(errsChan)
+		defer func() {
+			errsMu.Lock()
+			errsClosed = true
+			close(errsChan)
+			errsMu.Unlock()
+		}()
 
-		// Per cycle of liveliness, figure out what is lively
-		// what isn't
-		lproxy := makeLivelyProxy(req.BackendPingPeriod, req.PrefixRouter)
 		go func() {
 			feedbackChanMap := lproxy.run()
 			for route, feedbackChan := range feedbackChanMap {
-				go func(route string, feedbackChan chan *cycleFeedback) {
-					for feedback := range feedbackChan {
-						if err := feedback.err; err != nil {
-							errsChan <- err
-						}
-					}
-				}(route, feedbackChan)
+				go lc.collectFeedback(route, feedbackChan)
 			}
 		}()
-		errsChan <- http.Serve(listener, lproxy)
+		err := server.Serve(listener)
+		lc.mu.Lock()
+		if shuttingDown && errors.Is(err, net.ErrClosed) {
+			// Shutdown closed the listener before the server.
+			err = http.ErrServerClosed
+		}
+		lc.mu.Unlock()
+		errsChan <- err
 	}()
 
 	return lc, nil
@@ -15,7 +15,11 @@
 package frontender_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -23,9 +27,14 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/orijtech/frontender"
+	"github.com/orijtech/frontender/lively"
+	"golang.org/x/net/http2"
 )
 
 func TestListen(t *testing.T) {
@@ -129,6 +138,30 @@ func TestRequestValidate(t *testing.T) {
 			// No proxy address specified.
 			wantErr: true,
 		},
+		4: {
+			req: &frontender.Request{
+				HTTP1:        true,
+				PrefixRouter: map[string][]string{"/foo": {"http://localhost:9999"}},
+			},
+		},
+		5: {
+			req: &frontender.Request{
+				HTTP1:        true,
+				PrefixRouter: map[string][]string{"foo": {"http://localhost:9999"}},
+			},
+			// The route prefix doesn't start with "/".
+			wantErr: true,
+		},
+		6: {
+			req: &frontender.Request{
+				HTTP1: true,
+				Routes: map[string]*frontender.RouteOptions{
+					"api/": {Backends: []string{"http://localhost:9999"}},
+				},
+			},
+			// The route prefix doesn't start with "/".
+			wantErr: true,
+		},
 	}
 
 	for i, tt := range tests {
@@ -141,6 +174,20 @@ func TestRequestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateRoutePrefixError(t *testing.T) {
+	req := &frontender.Request{
+		HTTP1:        true,
+		PrefixRouter: map[string][]string{"foo": {"http://localhost:9999"}, "/bar": {"http://localhost:9999"}},
+	}
+	err := req.Validate()
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if got, want := err.Error(), `route prefixes must start with "/", got: ["foo"]`; got != want {
+		t.Errorf("error got=%q want=%q", got, want)
+	}
+}
+
 func TestRequestMakeDomains(t *testing.T) {
 	tests := [...]struct {
 		req  *frontender.Request
@@ -170,6 +217,20 @@ func TestRequestMakeDomains(t *testing.T) {
 				"www.flux",
 			},
 		},
+
+		2: {
+			req: &frontender.Request{
+				Domains:      []string{"foo", "bar", "www.baz", "qux"},
+				NoAutoWWWFor: []string{"FOO", " baz ", "www.baz", "qux"},
+			},
+			want: []string{
+				"foo",
+				"bar",
+				"www.bar",
+				"www.baz",
+				"qux",
+			},
+		},
 	}
 
 	for i, tt := range tests {
@@ -185,3 +246,1312 @@ func TestRequestMakeDomains(t *testing.T) {
 		}
 	}
 }
+
+func TestListenEffectiveConfig(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		Domains:         []string{" example.org "},
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		PrefixRouter: map[string][]string{
+			"/": {" http://localhost:9999 ", "", "http://localhost:8888"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	got := lc.EffectiveConfig()
+	want := &frontender.EffectiveConfig{
+		HTTP1:   true,
+		Domains: []string{"example.org", "www.example.org"},
+		PrefixRouter: map[string][]string{
+			"/": {"http://localhost:9999", "http://localhost:8888"},
+		},
+		Routes: map[string]*frontender.RouteOptions{
+			"/": {Backends: []string{"http://localhost:9999", "http://localhost:8888"}},
+		},
+		BackendPingPeriod: 3 * time.Minute,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %#v\nwant: %#v", got, want)
+	}
+
+	// Mutating the returned config must not affect the running one.
+	got.PrefixRouter["/"][0] = "http://mutated"
+	if again := lc.EffectiveConfig(); !reflect.DeepEqual(again, want) {
+		t.Errorf("config was mutated:\ngot:  %#v\nwant: %#v", again, want)
+	}
+}
+
+func TestListenNilDomainsListener(t *testing.T) {
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		Domains:         []string{"example.org"},
+		DomainsListener: func(domains ...string) net.Listener { return nil },
+		PrefixRouter:    map[string][]string{"/": {"http://localhost:9999"}},
+	})
+	if err == nil {
+		lc.Close()
+		t.Fatal("expected an error for a nil listener")
+	}
+	if !strings.Contains(err.Error(), "DomainsListener") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestRequestNormalize(t *testing.T) {
+	tests := [...]struct {
+		period time.Duration
+		want   time.Duration
+	}{
+		0: {period: 0, want: frontender.DefaultBackendPingPeriod},
+		1: {period: -1, want: frontender.DefaultBackendPingPeriod},
+		2: {period: 10 * time.Second, want: 10 * time.Second},
+	}
+
+	for i, tt := range tests {
+		req := &frontender.Request{BackendPingPeriod: tt.period}
+		req.Normalize()
+		if got, want := req.BackendPingPeriod, tt.want; got != want {
+			t.Errorf("#%d: got=%v want=%v", i, got, want)
+		}
+	}
+
+	if got, want := frontender.DefaultBackendPingPeriod, 3*time.Minute; got != want {
+		t.Errorf("DefaultBackendPingPeriod: got=%v want=%v", got, want)
+	}
+}
+
+func TestProxyAddressesOnly(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("backend " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		ProxyAddresses:    []string{" " + backend.URL + " ", ""},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	// The ProxyAddresses make up the catch-all route.
+	if got, want := lc.EffectiveConfig().PrefixRouter, map[string][]string{"/": {backend.URL}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("effective routing:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get("http://" + ln.Addr().String() + "/users/1")
+		if err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				if got, want := string(body), "backend /users/1"; got != want {
+					t.Errorf("body got=%q want=%q", got, want)
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requests were never served")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProxyAddressesExampleConfig(t *testing.T) {
+	// Like Example_Listen, several ProxyAddresses of which
+	// only some are up, and no PrefixRouter nor Routes.
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("proxied"))
+	}))
+	defer backend.Close()
+	var downAddresses []string
+	for i := 0; i < 2; i++ {
+		down := httptest.NewServer(http.NotFoundHandler())
+		downAddresses = append(downAddresses, down.URL)
+		down.Close()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		Domains:         []string{"git.orijtech.com", "repo.orijtech.com"},
+		NoAutoWWW:       true,
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		ProxyAddresses: []string{
+			downAddresses[0],
+			backend.URL,
+			downAddresses[1],
+		},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+		req.Host = "git.orijtech.com"
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				if got, want := string(body), "proxied"; got != want {
+					t.Errorf("body got=%q want=%q", got, want)
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requests were never proxied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckPathAndMethod(t *testing.T) {
+	pings := make(chan string, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("User-Agent") == lively.DefaultUserAgent {
+			pings <- req.Method + " " + req.URL.Path
+		}
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		ProxyAddresses:    []string{backend.URL},
+		BackendPingPeriod: 10 * time.Millisecond,
+		HealthCheckPath:   "/healthz",
+		HealthCheckMethod: "GET",
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	select {
+	case got := <-pings:
+		if want := "GET /healthz"; got != want {
+			t.Errorf("health check got %q want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the backend was never health checked")
+	}
+
+	_, err = frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		ProxyAddresses:    []string{backend.URL},
+		HealthCheckMethod: "GET /healthz",
+	})
+	if err == nil {
+		t.Errorf("expected an error for an invalid method")
+	}
+}
+
+func TestStatusAddr(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		PrefixRouter: map[string][]string{
+			"/":    {live.URL, dead.URL},
+			"/api": {live.URL},
+		},
+		BackendPingPeriod: 5 * time.Millisecond,
+		StatusAddr:        "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	statusURL := "http://" + lc.StatusAddr().String()
+	want := map[string]*frontender.RouteStatus{
+		"/":    {Live: []string{live.URL}, Dead: []string{dead.URL}},
+		"/api": {Live: []string{live.URL}, Dead: []string{}},
+	}
+	// Fetched repeatedly while the cycles update the state.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(statusURL)
+		if err != nil {
+			t.Fatalf("get status: %v", err)
+		}
+		var got map[string]*frontender.RouteStatus
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+		cycled := len(got) == len(want)
+		for _, rs := range got {
+			if rs.LastCycle < 2 {
+				cycled = false
+			}
+			rs.LastCycle = 0
+		}
+		if cycled {
+			if !reflect.DeepEqual(got, want) {
+				gotBlob, _ := json.Marshal(got)
+				wantBlob, _ := json.Marshal(want)
+				t.Errorf("status got %s want %s", gotBlob, wantBlob)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the routes were never cycled twice")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	lc.Close()
+	if _, err := http.Get(statusURL); err == nil {
+		t.Errorf("the status is still served once closed")
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("User-Agent") == lively.DefaultUserAgent {
+			return
+		}
+		mu.Lock()
+		hits += 1
+		mu.Unlock()
+		rw.Write([]byte("proxied"))
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	healthzWhileUnready := make(chan int, 1)
+	var adminURL string
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		ProxyAddresses:    []string{backend.URL},
+		BackendPingPeriod: 5 * time.Millisecond,
+		AdminAddr:         "127.0.0.1:0",
+		OnShutdownPhase: func(phase frontender.ShutdownPhase) {
+			if phase != frontender.ShutdownUnready {
+				return
+			}
+			res, err := http.Get(adminURL + "/healthz")
+			if err != nil {
+				healthzWhileUnready <- 0
+				return
+			}
+			res.Body.Close()
+			healthzWhileUnready <- res.StatusCode
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+	adminURL = "http://" + lc.AdminAddr().String()
+
+	get := func(url string) (int, string) {
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("get %s: %v", url, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	// Wait for the backend to be live so that the
+	// proxy routes would be served if they were.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if code, _ := get("http://" + ln.Addr().String() + "/"); code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the proxy never served")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if code, body := get(adminURL + "/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("healthz: got %d %q", code, body)
+	}
+	for _, path := range []string{"/status", "/metrics"} {
+		code, body := get(adminURL + path)
+		if code != http.StatusOK || !json.Valid([]byte(body)) {
+			t.Errorf("%s: got %d %q, want 200 with JSON", path, code, body)
+		}
+	}
+
+	mu.Lock()
+	before := hits
+	mu.Unlock()
+	for _, path := range []string{"/", "/users/1"} {
+		if code, _ := get(adminURL + path); code != http.StatusNotFound {
+			t.Errorf("admin %s: code got=%d want=%d", path, code, http.StatusNotFound)
+		}
+	}
+	mu.Lock()
+	after := hits
+	mu.Unlock()
+	if after != before {
+		t.Errorf("the admin server proxied %d requests", after-before)
+	}
+
+	if _, err := lc.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if got, want := <-healthzWhileUnready, http.StatusServiceUnavailable; got != want {
+		t.Errorf("healthz while shutting down: got=%d want=%d", got, want)
+	}
+	if _, err := http.Get(adminURL + "/healthz"); err == nil {
+		t.Errorf("the admin endpoints are still served once shut down")
+	}
+}
+
+func TestReloadInvokesOnBackendRemoved(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	var mu sync.Mutex
+	removed := make(map[string]int)
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		PrefixRouter: map[string][]string{
+			"/":    {"http://localhost:9997", "http://localhost:9998"},
+			"/api": {"http://localhost:9999"},
+		},
+		OnBackendRemoved: func(route, addr string) {
+			mu.Lock()
+			removed[route+" "+addr] += 1
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	reloaded := &frontender.Request{
+		HTTP1: true,
+		PrefixRouter: map[string][]string{
+			"/":     {"http://localhost:9997"},
+			"/blog": {"http://localhost:9996"},
+		},
+	}
+	// Reloading twice must only report the removals once.
+	for i := 0; i < 2; i++ {
+		if err := lc.Reload(reloaded); err != nil {
+			t.Fatalf("reload #%d: %v", i, err)
+		}
+	}
+
+	want := map[string]int{
+		"/ http://localhost:9998":    1,
+		"/api http://localhost:9999": 1,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed:\ngot:  %v\nwant: %v", removed, want)
+	}
+
+	if got, want := lc.EffectiveConfig().PrefixRouter, reloaded.PrefixRouter; !reflect.DeepEqual(got, want) {
+		t.Errorf("effective routing:\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+func TestReloadDrainsRemovedRoutes(t *testing.T) {
+	arrived := make(chan bool, 1)
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			return
+		}
+		arrived <- true
+		<-release
+		rw.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer fast.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	removedChan := make(chan string, 2)
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		PrefixRouter: map[string][]string{
+			"/slow": {slow.URL},
+			"/fast": {fast.URL},
+		},
+		BackendPingPeriod: 10 * time.Millisecond,
+		OnBackendRemoved: func(route, addr string) {
+			removedChan <- route
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	baseURL := "http://" + ln.Addr().String()
+	get := func(path string) (int, string) {
+		res, err := http.Get(baseURL + path)
+		if err != nil {
+			t.Errorf("get %s: %v", path, err)
+			return 0, ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, _ := get("/fast")
+		if code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready: %d", code)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	type result struct {
+		code int
+		body string
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		code, body := get("/slow")
+		inFlight <- result{code, body}
+	}()
+	<-arrived
+
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- lc.Reload(&frontender.Request{
+			HTTP1:             true,
+			PrefixRouter:      map[string][]string{"/fast": {fast.URL}},
+			RouteDrainTimeout: 5 * time.Second,
+		})
+	}()
+
+	// New requests to the removed route aren't served while the
+	// one in flight keeps the reload from completing.
+	for {
+		code, _ := get("/slow")
+		if code == http.StatusNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the removed route kept being served: %d", code)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case err := <-reloaded:
+		t.Fatalf("reload returned before the route drained: %v", err)
+	case route := <-removedChan:
+		t.Fatalf("%q reported removed before it drained", route)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if res := <-inFlight; res.code != http.StatusOK || res.body != "slow" {
+		t.Errorf("in flight request: got=(%d, %q) want=(200, %q)", res.code, res.body, "slow")
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, want := <-removedChan, "/slow"; got != want {
+		t.Errorf("removed route got=%q want=%q", got, want)
+	}
+}
+
+func TestListenDisableKeepAlives(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		lc, err := frontender.Listen(&frontender.Request{
+			HTTP1:             true,
+			DomainsListener:   func(domains ...string) net.Listener { return ln },
+			PrefixRouter:      map[string][]string{"/api": {"http://localhost:9999"}},
+			DisableKeepAlives: disable,
+		})
+		if err != nil {
+			t.Fatalf("disable=%v: listen err: %v", disable, err)
+		}
+
+		// Any response, even a 404, tells whether the
+		// connection will be kept alive or not.
+		res, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("disable=%v: get err: %v", disable, err)
+		} else {
+			res.Body.Close()
+			if got, want := res.Close, disable; got != want {
+				t.Errorf("disable=%v: connection closed got=%v want=%v", disable, got, want)
+			}
+		}
+		lc.Close()
+	}
+}
+
+func TestStageAndPromoteRouter(t *testing.T) {
+	makeBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		}))
+	}
+	blue := makeBackend("blue")
+	defer blue.Close()
+	green := makeBackend("green")
+	defer green.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {blue.URL}},
+		Routes:            map[string]*frontender.RouteOptions{"/": {Timeout: 5 * time.Second}},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	frontendURL := "http://" + ln.Addr().String() + "/"
+	waitForBody := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			res, err := http.Get(frontendURL)
+			if err == nil {
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if string(body) == want {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("never got %q from the frontend", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitForBody("blue")
+
+	if err := lc.PromoteStaged(); err == nil {
+		t.Fatalf("expected an error when nothing was staged")
+	}
+	if err := lc.StageRouter(map[string][]string{"/": {green.URL}}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Until promoted, traffic still goes to blue.
+		res, err := http.Get(frontendURL)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if got, want := string(body), "blue"; got != want {
+			t.Fatalf("before promotion: got=%q want=%q", got, want)
+		}
+
+		if err := lc.PromoteStaged(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("staged router never became healthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The staged backends were already health checked
+	// hence the very first request after promotion
+	// must already go to green.
+	res, err := http.Get(frontendURL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got, want := string(body), "green"; got != want {
+		t.Errorf("after promotion: got=%q want=%q", got, want)
+	}
+	config := lc.EffectiveConfig()
+	if got, want := config.PrefixRouter, map[string][]string{"/": {green.URL}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("effective routing:\ngot:  %v\nwant: %v", got, want)
+	}
+	// The options of the route are carried over.
+	wantRoutes := map[string]*frontender.RouteOptions{"/": {Backends: []string{green.URL}, Timeout: 5 * time.Second}}
+	if got := config.Routes; !reflect.DeepEqual(got, wantRoutes) {
+		t.Errorf("effective routes:\ngot:  %+v\nwant: %+v", got["/"], wantRoutes["/"])
+	}
+}
+
+func TestStageRouterDialAddresses(t *testing.T) {
+	green := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("green"))
+	}))
+	defer green.Close()
+	blue := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("blue"))
+	}))
+	defer blue.Close()
+
+	// green is only reachable at its dial address.
+	const greenURL = "http://green.invalid"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {blue.URL}},
+		DialAddresses:     map[string]string{greenURL: green.Listener.Addr().String()},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	if err := lc.StageRouter(map[string][]string{"/": {greenURL}}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for lc.PromoteStaged() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("staged router never became healthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	res, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got, want := string(body), "green"; got != want {
+		t.Errorf("after promotion: got=%q want=%q", got, want)
+	}
+}
+
+func TestShutdownPhases(t *testing.T) {
+	var mu sync.Mutex
+	pings := 0
+	arrived := make(chan bool, 1)
+	release := make(chan bool)
+	slowDone := false
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			mu.Lock()
+			pings += 1
+			mu.Unlock()
+			return
+		}
+		if req.URL.Path == "/slow" {
+			arrived <- true
+			<-release
+			mu.Lock()
+			slowDone = true
+			mu.Unlock()
+		}
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	type observation struct {
+		phase    frontender.ShutdownPhase
+		ready    bool
+		slowDone bool
+	}
+	var observations []observation
+	var lc *frontender.ListenConfirmation
+	lc, err = frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod: 10 * time.Millisecond,
+		OnShutdownPhase: func(phase frontender.ShutdownPhase) {
+			mu.Lock()
+			observations = append(observations, observation{phase, lc.Ready(), slowDone})
+			mu.Unlock()
+			if phase == frontender.ShutdownUnready {
+				// Let the in flight request complete.
+				close(release)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- lc.Wait() }()
+
+	frontendURL := "http://" + ln.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(frontendURL + "/")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !lc.Ready() {
+		t.Errorf("expected the frontend to be ready")
+	}
+
+	slowCode := make(chan int, 1)
+	go func() {
+		res, err := http.Get(frontendURL + "/slow")
+		if err != nil {
+			slowCode <- 0
+			return
+		}
+		res.Body.Close()
+		slowCode <- res.StatusCode
+	}()
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := lc.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if got, want := <-slowCode, http.StatusOK; got != want {
+		t.Errorf("in flight request: code got=%d want=%d", got, want)
+	}
+	if err := <-waitErr; err != http.ErrServerClosed {
+		t.Errorf("wait: got=%v want=%v", err, http.ErrServerClosed)
+	}
+
+	mu.Lock()
+	want := []observation{
+		{phase: frontender.ShutdownStoppedAccepting, ready: true},
+		// Readiness flips before the draining completes.
+		{phase: frontender.ShutdownUnready, ready: false},
+		{phase: frontender.ShutdownDrained, ready: false, slowDone: true},
+		{phase: frontender.ShutdownHealthChecksStopped, ready: false, slowDone: true},
+	}
+	if !reflect.DeepEqual(observations, want) {
+		t.Errorf("observations:\ngot:  %+v\nwant: %+v", observations, want)
+	}
+	pingsAtShutdown := pings
+	mu.Unlock()
+
+	// The health checks have stopped for good.
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if pings != pingsAtShutdown {
+		t.Errorf("pings went on after shutdown: %d then %d", pingsAtShutdown, pings)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	release := make(chan struct{})
+	var arrived sync.WaitGroup
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/fast":
+			arrived.Done()
+			time.Sleep(100 * time.Millisecond)
+		case "/stuck":
+			arrived.Done()
+			<-release
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	go lc.Wait()
+
+	frontendURL := "http://" + ln.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(frontendURL + "/")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	paths := []string{"/fast", "/fast", "/stuck"}
+	arrived.Add(len(paths))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, path := range paths {
+		go func(path string) {
+			if res, err := client.Get(frontendURL + path); err == nil {
+				res.Body.Close()
+			}
+		}(path)
+	}
+	arrived.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	report, err := lc.Shutdown(ctx)
+	if err == nil {
+		t.Errorf("expected the deadline to be hit")
+	}
+	if report == nil {
+		t.Fatalf("expected a non-nil report")
+	}
+	want := &frontender.ShutdownReport{Drained: 2, ForciblyClosed: 1}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report got=%+v want=%+v", report, want)
+	}
+
+	if _, err := lc.Shutdown(context.Background()); err == nil {
+		t.Errorf("expected an error shutting down twice")
+	}
+}
+
+func TestShutdownHealthChecksStillRunning(t *testing.T) {
+	var mu sync.Mutex
+	stuck := false
+	pingArrived := make(chan bool, 1)
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		block := stuck && req.URL.Path == "/ping"
+		mu.Unlock()
+		if block {
+			select {
+			case pingArrived <- true:
+			default:
+			}
+			<-release
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	var phases []frontender.ShutdownPhase
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod: 10 * time.Millisecond,
+		OnShutdownPhase: func(phase frontender.ShutdownPhase) {
+			mu.Lock()
+			phases = append(phases, phase)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	go lc.Wait()
+
+	frontendURL := "http://" + ln.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(frontendURL + "/")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Hold a health check up past the shutdown deadline.
+	mu.Lock()
+	stuck = true
+	mu.Unlock()
+	<-pingArrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := lc.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown err: got=%v want=%v", err, context.DeadlineExceeded)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []frontender.ShutdownPhase{
+		frontender.ShutdownStoppedAccepting,
+		frontender.ShutdownUnready,
+		frontender.ShutdownDrained,
+	}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("phases:\ngot:  %v\nwant: %v", phases, want)
+	}
+}
+
+func TestCloseDrainsWithinGracePeriod(t *testing.T) {
+	arrived := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/slow" {
+			return
+		}
+		arrived <- true
+		rw.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		rw.Write([]byte("the full response"))
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:               true,
+		DomainsListener:     func(domains ...string) net.Listener { return ln },
+		PrefixRouter:        map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod:   10 * time.Millisecond,
+		ShutdownGracePeriod: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	go lc.Wait()
+
+	frontendURL := "http://" + ln.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(frontendURL + "/")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	go func() {
+		res, err := client.Get(frontendURL + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		results <- result{string(body), err}
+	}()
+	<-arrived
+
+	start := time.Now()
+	if err := lc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// The backend takes 200ms to complete the response.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("close returned after %s, before the drain", elapsed)
+	}
+	select {
+	case res := <-results:
+		if res.err != nil || res.body != "the full response" {
+			t.Errorf("slow request: got %q, %v", res.body, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the slow request never completed")
+	}
+
+	if _, err := client.Get(frontendURL + "/"); err == nil {
+		t.Errorf("new connections are still accepted once closed")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		H2C:               true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/": {backend.URL}},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	// An HTTP/2 client that speaks cleartext HTTP/2 with prior knowledge.
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := client.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("h2c get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if got, want := res.ProtoMajor, 2; got != want {
+			t.Fatalf("proto major got=%d want=%d", got, want)
+		}
+		if res.StatusCode == http.StatusOK {
+			if got, want := string(body), "hello"; got != want {
+				t.Errorf("body got=%q want=%q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frontend never became ready: %s", res.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Plain HTTP/1.1 clients are still served.
+	res, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("http1 get: %v", err)
+	}
+	res.Body.Close()
+	if got, want := res.ProtoMajor, 1; got != want {
+		t.Errorf("http1: proto major got=%d want=%d", got, want)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:           true,
+		DomainsListener: func(domains ...string) net.Listener { return ln },
+		PrefixRouter: map[string][]string{
+			"/":    {"http://localhost:9001", "", " http://localhost:9002 "},
+			"/api": {"http://localhost:9002", "  ", "http://localhost:9003"},
+		},
+		Routes: map[string]*frontender.RouteOptions{
+			"/static": {Backends: []string{"http://localhost:9004", "http://localhost:9001"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	want := []string{
+		"http://localhost:9001",
+		"http://localhost:9002",
+		"http://localhost:9003",
+		"http://localhost:9004",
+	}
+	if got := lc.Backends(); !reflect.DeepEqual(got, want) {
+		t.Errorf("backends:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestValidateCanary(t *testing.T) {
+	tests := [...]struct {
+		canary  *frontender.CanaryOptions
+		wantErr bool
+	}{
+		0: {canary: &frontender.CanaryOptions{Backends: []string{"http://localhost:9000"}, Percent: 10, MaxErrorRate: 0.1}},
+		1: {canary: &frontender.CanaryOptions{Backends: []string{"http://localhost:9000"}, Percent: 101}, wantErr: true},
+		2: {canary: &frontender.CanaryOptions{Backends: []string{"http://localhost:9000"}, Percent: 10, MaxErrorRate: 2}, wantErr: true},
+		3: {canary: &frontender.CanaryOptions{Percent: 10}, wantErr: true},
+		4: {canary: &frontender.CanaryOptions{}},
+	}
+
+	for i, tt := range tests {
+		req := &frontender.Request{
+			NoAutoWWW: true,
+			Domains:   []string{"example.org"},
+			Routes: map[string]*frontender.RouteOptions{
+				"/": {Backends: []string{"http://localhost:8000"}, Canary: tt.canary},
+			},
+		}
+		err := req.Validate()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("#%d: expected a non-nil error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestServerWideOptions(t *testing.T) {
+	var mu sync.Mutex
+	proxiedOptions := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "OPTIONS" {
+			mu.Lock()
+			proxiedOptions += 1
+			mu.Unlock()
+		}
+	}))
+	defer backend.Close()
+
+	tests := [...]struct {
+		allow     []string
+		wantAllow string
+	}{
+		0: {wantAllow: "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+		1: {allow: []string{"GET", "OPTIONS"}, wantAllow: "GET, OPTIONS"},
+	}
+
+	for i, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("#%d: listen: %v", i, err)
+		}
+		lc, err := frontender.Listen(&frontender.Request{
+			HTTP1:           true,
+			DomainsListener: func(domains ...string) net.Listener { return ln },
+			PrefixRouter:    map[string][]string{"/": {backend.URL}},
+			ServerWideAllow: tt.allow,
+		})
+		if err != nil {
+			t.Fatalf("#%d: listen err: %v", i, err)
+		}
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			lc.Close()
+			t.Fatalf("#%d: dial: %v", i, err)
+		}
+		fmt.Fprintf(conn, "OPTIONS * HTTP/1.1\r\nHost: frontend.example\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		lc.Close()
+		if err != nil {
+			t.Errorf("#%d: read response: %v", i, err)
+			continue
+		}
+		if got, want := res.StatusCode, http.StatusNoContent; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := res.Header.Get("Allow"), tt.wantAllow; got != want {
+			t.Errorf("#%d: Allow got=%q want=%q", i, got, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if proxiedOptions != 0 {
+		t.Errorf("OPTIONS * was proxied %d times", proxiedOptions)
+	}
+}
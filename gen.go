@@ -16,13 +16,16 @@ package frontender
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,6 +37,41 @@ import (
 
 var errUnimplemented = errors.New("unimplemented")
 
+var errNilFrontendConfig = errors.New("nil FrontendConfig")
+
+// ConfigError is returned by GenerateBinary and GenerateDockerImage
+// when the embedded FrontendConfig is invalid, to tell it apart
+// from failures to build the binary or to write its files.
+type ConfigError struct {
+	Err error
+}
+
+func (ce *ConfigError) Error() string {
+	return fmt.Sprintf("frontender: invalid config: %v", ce.Err)
+}
+
+func (ce *ConfigError) Unwrap() error {
+	return ce.Err
+}
+
+// BuildError is returned by GenerateBinary and GenerateDockerImage
+// when the go command fails to build the binary. It tells the
+// effective platform and toolchain of the build, for diagnosis.
+type BuildError struct {
+	GOOS      string
+	GOARCH    string
+	GoVersion string
+	Err       error
+}
+
+func (be *BuildError) Error() string {
+	return fmt.Sprintf("frontender: building for GOOS=%s GOARCH=%s with %s: %v", be.GOOS, be.GOARCH, be.GoVersion, be.Err)
+}
+
+func (be *BuildError) Unwrap() error {
+	return be.Err
+}
+
 // Goal: Generate the binary so that it can be deployed as a disk image or a Dockerfile.
 
 type DeployInfo struct {
@@ -44,6 +82,25 @@ type DeployInfo struct {
 	TargetGOOS string
 	Environ    []string
 
+	// FrontenderVersion if set, pins the version of this package
+	// that the generated binary is built against, by generating a
+	// go.mod that requires it, for reproducible binaries.
+	FrontenderVersion string `json:"frontender_version"`
+
+	// FrontenderReplace if set, is the directory of a local copy
+	// of this package, that the generated go.mod replaces it with.
+	FrontenderReplace string `json:"frontender_replace"`
+
+	// Verify if set, runs the built binary with -print-config to
+	// check that it starts and decodes its embedded config, before
+	// returning it. Binaries built for platforms other than that
+	// of the host can't be run and hence aren't verified.
+	Verify bool `json:"verify"`
+
+	// BuildTags are passed to go build with -tags, for
+	// the conditional compilation of the generated binary.
+	BuildTags []string `json:"build_tags"`
+
 	CanonicalImageName       string `json:"canonical_image_name"`
 	CanonicalImageNamePrefix string `json:"canonical_image_name_prefix"`
 }
@@ -85,55 +142,130 @@ func GenerateBinary(req *DeployInfo) (io.ReadCloser, error) {
 }
 
 func generateBinary(req *DeployInfo) (*BinaryHandle, error) {
-	// 1. Generate the main.go file:
-	binDir := fmt.Sprintf("./%s", uuid.NewRandom())
-	if err := os.MkdirAll(binDir, 0777); err != nil {
+	mainGo, err := renderMain(req)
+	if err != nil {
 		return nil, err
 	}
-	abort := func() error { return os.RemoveAll(binDir) }
+	return buildBinary(req, Target{GOOS: req.TargetGOOS}, mainGo)
+}
 
-	goMainFilepath := filepath.Join(binDir, "main.go")
-	f, err := os.Create(goMainFilepath)
+// Target is a platform to generate binaries for.
+// Its unset fields default to those of the host.
+type Target struct {
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+}
+
+func (t Target) String() string {
+	return t.GOOS + "/" + t.GOARCH
+}
+
+// GenerateBinaries is like GenerateBinary but builds a binary for each of
+// targets, concurrently and each in its own directory. The handles of the
+// binaries must be closed independently. If any of the builds fails, the
+// binaries that were built are discarded and the first error is returned.
+func GenerateBinaries(req *DeployInfo, targets []Target) (map[Target]io.ReadCloser, error) {
+	mainGo, err := renderMain(req)
 	if err != nil {
-		abort()
 		return nil, err
 	}
 
+	seen := make(map[Target]bool, len(targets))
+	var mu sync.Mutex
+	var firstErr error
+	handles := make(map[Target]io.ReadCloser, len(targets))
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		wg.Add(1)
+		go func(target Target) {
+			defer wg.Done()
+
+			bh, err := buildBinary(req, target, mainGo)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("frontender: generating binary for %s: %w", target, err)
+				}
+				return
+			}
+			handles[target] = bh
+		}(target)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		for _, rc := range handles {
+			rc.Close()
+		}
+		return nil, firstErr
+	}
+	return handles, nil
+}
+
+// renderMain validates the config of req and renders
+// the main.go file of the binary that embeds it.
+func renderMain(req *DeployInfo) ([]byte, error) {
+	if req.FrontendConfig == nil {
+		return nil, &ConfigError{Err: errNilFrontendConfig}
+	}
 	if err := req.FrontendConfig.Validate(); err != nil {
-		abort()
+		return nil, &ConfigError{Err: err}
+	}
+	buf := new(bytes.Buffer)
+	if err := mainTmpl.Execute(buf, req.FrontendConfig); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	err = mainTmpl.Execute(f, req.FrontendConfig)
-	_ = f.Close()
+// buildBinary builds mainGo for target in a directory of its own.
+func buildBinary(req *DeployInfo, target Target, mainGo []byte) (*BinaryHandle, error) {
+	// 1. Write the main.go file:
+	binDir := fmt.Sprintf("./%s", uuid.NewRandom())
+	if err := os.MkdirAll(binDir, 0777); err != nil {
+		return nil, err
+	}
+	abort := func() error { return os.RemoveAll(binDir) }
 
-	if err != nil {
+	goMainFilepath := filepath.Join(binDir, "main.go")
+	if err := os.WriteFile(goMainFilepath, mainGo, 0666); err != nil {
 		abort()
 		return nil, err
 	}
 
+	// 1.1. Pin the version of frontender if requested.
+	if req.pinsFrontender() {
+		if err := writeGoMod(binDir, req); err != nil {
+			abort()
+			return nil, err
+		}
+		if err := runGo(req, target, binDir, "mod", "tidy"); err != nil {
+			abort()
+			return nil, err
+		}
+	}
+
 	// 2. Next step is to build the binary
 	binaryPath := filepath.Join(binDir, "generated-exec")
-	cmdArgs := []string{"build", "-o", binaryPath, binDir}
-	cmd := exec.Command("go", cmdArgs...)
-
-	// 2.1. Build the environment for the comment
-	cmd.Env = append(cmd.Env, os.Environ()...)
-	if goos := strings.TrimSpace(req.TargetGOOS); goos != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("GOOS=%s", goos))
-	}
-	if len(req.Environ) > 0 {
-		cmd.Env = append(cmd.Env, req.Environ...)
+	if err := runGo(req, target, binDir, req.buildArgs(filepath.Base(binaryPath))...); err != nil {
+		be := buildEnv(req, target, binDir)
+		be.Err = err
+		abort()
+		return nil, be
 	}
-
-	if resp, err := cmd.CombinedOutput(); err != nil {
-		if len(bytes.TrimSpace(resp)) > 0 {
-			err = errors.New(string(resp))
+	if req.Verify && runsOnHost(goEnv(req, target)) {
+		if err := verifyBinary(binaryPath); err != nil {
+			abort()
+			return nil, err
 		}
-		abort()
-		return nil, err
 	}
-	f, err = os.Open(binaryPath)
+	f, err := os.Open(binaryPath)
 	if err != nil {
 		abort()
 		return nil, err
@@ -148,6 +280,170 @@ func generateBinary(req *DeployInfo) (*BinaryHandle, error) {
 	return bh, nil
 }
 
+// verifyTimeout bounds how long verifying a binary may take.
+const verifyTimeout = 30 * time.Second
+
+// verifyBinary runs the binary at binaryPath with -print-config
+// and checks that it exits cleanly after printing its config.
+func verifyBinary(binaryPath string) error {
+	binaryPath, err := filepath.Abs(binaryPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binaryPath, "-print-config")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return fmt.Errorf("frontender: verifying the generated binary: %w", err)
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return fmt.Errorf("frontender: verifying the generated binary: invalid config printed: %q", stdout.Bytes())
+	}
+	return nil
+}
+
+// runsOnHost reports whether the binaries built with
+// the environment env can run on the host platform.
+func runsOnHost(env []string) bool {
+	goos, goarch := lastEnvValue(env, "GOOS"), lastEnvValue(env, "GOARCH")
+	return (goos == "" || goos == runtime.GOOS) && (goarch == "" || goarch == runtime.GOARCH)
+}
+
+// lastEnvValue returns the value of key in env, where
+// like for exec.Cmd, the last of duplicate keys wins.
+func lastEnvValue(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// execGo runs the go command cmd and returns its combined
+// output. Tests replace it to avoid invoking the toolchain.
+var execGo = func(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// runGo runs the go command with args in dir, in the
+// environment that req builds binaries for target with.
+func runGo(req *DeployInfo, target Target, dir string, args ...string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = goEnv(req, target)
+
+	if resp, err := execGo(cmd); err != nil {
+		if len(bytes.TrimSpace(resp)) > 0 {
+			err = errors.New(string(resp))
+		}
+		return err
+	}
+	return nil
+}
+
+// buildEnv returns the platform and toolchain that the go command
+// builds for target with in dir, as reported by "go env" since
+// for instance GOENV or GOTOOLCHAIN can affect them. If that fails,
+// they are inferred from the environment, defaulting to the host.
+func buildEnv(req *DeployInfo, target Target, dir string) *BuildError {
+	env := goEnv(req, target)
+	cmd := exec.Command("go", "env", "GOOS", "GOARCH", "GOVERSION")
+	cmd.Dir = dir
+	cmd.Env = env
+	if out, err := execGo(cmd); err == nil {
+		if values := strings.Fields(string(out)); len(values) == 3 {
+			return &BuildError{GOOS: values[0], GOARCH: values[1], GoVersion: values[2]}
+		}
+	}
+
+	be := &BuildError{
+		GOOS:      lastEnvValue(env, "GOOS"),
+		GOARCH:    lastEnvValue(env, "GOARCH"),
+		GoVersion: "an unknown go version",
+	}
+	if be.GOOS == "" {
+		be.GOOS = runtime.GOOS
+	}
+	if be.GOARCH == "" {
+		be.GOARCH = runtime.GOARCH
+	}
+	return be
+}
+
+// goEnv returns the environment that req builds binaries for target with.
+func goEnv(req *DeployInfo, target Target) []string {
+	env := os.Environ()
+	if goos := strings.TrimSpace(target.GOOS); goos != "" {
+		env = append(env, fmt.Sprintf("GOOS=%s", goos))
+	}
+	if goarch := strings.TrimSpace(target.GOARCH); goarch != "" {
+		env = append(env, fmt.Sprintf("GOARCH=%s", goarch))
+	}
+	return append(env, req.Environ...)
+}
+
+// buildArgs returns the arguments of the go
+// command that builds the binary to output.
+func (req *DeployInfo) buildArgs(output string) []string {
+	args := []string{"build", "-o", output}
+	var tags []string
+	for _, tag := range req.BuildTags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		args = append(args, "-tags", strings.Join(tags, ","))
+	}
+	return append(args, ".")
+}
+
+func (req *DeployInfo) pinsFrontender() bool {
+	return req.FrontenderVersion != "" || req.FrontenderReplace != ""
+}
+
+// replacedVersion is the version required of a module
+// that is only ever resolved through a replace directive.
+const replacedVersion = "v0.0.0-00010101000000-000000000000"
+
+type goModConfig struct {
+	Version string
+	Replace string
+}
+
+// writeGoMod writes to binDir the go.mod of the
+// generated binary, pinning the version of frontender.
+func writeGoMod(binDir string, req *DeployInfo) error {
+	config := &goModConfig{Version: req.FrontenderVersion, Replace: req.FrontenderReplace}
+	if config.Version == "" {
+		config.Version = replacedVersion
+	}
+	if config.Replace != "" {
+		replace, err := filepath.Abs(config.Replace)
+		if err != nil {
+			return err
+		}
+		config.Replace = replace
+	}
+
+	f, err := os.Create(filepath.Join(binDir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	err = goModTmpl.Execute(f, config)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func GenerateDockerImage(req *DeployInfo) (imageName string, err error) {
 	// 1. Generate the binary
 	bh, err := generateBinary(req)
@@ -181,7 +477,10 @@ func GenerateDockerImage(req *DeployInfo) (imageName string, err error) {
 	canonicalImageName := ensureCanonicalImage(req)
 	dockerBuildArgs := []string{"build", "-t", canonicalImageName, binDir}
 	cmd := exec.Command("docker", dockerBuildArgs...)
-	if resp, err := cmd.CombinedOutput(); err != nil {
+	imageBuilds.acquire()
+	resp, err := execDocker(cmd)
+	imageBuilds.release()
+	if err != nil {
 		if len(bytes.TrimSpace(resp)) > 0 {
 			err = errors.New(string(resp))
 		}
@@ -191,6 +490,70 @@ func GenerateDockerImage(req *DeployInfo) (imageName string, err error) {
 	return canonicalImageName, nil
 }
 
+// execDocker runs the docker command cmd and returns its combined
+// output. Tests replace it to avoid invoking docker.
+var execDocker = func(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// imageBuilds queues the docker builds of GenerateDockerImage.
+var imageBuilds = newBuildQueue()
+
+// SetMaxConcurrentImageBuilds caps the number of docker builds that
+// GenerateDockerImage runs at once, those beyond it waiting for their
+// turn, in order. A limit of 0 or less, the default, lifts the cap.
+// It can be changed at any time, affecting the builds still waiting.
+func SetMaxConcurrentImageBuilds(limit int) {
+	imageBuilds.setLimit(limit)
+}
+
+// buildQueue is a semaphore whose limit can be changed.
+type buildQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+	// next and served number the builds to let them in in order.
+	next, served uint64
+}
+
+func newBuildQueue() *buildQueue {
+	bq := new(buildQueue)
+	bq.cond = sync.NewCond(&bq.mu)
+	return bq
+}
+
+func (bq *buildQueue) setLimit(limit int) {
+	bq.mu.Lock()
+	bq.limit = limit
+	bq.mu.Unlock()
+	bq.cond.Broadcast()
+}
+
+// acquire waits for the turn of the caller and
+// for the number of running builds to be below
+// the limit, then counts the caller as running.
+func (bq *buildQueue) acquire() {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	turn := bq.next
+	bq.next += 1
+	for turn != bq.served || (bq.limit > 0 && bq.running >= bq.limit) {
+		bq.cond.Wait()
+	}
+	bq.served += 1
+	bq.running += 1
+	bq.cond.Broadcast()
+}
+
+func (bq *buildQueue) release() {
+	bq.mu.Lock()
+	bq.running -= 1
+	bq.mu.Unlock()
+	bq.cond.Broadcast()
+}
+
 func ensureCanonicalImage(req *DeployInfo) string {
 	if name := req.CanonicalImageName; name != "" {
 		return name
@@ -256,25 +619,49 @@ var funcs = template.FuncMap{
 var (
 	mainTmpl       = template.Must(template.New("mainTmpl").Funcs(funcs).Parse(mainBody))
 	dockerFileTmpl = template.Must(template.New("dockerfile").Funcs(funcs).Parse(dockerFileBody))
+	goModTmpl      = template.Must(template.New("gomod").Parse(goModBody))
 )
 
+const goModBody = `module frontender-generated
+
+go 1.21
+
+require github.com/orijtech/frontender {{.Version}}
+{{if .Replace}}
+replace github.com/orijtech/frontender => {{printf "%q" .Replace}}
+{{end}}`
+
 const mainBody = `
 package main
 
 import (
 	"log"
 	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"os"
 	"strings"
 
 	"github.com/orijtech/frontender"
 )
 
 func main() {
+	printConfig := flag.Bool("print-config", false, "if set, prints the embedded config as JSON and exits")
+	flag.Parse()
+
 	buf := strings.NewReader({{gobEncodeAndQuote .}})
 	req := new(frontender.Request)
 	if err := gob.NewDecoder(buf).Decode(req); err != nil {
 		log.Fatalf("gobDecoding err: %v", err)
 	}
+	if *printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(req); err != nil {
+			log.Fatalf("jsonEncoding err: %v", err)
+		}
+		return
+	}
 	lc, err := frontender.Listen(req)
 	if err != nil {
 		log.Fatal(err)
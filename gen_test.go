@@ -0,0 +1,487 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var embeddedConfigRe = regexp.MustCompile(`strings\.NewReader\(("(?:[^"\\]|\\.)*")\)`)
+
+func TestMainTemplatePrintConfig(t *testing.T) {
+	req := &Request{
+		Domains:           []string{"example.org"},
+		ProxyAddresses:    []string{"http://localhost:8080"},
+		PrefixRouter:      map[string][]string{"/api": {"http://localhost:9090"}},
+		BackendPingPeriod: 45 * time.Second,
+		DomainsListener:   func(domains ...string) net.Listener { return nil },
+	}
+
+	buf := new(bytes.Buffer)
+	if err := mainTmpl.Execute(buf, req); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	rendered := buf.String()
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", rendered, 0); err != nil {
+		t.Fatalf("rendered main.go doesn't parse: %v\n%s", err, rendered)
+	}
+	for _, want := range []string{`flag.Bool("print-config"`, "flag.Parse()", "json.NewEncoder(os.Stdout)"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered main.go is missing %q", want)
+		}
+	}
+
+	// Round trip the embedded config just like the
+	// generated binary does when given -print-config.
+	match := embeddedConfigRe.FindStringSubmatch(rendered)
+	if match == nil {
+		t.Fatalf("no embedded config found in:\n%s", rendered)
+	}
+	embedded, err := strconv.Unquote(match[1])
+	if err != nil {
+		t.Fatalf("unquote: %v", err)
+	}
+	decoded := new(Request)
+	if err := gob.NewDecoder(strings.NewReader(embedded)).Decode(decoded); err != nil {
+		t.Fatalf("gob decode: %v", err)
+	}
+	gotJSON, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("json encode decoded: %v", err)
+	}
+	wantJSON, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("json encode original: %v", err)
+	}
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("round trip mismatch:\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+}
+
+func TestGenerateBinaryConfigError(t *testing.T) {
+	_, err := GenerateBinary(&DeployInfo{FrontendConfig: &Request{}})
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("invalid config: got %T %v, want a *ConfigError", err, err)
+	}
+	if ce.Err != errEmptyProxyAddress {
+		t.Errorf("wrapped error got=%v want=%v", ce.Err, errEmptyProxyAddress)
+	}
+	if _, err := GenerateBinary(&DeployInfo{}); !errors.As(err, &ce) {
+		t.Errorf("nil config: got %T %v, want a *ConfigError", err, err)
+	}
+
+	// A working directory that no longer exists makes
+	// creating the build directory fail, even for root.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	gone, err := os.MkdirTemp("", "frontender-gen")
+	if err != nil {
+		t.Fatalf("mkdirtemp: %v", err)
+	}
+	if err := os.Chdir(gone); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Remove(gone); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	valid := &Request{
+		Domains:        []string{"example.org"},
+		ProxyAddresses: []string{"http://localhost:8080"},
+	}
+	_, err = GenerateBinary(&DeployInfo{FrontendConfig: valid})
+	if err == nil {
+		t.Fatal("expected a filesystem error")
+	}
+	if errors.As(err, &ce) {
+		t.Errorf("filesystem failure reported as a config error: %v", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want an os.ErrNotExist error", err)
+	}
+}
+
+func TestWriteGoModPinsFrontender(t *testing.T) {
+	tests := [...]struct {
+		version     string
+		replace     string
+		wantRequire string
+		wantReplace bool
+	}{
+		0: {version: "v0.9.1", wantRequire: "require github.com/orijtech/frontender v0.9.1"},
+		1: {replace: "testdata", wantRequire: "require github.com/orijtech/frontender " + replacedVersion, wantReplace: true},
+		2: {version: "v0.9.1", replace: "testdata", wantRequire: "require github.com/orijtech/frontender v0.9.1", wantReplace: true},
+	}
+
+	for i, tt := range tests {
+		binDir := t.TempDir()
+		if err := writeGoMod(binDir, &DeployInfo{FrontenderVersion: tt.version, FrontenderReplace: tt.replace}); err != nil {
+			t.Errorf("#%d: writeGoMod: %v", i, err)
+			continue
+		}
+		blob, err := os.ReadFile(filepath.Join(binDir, "go.mod"))
+		if err != nil {
+			t.Errorf("#%d: read go.mod: %v", i, err)
+			continue
+		}
+		goMod := string(blob)
+		if !strings.HasPrefix(goMod, "module frontender-generated\n") {
+			t.Errorf("#%d: unexpected module line in:\n%s", i, goMod)
+		}
+		if !strings.Contains(goMod, tt.wantRequire+"\n") {
+			t.Errorf("#%d: missing %q in:\n%s", i, tt.wantRequire, goMod)
+		}
+
+		absReplace, _ := filepath.Abs(tt.replace)
+		wantReplace := "replace github.com/orijtech/frontender => " + strconv.Quote(absReplace)
+		if got := strings.Contains(goMod, wantReplace); got != tt.wantReplace {
+			t.Errorf("#%d: has %q got=%v want=%v in:\n%s", i, wantReplace, got, tt.wantReplace, goMod)
+		}
+	}
+}
+
+// fakeGo replaces the go command for the duration of the test. Builds
+// write, as the binary, the GOOS/GOARCH that they were invoked with,
+// unless fail reports that the command should fail. It returns the
+// arguments of every go command that was run.
+func fakeGo(t *testing.T, fail func(cmd *exec.Cmd) bool) func() [][]string {
+	return fakeGoBinary(t, fail, func(target string) []byte { return []byte(target) })
+}
+
+// fakeGoBinary is like fakeGo except that the
+// binaries built for target are binary(target).
+func fakeGoBinary(t *testing.T, fail func(cmd *exec.Cmd) bool, binary func(target string) []byte) func() [][]string {
+	var mu sync.Mutex
+	var commands [][]string
+	prev := execGo
+	execGo = func(cmd *exec.Cmd) ([]byte, error) {
+		mu.Lock()
+		commands = append(commands, cmd.Args[1:])
+		mu.Unlock()
+
+		if fail != nil && fail(cmd) {
+			return []byte("build failed"), errors.New("exit status 1")
+		}
+		args := cmd.Args[1:]
+		if args[0] != "build" {
+			return nil, nil
+		}
+		for i, arg := range args {
+			if arg == "-o" {
+				target := lastEnvValue(cmd.Env, "GOOS") + "/" + lastEnvValue(cmd.Env, "GOARCH")
+				return nil, os.WriteFile(filepath.Join(cmd.Dir, args[i+1]), binary(target), 0777)
+			}
+		}
+		return nil, errors.New("no -o")
+	}
+	t.Cleanup(func() { execGo = prev })
+
+	return func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), commands...)
+	}
+}
+
+// chdirTemp changes the working directory, in which the
+// binaries are built, to a temporary one for the test.
+func chdirTemp(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func validDeployInfo() *DeployInfo {
+	return &DeployInfo{
+		FrontendConfig: &Request{
+			Domains:        []string{"example.org"},
+			ProxyAddresses: []string{"http://localhost:8080"},
+		},
+	}
+}
+
+func TestGenerateBinaries(t *testing.T) {
+	fakeGo(t, nil)
+	dir := chdirTemp(t)
+
+	targets := []Target{
+		{GOOS: "linux", GOARCH: "amd64"},
+		{GOOS: "linux", GOARCH: "arm64"},
+		{GOOS: "darwin", GOARCH: "arm64"},
+		// Duplicates are built once.
+		{GOOS: "linux", GOARCH: "amd64"},
+	}
+	handles, err := GenerateBinaries(validDeployInfo(), targets)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if got, want := len(handles), 3; got != want {
+		t.Fatalf("handles got=%d want=%d", got, want)
+	}
+	entries, _ := os.ReadDir(dir)
+	if got, want := len(entries), 3; got != want {
+		t.Errorf("build directories got=%d want=%d", got, want)
+	}
+
+	// Each handle reads its own binary and closing
+	// one of them leaves the others untouched.
+	for _, target := range targets[:3] {
+		rc := handles[target]
+		blob, err := io.ReadAll(rc)
+		if err != nil {
+			t.Errorf("%s: read: %v", target, err)
+		}
+		if got, want := string(blob), target.String(); got != want {
+			t.Errorf("binary got=%q want=%q", got, want)
+		}
+		if err := rc.Close(); err != nil {
+			t.Errorf("%s: close: %v", target, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("build directories left behind: %v", entries)
+	}
+}
+
+func TestGenerateBinariesFailure(t *testing.T) {
+	fakeGo(t, func(cmd *exec.Cmd) bool { return lastEnvValue(cmd.Env, "GOOS") == "plan9" })
+	dir := chdirTemp(t)
+
+	targets := []Target{
+		{GOOS: "linux", GOARCH: "amd64"},
+		{GOOS: "plan9", GOARCH: "amd64"},
+		{GOOS: "darwin", GOARCH: "arm64"},
+	}
+	handles, err := GenerateBinaries(validDeployInfo(), targets)
+	if err == nil || !strings.Contains(err.Error(), "plan9/amd64") {
+		t.Errorf("got err=%v, want the failure for plan9/amd64", err)
+	}
+	if handles != nil {
+		t.Errorf("got handles %v despite the failure", handles)
+	}
+	// The binaries that were built are discarded too.
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("build directories left behind: %v", entries)
+	}
+}
+
+func TestGenerateBinaryVerify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	tests := [...]struct {
+		name    string
+		script  string
+		goos    string
+		wantErr string
+	}{
+		0: {name: "good", script: "#!/bin/sh\necho '{\"domains\": [\"example.org\"]}'\n"},
+		1: {name: "crashes", script: "#!/bin/sh\necho 'gobDecoding err: EOF' >&2\nexit 1\n", wantErr: "gobDecoding err: EOF"},
+		2: {name: "garbled config", script: "#!/bin/sh\necho 'not json'\n", wantErr: "invalid config printed"},
+		// Binaries for other platforms can't be verified.
+		3: {name: "foreign", script: "#!/bin/sh\nexit 1\n", goos: otherGOOS()},
+	}
+
+	for _, tt := range tests {
+		fakeGoBinary(t, nil, func(string) []byte { return []byte(tt.script) })
+		dir := chdirTemp(t)
+
+		di := validDeployInfo()
+		di.Verify = true
+		di.TargetGOOS = tt.goos
+		rc, err := GenerateBinary(di)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got err=%v want one with %q", tt.name, err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%s: build directories left behind: %v", tt.name, entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err: %v", tt.name, err)
+			continue
+		}
+		rc.Close()
+	}
+}
+
+func otherGOOS() string {
+	if runtime.GOOS == "plan9" {
+		return "linux"
+	}
+	return "plan9"
+}
+
+func TestGenerateBinaryBuildTags(t *testing.T) {
+	tests := [...]struct {
+		tags []string
+		want []string
+	}{
+		0: {want: []string{"build", "-o", "generated-exec", "."}},
+		1: {tags: []string{"debug"}, want: []string{"build", "-o", "generated-exec", "-tags", "debug", "."}},
+		2: {tags: []string{"debug", " ", "netgo "}, want: []string{"build", "-o", "generated-exec", "-tags", "debug,netgo", "."}},
+	}
+
+	for i, tt := range tests {
+		commands := fakeGo(t, nil)
+		chdirTemp(t)
+
+		di := validDeployInfo()
+		di.BuildTags = tt.tags
+		rc, err := GenerateBinary(di)
+		if err != nil {
+			t.Errorf("#%d: generate: %v", i, err)
+			continue
+		}
+		rc.Close()
+
+		got := commands()
+		if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+			t.Errorf("#%d: go commands:\ngot:  %q\nwant: %q", i, got, [][]string{tt.want})
+		}
+	}
+}
+
+func TestMaxConcurrentImageBuilds(t *testing.T) {
+	fakeGo(t, nil)
+	chdirTemp(t)
+
+	var mu sync.Mutex
+	running, maxRunning, built := 0, 0, 0
+	prev := execDocker
+	execDocker = func(cmd *exec.Cmd) ([]byte, error) {
+		mu.Lock()
+		running += 1
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running -= 1
+		built += 1
+		mu.Unlock()
+		return nil, nil
+	}
+	defer func() { execDocker = prev }()
+
+	const limit = 2
+	SetMaxConcurrentImageBuilds(limit)
+	defer SetMaxConcurrentImageBuilds(0)
+
+	const n = 6
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			info := validDeployInfo()
+			info.CanonicalImageName = "image-" + strconv.Itoa(i)
+			_, err := GenerateDockerImage(info)
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("build #%d: %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if built != n {
+		t.Errorf("built got=%d want=%d", built, n)
+	}
+	if maxRunning != limit {
+		t.Errorf("concurrent builds got=%d want=%d", maxRunning, limit)
+	}
+}
+
+func TestBuildErrorTellsEnvironment(t *testing.T) {
+	fakeGo(t, func(cmd *exec.Cmd) bool { return cmd.Args[1] == "build" })
+	chdirTemp(t)
+
+	info := validDeployInfo()
+	info.TargetGOOS = "plan9"
+	info.Environ = []string{"GOARCH=386"}
+	_, err := GenerateBinary(info)
+	var be *BuildError
+	if !errors.As(err, &be) {
+		t.Fatalf("got %T %v, want a *BuildError", err, err)
+	}
+	// Without the output of "go env", the environment is inferred.
+	for _, want := range []string{"GOOS=plan9", "GOARCH=386", "unknown go version", "build failed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't mention %q", err, want)
+		}
+	}
+
+	prev := execGo
+	execGo = func(cmd *exec.Cmd) ([]byte, error) {
+		if cmd.Args[1] == "env" {
+			if got, want := lastEnvValue(cmd.Env, "GOOS"), "plan9"; got != want {
+				t.Errorf("go env: GOOS got=%q want=%q", got, want)
+			}
+			return []byte("plan9\n386\ngo1.99.1\n"), nil
+		}
+		return prev(cmd)
+	}
+	defer func() { execGo = prev }()
+
+	_, err = GenerateBinary(info)
+	if !errors.As(err, &be) {
+		t.Fatalf("got %T %v, want a *BuildError", err, err)
+	}
+	want := &BuildError{GOOS: "plan9", GOARCH: "386", GoVersion: "go1.99.1", Err: be.Err}
+	if !reflect.DeepEqual(be, want) {
+		t.Errorf("got %+v want %+v", be, want)
+	}
+	if got, want := err.Error(), "frontender: building for GOOS=plan9 GOARCH=386 with go1.99.1: build failed"; got != want {
+		t.Errorf("message got=%q want=%q", got, want)
+	}
+}
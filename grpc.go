@@ -0,0 +1,83 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcTransportFor returns the transport that proxies the gRPC
+// traffic of addr, which always speaks HTTP/2 to the backend:
+// over TLS for "https" backends and in cleartext i.e h2c otherwise.
+func (lp *livelyProxy) grpcTransportFor(addr string) http.RoundTripper {
+	lp.mu.Lock()
+	rt, ok := lp.grpcTransports[addr]
+	transportForBackend := lp.transportForBackend
+	lp.mu.Unlock()
+
+	if ok {
+		return rt
+	}
+	// Like in transportFor, the hook is called without lp.mu held.
+	if transportForBackend != nil {
+		rt = transportForBackend(addr)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if cached, ok := lp.grpcTransports[addr]; ok {
+		return cached
+	}
+	if rt == nil {
+		rt = grpcTransport(strings.HasPrefix(addr, "https://"), lp.dialAddresses[addr], lp.maxResponseHeaderBytes, lp.backendDialTimeout)
+	} else {
+		lp.noteSuppliedTransportLocked("grpc+" + addr)
+	}
+	if lp.grpcTransports == nil {
+		lp.grpcTransports = make(map[string]http.RoundTripper)
+	}
+	lp.grpcTransports[addr] = rt
+	return rt
+}
+
+func grpcTransport(useTLS bool, dialAddr string, maxHeaderBytes int64, dialTimeout time.Duration) *http2.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if dialTimeout > 0 {
+		dialer.Timeout = dialTimeout
+	}
+	t := &http2.Transport{AllowHTTP: !useTLS}
+	t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		if dialAddr != "" {
+			addr = dialAddr
+		}
+		if !useTLS {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		td := &tls.Dialer{NetDialer: dialer, Config: cfg}
+		return td.DialContext(ctx, network, addr)
+	}
+	if maxHeaderBytes > 0 && maxHeaderBytes <= 1<<32-1 {
+		t.MaxHeaderListSize = uint32(maxHeaderBytes)
+	}
+	return t
+}
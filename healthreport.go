@@ -0,0 +1,123 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+
+	"github.com/odeke-em/go-uuid"
+)
+
+// HealthReportOptions configures BackendHealthReport.
+type HealthReportOptions struct {
+	// UserAgent, PingPath, PingMethod and RequireOK configure
+	// the pings as for lively.Peer, whose defaults they share.
+	UserAgent  string `json:"user_agent"`
+	PingPath   string `json:"ping_path"`
+	PingMethod string `json:"ping_method"`
+	RequireOK  bool   `json:"require_ok"`
+
+	// ConcurrentPings if set, bounds the number of
+	// backends that are pinged at the same time.
+	ConcurrentPings int `json:"concurrent_pings"`
+
+	// Transport if set, is used for the pings
+	// instead of http.DefaultTransport.
+	Transport http.RoundTripper `json:"-"`
+}
+
+// HealthReport is the liveliness of the backends of every route.
+type HealthReport struct {
+	Time   time.Time                   `json:"time"`
+	Routes map[string][]*BackendHealth `json:"routes"`
+}
+
+// BackendHealth is the outcome of pinging a backend.
+type BackendHealth struct {
+	Addr      string  `json:"addr"`
+	Live      bool    `json:"live"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// BackendHealthReport pings the backends of the routes of pr once,
+// and returns the JSON encoded HealthReport of their liveliness,
+// with the backends of each route sorted by address. Backends that
+// appear in several routes are pinged only once.
+func BackendHealthReport(pr map[string][]string, opts *HealthReportOptions) ([]byte, error) {
+	if opts == nil {
+		opts = new(HealthReportOptions)
+	}
+	pinger := &lively.Peer{
+		ID:         uuid.NewRandom().String(),
+		Primary:    true,
+		UserAgent:  opts.UserAgent,
+		PingPath:   opts.PingPath,
+		PingMethod: opts.PingMethod,
+		RequireOK:  opts.RequireOK,
+	}
+	if opts.Transport != nil {
+		pinger.SetHTTPRoundTripper(opts.Transport)
+	}
+	added := make(map[string]bool)
+	for _, addresses := range pr {
+		for _, addr := range addresses {
+			if !added[addr] {
+				added[addr] = true
+				_ = pinger.AddPeer(&lively.Peer{Addr: addr, ID: uuid.NewRandom().String()})
+			}
+		}
+	}
+
+	live, nonLive, err := pinger.Liveliness(&lively.LivelyRequest{ConcurrentPings: opts.ConcurrentPings})
+	if err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]*BackendHealth, len(added))
+	for _, l := range append(live, nonLive...) {
+		bh := &BackendHealth{
+			Addr:      l.Addr,
+			Live:      l.Err == nil && l.Ping != nil,
+			LatencyMs: float64(l.Latency) / float64(time.Millisecond),
+		}
+		if l.Err != nil {
+			bh.Error = l.Err.Error()
+		}
+		byAddr[l.Addr] = bh
+	}
+
+	report := &HealthReport{
+		Time:   time.Now(),
+		Routes: make(map[string][]*BackendHealth, len(pr)),
+	}
+	for route, addresses := range pr {
+		seen := make(map[string]bool, len(addresses))
+		backends := make([]*BackendHealth, 0, len(addresses))
+		for _, addr := range addresses {
+			if bh := byAddr[addr]; bh != nil && !seen[addr] {
+				seen[addr] = true
+				backends = append(backends, bh)
+			}
+		}
+		sort.Slice(backends, func(i, j int) bool { return backends[i].Addr < backends[j].Addr })
+		report.Routes[route] = backends
+	}
+	return json.MarshalIndent(report, "", "  ")
+}
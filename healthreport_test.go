@@ -0,0 +1,119 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/orijtech/frontender"
+)
+
+func TestBackendHealthReport(t *testing.T) {
+	var mu sync.Mutex
+	pings := make(map[string]int)
+	newBackend := func(name string, code int, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/healthz" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			mu.Lock()
+			pings[name] += 1
+			mu.Unlock()
+			time.Sleep(delay)
+			rw.WriteHeader(code)
+		}))
+	}
+	healthy := newBackend("healthy", http.StatusOK, 20*time.Millisecond)
+	defer healthy.Close()
+	unhealthy := newBackend("unhealthy", http.StatusServiceUnavailable, 0)
+	defer unhealthy.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	pr := map[string][]string{
+		"/":    {healthy.URL, unhealthy.URL},
+		"/api": {healthy.URL, dead.URL},
+	}
+	blob, err := frontender.BackendHealthReport(pr, &frontender.HealthReportOptions{PingPath: "/healthz", RequireOK: true})
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+
+	// The structure of the JSON document.
+	var doc map[string]interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, blob)
+	}
+	var keys []string
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{"routes", "time"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys got=%q want=%q", keys, want)
+	}
+	first := doc["routes"].(map[string]interface{})["/"].([]interface{})[0].(map[string]interface{})
+	for _, key := range []string{"addr", "live", "latency_ms"} {
+		if _, ok := first[key]; !ok {
+			t.Errorf("backend is missing %q in %v", key, first)
+		}
+	}
+
+	// And its values.
+	report := new(frontender.HealthReport)
+	if err := json.Unmarshal(blob, report); err != nil {
+		t.Fatalf("unmarshal report: %v", err)
+	}
+	if report.Time.IsZero() {
+		t.Error("expected the time of the report")
+	}
+	byAddr := make(map[string]*frontender.BackendHealth)
+	for route, backends := range report.Routes {
+		if got, want := len(backends), len(pr[route]); got != want {
+			t.Errorf("%q: backends got=%d want=%d", route, got, want)
+		}
+		for _, bh := range backends {
+			byAddr[route+" "+bh.Addr] = bh
+		}
+	}
+	for _, route := range []string{"/", "/api"} {
+		bh := byAddr[route+" "+healthy.URL]
+		if bh == nil || !bh.Live || bh.Error != "" || bh.LatencyMs < 20 {
+			t.Errorf("%q: healthy backend: %+v", route, bh)
+		}
+	}
+	if bh := byAddr["/ "+unhealthy.URL]; bh == nil || bh.Live || !strings.Contains(bh.Error, "503") {
+		t.Errorf("unhealthy backend: %+v", bh)
+	}
+	if bh := byAddr["/api "+dead.URL]; bh == nil || bh.Live || bh.Error == "" {
+		t.Errorf("dead backend: %+v", bh)
+	}
+
+	// Backends shared by routes are pinged once.
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := pings, map[string]int{"healthy": 1, "unhealthy": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pings got=%v want=%v", got, want)
+	}
+}
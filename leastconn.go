@@ -0,0 +1,94 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// LoadBalanceStrategy is how the backends of a route are picked.
+type LoadBalanceStrategy string
+
+const (
+	// RoundRobin picks the backends in turn, in proportion
+	// to their weights. It is the default strategy.
+	RoundRobin LoadBalanceStrategy = "round_robin"
+
+	// LeastConnections picks the backends with the fewest requests
+	// in flight relative to their weights, in turn if several are
+	// tied. It suits requests that take long e.g large downloads.
+	LeastConnections LoadBalanceStrategy = "least_connections"
+)
+
+func (lbs LoadBalanceStrategy) validate() error {
+	switch lbs {
+	case "", RoundRobin, LeastConnections:
+		return nil
+	}
+	return fmt.Errorf("unknown load balance strategy %q", lbs)
+}
+
+// enterBackend counts a request in flight to addr, if they are needed
+// to pick the backends, until the returned func is invoked.
+func (lp *livelyProxy) enterBackend(addr string) (leave func()) {
+	if lp.loadBalanceStrategy != LeastConnections {
+		return func() {}
+	}
+
+	lp.mu.Lock()
+	n := lp.backendInFlight[addr]
+	if n == nil {
+		n = new(atomic.Int64)
+		if lp.backendInFlight == nil {
+			lp.backendInFlight = make(map[string]*atomic.Int64)
+		}
+		lp.backendInFlight[addr] = n
+	}
+	lp.mu.Unlock()
+
+	n.Add(1)
+	return func() { n.Add(-1) }
+}
+
+// leastLoadedLocked narrows candidates, and their weights, down to
+// those with the fewest requests in flight relative to their weights.
+// Candidates without any weight are only kept if none has any.
+// lp.mu must be held.
+func (lp *livelyProxy) leastLoadedLocked(candidates []string, weights []float64) ([]string, []float64) {
+	var least []string
+	var leastWeights []float64
+	var leastLoad float64
+	for i, addr := range candidates {
+		if weights[i] <= 0 {
+			continue
+		}
+		var inFlight int64
+		if n := lp.backendInFlight[addr]; n != nil {
+			inFlight = n.Load()
+		}
+		load := float64(inFlight) / weights[i]
+		switch {
+		case len(least) == 0 || load < leastLoad:
+			least, leastWeights, leastLoad = []string{addr}, []float64{weights[i]}, load
+		case load == leastLoad:
+			least, leastWeights = append(least, addr), append(leastWeights, weights[i])
+		}
+	}
+	if len(least) == 0 {
+		return candidates, weights
+	}
+	return least, leastWeights
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLeastConnections(t *testing.T) {
+	// The backends hold each request until told to release it.
+	arrived := make(chan string)
+	release := make(map[string]chan bool)
+	var addresses []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		release[name] = make(chan bool)
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			arrived <- name
+			<-release[name]
+		}))
+		defer backend.Close()
+		addresses = append(addresses, backend.URL)
+	}
+	// Unblock those still held if the test fails.
+	defer func() {
+		for _, ch := range release {
+			close(ch)
+		}
+	}()
+
+	lp := makeTestProxy(map[string][]string{"/": addresses})
+	lp.loadBalanceStrategy = LeastConnections
+
+	done := make(chan bool, 10)
+	send := func() string {
+		go func() {
+			lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+			done <- true
+		}()
+		return <-arrived
+	}
+
+	// Concurrent slow requests are spread over the idle backends.
+	var busy []string
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		name := send()
+		if seen[name] {
+			t.Fatalf("request #%d: went to %q which was busy", i, name)
+		}
+		seen[name] = true
+		busy = append(busy, name)
+	}
+
+	// Once that which got the second request is idle again, it
+	// gets the requests, where round robin would go on in turn.
+	idle := busy[1]
+	release[idle] <- true
+	<-done
+	for i := 0; i < 5; i++ {
+		if got := send(); got != idle {
+			t.Fatalf("request #%d: got %q want the idle %q", i, got, idle)
+		}
+		release[idle] <- true
+		<-done
+	}
+
+	for _, name := range []string{busy[0], busy[2]} {
+		release[name] <- true
+		<-done
+	}
+
+	if err := (&Request{HTTP1: true, ProxyAddresses: addresses, LoadBalanceStrategy: "random"}).Validate(); err == nil {
+		t.Errorf("expected an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/publicsuffix"
+)
+
+const httpsAddr = ":443"
+
+// netListen is swapped out in tests to simulate bind failures.
+var netListen = net.Listen
+
+// provisionCert obtains, or loads from the cache, the certificate
+// of domain. It is swapped out in tests to stub the autocert manager.
+var provisionCert = func(m *autocert.Manager, domain string) error {
+	_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	return err
+}
+
+var (
+	// httpsListenAttempts is the number of times that binding the
+	// HTTPS listener is tried when the address is still in use,
+	// for example while a previous instance is shutting down.
+	httpsListenAttempts = 3
+
+	httpsListenBackoff = 500 * time.Millisecond
+)
+
+// maxNewCertsPerRegisteredDomain mirrors Let's Encrypt's rate limit
+// of 50 new certificates per registered domain, e.g example.org, per
+// week. Autocert obtains a certificate for every domain rather than
+// one with them all as names, so it is this limit, not that of 100
+// names per certificate, which more domains than that run into.
+const maxNewCertsPerRegisteredDomain = 50
+
+// TooManyDomainsError is returned by Listen when more domains of a
+// registered domain, including the synthesized www ones, are still
+// without a certificate than can be issued in a week.
+type TooManyDomainsError struct {
+	RegisteredDomain string
+	Count            int
+	Max              int
+}
+
+func (tme *TooManyDomainsError) Error() string {
+	return fmt.Sprintf("frontender: %d domains of %q, including the synthesized www ones, need a certificate"+
+		" but Let's Encrypt issues at most %d per registered domain per week; drop the www variants with"+
+		" NoAutoWWW or NoAutoWWWFor, or add the domains over several weeks",
+		tme.Count, tme.RegisteredDomain, tme.Max)
+}
+
+// checkNewCerts returns a *TooManyDomainsError if more of domains
+// than maxNewCertsPerRegisteredDomain, grouped by registered domain,
+// have no certificate in the cache of m yet.
+func checkNewCerts(m *autocert.Manager, domains []string) error {
+	uncached := make(map[string]int)
+	for _, domain := range domains {
+		if m.Cache != nil {
+			if _, err := m.Cache.Get(context.Background(), domain); err == nil {
+				continue
+			}
+		}
+		registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil {
+			registered = domain
+		}
+		uncached[registered] += 1
+	}
+	registeredDomains := make([]string, 0, len(uncached))
+	for registered := range uncached {
+		registeredDomains = append(registeredDomains, registered)
+	}
+	sort.Strings(registeredDomains)
+	for _, registered := range registeredDomains {
+		if count := uncached[registered]; count > maxNewCertsPerRegisteredDomain {
+			return &TooManyDomainsError{RegisteredDomain: registered, Count: count, Max: maxNewCertsPerRegisteredDomain}
+		}
+	}
+	return nil
+}
+
+// ListenError is returned by Listen when the
+// HTTPS listener could not be established.
+type ListenError struct {
+	Addr string
+	Err  error
+}
+
+func (le *ListenError) Error() string {
+	msg := fmt.Sprintf("frontender: cannot listen for HTTPS on %q: %v", le.Addr, le.Err)
+	if errors.Is(le.Err, os.ErrPermission) {
+		msg += "; binding to ports below 1024 requires running as root or granting" +
+			" the binary the CAP_NET_BIND_SERVICE capability e.g." +
+			" `setcap 'cap_net_bind_service=+ep' /path/to/binary`"
+	}
+	return msg
+}
+
+func (le *ListenError) Unwrap() error {
+	return le.Err
+}
+
+// listenAutocert is like autocert.NewListener except that it binds
+// the TCP listener eagerly so that failures are reported right away
+// by Listen instead of surfacing later on from Accept. It also returns
+// the autocert manager, to provision certificates with once the
+// listener is served. email if set, is the contact of the ACME account.
+// It fails without listening if more domains need a certificate than
+// Let's Encrypt would issue. Warnings are logged with logf.
+func listenAutocert(logf func(string, ...interface{}), email string, domains ...string) (net.Listener, *autocert.Manager, error) {
+	m := newAutocertManager(logf, email, domains...)
+	if err := checkNewCerts(m, domains); err != nil {
+		return nil, nil, err
+	}
+
+	var ln net.Listener
+	var err error
+	backoff := httpsListenBackoff
+	for i := 0; i < httpsListenAttempts; i++ {
+		if i > 0 {
+			<-time.After(backoff)
+			backoff *= 2
+		}
+		ln, err = netListen("tcp", httpsAddr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, &ListenError{Addr: httpsAddr, Err: err}
+	}
+
+	return tls.NewListener(ln, m.TLSConfig()), m, nil
+}
+
+// provisionPriorityDomains provisions, in order, the certificates of
+// priorityDomains. The listener of m must already be served as the
+// ACME server validates the domains with tls-alpn-01 challenges,
+// which are answered on it.
+func provisionPriorityDomains(m *autocert.Manager, priorityDomains []string) error {
+	for _, domain := range priorityDomains {
+		if err := provisionCert(m, domain); err != nil {
+			return fmt.Errorf("frontender: provisioning the certificate of priority domain %q: %v", domain, err)
+		}
+	}
+	return nil
+}
+
+// newAutocertManager returns the autocert manager of domains,
+// configured as autocert.NewListener would have, except for email.
+func newAutocertManager(logf func(string, ...interface{}), email string, domains ...string) *autocert.Manager {
+	m := &autocert.Manager{Prompt: autocert.AcceptTOS, Email: email}
+	if len(domains) > 0 {
+		m.HostPolicy = autocert.HostWhitelist(domains...)
+	}
+	if dir, err := autocertCacheDir(); err != nil {
+		logf("frontender: not using an autocert cache: %v", err)
+	} else {
+		m.Cache = autocert.DirCache(dir)
+	}
+	return m
+}
+
+// autocertCacheDir returns the same cache directory
+// that autocert.NewListener would have used.
+func autocertCacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "golang-autocert")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestListenReportsHTTPSBindFailures(t *testing.T) {
+	defer func(fn func(string, string) (net.Listener, error), backoff time.Duration) {
+		netListen, httpsListenBackoff = fn, backoff
+	}(netListen, httpsListenBackoff)
+	httpsListenBackoff = time.Millisecond
+
+	tests := [...]struct {
+		err          error
+		wantAttempts int
+		wantHint     bool
+	}{
+		0: {err: &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EACCES)}, wantAttempts: 1, wantHint: true},
+		1: {err: &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, wantAttempts: httpsListenAttempts},
+	}
+
+	for i, tt := range tests {
+		attempts := 0
+		netListen = func(network, addr string) (net.Listener, error) {
+			attempts += 1
+			return nil, tt.err
+		}
+
+		lc, err := Listen(&Request{
+			Domains:        []string{"example.org"},
+			ProxyAddresses: []string{"http://localhost:9999"},
+		})
+		if err == nil {
+			lc.Close()
+			t.Errorf("#%d: expected a non-nil error", i)
+			continue
+		}
+		var le *ListenError
+		if !errors.As(err, &le) {
+			t.Errorf("#%d: got error of type %T, want *ListenError", i, err)
+			continue
+		}
+		if got, want := attempts, tt.wantAttempts; got != want {
+			t.Errorf("#%d: attempts got=%d want=%d", i, got, want)
+		}
+		if got, want := strings.Contains(err.Error(), "CAP_NET_BIND_SERVICE"), tt.wantHint; got != want {
+			t.Errorf("#%d: hint present got=%v want=%v; err=%v", i, got, want, err)
+		}
+	}
+}
+
+func TestPriorityDomainsProvisionedEagerly(t *testing.T) {
+	defer func(fn func(string, string) (net.Listener, error), provision func(*autocert.Manager, string) error) {
+		netListen, provisionCert = fn, provision
+	}(netListen, provisionCert)
+
+	var listenAddr string
+	netListen = func(network, addr string) (net.Listener, error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			listenAddr = ln.Addr().String()
+		}
+		return ln, err
+	}
+
+	var provisioned []string
+	failFor := ""
+	provisionCert = func(m *autocert.Manager, domain string) error {
+		// The ACME challenges are answered on the HTTPS
+		// listener, which must thus already be served.
+		if !servesHTTPS(listenAddr) {
+			t.Errorf("provisioning %q before the HTTPS listener is served", domain)
+		}
+		provisioned = append(provisioned, domain)
+		if err := m.HostPolicy(context.Background(), domain); err != nil {
+			return err
+		}
+		if domain == failFor {
+			return errors.New("rate limited")
+		}
+		return nil
+	}
+
+	req := &Request{
+		Domains:         []string{"example.org", "shop.example.org", "blog.example.org"},
+		NoAutoWWW:       true,
+		ProxyAddresses:  []string{"http://localhost:9999"},
+		PriorityDomains: []string{"shop.example.org", "example.org"},
+	}
+	lc, err := Listen(req)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc.Close()
+	if got, want := provisioned, req.PriorityDomains; !reflect.DeepEqual(got, want) {
+		t.Errorf("provisioned got=%q want=%q", got, want)
+	}
+
+	// A failure to provision a priority domain fails Listen.
+	provisioned, failFor = nil, "shop.example.org"
+	if lc, err := Listen(req); err == nil {
+		lc.Close()
+		t.Errorf("expected an error when provisioning fails")
+	}
+	if got, want := provisioned, []string{"shop.example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after failure: provisioned got=%q want=%q", got, want)
+	}
+
+	// Priority domains must be among the served domains.
+	provisioned, failFor = nil, ""
+	req.PriorityDomains = []string{"elsewhere.org"}
+	if lc, err := Listen(req); err == nil {
+		lc.Close()
+		t.Errorf("expected an error for an unknown priority domain")
+	}
+	if len(provisioned) != 0 {
+		t.Errorf("unexpectedly provisioned %q", provisioned)
+	}
+}
+
+// servesHTTPS reports whether an HTTPS server is serving at addr,
+// by whether it answers to a plain HTTP request.
+func servesHTTPS(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(line, "HTTP/1.0 400")
+}
+
+func TestTooManyDomains(t *testing.T) {
+	defer func(fn func(string, string) (net.Listener, error)) {
+		netListen = fn
+	}(netListen)
+
+	listened := false
+	netListen = func(network, addr string) (net.Listener, error) {
+		listened = true
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+
+	var domains []string
+	for i := 0; i < 51; i++ {
+		domains = append(domains, fmt.Sprintf("d%d.example.org", i))
+	}
+	req := &Request{
+		Domains:        domains,
+		ProxyAddresses: []string{"http://localhost:9999"},
+	}
+
+	// 51 domains plus their www variants make 102 certificates
+	// for the registered domain example.org to be issued.
+	lc, err := Listen(req)
+	if err == nil {
+		lc.Close()
+		t.Fatalf("expected an error")
+	}
+	var tme *TooManyDomainsError
+	if !errors.As(err, &tme) {
+		t.Fatalf("got error of type %T, want *TooManyDomainsError", err)
+	}
+	if tme.RegisteredDomain != "example.org" || tme.Count != 102 || tme.Max != maxNewCertsPerRegisteredDomain {
+		t.Errorf("got registered domain=%q count=%d max=%d", tme.RegisteredDomain, tme.Count, tme.Max)
+	}
+	if listened {
+		t.Errorf("unexpectedly listened despite too many domains")
+	}
+
+	// Without the www variants, the first 50 domains of example.org
+	// fit the limit, while the last one is of another registered domain.
+	req.Domains[50] = "example.net"
+	req.NoAutoWWW = true
+	lc, err = Listen(req)
+	if err != nil {
+		t.Fatalf("without www variants: %v", err)
+	}
+	lc.Close()
+}
+
+// memCache is an in-memory autocert.Cache.
+type memCache map[string][]byte
+
+func (mc memCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if data, ok := mc[key]; ok {
+		return data, nil
+	}
+	return nil, autocert.ErrCacheMiss
+}
+
+func (mc memCache) Put(ctx context.Context, key string, data []byte) error {
+	mc[key] = data
+	return nil
+}
+
+func (mc memCache) Delete(ctx context.Context, key string) error {
+	delete(mc, key)
+	return nil
+}
+
+func TestTooManyDomainsCached(t *testing.T) {
+	var domains []string
+	for i := 0; i < 101; i++ {
+		domains = append(domains, fmt.Sprintf("d%d.example.org", i))
+	}
+	cache := make(memCache)
+	m := &autocert.Manager{Cache: cache}
+	if err := checkNewCerts(m, domains); err == nil {
+		t.Fatal("expected an error for 101 new certificates")
+	}
+
+	// Domains whose certificates are already cached don't need new ones.
+	for _, domain := range domains[:60] {
+		cache[domain] = []byte("certificate")
+	}
+	if err := checkNewCerts(m, domains); err != nil {
+		t.Errorf("with 41 new certificates: %v", err)
+	}
+}
+
+func TestACMEEmail(t *testing.T) {
+	defer func(fn func(string, string) (net.Listener, error), provision func(*autocert.Manager, string) error) {
+		netListen, provisionCert = fn, provision
+	}(netListen, provisionCert)
+
+	netListen = func(network, addr string) (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+	var emails []string
+	provisionCert = func(m *autocert.Manager, domain string) error {
+		emails = append(emails, m.Email)
+		return nil
+	}
+
+	lc, err := Listen(&Request{
+		Domains:         []string{"example.org"},
+		NoAutoWWW:       true,
+		ProxyAddresses:  []string{"http://localhost:9999"},
+		PriorityDomains: []string{"example.org"},
+		ACMEEmail:       "ops@example.org",
+	})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc.Close()
+
+	if got, want := emails, []string{"ops@example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("manager emails got=%q want=%q", got, want)
+	}
+	if got := newAutocertManager(t.Logf, "", "example.org").Email; got != "" {
+		t.Errorf("unexpected default email %q", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -24,6 +25,37 @@ type Peer struct {
 
 	Peers map[string]*Peer `json:"peers"`
 
+	// UserAgent is the User-Agent header sent with the pings
+	// to the other peers. It defaults to DefaultUserAgent.
+	UserAgent string `json:"user_agent"`
+
+	// StrictJSON if set, treats peers whose successful ping
+	// responses aren't valid JSON as not live, instead of
+	// considering them live with a zero valued Ping.
+	StrictJSON bool `json:"strict_json"`
+
+	// PingBody if set, is sent as the body of the pings to
+	// the other peers instead of the JSON encoded Ping, for
+	// peers that validate the body of health checks.
+	PingBody []byte `json:"ping_body"`
+
+	// PingContentType if set, is the Content-Type of the pings.
+	PingContentType string `json:"ping_content_type"`
+
+	// PingPath is the path that the other peers are
+	// pinged at. It defaults to DefaultPingPath.
+	PingPath string `json:"ping_path"`
+
+	// PingMethod is the HTTP method of the pings, e.g "GET" for
+	// peers that don't accept POST. It defaults to DefaultPingMethod.
+	// Pings with the GET or HEAD methods are sent without a body.
+	PingMethod string `json:"ping_method"`
+
+	// RequireOK if set, treats peers that respond to pings with
+	// non-2XX status codes as not live. Otherwise any response is
+	// a sign of liveliness, for peers without a ping route.
+	RequireOK bool `json:"require_ok"`
+
 	mu sync.RWMutex
 	rt http.RoundTripper
 }
@@ -35,18 +67,51 @@ type Ping struct {
 
 var blankPing = new(Ping)
 
+// DefaultUserAgent is the User-Agent sent with pings
+// so that they can be told apart from real traffic.
+const DefaultUserAgent = "frontender-healthcheck/1.0"
+
+// DefaultPingPath is the path that peers are pinged at by default.
+const DefaultPingPath = "/ping"
+
+// DefaultPingMethod is the HTTP method of the pings by default.
+const DefaultPingMethod = "POST"
+
 func (e *Peer) ping(other *Peer) (*Ping, error) {
-	blob, err := json.Marshal(&Ping{PeerID: e.ID, Clock: time.Now().Unix()})
-	if err != nil {
-		return nil, err
+	blob := e.PingBody
+	if blob == nil {
+		var err error
+		blob, err = json.Marshal(&Ping{PeerID: e.ID, Clock: time.Now().Unix()})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	addr := fmt.Sprintf("%s/ping", other.Addr)
-	body := bytes.NewReader(blob)
-	req, err := http.NewRequest("POST", addr, body)
+	pingPath := e.PingPath
+	if pingPath == "" {
+		pingPath = DefaultPingPath
+	}
+	method := e.PingMethod
+	if method == "" {
+		method = DefaultPingMethod
+	}
+	addr := other.Addr + pingPath
+	var body io.Reader
+	if method != "GET" && method != "HEAD" {
+		body = bytes.NewReader(blob)
+	}
+	req, err := http.NewRequest(method, addr, body)
 	if err != nil {
 		return nil, err
 	}
+	userAgent := e.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil && e.PingContentType != "" {
+		req.Header.Set("Content-Type", e.PingContentType)
+	}
 	res, err := e.httpClient().Do(req)
 	if err != nil {
 		return nil, err
@@ -55,6 +120,9 @@ func (e *Peer) ping(other *Peer) (*Ping, error) {
 		defer res.Body.Close()
 	}
 	if !otils.StatusOK(res.StatusCode) {
+		if e.RequireOK {
+			return nil, fmt.Errorf("ping of %q: %s", other.Addr, res.Status)
+		}
 		// There is an exception::
 		// 1) Not every backend service is bound to have a /ping route defined
 		// Therefore to make adoption easy and for compatibility with legacy
@@ -72,8 +140,9 @@ func (e *Peer) ping(other *Peer) (*Ping, error) {
 		return nil, err
 	}
 	recv := new(Ping)
-	// We don't really care about the error returned
-	_ = json.Unmarshal(slurp, recv)
+	if err := json.Unmarshal(slurp, recv); err != nil && e.StrictJSON {
+		return nil, fmt.Errorf("malformed ping response from %q: %v", other.Addr, err)
+	}
 	return recv, nil
 }
 
@@ -100,16 +169,23 @@ func (p *Peer) AddPeer(other *Peer) error {
 		return errBlankPeerID
 	}
 
-	p.mu.RLock()
+	p.mu.Lock()
 	if p.Peers == nil {
 		p.Peers = make(map[string]*Peer)
 	}
 	p.Peers[otherID] = other
-	p.mu.RUnlock()
+	p.mu.Unlock()
 
 	return nil
 }
 
+// RemovePeer removes the peer with the given ID, if present.
+func (p *Peer) RemovePeer(id string) {
+	p.mu.Lock()
+	delete(p.Peers, id)
+	p.mu.Unlock()
+}
+
 func (p *Peer) SetHTTPRoundTripper(rt http.RoundTripper) {
 	p.mu.Lock()
 	p.rt = rt
@@ -121,10 +197,18 @@ type Liveliness struct {
 	Ping   *Ping  `json:"ping"`
 	Err    error  `json:"error"`
 	Addr   string `json:"addr,omitepty"`
+
+	// Latency is how long pinging the peer took.
+	Latency time.Duration `json:"latency"`
 }
 
 type LivelyRequest struct {
 	ConcurrentPings int
+
+	// Limiter if set, is a semaphore whose capacity bounds the
+	// number of simultaneous pings. Sharing it across Liveliness
+	// calls, caps the pings of all those calls combined.
+	Limiter chan struct{}
 }
 
 func (p *Peer) Liveliness(llv *LivelyRequest) (livePeers, nonLivePeers []*Liveliness, err error) {
@@ -135,12 +219,16 @@ func (p *Peer) Liveliness(llv *LivelyRequest) (livePeers, nonLivePeers []*Liveli
 	}
 	p.mu.RUnlock()
 
+	var limiter chan struct{}
+	if llv != nil {
+		limiter = llv.Limiter
+	}
 	jobsBench := make(chan semalim.Job)
 	go func() {
 		defer close(jobsBench)
 
 		for _, curPeer := range curPeers {
-			jobsBench <- &peerPing{id: curPeer.ID, peer: curPeer, self: p}
+			jobsBench <- &peerPing{id: curPeer.ID, peer: curPeer, self: p, limiter: limiter}
 		}
 	}()
 
@@ -159,10 +247,11 @@ func (p *Peer) Liveliness(llv *LivelyRequest) (livePeers, nonLivePeers []*Liveli
 			ptr = &livePeers
 		}
 		*ptr = append(*ptr, &Liveliness{
-			Err:    err,
-			PeerID: peerID,
-			Ping:   pping,
-			Addr:   peerAddr,
+			Err:     err,
+			PeerID:  peerID,
+			Ping:    pping,
+			Addr:    peerAddr,
+			Latency: addrpPing.latency,
 		})
 	}
 
@@ -170,9 +259,10 @@ func (p *Peer) Liveliness(llv *LivelyRequest) (livePeers, nonLivePeers []*Liveli
 }
 
 type peerPing struct {
-	id   string
-	peer *Peer
-	self *Peer
+	id      string
+	peer    *Peer
+	self    *Peer
+	limiter chan struct{}
 }
 
 var _ semalim.Job = (*peerPing)(nil)
@@ -182,11 +272,17 @@ func (pp *peerPing) Id() interface{} {
 }
 
 type addrPing struct {
-	addr string
-	ping *Ping
+	addr    string
+	ping    *Ping
+	latency time.Duration
 }
 
 func (pp *peerPing) Do() (interface{}, error) {
+	if pp.limiter != nil {
+		pp.limiter <- struct{}{}
+		defer func() { <-pp.limiter }()
+	}
+	start := time.Now()
 	ping, err := pp.self.ping(pp.peer)
-	return &addrPing{addr: pp.peer.Addr, ping: ping}, err
+	return &addrPing{addr: pp.peer.Addr, ping: ping, latency: time.Since(start)}, err
 }
@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -214,3 +215,273 @@ func (cr *closeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 	resp := makeResp(`Foo OK`, cr.statusCode, cr.body)
 	return resp, nil
 }
+
+type userAgentRoundTripper struct {
+	mu         sync.Mutex
+	userAgents []string
+}
+
+func (ur *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ur.mu.Lock()
+	ur.userAgents = append(ur.userAgents, req.Header.Get("User-Agent"))
+	ur.mu.Unlock()
+	return makeResp("200 OK", http.StatusOK, ioutil.NopCloser(strings.NewReader(`{}`))), nil
+}
+
+func TestPingUserAgent(t *testing.T) {
+	tests := [...]struct {
+		userAgent string
+		want      string
+	}{
+		0: {userAgent: "", want: lively.DefaultUserAgent},
+		1: {userAgent: "acme-probe/2.0", want: "acme-probe/2.0"},
+	}
+
+	for i, tt := range tests {
+		peers := nPeers(2, "http://192.168.1.68")
+		primary := peers[0]
+		primary.Primary = true
+		primary.UserAgent = tt.userAgent
+		primary.AddPeer(peers[1])
+
+		rt := new(userAgentRoundTripper)
+		primary.SetHTTPRoundTripper(rt)
+		if _, _, err := primary.Liveliness(nil); err != nil {
+			t.Errorf("#%d: liveliness err: %v", i, err)
+			continue
+		}
+		if got, want := rt.userAgents, []string{tt.want}; !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+type bodyRoundTripper string
+
+func (br bodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return makeResp("200 OK", http.StatusOK, ioutil.NopCloser(strings.NewReader(string(br)))), nil
+}
+
+func TestPingStrictJSON(t *testing.T) {
+	tests := [...]struct {
+		body     string
+		strict   bool
+		wantLive bool
+	}{
+		0: {body: `{"id":"abc","clock":1500000000}`, strict: false, wantLive: true},
+		1: {body: `{"id":"abc","clock":1500000000}`, strict: true, wantLive: true},
+		2: {body: `<html>oops</html>`, strict: false, wantLive: true},
+		3: {body: `<html>oops</html>`, strict: true, wantLive: false},
+	}
+
+	for i, tt := range tests {
+		peers := nPeers(2, "http://192.168.1.68")
+		primary := peers[0]
+		primary.Primary = true
+		primary.StrictJSON = tt.strict
+		primary.AddPeer(peers[1])
+		primary.SetHTTPRoundTripper(bodyRoundTripper(tt.body))
+
+		livePeers, nonLivePeers, err := primary.Liveliness(nil)
+		if err != nil {
+			t.Errorf("#%d: liveliness err: %v", i, err)
+			continue
+		}
+		gotLive := len(livePeers) == 1 && len(nonLivePeers) == 0
+		if gotLive != tt.wantLive {
+			t.Errorf("#%d: live got=%v want=%v; live=%d nonLive=%d", i, gotLive, tt.wantLive, len(livePeers), len(nonLivePeers))
+			continue
+		}
+		if !tt.wantLive && nonLivePeers[0].Err == nil {
+			t.Errorf("#%d: expected an error for the non-live peer", i)
+		}
+	}
+}
+
+// recordingRoundTripper records the pings that it answers,
+// with code if set, otherwise with 200 OK.
+type recordingRoundTripper struct {
+	code int
+
+	mu           sync.Mutex
+	bodies       []string
+	contentTypes []string
+	requests     []string
+}
+
+func (rr *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	rr.mu.Lock()
+	rr.bodies = append(rr.bodies, string(body))
+	rr.contentTypes = append(rr.contentTypes, req.Header.Get("Content-Type"))
+	rr.requests = append(rr.requests, req.Method+" "+req.URL.Path)
+	rr.mu.Unlock()
+	code := rr.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return makeResp(http.StatusText(code), code, ioutil.NopCloser(strings.NewReader("{}"))), nil
+}
+
+func TestPingBody(t *testing.T) {
+	tests := [...]struct {
+		body            []byte
+		contentType     string
+		wantBody        string
+		wantContentType string
+	}{
+		0: {body: []byte(`{"status":"check"}`), contentType: "application/health+json", wantBody: `{"status":"check"}`, wantContentType: "application/health+json"},
+		1: {body: []byte("ping"), wantBody: "ping"},
+		// By default the JSON encoded Ping is sent.
+		2: {wantBody: `{"id":"primary","clock":`},
+	}
+
+	for i, tt := range tests {
+		peers := nPeers(2, "http://192.168.1.68")
+		primary := peers[0]
+		primary.ID = "primary"
+		primary.Primary = true
+		primary.PingBody = tt.body
+		primary.PingContentType = tt.contentType
+		primary.AddPeer(peers[1])
+		rr := new(recordingRoundTripper)
+		primary.SetHTTPRoundTripper(rr)
+
+		if _, _, err := primary.Liveliness(nil); err != nil {
+			t.Errorf("#%d: liveliness err: %v", i, err)
+			continue
+		}
+		if len(rr.bodies) != 1 {
+			t.Errorf("#%d: pings got=%d want=1", i, len(rr.bodies))
+			continue
+		}
+		if got, want := rr.bodies[0], tt.wantBody; !strings.HasPrefix(got, want) {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+		if got, want := rr.contentTypes[0], tt.wantContentType; got != want {
+			t.Errorf("#%d: content type got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+// statusByPath answers pings with the status code of their
+// path, and with 404 Not Found for the other paths.
+type statusByPath map[string]int
+
+func (sp statusByPath) RoundTrip(req *http.Request) (*http.Response, error) {
+	code, ok := sp[req.URL.Path]
+	if !ok {
+		code = http.StatusNotFound
+	}
+	return makeResp(http.StatusText(code), code, ioutil.NopCloser(strings.NewReader("{}"))), nil
+}
+
+func TestPingPathRequireOK(t *testing.T) {
+	statuses := statusByPath{"/ping": http.StatusOK, "/ready": http.StatusServiceUnavailable, "/healthz": http.StatusOK}
+	tests := [...]struct {
+		path      string
+		requireOK bool
+		wantLive  bool
+	}{
+		0: {path: "", wantLive: true},
+		1: {path: "/healthz", requireOK: true, wantLive: true},
+		// Without RequireOK, any response is a sign of liveliness.
+		2: {path: "/ready", wantLive: true},
+		3: {path: "/ready", requireOK: true, wantLive: false},
+		4: {path: "/missing", requireOK: true, wantLive: false},
+	}
+
+	for i, tt := range tests {
+		peers := nPeers(2, "http://192.168.1.68")
+		primary := peers[0]
+		primary.Primary = true
+		primary.PingPath = tt.path
+		primary.RequireOK = tt.requireOK
+		primary.AddPeer(peers[1])
+		primary.SetHTTPRoundTripper(statuses)
+
+		livePeers, nonLivePeers, err := primary.Liveliness(nil)
+		if err != nil {
+			t.Errorf("#%d: liveliness err: %v", i, err)
+			continue
+		}
+		if gotLive := len(livePeers) == 1 && len(nonLivePeers) == 0; gotLive != tt.wantLive {
+			t.Errorf("#%d: live got=%v want=%v", i, gotLive, tt.wantLive)
+		}
+	}
+}
+
+func TestPingMethod(t *testing.T) {
+	tests := [...]struct {
+		method string
+		path   string
+		want   string
+	}{
+		0: {want: "POST /ping"},
+		1: {method: "GET", path: "/healthz", want: "GET /healthz"},
+		2: {method: "HEAD", path: "/status", want: "HEAD /status"},
+		3: {method: "PUT", want: "PUT /ping"},
+	}
+
+	for i, tt := range tests {
+		peers := nPeers(2, "http://192.168.1.68")
+		primary := peers[0]
+		primary.Primary = true
+		primary.PingMethod = tt.method
+		primary.PingPath = tt.path
+		primary.AddPeer(peers[1])
+		rr := &recordingRoundTripper{code: http.StatusNotFound}
+		primary.SetHTTPRoundTripper(rr)
+
+		livePeers, _, err := primary.Liveliness(nil)
+		if err != nil {
+			t.Errorf("#%d: liveliness err: %v", i, err)
+			continue
+		}
+		// The 404 is still a sign of liveliness.
+		if len(livePeers) != 1 {
+			t.Errorf("#%d: live got=%d want=1", i, len(livePeers))
+		}
+		if got := strings.Join(rr.requests, ", "); got != tt.want {
+			t.Errorf("#%d: got %q want %q", i, got, tt.want)
+		}
+		// Only the methods that take a body are sent one.
+		wantBody := tt.method != "GET" && tt.method != "HEAD"
+		if gotBody := rr.bodies[0] != ""; gotBody != wantBody {
+			t.Errorf("#%d: sent a body: %v want %v", i, gotBody, wantBody)
+		}
+	}
+}
+
+// slowRoundTripper answers pings after a delay.
+type slowRoundTripper time.Duration
+
+func (srt slowRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(time.Duration(srt))
+	return makeResp("200 OK", http.StatusOK, ioutil.NopCloser(strings.NewReader("{}"))), nil
+}
+
+func TestLivelinessLatency(t *testing.T) {
+	peers := nPeers(2, "http://192.168.1.68")
+	primary := peers[0]
+	primary.Primary = true
+	primary.AddPeer(peers[1])
+	primary.SetHTTPRoundTripper(slowRoundTripper(20 * time.Millisecond))
+
+	livePeers, _, err := primary.Liveliness(nil)
+	if err != nil {
+		t.Fatalf("liveliness err: %v", err)
+	}
+	if len(livePeers) != 1 {
+		t.Fatalf("live peers got=%d want=1", len(livePeers))
+	}
+	if got, min := livePeers[0].Latency, 20*time.Millisecond; got < min {
+		t.Errorf("latency got=%s want at least %s", got, min)
+	}
+}
@@ -0,0 +1,2431 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// makeTestProxy creates a livelyProxy whose backends
+// are all considered live without having to ping them.
+func makeTestProxy(pr map[string][]string) *livelyProxy {
+	lp := makeLivelyProxy(0, pr)
+	for route, addresses := range pr {
+		lp.liveAddresses[route] = append([]string(nil), addresses...)
+	}
+	return lp
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	body := strings.Repeat("a", 1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/chunked" {
+			// Flushing before writing anything forces
+			// a chunked response without Content-Length.
+			rw.(http.Flusher).Flush()
+		}
+		rw.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	tests := [...]struct {
+		path     string
+		maxBytes int64
+		wantCode int
+		wantBody string
+	}{
+		0: {path: "/", maxBytes: 0, wantCode: http.StatusOK, wantBody: body},
+		1: {path: "/", maxBytes: 2048, wantCode: http.StatusOK, wantBody: body},
+		2: {path: "/", maxBytes: 1024, wantCode: http.StatusOK, wantBody: body},
+		3: {path: "/", maxBytes: 100, wantCode: http.StatusBadGateway, wantBody: ""},
+		4: {path: "/chunked", maxBytes: 100, wantCode: http.StatusOK, wantBody: body[:100]},
+	}
+
+	for i, tt := range tests {
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.maxResponseBodyBytes = tt.maxBytes
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		if got, want := rec.Body.String(), tt.wantBody; got != want {
+			t.Errorf("#%d: body got %d bytes want %d bytes", i, len(got), len(want))
+		}
+	}
+}
+
+func TestConnectionCloseDeprioritizesBackend(t *testing.T) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	makeBackend := func(name string, closeConn bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			hits[name] += 1
+			mu.Unlock()
+			if closeConn {
+				rw.Header().Set("Connection", "close")
+			}
+			rw.Write([]byte(name))
+		}))
+	}
+	closing := makeBackend("closing", true)
+	defer closing.Close()
+	healthy := makeBackend("healthy", false)
+	defer healthy.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {closing.URL, healthy.URL}})
+	// The first request goes to the closing backend
+	// which then responds with "Connection: close".
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got, want := rec.Body.String(), "closing"; got != want {
+		t.Fatalf("first request: got=%q want=%q", got, want)
+	}
+
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got, want := rec.Body.String(), "healthy"; got != want {
+			t.Errorf("#%d: got=%q want=%q", i, got, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := hits["closing"], 1; got != want {
+		t.Errorf("closing backend hits: got=%d want=%d", got, want)
+	}
+}
+
+func TestRoundRobinEvenAcrossCycles(t *testing.T) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("backend-%d", i)
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/ping" {
+				return
+			}
+			mu.Lock()
+			hits[name] += 1
+			mu.Unlock()
+		}))
+		defer backend.Close()
+		addresses = append(addresses, backend.URL)
+	}
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": addresses})
+	primary := lp.primariesMap["/"]
+
+	// Send fewer requests per cycle than there are
+	// backends so that any reset of the counter on
+	// each cycle would show up as a skew.
+	cycles, perCycle := 30, 2
+	for i := 0; i < cycles; i++ {
+		if _, _, err := lp.cycle("/", primary); err != nil {
+			t.Fatalf("cycle #%d: %v", i, err)
+		}
+		for j := 0; j < perCycle; j++ {
+			rec := httptest.NewRecorder()
+			lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		}
+	}
+
+	if got, want := lp.generation["/"], uint64(1); got != want {
+		t.Errorf("generation: got=%d want=%d", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantPerBackend := cycles * perCycle / len(addresses)
+	for name, n := range hits {
+		if n < wantPerBackend-1 || n > wantPerBackend+1 {
+			t.Errorf("%s: got %d hits, want about %d; all hits: %v", name, n, wantPerBackend, hits)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	for _, enabled := range []bool{false, true} {
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.serverTiming = enabled
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		header := rec.Header().Get("Server-Timing")
+		if !enabled {
+			if header != "" {
+				t.Errorf("disabled: unexpected Server-Timing header %q", header)
+			}
+			continue
+		}
+
+		var ms float64
+		if _, err := fmt.Sscanf(header, "upstream;dur=%g", &ms); err != nil {
+			t.Errorf("enabled: malformed Server-Timing header %q: %v", header, err)
+			continue
+		}
+		if ms < 20 || ms > 10000 {
+			t.Errorf("enabled: implausible duration %vms", ms)
+		}
+	}
+}
+
+func TestSampledDumps(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Backend", "yes")
+		io.Copy(rw, req.Body)
+	}))
+	defer backend.Close()
+
+	for _, pct := range []float64{0, 100} {
+		var dumps []string
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.dumpSamplePercent = pct
+		lp.dumpMaxBodyBytes = 5
+		lp.logfFn = func(format string, args ...interface{}) {
+			dumps = append(dumps, fmt.Sprintf(format, args...))
+		}
+
+		for i := 0; i < 5; i++ {
+			rec := httptest.NewRecorder()
+			lp.ServeHTTP(rec, httptest.NewRequest("POST", "/echo", strings.NewReader("hello world")))
+			// Dumping must not consume the bodies.
+			if got, want := rec.Body.String(), "hello world"; got != want {
+				t.Errorf("pct=%v #%d: body got=%q want=%q", pct, i, got, want)
+			}
+		}
+
+		if pct == 0 {
+			if len(dumps) != 0 {
+				t.Errorf("pct=0: got %d dumps, want none", len(dumps))
+			}
+			continue
+		}
+		if got, want := len(dumps), 10; got != want {
+			t.Errorf("pct=100: got %d dumps want %d", got, want)
+			continue
+		}
+		reqDump, resDump := dumps[0], dumps[1]
+		if !strings.Contains(reqDump, "POST /echo") || !strings.HasSuffix(reqDump, "hello") {
+			t.Errorf("unexpected request dump: %q", reqDump)
+		}
+		if !strings.Contains(resDump, "X-Backend: yes") || !strings.HasSuffix(resDump, "hello") {
+			t.Errorf("unexpected response dump: %q", resDump)
+		}
+	}
+}
+
+func TestDumpsRedactCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Set-Cookie", "session=backend-secret")
+		rw.Header().Set("X-Backend", "yes")
+	}))
+	defer backend.Close()
+
+	var dumps []string
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.dumpSamplePercent = 100
+	lp.logfFn = func(format string, args ...interface{}) {
+		dumps = append(dumps, fmt.Sprintf(format, args...))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer client-secret")
+	req.Header.Set("Proxy-Authorization", "Basic proxy-secret")
+	req.Header.Set("Cookie", "session=client-secret")
+	req.Header.Set("X-Client", "yes")
+	lp.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got, want := len(dumps), 2; got != want {
+		t.Fatalf("got %d dumps want %d", got, want)
+	}
+	reqDump, resDump := dumps[0], dumps[1]
+	for _, want := range []string{"Authorization: [REDACTED]", "Proxy-Authorization: [REDACTED]", "Cookie: [REDACTED]", "X-Client: yes"} {
+		if !strings.Contains(reqDump, want) {
+			t.Errorf("request dump %q: missing %q", reqDump, want)
+		}
+	}
+	for _, want := range []string{"Set-Cookie: [REDACTED]", "X-Backend: yes"} {
+		if !strings.Contains(resDump, want) {
+			t.Errorf("response dump %q: missing %q", resDump, want)
+		}
+	}
+	for _, dump := range dumps {
+		if strings.Contains(dump, "secret") {
+			t.Errorf("credentials were dumped: %q", dump)
+		}
+	}
+	// The forwarded headers are left intact.
+	if got, want := req.Header.Get("Authorization"), "Bearer client-secret"; got != want {
+		t.Errorf("Authorization got=%q want=%q", got, want)
+	}
+}
+
+func TestStrictSNI(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	tests := [...]struct {
+		strict     bool
+		protoMajor int
+		host       string
+		serverName string
+		wantCode   int
+	}{
+		0: {strict: true, protoMajor: 2, host: "a.example.com", serverName: "a.example.com", wantCode: http.StatusOK},
+		1: {strict: true, protoMajor: 2, host: "A.example.com:443", serverName: "a.example.com", wantCode: http.StatusOK},
+		// A request coalesced onto a connection established for another tenant.
+		2: {strict: true, protoMajor: 2, host: "b.example.com", serverName: "a.example.com", wantCode: http.StatusMisdirectedRequest},
+		3: {strict: false, protoMajor: 2, host: "b.example.com", serverName: "a.example.com", wantCode: http.StatusOK},
+		// HTTP/1.1 connections can't be coalesced.
+		4: {strict: true, protoMajor: 1, host: "b.example.com", serverName: "a.example.com", wantCode: http.StatusOK},
+		5: {strict: true, protoMajor: 2, host: "a.example.com.:8443", serverName: "a.example.com", wantCode: http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.strictSNI = tt.strict
+
+		req := httptest.NewRequest("GET", "https://"+tt.host+"/", nil)
+		req.ProtoMajor = tt.protoMajor
+		req.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+	}
+}
+
+func TestWarmingUpVersusAllBackendsDown(t *testing.T) {
+	// A backend that refuses connections.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": {dead.URL}})
+	lp.warmingUpRetryAfter = 1500 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("warming up: code got=%d want=%d", got, want)
+	}
+	if got, want := rec.Header().Get("Retry-After"), "2"; got != want {
+		t.Errorf("warming up: Retry-After got=%q want=%q", got, want)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), "warming up"; got != want {
+		t.Errorf("warming up: body got=%q want=%q", got, want)
+	}
+
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("all down: code got=%d want=%d", got, want)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("all down: unexpected Retry-After %q", got)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), "no live backends for route /"; got != want {
+		t.Errorf("all down: body got=%q want=%q", got, want)
+	}
+}
+
+func TestNoLiveBackendsOrNoRoute(t *testing.T) {
+	lp := makeLivelyProxy(0, map[string][]string{"/foo": nil})
+	if _, _, err := lp.cycle("/foo", lp.primariesMap["/foo"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	tests := [...]struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		0: {path: "/foo/a", wantCode: http.StatusServiceUnavailable, wantBody: "no live backends for route /foo"},
+		// Without a route for "/", nothing else is proxied.
+		1: {path: "/bar", wantCode: http.StatusNotFound, wantBody: "404 page not found"},
+		2: {path: "/", wantCode: http.StatusNotFound, wantBody: "404 page not found"},
+	}
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: %s: code got=%d want=%d", i, tt.path, got, tt.wantCode)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+			t.Errorf("#%d: %s: body got=%q want=%q", i, tt.path, got, tt.wantBody)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer live.Close()
+
+	tests := [...]struct {
+		backends       []string
+		minLive        int
+		retryAfter     time.Duration
+		wantBody       string
+		wantRetryAfter string
+	}{
+		0: {backends: []string{dead.URL}, retryAfter: 30 * time.Second, wantBody: "no live backends for route /", wantRetryAfter: "30"},
+		1: {backends: []string{dead.URL}, retryAfter: 2500 * time.Millisecond, wantBody: "no live backends for route /", wantRetryAfter: "3"},
+		2: {backends: []string{dead.URL, live.URL}, minLive: 2, retryAfter: 10 * time.Second, wantBody: "too few live backends for route /", wantRetryAfter: "10"},
+		3: {backends: []string{dead.URL}, wantBody: "no live backends for route /"},
+	}
+
+	for i, tt := range tests {
+		lp := makeLivelyProxy(0, map[string][]string{"/": tt.backends})
+		lp.routeOptions = map[string]*RouteOptions{"/": {Backends: tt.backends, MinLiveBackends: tt.minLive}}
+		lp.retryAfter = tt.retryAfter
+		if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+			t.Fatalf("#%d: cycle: %v", i, err)
+		}
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), tt.wantBody; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+		if got, want := rec.Header().Get("Retry-After"), tt.wantRetryAfter; got != want {
+			t.Errorf("#%d: Retry-After got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+type countingTransport struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.mu.Lock()
+	ct.count += 1
+	ct.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTransportForBackend(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+		defer backend.Close()
+		addresses = append(addresses, backend.URL)
+	}
+
+	var mu sync.Mutex
+	hookCalls := make(map[string]int)
+	transports := make(map[string]*countingTransport)
+	lp := makeTestProxy(map[string][]string{"/": addresses})
+	lp.transportForBackend = func(addr string) http.RoundTripper {
+		mu.Lock()
+		defer mu.Unlock()
+		hookCalls[addr] += 1
+		if addr == addresses[0] {
+			transports[addr] = new(countingTransport)
+			return transports[addr]
+		}
+		// Use the default transport.
+		return nil
+	}
+
+	for i := 0; i < 6; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, addr := range addresses {
+		if got, want := hookCalls[addr], 1; got != want {
+			t.Errorf("%s: hook called %d times, want %d", addr, got, want)
+		}
+	}
+	if got, want := transports[addresses[0]].count, 3; got != want {
+		t.Errorf("custom transport used %d times, want %d", got, want)
+	}
+}
+
+func TestTransportForBackendCallingBack(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	// A hook that calls back into the frontend mustn't deadlock it.
+	lp.transportForBackend = func(addr string) http.RoundTripper {
+		if got := lp.backendAddresses(); len(got) != 1 {
+			t.Errorf("backends got=%q", got)
+		}
+		return nil
+	}
+
+	served := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		served <- rec.Code
+	}()
+	select {
+	case code := <-served:
+		if code != http.StatusOK {
+			t.Errorf("code got=%d want=%d", code, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request is stuck behind the hook")
+	}
+}
+
+func TestMinLiveBackends(t *testing.T) {
+	var backends []*httptest.Server
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+		defer backend.Close()
+		backends = append(backends, backend)
+		addresses = append(addresses, backend.URL)
+	}
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": addresses})
+	lp.routeOptions = map[string]*RouteOptions{"/": {Backends: addresses, MinLiveBackends: 2}}
+	primary := lp.primariesMap["/"]
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	if _, _, err := lp.cycle("/", primary); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	if got, want := serve().Code, http.StatusOK; got != want {
+		t.Errorf("all live: code got=%d want=%d", got, want)
+	}
+
+	// Drop to exactly the threshold.
+	backends[0].Close()
+	if _, _, err := lp.cycle("/", primary); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	if got, want := serve().Code, http.StatusOK; got != want {
+		t.Errorf("at threshold: code got=%d want=%d", got, want)
+	}
+
+	// Below the threshold even though one backend is still live.
+	backends[1].Close()
+	if _, _, err := lp.cycle("/", primary); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	if got := len(lp.liveAddresses["/"]); got != 1 {
+		t.Fatalf("live backends: got=%d want=1", got)
+	}
+	rec := serve()
+	if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("below threshold: code got=%d want=%d", got, want)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), "too few live backends for route /"; got != want {
+		t.Errorf("below threshold: body got=%q want=%q", got, want)
+	}
+}
+
+// fakeClock is a clock whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+
+	// sleepers receives a value each time After is called.
+	sleepers chan struct{}
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+var _ clock = (*fakeClock)(nil)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:      time.Unix(1500000000, 0),
+		sleepers: make(chan struct{}, 16),
+	}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	c := make(chan time.Time, 1)
+	fc.waiters = append(fc.waiters, &fakeWaiter{deadline: fc.now.Add(d), c: c})
+	fc.mu.Unlock()
+	fc.sleepers <- struct{}{}
+	return c
+}
+
+// Advance moves the time forward by d, firing every
+// waiter whose deadline has been reached.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = fc.now.Add(d)
+	var pending []*fakeWaiter
+	for _, w := range fc.waiters {
+		if w.deadline.After(fc.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- fc.now
+	}
+	fc.waiters = pending
+}
+
+// okPings answers every ping as live without any network.
+type okPings struct{}
+
+func (okPings) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(`{"id":"backend"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestRunCollectsFeedback(t *testing.T) {
+	pr := map[string][]string{
+		"/":    {"http://a.invalid"},
+		"/api": {"http://b.invalid", "http://c.invalid"},
+	}
+	lp := makeLivelyProxy(10*time.Millisecond, pr)
+	lp.transportForBackend = func(addr string) http.RoundTripper { return okPings{} }
+
+	feedbackChanMap := lp.run()
+	if got, want := len(feedbackChanMap), len(pr); got != want {
+		t.Fatalf("feedback channels got=%d want=%d", got, want)
+	}
+	for route, feedbackChan := range feedbackChanMap {
+		// The cycles carry on as their feedback is collected.
+		for want := uint64(1); want <= 2; want++ {
+			select {
+			case feedback := <-feedbackChan:
+				if feedback.cycleNumber != want || feedback.err != nil {
+					t.Errorf("%q: cycle #%d: got number=%d err=%v", route, want, feedback.cycleNumber, feedback.err)
+				}
+				if got, want := len(feedback.livePeers), len(pr[route]); got != want {
+					t.Errorf("%q: live peers got=%d want=%d", route, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%q: no feedback for cycle #%d", route, want)
+			}
+		}
+	}
+
+	lp.stopHealthChecks()
+	for route, feedbackChan := range feedbackChanMap {
+		for range feedbackChan {
+		}
+		if len(lp.liveAddresses[route]) != len(pr[route]) {
+			t.Errorf("%q: live addresses got=%v", route, lp.liveAddresses[route])
+		}
+	}
+}
+
+func TestCyclesWithFakeClock(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	freq := time.Hour
+	fc := newFakeClock()
+	lp := makeLivelyProxy(freq, map[string][]string{"/": {backend.URL}})
+	lp.clock = fc
+
+	feedbackChan := lp.startCycling("/", lp.primariesMap["/"])
+	for want := uint64(1); want <= 5; want++ {
+		select {
+		case feedback := <-feedbackChan:
+			if feedback.cycleNumber != want {
+				t.Fatalf("cycle number got=%d want=%d", feedback.cycleNumber, want)
+			}
+			if feedback.err != nil || len(feedback.livePeers) != 1 {
+				t.Fatalf("cycle #%d: err=%v live=%d", want, feedback.err, len(feedback.livePeers))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle #%d never happened", want)
+		}
+
+		// Wait for the next cycle to be scheduled.
+		<-fc.sleepers
+		// Advancing by less than the period must not cycle.
+		fc.Advance(freq - time.Second)
+		select {
+		case <-feedbackChan:
+			t.Fatalf("cycle #%d happened before its period elapsed", want+1)
+		case <-time.After(10 * time.Millisecond):
+		}
+		fc.Advance(time.Second)
+	}
+
+	// Removing the route stops the cycling at the next period.
+	<-feedbackChan
+	<-fc.sleepers
+	lp.mu.Lock()
+	delete(lp.primariesMap, "/")
+	lp.mu.Unlock()
+	fc.Advance(freq)
+	if _, ok := <-feedbackChan; ok {
+		t.Errorf("expected cycling to stop once the route was removed")
+	}
+}
+
+func TestGlobalPingConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight += 1
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight -= 1
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	// Distinct addresses, since an address shared
+	// by several routes is only pinged once.
+	pr := make(map[string][]string)
+	for i := 0; i < 20; i++ {
+		pr[fmt.Sprintf("/route%d", i)] = []string{fmt.Sprintf("%s/route%d", backend.URL, i)}
+	}
+	const limit = 3
+	lp := makeLivelyProxy(0, pr)
+	lp.pingLimiter = make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for route, primary := range lp.primariesMap {
+		wg.Add(1)
+		go func(route string, primary *lively.Peer) {
+			defer wg.Done()
+			livePeers, _, err := lp.cycle(route, primary)
+			if err != nil || len(livePeers) != 1 {
+				t.Errorf("%s: err=%v live=%d", route, err, len(livePeers))
+			}
+		}(route, primary)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight > limit {
+		t.Errorf("simultaneous pings: got=%d want at most %d", maxInFlight, limit)
+	}
+	if maxInFlight < 2 {
+		t.Errorf("simultaneous pings: got=%d, the pings should still run concurrently", maxInFlight)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/api": {backend.URL}, "/web": {backend.URL}})
+	lp.metricsPath = "/metrics"
+
+	for _, path := range []string{"/api/a", "/api/b", "/web", "/nowhere"} {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := rec.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("Content-Type got=%q want=%q", got, want)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, rec.Body.Bytes())
+	}
+	for _, key := range []string{"requests", "live_backends", "goroutines", "memstats"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("missing key %q in %s", key, rec.Body.Bytes())
+		}
+	}
+
+	wantRequests := map[string]interface{}{
+		"total":     float64(4),
+		"not_found": float64(1),
+		"by_route":  map[string]interface{}{"/api": float64(2), "/web": float64(1)},
+	}
+	if !reflect.DeepEqual(got["requests"], wantRequests) {
+		t.Errorf("requests:\ngot:  %v\nwant: %v", got["requests"], wantRequests)
+	}
+	wantLive := map[string]interface{}{"/api": float64(1), "/web": float64(1)}
+	if !reflect.DeepEqual(got["live_backends"], wantLive) {
+		t.Errorf("live_backends:\ngot:  %v\nwant: %v", got["live_backends"], wantLive)
+	}
+	if n, _ := got["goroutines"].(float64); n < 1 {
+		t.Errorf("goroutines: got=%v", got["goroutines"])
+	}
+	if memstats, _ := got["memstats"].(map[string]interface{}); memstats["heap_alloc"] == nil {
+		t.Errorf("memstats: missing heap_alloc in %v", got["memstats"])
+	}
+}
+
+func TestPingsDeduplicatedAcrossRoutes(t *testing.T) {
+	var mu sync.Mutex
+	pings := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		pings[req.URL.Path] += 1
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	a, b, c := backend.URL+"/a", backend.URL+"/b", backend.URL+"/c"
+	pr := map[string][]string{
+		"/x": {a, b, c},
+		"/y": {a, b},
+		"/z": {a},
+	}
+	lp := makeLivelyProxy(time.Hour, pr)
+
+	var wg sync.WaitGroup
+	for route, primary := range lp.primariesMap {
+		wg.Add(1)
+		go func(route string, primary *lively.Peer) {
+			defer wg.Done()
+			livePeers, nonLivePeers, err := lp.cycle(route, primary)
+			if err != nil || len(livePeers) != len(pr[route]) || len(nonLivePeers) != 0 {
+				t.Errorf("%s: err=%v live=%d nonLive=%d", route, err, len(livePeers), len(nonLivePeers))
+			}
+		}(route, primary)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	want := map[string]int{"/a/ping": 1, "/b/ping": 1, "/c/ping": 1}
+	if !reflect.DeepEqual(pings, want) {
+		t.Errorf("pings got=%v want=%v", pings, want)
+	}
+	mu.Unlock()
+
+	for route, addresses := range pr {
+		if got, want := len(lp.liveAddresses[route]), len(addresses); got != want {
+			t.Errorf("%s: live addresses got=%d want=%d", route, got, want)
+		}
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	tests := [...]struct {
+		handler  http.Handler
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		0: {path: "/nowhere", wantCode: http.StatusNotFound, wantBody: "404 page not found"},
+		1: {
+			handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte("nothing at " + req.URL.Path))
+			}),
+			path:     "/nowhere",
+			wantCode: http.StatusNotFound,
+			wantBody: "nothing at /nowhere",
+		},
+		2: {
+			handler:  http.NotFoundHandler(),
+			path:     "/api/users",
+			wantCode: http.StatusOK,
+			wantBody: "backend",
+		},
+	}
+
+	for i, tt := range tests {
+		lp := makeTestProxy(map[string][]string{"/api": {backend.URL}})
+		lp.notFoundHandler = tt.handler
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), tt.wantBody; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+func TestCoalesceGETs(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	upstream := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		upstream += 1
+		mu.Unlock()
+		<-release
+		rw.Header().Set("X-Backend", "yes")
+		rw.Write([]byte("expensive " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.coalesceGETs = true
+
+	const n = 20
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			lp.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+		}(recs[i])
+	}
+
+	// Only release the backend once every other request waits on the first.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lp.mu.Lock()
+		f := lp.flights["example.com /report"]
+		waiters := 0
+		if f != nil {
+			waiters = f.waiters
+		}
+		lp.mu.Unlock()
+		if waiters == n-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d requests were coalesced", waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if upstream != 1 {
+		t.Errorf("upstream requests: got=%d want=1", upstream)
+	}
+	for i, rec := range recs {
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := rec.Body.String(), "expensive /report"; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+		if got, want := rec.Header().Get("X-Backend"), "yes"; got != want {
+			t.Errorf("#%d: X-Backend got=%q want=%q", i, got, want)
+		}
+	}
+
+	// Requests with credentials are never coalesced.
+	req := httptest.NewRequest("GET", "/report", nil)
+	req.Header.Set("Cookie", "session=secret")
+	lp.ServeHTTP(httptest.NewRecorder(), req)
+	if upstream != 2 {
+		t.Errorf("after a request with a cookie: upstream got=%d want=2", upstream)
+	}
+}
+
+func TestCoalescable(t *testing.T) {
+	tests := [...]struct {
+		method string
+		header map[string]string
+		want   bool
+	}{
+		0: {method: "GET", want: true},
+		1: {method: "POST"},
+		2: {method: "GET", header: map[string]string{"Authorization": "Bearer token"}},
+		3: {method: "GET", header: map[string]string{"Cookie": "session=secret"}},
+		// Partial responses would be replayed to clients asking for all.
+		4: {method: "GET", header: map[string]string{"Range": "bytes=0-99"}},
+		// As would streams to clients that arrived late.
+		5: {method: "GET", header: map[string]string{"Accept": "text/event-stream"}},
+		6: {method: "GET", header: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/report", nil)
+		for key, value := range tt.header {
+			req.Header.Set(key, value)
+		}
+		if got := coalescable(req); got != tt.want {
+			t.Errorf("#%d: got=%t want=%t", i, got, tt.want)
+		}
+	}
+
+	// Nor are requests that authenticate with a client certificate.
+	mtls := httptest.NewRequest("GET", "/report", nil)
+	mtls.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	if coalescable(mtls) {
+		t.Error("a request with a client certificate is coalescable")
+	}
+
+	plain := httptest.NewRequest("GET", "/report", nil)
+	gzipped := httptest.NewRequest("GET", "/report", nil)
+	gzipped.Header.Set("Accept-Encoding", "gzip")
+	if coalescingKey(plain) == coalescingKey(gzipped) {
+		t.Errorf("requests accepting different encodings share the key %q", coalescingKey(plain))
+	}
+}
+
+func TestCoalesceGETsVary(t *testing.T) {
+	release := make(chan struct{})
+	var upstream atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if upstream.Add(1) == 1 {
+			<-release
+		}
+		rw.Header().Set("Vary", "Accept-Language")
+		rw.Write([]byte("report in " + req.Header.Get("Accept-Language")))
+	}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.coalesceGETs = true
+
+	languages := []string{"fr", "de"}
+	recs := make([]*httptest.ResponseRecorder, len(languages))
+	var wg sync.WaitGroup
+	for i, language := range languages {
+		recs[i] = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/report", nil)
+		req.Header.Set("Accept-Language", language)
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder, req *http.Request) {
+			defer wg.Done()
+			lp.ServeHTTP(rec, req)
+		}(recs[i], req)
+		if i > 0 {
+			continue
+		}
+		// Let the first request be in flight before the second.
+		for upstream.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for {
+		lp.mu.Lock()
+		waiters := lp.flights["example.com /report"].waiters
+		lp.mu.Unlock()
+		if waiters == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	// The response varies by language, so it can't be shared.
+	for i, language := range languages {
+		if got, want := recs[i].Body.String(), "report in "+language; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+	}
+	if got, want := upstream.Load(), int32(2); got != want {
+		t.Errorf("upstream requests: got=%d want=%d", got, want)
+	}
+}
+
+func TestCoalesceGETsPrivate(t *testing.T) {
+	tests := [...]struct {
+		name   string
+		header map[string]string
+	}{
+		{name: "cookie", header: map[string]string{"Set-Cookie": "session=%d"}},
+		{name: "private", header: map[string]string{"Cache-Control": "max-age=60, private"}},
+		{name: "no-store", header: map[string]string{"Cache-Control": "No-Store"}},
+	}
+	for _, tt := range tests {
+		release := make(chan struct{})
+		var upstream atomic.Int32
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			n := upstream.Add(1)
+			if n == 1 {
+				<-release
+			}
+			for key, value := range tt.header {
+				rw.Header().Set(key, strings.ReplaceAll(value, "%d", fmt.Sprint(n)))
+			}
+			rw.Write([]byte(fmt.Sprintf("response %d", n)))
+		}))
+
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.coalesceGETs = true
+
+		recs := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+		var wg sync.WaitGroup
+		for i, rec := range recs {
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder) {
+				defer wg.Done()
+				lp.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+			}(rec)
+			if i > 0 {
+				continue
+			}
+			for upstream.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		for {
+			lp.mu.Lock()
+			waiters := lp.flights["example.com /report"].waiters
+			lp.mu.Unlock()
+			if waiters == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+		backend.Close()
+
+		// The waiter gets a response of its own instead of the private one.
+		if got, want := upstream.Load(), int32(2); got != want {
+			t.Errorf("%s: upstream requests: got=%d want=%d", tt.name, got, want)
+		}
+		if recs[0].Body.String() == recs[1].Body.String() {
+			t.Errorf("%s: both requests got %q", tt.name, recs[0].Body.String())
+		}
+	}
+}
+
+func TestCoalesceGETsStreams(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("first\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		rw.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.coalesceGETs = true
+	front := httptest.NewServer(lp)
+	defer front.Close()
+
+	res, err := http.Get(front.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// The first part arrives while the backend is still writing,
+	// as nothing waits on the response for it to be buffered.
+	buf := make([]byte, len("first\n"))
+	if _, err := io.ReadFull(res.Body, buf); err != nil {
+		t.Fatalf("reading the first part: %v", err)
+	}
+	if got, want := string(buf), "first\n"; got != want {
+		t.Errorf("first part: got=%q want=%q", got, want)
+	}
+
+	// Once streaming, the flight can't be joined anymore.
+	lp.mu.Lock()
+	inFlight := len(lp.flights)
+	lp.mu.Unlock()
+	if inFlight != 0 {
+		t.Errorf("flights got=%d want=0", inFlight)
+	}
+}
+
+func TestDialAddresses(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, req.URL.Path+" "+req.Host)
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	// The logical address doesn't resolve, so
+	// only dialing the backend itself can work.
+	logical := "http://api.frontender.invalid:8080"
+	lp := makeLivelyProxy(0, map[string][]string{"/": {logical}})
+	lp.dialAddresses = map[string]string{logical: strings.TrimPrefix(backend.URL, "http://")}
+
+	livePeers, _, err := lp.cycle("/", lp.primariesMap["/"])
+	if err != nil || len(livePeers) != 1 {
+		t.Fatalf("cycle: err=%v live=%d", err, len(livePeers))
+	}
+
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "http://frontend.example/users", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("code got=%d want=%d", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"/ping api.frontender.invalid:8080",
+		"/users api.frontender.invalid:8080",
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got=%q want=%q", hosts, want)
+	}
+}
+
+func TestMaxBackendResponseHeaderBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/huge" {
+			rw.Header().Set("X-Huge", strings.Repeat("a", 16<<10))
+		}
+		rw.Header().Set("X-Small", "ok")
+	}))
+	defer backend.Close()
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": {backend.URL}})
+	lp.maxResponseHeaderBytes = 4 << 10
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	tests := [...]struct {
+		path     string
+		wantCode int
+	}{
+		0: {path: "/small", wantCode: http.StatusOK},
+		1: {path: "/huge", wantCode: http.StatusBadGateway},
+	}
+
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "http://frontend.example"+tt.path, nil))
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if rec.Header().Get("X-Huge") != "" {
+			t.Errorf("#%d: the oversized header was passed through", i)
+		}
+	}
+}
+
+func TestHealthWebhook(t *testing.T) {
+	defer func(backoff time.Duration) {
+		healthWebhookBackoff = backoff
+	}(healthWebhookBackoff)
+	healthWebhookBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan *HealthTransition, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		attempts += 1
+		failing := attempts == 1
+		mu.Unlock()
+		if failing {
+			// Fail the first delivery to exercise the retries.
+			http.Error(rw, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		transition := new(HealthTransition)
+		if err := json.NewDecoder(req.Body).Decode(transition); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		received <- transition
+	}))
+	defer webhook.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	lp := makeLivelyProxy(0, map[string][]string{"/api": {backend.URL}})
+	lp.healthWebhookURL = webhook.URL
+	primary := lp.primariesMap["/api"]
+
+	// The first observation isn't a transition.
+	lp.cycle("/api", primary)
+	lp.cycle("/api", primary)
+
+	backend.Close()
+	lp.cycle("/api", primary)
+
+	select {
+	case transition := <-received:
+		if transition.Route != "/api" || transition.Addr != backend.URL || transition.State != HealthNonLive {
+			t.Errorf("unexpected transition %+v", transition)
+		}
+		if transition.Time.IsZero() {
+			t.Errorf("expected a timestamp")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the transition was never delivered")
+	}
+
+	select {
+	case transition := <-received:
+		t.Errorf("unexpected extra transition %+v", transition)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := attempts, 2; got != want {
+		t.Errorf("delivery attempts got=%d want=%d", got, want)
+	}
+}
+
+func TestHealthWebhookOrder(t *testing.T) {
+	defer func(backoff time.Duration) {
+		healthWebhookBackoff = backoff
+	}(healthWebhookBackoff)
+	// Slow enough for the next transition to be
+	// posted before the retry, if not queued.
+	healthWebhookBackoff = 100 * time.Millisecond
+
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		attempts += 1
+		failing := attempts == 1
+		mu.Unlock()
+		if failing {
+			http.Error(rw, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		transition := new(HealthTransition)
+		if err := json.NewDecoder(req.Body).Decode(transition); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		received <- transition.State
+	}))
+	defer webhook.Close()
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !healthy.Load() {
+			conn, _, _ := rw.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": {backend.URL}})
+	lp.healthWebhookURL = webhook.URL
+	lp.logfFn = t.Logf
+	primary := lp.primariesMap["/"]
+
+	// The backend flaps, the delivery of it going
+	// non-live being retried as it goes live again.
+	lp.cycle("/", primary)
+	healthy.Store(false)
+	lp.cycle("/", primary)
+	healthy.Store(true)
+	lp.cycle("/", primary)
+
+	var states []string
+	for len(states) < 2 {
+		select {
+		case state := <-received:
+			states = append(states, state)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got the transitions %q", states)
+		}
+	}
+	if want := []string{HealthNonLive, HealthLive}; !reflect.DeepEqual(states, want) {
+		t.Errorf("transitions got=%q want=%q", states, want)
+	}
+}
+
+func TestCanaryRollback(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Pool", "stable")
+	}))
+	defer stable.Close()
+
+	var mu sync.Mutex
+	canaryHits := 0
+	canaryBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		canaryHits += 1
+		mu.Unlock()
+		rw.Header().Set("X-Pool", "canary")
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer canaryBackend.Close()
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": {stable.URL}})
+	lp.logfFn = t.Logf
+	lp.routeOptions = map[string]*RouteOptions{
+		"/": {
+			Backends: []string{stable.URL},
+			Canary: &CanaryOptions{
+				Backends:     []string{canaryBackend.URL},
+				Percent:      50,
+				MaxErrorRate: 0.2,
+				MinRequests:  4,
+			},
+		},
+	}
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	pools := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		pools[rec.Header().Get("X-Pool")] += 1
+	}
+
+	mu.Lock()
+	// Only MinRequests canary requests are
+	// needed to see that it is failing.
+	if got, want := canaryHits, 4; got != want {
+		t.Errorf("canary hits got=%d want=%d", got, want)
+	}
+	mu.Unlock()
+	if got, want := pools["stable"], 96; got != want {
+		t.Errorf("stable responses got=%d want=%d", got, want)
+	}
+
+	serveCanaried := func() (canaried int) {
+		for i := 0; i < 10; i++ {
+			rec := httptest.NewRecorder()
+			lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Header().Get("X-Pool") == "canary" {
+				canaried += 1
+			}
+		}
+		return canaried
+	}
+
+	// A reload that keeps the canary as it was doesn't bring it back.
+	lp.reload(map[string][]string{"/": {stable.URL}}, copyRoutes(lp.routeOptions), false)
+	if got := serveCanaried(); got != 0 {
+		t.Errorf("after an unchanged reload: %d requests went to the rolled back canary", got)
+	}
+
+	// Whereas one that changes it starts it over,
+	// until it is rolled back again.
+	routes := copyRoutes(lp.routeOptions)
+	routes["/"].Canary.Percent = 20
+	lp.reload(map[string][]string{"/": {stable.URL}}, routes, false)
+	if got, want := serveCanaried(), 4; got != want {
+		t.Errorf("after changing the canary: canaried requests got=%d want=%d", got, want)
+	}
+}
+
+func TestGRPCEndToEnd(t *testing.T) {
+	backendProtos := make(chan int, 1)
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		backendProtos <- req.ProtoMajor
+		body, _ := io.ReadAll(req.Body)
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		rw.Write(body)
+		rw.Header().Set("Grpc-Status", "0")
+		rw.Header().Set("Grpc-Message", "all good")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.routeOptions = map[string]*RouteOptions{"/": {Backends: []string{backend.URL}, GRPC: true}}
+	frontend := httptest.NewServer(h2c.NewHandler(lp, &http2.Server{}))
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}}
+	req, _ := http.NewRequest("POST", frontend.URL+"/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x05hello"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	if got, want := res.ProtoMajor, 2; got != want {
+		t.Errorf("frontend proto major got=%d want=%d", got, want)
+	}
+	if got, want := <-backendProtos, 2; got != want {
+		t.Errorf("backend proto major got=%d want=%d", got, want)
+	}
+	if got, want := string(body), "\x00\x00\x00\x00\x05hello"; got != want {
+		t.Errorf("body got=%q want=%q", got, want)
+	}
+	if got, want := res.Trailer.Get("Grpc-Status"), "0"; got != want {
+		t.Errorf("Grpc-Status trailer got=%q want=%q", got, want)
+	}
+	if got, want := res.Trailer.Get("Grpc-Message"), "all good"; got != want {
+		t.Errorf("Grpc-Message trailer got=%q want=%q", got, want)
+	}
+}
+
+func TestGRPCHealthChecks(t *testing.T) {
+	// A backend that only speaks HTTP/2 with prior knowledge, like
+	// gRPC servers without TLS do, unlike h2c.NewHandler which also
+	// accepts HTTP/1 requests.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	h2s := &http2.Server{}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/grpc")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h2s.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+	backendURL := "http://" + ln.Addr().String()
+
+	for _, grpc := range []bool{true, false} {
+		lp := makeLivelyProxy(0, map[string][]string{"/": {backendURL}})
+		lp.routeOptions = map[string]*RouteOptions{"/": {Backends: []string{backendURL}, GRPC: grpc}}
+		lp.cycle("/", lp.primariesMap["/"])
+
+		// Only pinged over HTTP/2 is the backend reachable.
+		lp.mu.Lock()
+		live := len(lp.liveAddresses["/"]) == 1
+		lp.mu.Unlock()
+		if live != grpc {
+			t.Errorf("grpc=%t: live got=%t want=%t", grpc, live, grpc)
+		}
+	}
+}
+
+func TestHealthCheckBody(t *testing.T) {
+	type ping struct{ body, contentType string }
+	pings := make(chan ping, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			body, _ := io.ReadAll(req.Body)
+			pings <- ping{string(body), req.Header.Get("Content-Type")}
+		}
+	}))
+	defer backend.Close()
+
+	req := &Request{
+		HealthCheckBody:        `<health contract="v2"/>`,
+		HealthCheckContentType: "application/xml",
+	}
+	lp := makeLivelyProxy(0, map[string][]string{"/": {backend.URL}})
+	lp.setHealthCheckOptions(req.healthCheckOptions())
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	got := <-pings
+	if want := (ping{`<health contract="v2"/>`, "application/xml"}); got != want {
+		t.Errorf("ping got=%+v want=%+v", got, want)
+	}
+}
+
+// idleClosingTransport records the closing of its idle connections.
+type idleClosingTransport struct {
+	http.RoundTripper
+	closed chan bool
+}
+
+func (it *idleClosingTransport) CloseIdleConnections() {
+	select {
+	case it.closed <- true:
+	default:
+	}
+}
+
+func TestRemovedBackendProxiesDiscarded(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	kept, supplied := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer kept.Close()
+	defer supplied.Close()
+	// The idle connections of the built-in transports are closed.
+	closedConns := make(chan bool, 1)
+	builtIn := httptest.NewUnstartedServer(handler)
+	builtIn.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closedConns <- true:
+			default:
+			}
+		}
+	}
+	builtIn.Start()
+	defer builtIn.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {kept.URL, supplied.URL, builtIn.URL}})
+	// Lest the backend get the shared http.DefaultTransport.
+	lp.backendDialTimeout = 5 * time.Second
+	transports := make(map[string]*idleClosingTransport)
+	lp.transportForBackend = func(addr string) http.RoundTripper {
+		if addr == builtIn.URL {
+			return nil
+		}
+		it := &idleClosingTransport{RoundTripper: http.DefaultTransport, closed: make(chan bool, 1)}
+		transports[addr] = it
+		return it
+	}
+	for i := 0; i < 6; i++ {
+		lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if len(transports) != 2 {
+		t.Fatalf("expected all the backends to have been proxied to, got %d supplied transports", len(transports))
+	}
+
+	gone, _, _ := lp.reload(map[string][]string{"/": {kept.URL}}, nil, false)
+	if len(gone) != 2 {
+		t.Fatalf("unexpected removed backends: %+v", gone)
+	}
+	lp.discardBackendsAfter([]string{gone[0].addr, gone[1].addr}, time.Millisecond)
+
+	select {
+	case <-closedConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connections of the removed backend weren't closed")
+	}
+	// Those supplied by TransportForBackend may be shared.
+	select {
+	case <-transports[supplied.URL].closed:
+		t.Error("the idle connections of a supplied transport were closed")
+	case <-transports[kept.URL].closed:
+		t.Error("the idle connections of the kept backend were closed")
+	default:
+	}
+
+	lp.mu.Lock()
+	for _, addr := range []string{supplied.URL, builtIn.URL} {
+		if _, ok := lp.proxies[addr]; ok {
+			t.Errorf("the proxy of the removed backend %q is still cached", addr)
+		}
+		if _, ok := lp.transports[addr]; ok {
+			t.Errorf("the transport of the removed backend %q is still cached", addr)
+		}
+	}
+	if _, ok := lp.proxies[kept.URL]; !ok {
+		t.Error("the proxy of the kept backend was discarded")
+	}
+	lp.mu.Unlock()
+
+	// Promoting a staged router discards those it removes too.
+	lp.removedBackendGracePeriod = time.Millisecond
+	lp.swapIn(makeTestProxy(map[string][]string{"/": {supplied.URL}}))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lp.mu.Lock()
+		_, cached := lp.proxies[kept.URL]
+		lp.mu.Unlock()
+		if !cached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the proxy of the backend removed by the promotion is still cached")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRemovedBackendPingsDiscarded(t *testing.T) {
+	const gone, kept = "http://127.0.0.1:1", "http://127.0.0.2:1"
+	lp := makeTestProxy(map[string][]string{"/": {gone, kept}})
+	lp.pings = make(map[string]*pingResult)
+	for _, key := range []string{gone, "grpc+" + gone, kept} {
+		lp.pings[key] = &pingResult{live: true}
+	}
+	lp.liveness = map[string]bool{gone: true, kept: true}
+
+	lp.reload(map[string][]string{"/": {kept}}, nil, false)
+	lp.discardBackends([]string{gone})
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for _, key := range []string{gone, "grpc+" + gone} {
+		if _, ok := lp.pings[key]; ok {
+			t.Errorf("the ping result of the removed backend %q is still kept", key)
+		}
+	}
+	if _, ok := lp.pings[kept]; !ok {
+		t.Error("the ping result of the kept backend was discarded")
+	}
+	if got, want := lp.liveness, map[string]bool{kept: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveness got=%v want=%v", got, want)
+	}
+}
+
+func TestReloadPreservesBackendState(t *testing.T) {
+	backend := func() string {
+		cst := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+		t.Cleanup(cst.Close)
+		return cst.URL
+	}
+	a, b, c := backend(), backend(), backend()
+	lp := makeTestProxy(map[string][]string{"/": {a, b, c}})
+	lp.loadBalanceStrategy = LeastConnections
+	lp.routeOptions = map[string]*RouteOptions{"/": {Weights: map[string]int{a: 3}}}
+
+	peerOf := func(addr string) *lively.Peer {
+		for _, secondary := range lp.secondariesMap["/"] {
+			if secondary.Addr == addr {
+				return secondary
+			}
+		}
+		return nil
+	}
+	peerA := peerOf(a)
+
+	for i := 0; i < 4; i++ {
+		lp.roundRobinedAddress("/")
+	}
+	leave := lp.enterBackend(a)
+	lp.mu.Lock()
+	before := lp.currentWeights["/"][a] - lp.currentWeights["/"][b]
+	lp.mu.Unlock()
+
+	lp.reload(map[string][]string{"/": {a, b}}, lp.routeOptions, false)
+
+	if peerOf(a) != peerA {
+		t.Error("the peer of a kept backend was replaced")
+	}
+	lp.mu.Lock()
+	current := lp.currentWeights["/"]
+	if _, ok := current[c]; ok {
+		t.Error("the removed backend still has a current weight")
+	}
+	if got := current[a] - current[b]; got != before {
+		t.Errorf("the current weights of the kept backends changed: got=%v want=%v", got, before)
+	}
+	if sum := current[a] + current[b]; sum != 0 {
+		t.Errorf("the current weights sum to %v, not 0", sum)
+	}
+	inFlight := lp.backendInFlight[a].Load()
+	lp.mu.Unlock()
+	if inFlight != 1 {
+		t.Errorf("requests in flight to the kept backend got=%d want=1", inFlight)
+	}
+
+	// Leaving after the reload is accounted for too.
+	leave()
+	lp.mu.Lock()
+	inFlight = lp.backendInFlight[a].Load()
+	lp.mu.Unlock()
+	if inFlight != 0 {
+		t.Errorf("requests in flight after leaving got=%d want=0", inFlight)
+	}
+
+	// A reload that adds a backend keeps the current weights
+	// of the others once the new one is found to be live.
+	d := backend()
+	lp.reload(map[string][]string{"/": {a, b, d}}, lp.routeOptions, false)
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if got, want := len(lp.liveAddresses["/"]), 3; got != want {
+		t.Fatalf("live backends after adding one got=%d want=%d", got, want)
+	}
+	current = lp.currentWeights["/"]
+	if got := current[a] - current[b]; got != before {
+		t.Errorf("the current weights changed when adding a backend: got=%v want=%v", got, before)
+	}
+}
+
+func TestReadinessAndLiveness(t *testing.T) {
+	var livenessPings atomic.Int32
+	newBackend := func(name string, ready, alive bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// Like most readiness and liveness endpoints, these only accept GET.
+			if req.URL.Path != "/" && req.Method != "GET" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			switch req.URL.Path {
+			case "/ready":
+				if !ready {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+				}
+			case "/alive":
+				livenessPings.Add(1)
+				if !alive {
+					rw.WriteHeader(http.StatusInternalServerError)
+				}
+			default:
+				rw.Write([]byte(name))
+			}
+		}))
+	}
+	ready := newBackend("ready", true, true)
+	defer ready.Close()
+	notReady := newBackend("not ready", false, true)
+	defer notReady.Close()
+	dead := newBackend("dead", false, false)
+	defer dead.Close()
+
+	req := &Request{ReadinessPath: "/ready", LivenessPath: "/alive"}
+	backends := []string{ready.URL, notReady.URL, dead.URL}
+	lp := makeLivelyProxy(time.Minute, map[string][]string{"/": backends, "/api": backends})
+	lp.setHealthCheckOptions(req.healthCheckOptions())
+	lp.livenessPath = req.LivenessPath
+	for _, route := range []string{"/", "/api"} {
+		if _, _, err := lp.cycle(route, lp.primariesMap[route]); err != nil {
+			t.Fatalf("cycle: %v", err)
+		}
+	}
+	// The backends shared by the routes are checked once per cycle.
+	if got, want := livenessPings.Load(), int32(len(backends)); got != want {
+		t.Errorf("liveness pings got=%d want=%d", got, want)
+	}
+
+	// Only the ready backend gets traffic.
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got, want := rec.Body.String(), "ready"; got != want {
+			t.Errorf("#%d: served by %q want %q", i, got, want)
+		}
+	}
+
+	// Yet the backend that isn't ready is still tracked as alive.
+	got := lp.snapshotMetrics()
+	if got, want := got.LiveBackends["/"], 1; got != want {
+		t.Errorf("live backends got=%d want=%d", got, want)
+	}
+	wantLiveness := map[string]bool{ready.URL: true, notReady.URL: true, dead.URL: false}
+	if !reflect.DeepEqual(got.Liveness, wantLiveness) {
+		t.Errorf("liveness:\ngot:  %v\nwant: %v", got.Liveness, wantLiveness)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	var down atomic.Bool
+	handler := func(canGoDown bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			if canGoDown && down.Load() {
+				// Simulate the backend being down.
+				hj, _ := rw.(http.Hijacker)
+				conn, _, _ := hj.Hijack()
+				conn.Close()
+			}
+		}
+	}
+	steady := httptest.NewServer(handler(false))
+	defer steady.Close()
+	recovering := httptest.NewServer(handler(true))
+	defer recovering.Close()
+
+	const ramp = 100 * time.Second
+	lp := makeLivelyProxy(0, map[string][]string{"/": {steady.URL, recovering.URL}})
+	lp.routeOptions = map[string]*RouteOptions{"/": {SlowStart: ramp}}
+	fc := newFakeClock()
+	lp.clock = fc
+
+	cycle := func() {
+		if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+			t.Fatalf("cycle: %v", err)
+		}
+	}
+	shareOfRecovering := func() float64 {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if lp.roundRobinedAddress("/") == recovering.URL {
+				n += 1
+			}
+		}
+		return float64(n) / 1000
+	}
+
+	// Backends live from the start don't slow start.
+	cycle()
+	if got := shareOfRecovering(); got != 0.5 {
+		t.Fatalf("initial share got=%.3f want=0.5", got)
+	}
+
+	down.Store(true)
+	cycle()
+	if got := shareOfRecovering(); got != 0 {
+		t.Fatalf("share while down got=%.3f want=0", got)
+	}
+	down.Store(false)
+	cycle()
+
+	// A backend ramping up to fraction f of its turns gets f/(1+f).
+	prev := -1.0
+	for _, elapsed := range []time.Duration{0, 20 * time.Second, 20 * time.Second, 20 * time.Second, 20 * time.Second, 20 * time.Second} {
+		fc.Advance(elapsed)
+		got := shareOfRecovering()
+		if got <= prev && got < 0.5 {
+			t.Errorf("at %s: share got=%.3f, want more than the previous %.3f", fc.Now().Sub(time.Unix(1500000000, 0)), got, prev)
+		}
+		prev = got
+	}
+	if prev != 0.5 {
+		t.Errorf("after the ramp: share got=%.3f want=0.5", prev)
+	}
+}
+
+func TestSmoothWeightedRoundRobin(t *testing.T) {
+	const heavy, light1, light2 = "http://heavy", "http://light1", "http://light2"
+	lp := makeTestProxy(map[string][]string{"/": {heavy, light1, light2}})
+	lp.routeOptions = map[string]*RouteOptions{"/": {Weights: map[string]int{heavy: 3}}}
+
+	counts := make(map[string]int)
+	run, prev := 0, ""
+	for i := 0; i < 5*100; i++ {
+		addr := lp.roundRobinedAddress("/")
+		counts[addr] += 1
+		if addr == prev {
+			run += 1
+		} else {
+			run = 1
+		}
+		prev = addr
+		// Unlike weighting by repetition, the picks
+		// of heavy are spread among those of the others.
+		if run > 2 {
+			t.Fatalf("pick #%d: %q picked %d times in a row", i, addr, run)
+		}
+	}
+	want := map[string]int{heavy: 300, light1: 100, light2: 100}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts got=%v want=%v", counts, want)
+	}
+
+	// Without weights, it is plain round robin.
+	lp.routeOptions = nil
+	delete(lp.currentWeights, "/")
+	for i := 0; i < 9; i++ {
+		if got, want := lp.roundRobinedAddress("/"), lp.liveAddresses["/"][i%3]; got != want {
+			t.Errorf("pick #%d: got %q want %q", i, got, want)
+		}
+	}
+}
+
+func TestBackendResponseTimeout(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(100 * time.Millisecond):
+		}
+		rw.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}, "/patient": {backend.URL}})
+	lp.backendResponseTimeout = 20 * time.Millisecond
+	// The timeout of a route takes precedence.
+	lp.routeOptions = map[string]*RouteOptions{"/patient": {Timeout: 5 * time.Second}}
+
+	tests := [...]struct {
+		path     string
+		wantCode int
+	}{
+		0: {"/", http.StatusGatewayTimeout},
+		1: {"/patient", http.StatusOK},
+	}
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: %s: code got=%d want=%d", i, tt.path, got, tt.wantCode)
+		}
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("X-Frontender-Timeout"); got != "" {
+			t.Errorf("the timeout header was forwarded: %q", got)
+		}
+		select {
+		case <-release:
+		case <-time.After(100 * time.Millisecond):
+		}
+		rw.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	lp.backendResponseTimeout = 20 * time.Millisecond
+	lp.timeoutHeader = "X-Frontender-Timeout"
+	lp.maxHeaderTimeout = 5 * time.Second
+	lp.trustedProxies = []string{"192.0.2.0/24"}
+
+	tests := [...]struct {
+		header      string
+		remoteAddr  string
+		maxTimeout  time.Duration
+		wantTimeout time.Duration
+		wantCode    int
+	}{
+		// Without the header, the default applies.
+		0: {wantCode: http.StatusGatewayTimeout},
+		1: {header: "2s", wantTimeout: 2 * time.Second, wantCode: http.StatusOK},
+		2: {header: "1.5", wantTimeout: 1500 * time.Millisecond, wantCode: http.StatusOK},
+		// Overrides beyond the max are clamped to it.
+		3: {header: "1h", maxTimeout: 30 * time.Millisecond, wantTimeout: 30 * time.Millisecond, wantCode: http.StatusGatewayTimeout},
+		4: {header: "1h", wantTimeout: 5 * time.Second, wantCode: http.StatusOK},
+		// Invalid overrides are ignored.
+		5: {header: "forever", wantCode: http.StatusGatewayTimeout},
+		6: {header: "-1s", wantCode: http.StatusGatewayTimeout},
+		// Clients can't override it past the trusted proxies.
+		7: {header: "2s", remoteAddr: "203.0.113.1:1234", wantCode: http.StatusGatewayTimeout},
+	}
+	for i, tt := range tests {
+		lp.maxHeaderTimeout = 5 * time.Second
+		if tt.maxTimeout > 0 {
+			lp.maxHeaderTimeout = tt.maxTimeout
+		}
+		newRequest := func() *http.Request {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Frontender-Timeout", tt.header)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			return req
+		}
+
+		timeout, ok := lp.takeHeaderTimeout(newRequest())
+		if ok != (tt.wantTimeout > 0) || timeout != tt.wantTimeout {
+			t.Errorf("#%d: timeout got=(%v, %t) want=%v", i, timeout, ok, tt.wantTimeout)
+		}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, newRequest())
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: code got=%d want=%d", i, got, tt.wantCode)
+		}
+	}
+
+	// Nor is it mirrored.
+	mirroredc := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mirroredc <- req.Header.Get("X-Frontender-Timeout")
+	}))
+	defer shadow.Close()
+	lp.routeOptions = map[string]*RouteOptions{"/": {Mirror: &MirrorOptions{Backends: []string{shadow.URL}, Percent: 100}}}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Frontender-Timeout", "2s")
+	lp.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case got := <-mirroredc:
+		if got != "" {
+			t.Errorf("the timeout header was mirrored: %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the shadow didn't get the request")
+	}
+
+	if err := (&Request{ProxyAddresses: []string{"http://localhost:8080"}, HTTP1: true, TimeoutHeader: "X-Timeout"}).Validate(); err == nil {
+		t.Error("expected an error for a timeout header without a max")
+	}
+	if err := (&Request{ProxyAddresses: []string{"http://localhost:8080"}, HTTP1: true, TimeoutHeader: "X-Timeout", MaxHeaderTimeout: time.Minute}).Validate(); err == nil {
+		t.Error("expected an error for a timeout header without trusted proxies")
+	}
+}
+
+func TestBackendDialTimeout(t *testing.T) {
+	if rt := backendTransport("", 0, 0); rt != http.DefaultTransport {
+		t.Errorf("without options got %T, want http.DefaultTransport", rt)
+	}
+	rt, ok := backendTransport("", 0, time.Second).(*http.Transport)
+	if !ok || rt == http.DefaultTransport || rt.DialContext == nil {
+		t.Fatalf("with a dial timeout got %T, want a transport of its own", rt)
+	}
+
+	// The gRPC transports are dialed with the timeout too.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	glp := makeTestProxy(map[string][]string{"/": {"http://" + ln.Addr().String()}})
+	for _, dialTimeout := range []time.Duration{0, time.Nanosecond} {
+		glp.backendDialTimeout = dialTimeout
+		glp.grpcTransports = nil
+		gt := glp.grpcTransportFor("http://" + ln.Addr().String()).(*http2.Transport)
+		conn, err := gt.DialTLSContext(context.Background(), "tcp", ln.Addr().String(), nil)
+		if dialTimeout == 0 {
+			if err != nil {
+				t.Errorf("gRPC dial without a timeout: %v", err)
+			} else {
+				conn.Close()
+			}
+			continue
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("gRPC dial with a timeout of %s: got err=%v, want a timeout", dialTimeout, err)
+		}
+	}
+
+	// Dials that time out are answered with 504 too.
+	var logged []string
+	lp := &livelyProxy{logfFn: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+	rec := httptest.NewRecorder()
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	lp.proxyErrorHandler(rec, httptest.NewRequest("GET", "/", nil), fmt.Errorf("proxying: %w", dialErr))
+	if got, want := rec.Code, http.StatusGatewayTimeout; got != want {
+		t.Errorf("dial timeout: code got=%d want=%d", got, want)
+	}
+	rec = httptest.NewRecorder()
+	lp.proxyErrorHandler(rec, httptest.NewRequest("GET", "/", nil), &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrNotExist})
+	if got, want := rec.Code, http.StatusBadGateway; got != want {
+		t.Errorf("dial failure: code got=%d want=%d", got, want)
+	}
+	// The errors are logged with Request.Logf.
+	if got, want := len(logged), 2; got != want || !strings.HasPrefix(logged[0], "frontender: proxy error: ") {
+		t.Errorf("logged got=%q want %d proxy errors", logged, want)
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	var addrs []string
+	names := make(map[string]string)
+	for _, name := range []string{"eu", "us", "asia"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		}))
+		defer backend.Close()
+		addrs = append(addrs, backend.URL)
+		names[name] = backend.URL
+	}
+
+	lp := makeTestProxy(map[string][]string{"/": addrs})
+	var mu sync.Mutex
+	var gotLive []string
+	lp.selectBackend = func(route string, liveAddrs []string, r *http.Request) string {
+		mu.Lock()
+		gotLive = liveAddrs
+		mu.Unlock()
+		switch region := r.Header.Get("X-Region"); region {
+		case "":
+			return ""
+		case "mars":
+			return "http://mars.example.com"
+		default:
+			return names[region]
+		}
+	}
+
+	for _, region := range []string{"eu", "asia", "us", "asia", "asia"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Region", region)
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != region {
+			t.Errorf("region %q: served by %q", region, got)
+		}
+	}
+	wantLive := append([]string(nil), addrs...)
+	sort.Strings(wantLive)
+	if !reflect.DeepEqual(gotLive, wantLive) {
+		t.Errorf("live addresses got=%v want=%v", gotLive, wantLive)
+	}
+
+	// Without a valid pick, the built-in strategy picks.
+	for _, region := range []string{"", "mars"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Region", region)
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || names[rec.Body.String()] == "" {
+			t.Errorf("region %q: got %d %q, want a backend", region, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestStageRouterWeights(t *testing.T) {
+	const old, blue, green = "http://127.0.0.1:1", "http://127.0.0.2:1", "http://127.0.0.3:1"
+	lp := makeTestProxy(map[string][]string{"/": {old}})
+	lp.routeOptions = map[string]*RouteOptions{
+		"/": {Backends: []string{old}, Timeout: 5 * time.Second, Weights: map[string]int{old: 3}},
+	}
+	lc := &ListenConfirmation{lproxy: lp, done: make(chan struct{})}
+	defer close(lc.done)
+
+	if err := lc.StageRouter(map[string][]string{"/": {blue + "|weight=lots"}}); err == nil {
+		t.Fatal("expected an error for a malformed weight")
+	}
+	if err := lc.StageRouter(map[string][]string{"/": {blue + "|weight=4", green}}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	lc.mu.Lock()
+	staged := lc.staged
+	lc.staged = nil
+	lc.mu.Unlock()
+	lp.swapIn(staged)
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	// The other options are carried over, but the weights
+	// are those of the staged backends.
+	want := &RouteOptions{Timeout: 5 * time.Second, Weights: map[string]int{blue: 4}}
+	if got := lp.routeOptions["/"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("route options got=%+v want=%+v", got, want)
+	}
+}
+
+// blockingResolver resolves pr once released.
+type blockingResolver struct {
+	resolving chan struct{}
+	release   chan struct{}
+	pr        map[string][]string
+}
+
+func (br *blockingResolver) Resolve() (map[string][]string, error) {
+	br.resolving <- struct{}{}
+	<-br.release
+	return br.pr, nil
+}
+
+func TestRefreshDoesNotRevertReload(t *testing.T) {
+	const stale, reloaded = "http://127.0.0.1:1", "http://127.0.0.2:1"
+	lp := makeTestProxy(map[string][]string{"/": {stale}})
+	lc := &ListenConfirmation{lproxy: lp, done: make(chan struct{})}
+	defer close(lc.done)
+	br := &blockingResolver{
+		resolving: make(chan struct{}),
+		release:   make(chan struct{}),
+		pr:        map[string][]string{"/": {stale}},
+	}
+	lc.base = &Request{HTTP1: true, BackendResolver: br}
+
+	errsChan := make(chan error)
+	go func() { errsChan <- lc.refreshOnce() }()
+	<-br.resolving
+
+	// The operator reloads while the refresh is resolving.
+	if err := lc.Reload(&Request{HTTP1: true, PrefixRouter: map[string][]string{"/": {reloaded}}}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	close(br.release)
+	if err := <-errsChan; err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	var got []string
+	for _, secondary := range lp.secondariesMap["/"] {
+		got = append(got, secondary.Addr)
+	}
+	if want := []string{reloaded}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends got=%q want=%q", got, want)
+	}
+}
+
+func TestReloadValidatesTheRoutingOnly(t *testing.T) {
+	lp := makeTestProxy(map[string][]string{"/": {"http://127.0.0.1:1"}})
+	lc := &ListenConfirmation{lproxy: lp, done: make(chan struct{})}
+	defer close(lc.done)
+
+	// The domains of a frontend that isn't HTTP1 aren't reloaded.
+	if err := lc.Reload(&Request{PrefixRouter: map[string][]string{"/": {"http://127.0.0.2:1"}}}); err != nil {
+		t.Errorf("reload: %v", err)
+	}
+	if err := lc.Reload(&Request{PrefixRouter: map[string][]string{"api": {"http://127.0.0.2:1"}}}); err == nil {
+		t.Error("expected an error for a route prefix without a leading /")
+	}
+}
+
+func TestSwapInForgetsRouteState(t *testing.T) {
+	const a, b, c = "http://127.0.0.1:1", "http://127.0.0.2:1", "http://127.0.0.3:1"
+	lp := makeTestProxy(map[string][]string{"/same": {a}, "/changed": {a, b}, "/gone": {c}})
+	lp.mu.Lock()
+	lp.canaries = make(map[string]*canaryState)
+	lp.affinityRings = make(map[string]*hashRing)
+	lp.slowStarts = make(map[string]map[string]*slowStart)
+	lp.healthStates = make(map[string]map[string]bool)
+	for route, addrs := range map[string][]string{"/same": {a}, "/changed": {a, b}, "/gone": {c}} {
+		lp.canaries[route] = &canaryState{rolledBack: true}
+		lp.affinityRings[route] = newHashRing(addrs, 0)
+		lp.slowStarts[route] = make(map[string]*slowStart)
+		lp.healthStates[route] = make(map[string]bool)
+		for _, addr := range addrs {
+			lp.slowStarts[route][addr] = new(slowStart)
+			lp.healthStates[route][addr] = true
+		}
+	}
+	lp.mu.Unlock()
+
+	lp.swapIn(makeTestProxy(map[string][]string{"/same": {a}, "/changed": {a, c}}))
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if lp.canaries["/same"] == nil || lp.affinityRings["/same"] == nil {
+		t.Error("the state of the unchanged route was forgotten")
+	}
+	for _, route := range []string{"/changed", "/gone"} {
+		if lp.canaries[route] != nil {
+			t.Errorf("%s: the canary verdict from before the promotion is kept", route)
+		}
+		if lp.affinityRings[route] != nil {
+			t.Errorf("%s: the affinity ring from before the promotion is kept", route)
+		}
+	}
+	if _, ok := lp.healthStates["/gone"]; ok {
+		t.Error("the health states of the removed route are kept")
+	}
+	// The backend that remains carries on.
+	if got, want := lp.healthStates["/changed"], map[string]bool{a: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("health states got=%v want=%v", got, want)
+	}
+	if _, ok := lp.slowStarts["/changed"][b]; ok {
+		t.Error("the ramp up of the removed backend is kept")
+	}
+	if _, ok := lp.slowStarts["/changed"][a]; !ok {
+		t.Error("the ramp up of the remaining backend was forgotten")
+	}
+}
+
+func TestReloadForgetsRemovedRoutes(t *testing.T) {
+	const addr = "http://127.0.0.1:1"
+	lp := makeTestProxy(map[string][]string{"/": {addr}, "/gone": {addr}})
+	lp.mu.Lock()
+	lp.healthStates = map[string]map[string]bool{"/": {addr: true}, "/gone": {addr: false}}
+	lp.mirrors = map[string]*mirrorState{"/": new(mirrorState), "/gone": new(mirrorState)}
+	lp.mu.Unlock()
+
+	lp.reload(map[string][]string{"/": {addr}}, nil, false)
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	// Were the route added back, it would start afresh.
+	if _, ok := lp.healthStates["/gone"]; ok {
+		t.Error("the health states of the removed route are kept")
+	}
+	if _, ok := lp.mirrors["/gone"]; ok {
+		t.Error("the mirror of the removed route is kept")
+	}
+	if lp.healthStates["/"] == nil || lp.mirrors["/"] == nil {
+		t.Error("the state of the remaining route was forgotten")
+	}
+}
+
+func TestWaitRoutesDrainedSharesTheDeadline(t *testing.T) {
+	const addr = "http://127.0.0.1:1"
+	lp := makeTestProxy(map[string][]string{"/a": {addr}, "/b": {addr}, "/c": {addr}})
+	fc := newFakeClock()
+	lp.clock = fc
+	lp.mu.Lock()
+	for _, route := range []string{"/a", "/b", "/c"} {
+		lp.enterRouteLocked(route)
+	}
+	lp.mu.Unlock()
+
+	undrainedChan := make(chan []string)
+	go func() { undrainedChan <- lp.waitRoutesDrained([]string{"/a", "/b", "/c"}, time.Minute) }()
+	<-fc.sleepers
+	lp.leaveRoute("/b")
+
+	// A single timeout elapsing is enough for all the routes.
+	fc.Advance(time.Minute)
+	select {
+	case undrained := <-undrainedChan:
+		if want := []string{"/a", "/c"}; !reflect.DeepEqual(undrained, want) {
+			t.Errorf("undrained got=%q want=%q", undrained, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting past the shared deadline")
+	}
+	if n := len(fc.sleepers); n != 0 {
+		t.Errorf("waited on %d more timeouts", n)
+	}
+}
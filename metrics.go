@@ -0,0 +1,137 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// requestCounts tallies the requests served by the frontend.
+type requestCounts struct {
+	mu       sync.Mutex
+	total    uint64
+	notFound uint64
+	byRoute  map[string]uint64
+}
+
+func (rc *requestCounts) add(route string, matched bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.total += 1
+	if !matched {
+		rc.notFound += 1
+		return
+	}
+	if rc.byRoute == nil {
+		rc.byRoute = make(map[string]uint64)
+	}
+	rc.byRoute[route] += 1
+}
+
+type requestsMetrics struct {
+	Total    uint64            `json:"total"`
+	NotFound uint64            `json:"not_found"`
+	ByRoute  map[string]uint64 `json:"by_route"`
+}
+
+type memMetrics struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+type metrics struct {
+	Requests     *requestsMetrics `json:"requests"`
+	LiveBackends map[string]int   `json:"live_backends"`
+	Goroutines   int              `json:"goroutines"`
+	MemStats     *memMetrics      `json:"memstats"`
+
+	// Liveness maps backend addresses to whether they pass
+	// the liveness check, when a LivenessPath is set.
+	Liveness map[string]bool `json:"liveness,omitempty"`
+}
+
+func (lp *livelyProxy) snapshotMetrics() *metrics {
+	lp.requestCounts.mu.Lock()
+	requests := &requestsMetrics{
+		Total:    lp.requestCounts.total,
+		NotFound: lp.requestCounts.notFound,
+		ByRoute:  make(map[string]uint64, len(lp.requestCounts.byRoute)),
+	}
+	for route, n := range lp.requestCounts.byRoute {
+		requests.ByRoute[route] = n
+	}
+	lp.requestCounts.mu.Unlock()
+
+	lp.mu.Lock()
+	liveBackends := make(map[string]int, len(lp.primariesMap))
+	for route := range lp.primariesMap {
+		distinct := make(map[string]bool)
+		for _, addr := range lp.liveAddresses[route] {
+			distinct[addr] = true
+		}
+		liveBackends[route] = len(distinct)
+	}
+	var liveness map[string]bool
+	if lp.livenessPath != "" {
+		liveness = make(map[string]bool)
+		for _, peersMap := range lp.secondariesMap {
+			for _, secondary := range peersMap {
+				if alive, ok := lp.liveness[secondary.Addr]; ok {
+					liveness[secondary.Addr] = alive
+				}
+			}
+		}
+	}
+	lp.mu.Unlock()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return &metrics{
+		Requests:     requests,
+		LiveBackends: liveBackends,
+		Liveness:     liveness,
+		Goroutines:   runtime.NumGoroutine(),
+		MemStats: &memMetrics{
+			Alloc:        ms.Alloc,
+			TotalAlloc:   ms.TotalAlloc,
+			Sys:          ms.Sys,
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapObjects:  ms.HeapObjects,
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+		},
+	}
+}
+
+func (lp *livelyProxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	blob, err := json.MarshalIndent(lp.snapshotMetrics(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// MirrorOptions copies a share of the traffic of a route to a pool
+// of shadow backends, for instance to try a new version of a backend
+// with production traffic. The copies are sent asynchronously and
+// the responses of the shadows are discarded: clients only ever get
+// those of the usual backends.
+//
+// Shadow backends aren't health checked. Requests whose bodies are
+// too large to be buffered, as well as upgrades, aren't mirrored.
+type MirrorOptions struct {
+	Backends []string `json:"backends"`
+
+	// Percent is the share, from 0 to 100, of
+	// the requests of the route that are mirrored.
+	Percent int `json:"percent"`
+}
+
+// maxMirroredInFlight bounds the mirrored requests in flight, beyond
+// which requests aren't mirrored, so that slow shadows don't pile up.
+const maxMirroredInFlight = 256
+
+// defaultMirrorTimeout bounds the mirrored requests
+// of the routes without any Timeout.
+const defaultMirrorTimeout = 30 * time.Second
+
+func (mo *MirrorOptions) validate() error {
+	if mo.Percent < 0 || mo.Percent > 100 {
+		return fmt.Errorf("mirror percent must be between 0 and 100, got: %d", mo.Percent)
+	}
+	if mo.Percent > 0 && len(normalizeAddresses(mo.Backends)) == 0 {
+		return fmt.Errorf("mirror of %d%% has no backends", mo.Percent)
+	}
+	return nil
+}
+
+func (req *Request) validateMirrors() error {
+	for route, opts := range req.Routes {
+		if opts == nil || opts.Mirror == nil {
+			continue
+		}
+		if err := opts.Mirror.validate(); err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+	}
+	return nil
+}
+
+// mirrorState tracks the requests of a route, to deterministically
+// pick which are mirrored, and the shadow backend to mirror them to.
+type mirrorState struct {
+	sent uint64
+	next int
+}
+
+// mirrorAddress returns the shadow backend that a copy of the
+// request should be sent to, or "" if it shouldn't be mirrored.
+func (lp *livelyProxy) mirrorAddress(route string, mo *MirrorOptions) string {
+	if mo == nil || mo.Percent <= 0 {
+		return ""
+	}
+	backends := normalizeAddresses(mo.Backends)
+	if len(backends) == 0 {
+		return ""
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.mirrors == nil {
+		lp.mirrors = make(map[string]*mirrorState)
+	}
+	ms := lp.mirrors[route]
+	if ms == nil {
+		ms = new(mirrorState)
+		lp.mirrors[route] = ms
+	}
+	// Spread the mirrored requests evenly rather
+	// than mirroring the first Percent of each 100.
+	n, pct := ms.sent%100, uint64(mo.Percent)
+	ms.sent += 1
+	if (n+1)*pct/100 == n*pct/100 {
+		return ""
+	}
+	addr := backends[ms.next%len(backends)]
+	ms.next += 1
+	return addr
+}
+
+// mirror sends, in the background, a copy of r as it is about to
+// be forwarded, to a shadow backend of route if it is picked to be
+// mirrored. The body of r is buffered for it to be read twice.
+func (lp *livelyProxy) mirror(route string, opts *RouteOptions, r *http.Request, host string) {
+	addr := lp.mirrorAddress(route, opts.Mirror)
+	if addr == "" {
+		return
+	}
+	target, err := url.Parse(addr)
+	if err != nil || target.Host == "" {
+		return
+	}
+	if replayable, err := bufferBody(r); err != nil || !replayable {
+		return
+	}
+	if lp.mirroredInFlight.Add(1) > maxMirroredInFlight {
+		lp.mirroredInFlight.Add(-1)
+		return
+	}
+
+	timeout := defaultMirrorTimeout
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	} else if lp.backendResponseTimeout > 0 {
+		timeout = lp.backendResponseTimeout
+	}
+	// The copy mustn't be canceled along with r once it is served.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shadow := r.Clone(ctx)
+	shadow.RequestURI = ""
+	shadow.Host = host
+	shadow.URL.Scheme = target.Scheme
+	shadow.URL.Host = target.Host
+	shadow.URL.Path = singleJoiningSlash(target.Path, r.URL.Path)
+	shadow.Body = http.NoBody
+	if r.GetBody != nil {
+		shadow.Body, _ = r.GetBody()
+	}
+	for _, hdr := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		shadow.Header.Del(hdr)
+	}
+
+	go func() {
+		defer lp.mirroredInFlight.Add(-1)
+		defer cancel()
+
+		res, err := lp.transportFor(addr).RoundTrip(shadow)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		rw.Write([]byte("primary got " + string(body)))
+	}))
+	defer primary.Close()
+
+	type mirrored struct {
+		method, path, host, body string
+	}
+	mirroredc := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mirroredc <- mirrored{req.Method, req.URL.Path, req.Host, string(body)}
+		// Neither its failures nor its slowness reach the clients.
+		time.Sleep(50 * time.Millisecond)
+		http.Error(rw, "shadow failed", http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	lp := makeTestProxy(map[string][]string{"/api": {primary.URL}})
+	lp.routeOptions = map[string]*RouteOptions{
+		"/api": {Mirror: &MirrorOptions{Backends: []string{shadow.URL}, Percent: 50}},
+	}
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("POST", "/api/items", strings.NewReader("hello"))
+		req.Host = "example.org"
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := rec.Body.String(), "primary got hello"; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+	}
+
+	// Half of the requests are mirrored, as they were forwarded.
+	want := mirrored{"POST", "/items", "example.org", "hello"}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-mirroredc:
+			if got != want {
+				t.Errorf("mirrored #%d: got=%+v want=%+v", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mirrored #%d: the shadow didn't get the request", i)
+		}
+	}
+	select {
+	case got := <-mirroredc:
+		t.Errorf("unexpectedly mirrored a third request: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := (&MirrorOptions{Percent: 10}).validate(); err == nil {
+		t.Error("expected an error for a mirror without backends")
+	}
+}
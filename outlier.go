@@ -0,0 +1,197 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// OutlierDetection ejects the backends whose responses fail too often
+// from the rotation of their routes, regardless of the health checks,
+// like the outlier detection of Envoy. Ejected backends are re-admitted
+// after EjectionTime. Backends aren't ejected while all the others of a
+// route are too, lest the route be left without any. The clients pinned
+// to an ejected backend by SessionAffinity or ShardHeader go to another
+// one meanwhile, and SelectBackend isn't offered it.
+type OutlierDetection struct {
+	// MaxErrorRate is the fraction, from 0 to 1, of the requests to a
+	// backend within the rolling Window that may fail with a 5XX status
+	// or fail to reach the backend, before the backend is ejected.
+	MaxErrorRate float64 `json:"max_error_rate"`
+
+	// Window is the rolling period over which the error rates
+	// are measured. It defaults to 30 seconds, and if set must
+	// be at least 10 nanoseconds.
+	Window time.Duration `json:"window"`
+
+	// MinRequests is the number of requests to a backend needed
+	// in a window before its error rate is considered. It
+	// defaults to 10.
+	MinRequests int `json:"min_requests"`
+
+	// EjectionTime is how long ejected backends are kept
+	// out of rotation. It defaults to 30 seconds.
+	EjectionTime time.Duration `json:"ejection_time"`
+}
+
+const (
+	defaultOutlierWindow       = 30 * time.Second
+	defaultOutlierMinRequests  = 10
+	defaultOutlierEjectionTime = 30 * time.Second
+)
+
+func (od *OutlierDetection) validate() error {
+	if od == nil {
+		return nil
+	}
+	if od.MaxErrorRate < 0 || od.MaxErrorRate > 1 {
+		return fmt.Errorf("outlier detection max error rate must be between 0 and 1, got: %v", od.MaxErrorRate)
+	}
+	if od.Window < 0 || od.EjectionTime < 0 || od.MinRequests < 0 {
+		return errors.New("outlier detection window, ejection time and min requests can't be negative")
+	}
+	if od.Window > 0 && od.Window < outlierBuckets {
+		// The window is divided into buckets of at least a nanosecond.
+		return fmt.Errorf("outlier detection window must be at least %s, got: %s", time.Duration(outlierBuckets), od.Window)
+	}
+	return nil
+}
+
+func (od *OutlierDetection) window() time.Duration {
+	if od.Window > 0 {
+		return od.Window
+	}
+	return defaultOutlierWindow
+}
+
+func (od *OutlierDetection) minRequests() int {
+	if od.MinRequests > 0 {
+		return od.MinRequests
+	}
+	return defaultOutlierMinRequests
+}
+
+func (od *OutlierDetection) ejectionTime() time.Duration {
+	if od.EjectionTime > 0 {
+		return od.EjectionTime
+	}
+	return defaultOutlierEjectionTime
+}
+
+// outlierBuckets is the number of buckets that the rolling window is
+// divided into: the oldest bucket is let go of as the window rolls.
+const outlierBuckets = 10
+
+type outlierBucket struct {
+	start            time.Time
+	requests, errors int
+}
+
+// outlierState tracks the outcomes of the
+// recent requests to a backend, by bucket.
+type outlierState struct {
+	buckets      [outlierBuckets]outlierBucket
+	ejectedUntil time.Time
+}
+
+// recordOutcome counts the outcome of a request to the backend at
+// addr and ejects it if its error rate within the window is too high.
+func (lp *livelyProxy) recordOutcome(addr string, failed bool) {
+	od := lp.outlierDetection
+	if od == nil {
+		return
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.outliers == nil {
+		lp.outliers = make(map[string]*outlierState)
+	}
+	state := lp.outliers[addr]
+	if state == nil {
+		state = new(outlierState)
+		lp.outliers[addr] = state
+	}
+	now := lp.clock.Now()
+	if now.Before(state.ejectedUntil) {
+		// Requests that were in flight as it got ejected.
+		return
+	}
+
+	width := od.window() / outlierBuckets
+	start := now.Truncate(width)
+	bucket := &state.buckets[(start.UnixNano()/int64(width))%outlierBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = outlierBucket{start: start}
+	}
+	bucket.requests += 1
+	if failed {
+		bucket.errors += 1
+	}
+
+	var requests, errs int
+	for _, b := range state.buckets {
+		if now.Sub(b.start) < od.window() {
+			requests += b.requests
+			errs += b.errors
+		}
+	}
+	if requests < od.minRequests() {
+		return
+	}
+	if rate := float64(errs) / float64(requests); rate > od.MaxErrorRate {
+		// Re-admitted backends start over with a clean slate.
+		*state = outlierState{ejectedUntil: now.Add(od.ejectionTime())}
+		lp.logf("frontender: ejected backend %q for %s: error rate %.2f exceeds %.2f", addr, od.ejectionTime(), rate, od.MaxErrorRate)
+	}
+}
+
+// isEjectedLocked reports whether the backend at addr
+// is out of rotation. lp.mu must be held.
+func (lp *livelyProxy) isEjectedLocked(addr string, now time.Time) bool {
+	state := lp.outliers[addr]
+	return state != nil && now.Before(state.ejectedUntil)
+}
+
+// admittedLocked returns those of addrs that aren't
+// ejected at now, or all of them if they all are.
+func (lp *livelyProxy) admittedLocked(addrs []string, now time.Time) []string {
+	admitted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !lp.isEjectedLocked(addr, now) {
+			admitted = append(admitted, addr)
+		}
+	}
+	if len(admitted) == 0 {
+		return addrs
+	}
+	return admitted
+}
+
+// roundTripCounted sends req to the backend at addr, counting
+// the outcome for the outlier detection. Requests that the client
+// gave up on, rather than the backend failing, aren't counted.
+func (lp *livelyProxy) roundTripCounted(addr string, req *http.Request) (*http.Response, error) {
+	res, err := lp.transportFor(addr).RoundTrip(req)
+	if err == nil || !errors.Is(req.Context().Err(), context.Canceled) {
+		lp.recordOutcome(addr, err != nil || res.StatusCode >= 500)
+	}
+	return res, err
+}
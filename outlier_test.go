@@ -0,0 +1,196 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "failed", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer good.Close()
+
+	clock := newFakeClock()
+	lp := makeTestProxy(map[string][]string{"/": {bad.URL, good.URL}})
+	lp.clock = clock
+	lp.logfFn = func(string, ...interface{}) {}
+	lp.outlierDetection = &OutlierDetection{
+		MaxErrorRate: 0.5,
+		Window:       10 * time.Second,
+		MinRequests:  4,
+		EjectionTime: time.Minute,
+	}
+
+	serve := func(n int) (failures int) {
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code >= 500 {
+				failures += 1
+			}
+		}
+		return failures
+	}
+
+	// Round robined, the bad backend gets its 4 requests and is ejected.
+	if got, want := serve(8), 4; got != want {
+		t.Fatalf("failures before the ejection got=%d want=%d", got, want)
+	}
+	if got := serve(10); got != 0 {
+		t.Errorf("got %d failures while the bad backend was ejected", got)
+	}
+
+	// Once the ejection time is over, it is re-admitted.
+	clock.Advance(time.Minute + time.Second)
+	if got, want := serve(4), 2; got != want {
+		t.Errorf("failures after the re-admission got=%d want=%d", got, want)
+	}
+
+	// Errors that fell out of the rolling window don't count: with
+	// only 2 requests within it, the bad backend isn't ejected again.
+	clock.Advance(11 * time.Second)
+	if got, want := serve(6), 3; got != want {
+		t.Errorf("failures after the window rolled got=%d want=%d", got, want)
+	}
+}
+
+func TestValidateOutlierDetection(t *testing.T) {
+	tests := [...]struct {
+		od      *OutlierDetection
+		wantErr bool
+	}{
+		0: {od: nil},
+		1: {od: &OutlierDetection{MaxErrorRate: 0.5}},
+		2: {od: &OutlierDetection{MaxErrorRate: 1.5}, wantErr: true},
+		3: {od: &OutlierDetection{Window: -time.Second}, wantErr: true},
+		// Windows too short to be divided into buckets, as
+		// JSON durations of a few nanoseconds would be.
+		4: {od: &OutlierDetection{Window: 5}, wantErr: true},
+		5: {od: &OutlierDetection{Window: outlierBuckets - 1}, wantErr: true},
+		6: {od: &OutlierDetection{Window: outlierBuckets}},
+	}
+	for i, tt := range tests {
+		err := tt.od.validate()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("#%d: err=%v wantErr=%t", i, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOutlierDetectionShortestWindow(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "failed", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {bad.URL}})
+	lp.logfFn = func(string, ...interface{}) {}
+	lp.outlierDetection = &OutlierDetection{Window: outlierBuckets}
+	// Recording outcomes into buckets of a nanosecond mustn't panic.
+	for i := 0; i < 3; i++ {
+		lp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+}
+
+func TestOutlierDetectionSparesTheLastBackends(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "failed", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {bad.URL}})
+	lp.logfFn = func(string, ...interface{}) {}
+	lp.outlierDetection = &OutlierDetection{MaxErrorRate: 0.1, MinRequests: 2}
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		// Still proxied, rather than the route running out of backends.
+		if got, want := rec.Code, http.StatusInternalServerError; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+	}
+}
+
+func TestOutlierDetectionPinnedClients(t *testing.T) {
+	backends := []string{"http://10.0.0.1", "http://10.0.0.2", "http://10.0.0.3"}
+	lp := makeTestProxy(map[string][]string{"/": backends})
+	lp.clock = newFakeClock()
+	lp.sessionAffinity = CookieAffinity
+	lp.sessionAffinityCookie = "sticky"
+	opts := &RouteOptions{ShardHeader: "X-Shard"}
+
+	pick := func(cookie, shard string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "sticky", Value: cookie})
+		}
+		if shard != "" {
+			r.Header.Set("X-Shard", shard)
+		}
+		return lp.pickAddress("/", opts, httptest.NewRecorder(), r)
+	}
+
+	// Find a client pinned to each backend.
+	pinned := make(map[string]string)
+	for i := 0; len(pinned) < len(backends) && i < 1000; i++ {
+		cookie := fmt.Sprintf("client-%d", i)
+		pinned[pick(cookie, "")] = cookie
+	}
+	if len(pinned) != len(backends) {
+		t.Fatalf("couldn't pin clients to every backend: %v", pinned)
+	}
+
+	ejected := backends[1]
+	lp.mu.Lock()
+	lp.outliers = map[string]*outlierState{ejected: {ejectedUntil: lp.clock.Now().Add(time.Minute)}}
+	lp.mu.Unlock()
+
+	for addr, cookie := range pinned {
+		got := pick(cookie, "")
+		if addr == ejected {
+			if got == ejected {
+				t.Errorf("client %q still pinned to the ejected backend", cookie)
+			}
+		} else if got != addr {
+			t.Errorf("client %q moved from %q to %q", cookie, addr, got)
+		}
+	}
+	for shard, want := range []string{backends[0], backends[2], backends[2]} {
+		if got := pick("", strconv.Itoa(shard)); got != want {
+			t.Errorf("shard %d: got=%q want=%q", shard, got, want)
+		}
+	}
+
+	lp.selectBackend = func(route string, liveAddrs []string, r *http.Request) string {
+		for _, addr := range liveAddrs {
+			if addr == ejected {
+				t.Errorf("SelectBackend was offered the ejected backend")
+			}
+		}
+		return ejected
+	}
+	if got := pick("", ""); got == ejected {
+		t.Errorf("SelectBackend picked the ejected backend")
+	}
+}
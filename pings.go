@@ -0,0 +1,193 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+)
+
+// pingResult is the outcome of pinging a backend address,
+// shared by all the routes that the address belongs to.
+type pingResult struct {
+	at         time.Time
+	live       bool
+	liveliness *lively.Liveliness
+
+	// done is closed once the ping completes.
+	done    chan struct{}
+	pending bool
+}
+
+var errNoPingResult = errors.New("no ping result for the backend")
+
+// pingPeers checks the liveliness of peers on behalf of primary. Each
+// unique backend address is only pinged once per cycle: addresses
+// whose ping is in flight for another route, or that were pinged by
+// another route less than half a cycle ago, reuse that result. The
+// backends of gRPC routes are pinged over HTTP/2, like they are
+// proxied to, hence separately from those of the other routes.
+func (lp *livelyProxy) pingPeers(primary *lively.Peer, peers []*lively.Peer, grpc bool) (livePeers, nonLivePeers []*lively.Liveliness, err error) {
+	pinger := &lively.Peer{
+		ID:              primary.ID,
+		Primary:         true,
+		UserAgent:       primary.UserAgent,
+		StrictJSON:      primary.StrictJSON,
+		PingBody:        primary.PingBody,
+		PingContentType: primary.PingContentType,
+		PingPath:        primary.PingPath,
+		PingMethod:      primary.PingMethod,
+		RequireOK:       primary.RequireOK,
+	}
+	return lp.pingOnce(pinger, peers, grpc, false)
+}
+
+// pingKey is the key of the ping results of addr, whose
+// gRPC and liveness pings are kept apart from the others.
+func pingKey(addr string, grpc, liveness bool) string {
+	if grpc {
+		addr = "grpc+" + addr
+	}
+	if liveness {
+		addr = "liveness+" + addr
+	}
+	return addr
+}
+
+// pingOnce pings with pinger those of peers that weren't pinged
+// less than half a cycle ago nor are being pinged already, with
+// the same kind of ping, and returns the results of all of them.
+func (lp *livelyProxy) pingOnce(pinger *lively.Peer, peers []*lively.Peer, grpc, liveness bool) (livePeers, nonLivePeers []*lively.Liveliness, err error) {
+	lp.mu.Lock()
+	now := lp.clock.Now()
+	freshness := lp.cycleFreq / 2
+	if lp.pings == nil {
+		lp.pings = make(map[string]*pingResult)
+	}
+	results := make(map[string]*pingResult, len(peers))
+	claimed := make(map[string]*lively.Peer)
+	for _, peer := range peers {
+		if _, ok := results[peer.Addr]; ok {
+			continue
+		}
+		key := pingKey(peer.Addr, grpc, liveness)
+		res := lp.pings[key]
+		if res == nil || (!res.pending && now.Sub(res.at) >= freshness) {
+			res = &pingResult{done: make(chan struct{}), pending: true}
+			lp.pings[key] = res
+			claimed[peer.Addr] = peer
+		}
+		results[peer.Addr] = res
+	}
+	lp.mu.Unlock()
+
+	if len(claimed) > 0 {
+		for _, peer := range claimed {
+			_ = pinger.AddPeer(peer)
+		}
+		pinger.SetHTTPRoundTripper(lp.backendsTransportFor(claimed, grpc))
+		live, nonLive, lerr := pinger.Liveliness(&lively.LivelyRequest{Limiter: lp.pingLimiter})
+		if lerr != nil {
+			err = lerr
+		}
+		byAddr := make(map[string]*lively.Liveliness, len(claimed))
+		liveAddrs := make(map[string]bool, len(live))
+		for _, l := range live {
+			byAddr[l.Addr] = l
+			liveAddrs[l.Addr] = true
+		}
+		for _, l := range nonLive {
+			byAddr[l.Addr] = l
+		}
+
+		lp.mu.Lock()
+		at := lp.clock.Now()
+		for addr := range claimed {
+			res := results[addr]
+			res.at = at
+			res.live = liveAddrs[addr]
+			res.liveliness = byAddr[addr]
+			if res.liveliness == nil {
+				res.liveliness = &lively.Liveliness{Addr: addr, Err: errNoPingResult}
+			}
+			res.pending = false
+			close(res.done)
+		}
+		lp.mu.Unlock()
+	}
+
+	for _, peer := range peers {
+		res := results[peer.Addr]
+		<-res.done
+
+		l := *res.liveliness
+		l.PeerID = peer.ID
+		if res.live {
+			livePeers = append(livePeers, &l)
+		} else {
+			nonLivePeers = append(nonLivePeers, &l)
+		}
+	}
+	return livePeers, nonLivePeers, err
+}
+
+// backendsTransportFor returns the transport that routes the pings
+// of peers through their backends' transports, the gRPC ones if grpc.
+func (lp *livelyProxy) backendsTransportFor(peers map[string]*lively.Peer, grpc bool) *backendsTransport {
+	bt := &backendsTransport{lp: lp, byOrigin: make(map[string]string), grpc: grpc}
+	for _, peer := range peers {
+		if u, err := url.Parse(peer.Addr); err == nil {
+			bt.byOrigin[u.Scheme+"://"+u.Host] = peer.Addr
+		}
+	}
+	return bt
+}
+
+// checkLiveness pings peers at the liveness path only to record
+// whether they are alive: unlike their readiness, which decides
+// whether they get traffic, it is tracked for alerting alone. Like
+// the readiness pings, each backend is only pinged once per cycle.
+func (lp *livelyProxy) checkLiveness(primary *lively.Peer, peers []*lively.Peer, grpc bool) {
+	pinger := &lively.Peer{
+		ID:              primary.ID,
+		Primary:         true,
+		UserAgent:       primary.UserAgent,
+		PingBody:        primary.PingBody,
+		PingContentType: primary.PingContentType,
+		PingPath:        lp.livenessPath,
+		PingMethod:      primary.PingMethod,
+		RequireOK:       true,
+	}
+	if pinger.PingMethod == "" {
+		pinger.PingMethod = "GET"
+	}
+	live, nonLive, _ := lp.pingOnce(pinger, peers, grpc, true)
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.liveness == nil {
+		lp.liveness = make(map[string]bool)
+	}
+	for _, l := range live {
+		lp.liveness[l.Addr] = true
+	}
+	for _, l := range nonLive {
+		lp.liveness[l.Addr] = false
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resolver looks up the IP addresses of a host.
+// *net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Resolver = (*net.Resolver)(nil)
+
+// DomainMismatch describes a domain that
+// doesn't resolve to any of the expected IPs.
+type DomainMismatch struct {
+	Domain   string
+	Resolved []net.IP
+	Err      error
+}
+
+// PreflightError is returned by PreflightDomains
+// when at least one domain didn't check out.
+type PreflightError struct {
+	Mismatches []*DomainMismatch
+}
+
+func (pe *PreflightError) Error() string {
+	var msgs []string
+	for _, mm := range pe.Mismatches {
+		if mm.Err != nil {
+			msgs = append(msgs, fmt.Sprintf("%q: %v", mm.Domain, mm.Err))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%q resolves to %v", mm.Domain, mm.Resolved))
+		}
+	}
+	return "frontender: domains not pointing to this host: " + strings.Join(msgs, "; ")
+}
+
+// PreflightDomains checks that each domain resolves to at least one
+// of hostIPs, so that mistakes in DNS are caught before they cause
+// ACME certificate requests to fail. If hostIPs is empty, the IPs
+// of this machine's network interfaces are used. If resolver is
+// nil, net.DefaultResolver is used.
+func PreflightDomains(ctx context.Context, resolver Resolver, hostIPs []net.IP, domains ...string) error {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if len(hostIPs) == 0 {
+		ips, err := interfaceIPs()
+		if err != nil {
+			return err
+		}
+		hostIPs = ips
+	}
+
+	var mismatches []*DomainMismatch
+	for _, domain := range domains {
+		addrs, err := resolver.LookupIPAddr(ctx, domain)
+		if err != nil {
+			mismatches = append(mismatches, &DomainMismatch{Domain: domain, Err: err})
+			continue
+		}
+		var resolved []net.IP
+		matched := false
+		for _, addr := range addrs {
+			resolved = append(resolved, addr.IP)
+			for _, ip := range hostIPs {
+				if ip.Equal(addr.IP) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			mismatches = append(mismatches, &DomainMismatch{Domain: domain, Resolved: resolved})
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return &PreflightError{Mismatches: mismatches}
+	}
+	return nil
+}
+
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
+
+func parseIPs(strs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, str := range strs {
+		ip := net.ParseIP(strings.TrimSpace(str))
+		if ip == nil {
+			return nil, fmt.Errorf("frontender: invalid IP address %q", str)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
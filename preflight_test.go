@@ -0,0 +1,80 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/orijtech/frontender"
+)
+
+type stubResolver map[string][]string
+
+func (sr stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := sr[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestPreflightDomains(t *testing.T) {
+	resolver := stubResolver{
+		"orijtech.com":     {"203.0.113.7"},
+		"www.orijtech.com": {"198.51.100.1", "2001:db8::7"},
+		"git.orijtech.com": {"198.51.100.2"},
+	}
+	hostIPs := []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")}
+
+	tests := [...]struct {
+		domains         []string
+		wantMismatching []string
+	}{
+		0: {domains: []string{"orijtech.com", "www.orijtech.com"}},
+		1: {domains: []string{"orijtech.com", "git.orijtech.com"}, wantMismatching: []string{"git.orijtech.com"}},
+		2: {domains: []string{"missing.orijtech.com", "orijtech.com"}, wantMismatching: []string{"missing.orijtech.com"}},
+	}
+
+	for i, tt := range tests {
+		err := frontender.PreflightDomains(context.Background(), resolver, hostIPs, tt.domains...)
+		if len(tt.wantMismatching) == 0 {
+			if err != nil {
+				t.Errorf("#%d: unexpected err: %v", i, err)
+			}
+			continue
+		}
+
+		var pe *frontender.PreflightError
+		if !errors.As(err, &pe) {
+			t.Errorf("#%d: got err %v, want a *PreflightError", i, err)
+			continue
+		}
+		var got []string
+		for _, mm := range pe.Mismatches {
+			got = append(got, mm.Domain)
+		}
+		if !reflect.DeepEqual(got, tt.wantMismatching) {
+			t.Errorf("#%d: mismatches got=%q want=%q", i, got, tt.wantMismatching)
+		}
+	}
+}
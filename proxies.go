@@ -0,0 +1,258 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// proxiedRequest is the per request state that the reverse
+// proxies, which are shared by all the requests to a backend,
+// need. It travels in the context of the request.
+type proxiedRequest struct {
+	route    string
+	addr     string
+	path     string
+	retries  int
+	canary   *CanaryOptions
+	toCanary bool
+	dump     bool
+	start    time.Time
+	// staleKey if set, is the key that the
+	// response is kept under, see serveStale.
+	staleKey string
+}
+
+type proxiedRequestKey struct{}
+
+func proxiedRequestFrom(ctx context.Context) *proxiedRequest {
+	pr, _ := ctx.Value(proxiedRequestKey{}).(*proxiedRequest)
+	return pr
+}
+
+// backendProxy is the reverse proxy of a backend
+// along with the parsed address of that backend.
+type backendProxy struct {
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+// proxyFor returns the reverse proxy of addr, creating it on
+// first use, so that the address is parsed only once and the
+// proxy's setup isn't redone on every request.
+func (lp *livelyProxy) proxyFor(addr string, grpc bool) (*backendProxy, error) {
+	key := addr
+	if grpc {
+		key = "grpc+" + addr
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if bp, ok := lp.proxies[key]; ok {
+		return bp, nil
+	}
+	target, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	rproxy := httputil.NewSingleHostReverseProxy(target)
+	rproxy.ModifyResponse = lp.modifyProxiedResponse
+	rproxy.ErrorHandler = lp.handleProxyError
+	rproxy.BufferPool = proxyBufferPool
+	rproxy.Transport = &proxyTransport{lp: lp, addr: addr, grpc: grpc}
+	if grpc {
+		// Stream responses as they come.
+		rproxy.FlushInterval = -1
+	}
+
+	bp := &backendProxy{target: target, proxy: rproxy}
+	if lp.proxies == nil {
+		lp.proxies = make(map[string]*backendProxy)
+	}
+	lp.proxies[key] = bp
+	return bp, nil
+}
+
+// DefaultRemovedBackendGracePeriod is how long, by default, the cached
+// proxy and transport of a backend removed by Reload are kept around.
+const DefaultRemovedBackendGracePeriod = time.Minute
+
+// discardBackendsAfter discards, once grace has elapsed, the cached
+// proxies and transports of those of addrs that by then aren't in
+// any route, in case a later reload brought them back.
+func (lp *livelyProxy) discardBackendsAfter(addrs []string, grace time.Duration) {
+	go func() {
+		<-lp.clock.After(grace)
+		lp.discardBackends(addrs)
+	}()
+}
+
+// noteSuppliedTransportLocked records that the transport of the
+// backend keyed by key was supplied by transportForBackend.
+func (lp *livelyProxy) noteSuppliedTransportLocked(key string) {
+	if lp.suppliedTransports == nil {
+		lp.suppliedTransports = make(map[string]bool)
+	}
+	lp.suppliedTransports[key] = true
+}
+
+// discardBackends forgets the cached proxies, transports, ping results
+// and liveness of the addrs that aren't in any route and closes their
+// idle connections, unless transportForBackend supplied their transports.
+func (lp *livelyProxy) discardBackends(addrs []string) {
+	lp.mu.Lock()
+	configured := make(map[string]bool)
+	for _, peersMap := range lp.secondariesMap {
+		for _, secondary := range peersMap {
+			configured[secondary.Addr] = true
+		}
+	}
+	var discarded []http.RoundTripper
+	for _, addr := range addrs {
+		if configured[addr] {
+			continue
+		}
+		delete(lp.proxies, addr)
+		delete(lp.proxies, "grpc+"+addr)
+		delete(lp.backendInFlight, addr)
+		delete(lp.outliers, addr)
+		for _, grpc := range [...]bool{false, true} {
+			delete(lp.pings, pingKey(addr, grpc, false))
+			delete(lp.pings, pingKey(addr, grpc, true))
+		}
+		delete(lp.liveness, addr)
+		for key, transports := range map[string]map[string]http.RoundTripper{addr: lp.transports, "grpc+" + addr: lp.grpcTransports} {
+			rt, ok := transports[addr]
+			if !ok {
+				continue
+			}
+			delete(transports, addr)
+			if lp.suppliedTransports[key] {
+				delete(lp.suppliedTransports, key)
+				continue
+			}
+			discarded = append(discarded, rt)
+		}
+	}
+	lp.mu.Unlock()
+
+	for _, rt := range discarded {
+		if rt == http.DefaultTransport {
+			// It is shared by the other backends.
+			continue
+		}
+		if ci, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			ci.CloseIdleConnections()
+		}
+	}
+}
+
+func (lp *livelyProxy) modifyProxiedResponse(res *http.Response) error {
+	pr := proxiedRequestFrom(res.Request.Context())
+	if pr == nil {
+		return nil
+	}
+	if pr.dump {
+		lp.dumpResponse(res)
+	}
+	if lp.version != "" {
+		res.Header.Set(versionHeader, lp.version)
+	}
+	if lp.serverTiming {
+		// The backend's response headers have just arrived
+		// hence this is the upstream time to first byte.
+		addServerTiming(res.Header, "upstream", time.Since(pr.start))
+	}
+	if err := lp.modifyResponse(pr.addr, res); err != nil {
+		// The ErrorHandler takes it from here.
+		return err
+	}
+	if pr.toCanary {
+		lp.recordCanaryResult(pr.route, pr.canary, res.StatusCode >= 500)
+	}
+	lp.recordStale(pr.staleKey, res)
+	return nil
+}
+
+func (lp *livelyProxy) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if pr := proxiedRequestFrom(r.Context()); pr != nil && pr.toCanary {
+		lp.recordCanaryResult(pr.route, pr.canary, true)
+	}
+	lp.proxyErrorHandler(w, r, err)
+}
+
+// proxyTransport picks, for each request, the
+// transport to reach the backend at addr with.
+type proxyTransport struct {
+	lp   *livelyProxy
+	addr string
+	grpc bool
+}
+
+var _ http.RoundTripper = (*proxyTransport)(nil)
+
+func (pt *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	pr := proxiedRequestFrom(req.Context())
+	switch {
+	case pt.grpc:
+		res, err = pt.lp.grpcTransportFor(pt.addr).RoundTrip(req)
+	case pr != nil && pr.retries > 0:
+		rt := &retryTransport{
+			lp:      pt.lp,
+			route:   pr.route,
+			addr:    pt.addr,
+			path:    pr.path,
+			retries: pr.retries,
+		}
+		res, err = rt.RoundTrip(req)
+	case pr != nil && pr.toCanary:
+		// Canaries have their own error accounting.
+		res, err = pt.lp.transportFor(pt.addr).RoundTrip(req)
+	default:
+		res, err = pt.lp.roundTripCounted(pt.addr, req)
+	}
+	if res != nil && res.Request == nil {
+		// ModifyResponse finds the proxiedRequest via res.Request.
+		res.Request = req
+	}
+	return res, err
+}
+
+// proxyBufferPool recycles the buffers that
+// response bodies are copied to clients with.
+var proxyBufferPool httputil.BufferPool = new(bufferPool)
+
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (bp *bufferPool) Get() []byte {
+	if b, ok := bp.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, 32<<10)
+}
+
+func (bp *bufferPool) Put(b []byte) {
+	bp.pool.Put(&b)
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/orijtech/otils"
+)
+
+// nonHTTPSRedirectHandler redirects non-HTTPS traffic to the target
+// in NonHTTPSRedirectHosts for its host, or otherwise to
+// NonHTTPSRedirectURL. Traffic that one of the TrustedProxies forwarded
+// from HTTPS is instead served by secure, to not redirect it in a loop.
+// It returns nil if there is nothing to redirect to.
+func (req *Request) nonHTTPSRedirectHandler(secure http.Handler) http.Handler {
+	redirectURL := strings.TrimSpace(req.NonHTTPSRedirectURL)
+	if redirectURL == "" && len(req.NonHTTPSRedirectHosts) == 0 {
+		return nil
+	}
+
+	var fallback http.Handler = http.NotFoundHandler()
+	if redirectURL != "" {
+		fallback = otils.RedirectAllTrafficTo(redirectURL)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if req.forwardedFromHTTPS(r) {
+			secure.ServeHTTP(w, r)
+			return
+		}
+		target := req.nonHTTPSRedirectTarget(r)
+		if target == "" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// nonHTTPSRedirectTarget returns the URL that r should be redirected
+// to according to NonHTTPSRedirectHosts, preserving its path and query.
+// It returns "" if the host of r has no per-host target.
+func (req *Request) nonHTTPSRedirectTarget(r *http.Request) string {
+	host := normalizeHost(r.Host)
+
+	var target string
+	for h, t := range req.NonHTTPSRedirectHosts {
+		if normalizeHost(strings.TrimSpace(h)) == host {
+			target = strings.TrimSpace(t)
+			break
+		}
+	}
+	if target == "" {
+		return ""
+	}
+
+	target = strings.TrimSuffix(target, "/") + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	return target
+}
+
+// forwardedFromHTTPS reports whether r was forwarded by one of the
+// TrustedProxies, such as a TLS terminator in front of the frontend,
+// with an X-Forwarded-Proto telling that the client used HTTPS. Like
+// for clientIP, each proxy appends the protocol it was reached over,
+// hence the value told by the proxy that the client reached is the
+// last one, or the one TrustedHops from the right, as those further
+// left could have been made up by the client.
+func (req *Request) forwardedFromHTTPS(r *http.Request) bool {
+	if len(req.TrustedProxies) == 0 {
+		return false
+	}
+	addr, ok := remoteIP(r.RemoteAddr)
+	if !ok || !aclContains(req.TrustedProxies, addr) {
+		return false
+	}
+	var protos []string
+	for _, value := range r.Header.Values("X-Forwarded-Proto") {
+		for _, proto := range strings.Split(value, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				protos = append(protos, proto)
+			}
+		}
+	}
+	if len(protos) == 0 {
+		return false
+	}
+	hops := req.TrustedHops
+	if hops <= 0 {
+		hops = 1
+	}
+	i := len(protos) - hops
+	if i < 0 {
+		i = 0
+	}
+	return strings.EqualFold(protos[i], "https")
+}
+
+func (req *Request) validateTrustedProxies() error {
+	for _, entry := range req.TrustedProxies {
+		if _, err := parseACLEntry(entry); err != nil {
+			return fmt.Errorf("trusted proxy %q: %v", entry, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNonHTTPSRedirectTarget(t *testing.T) {
+	req := &Request{
+		NonHTTPSRedirectHosts: map[string]string{
+			"foo.com":  "https://foo.com",
+			"BAR.org ": "https://www.bar.org/",
+		},
+	}
+
+	tests := [...]struct {
+		url  string
+		want string
+	}{
+		0: {url: "http://foo.com/", want: "https://foo.com/"},
+		1: {url: "http://foo.com:80/a/b?c=d&e", want: "https://foo.com/a/b?c=d&e"},
+		2: {url: "http://bar.org/x", want: "https://www.bar.org/x"},
+		3: {url: "http://Bar.ORG./x%2Fy", want: "https://www.bar.org/x%2Fy"},
+		4: {url: "http://baz.net/", want: ""},
+		5: {url: "http://sub.foo.com/", want: ""},
+		6: {url: "http://foo.com:8443/a", want: "https://foo.com/a"},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if got := req.nonHTTPSRedirectTarget(r); got != tt.want {
+			t.Errorf("#%d: %s: got=%q want=%q", i, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestNonHTTPSRedirectHandler(t *testing.T) {
+	if h := new(Request).nonHTTPSRedirectHandler(nil); h != nil {
+		t.Errorf("expected no handler without any redirect targets")
+	}
+
+	h := (&Request{
+		NonHTTPSRedirectHosts: map[string]string{"foo.com": "https://foo.com"},
+	}).nonHTTPSRedirectHandler(nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://foo.com/a?b=c", nil))
+	if got, want := rec.Code, http.StatusMovedPermanently; got != want {
+		t.Errorf("known host: code got=%d want=%d", got, want)
+	}
+	if got, want := rec.Header().Get("Location"), "https://foo.com/a?b=c"; got != want {
+		t.Errorf("known host: Location got=%q want=%q", got, want)
+	}
+
+	// Without NonHTTPSRedirectURL there is nowhere to send unknown hosts.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://bar.org/", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unknown host: code got=%d want=%d", got, want)
+	}
+}
+
+func TestNonHTTPSRedirectHonorsTrustedForwardedProto(t *testing.T) {
+	secure := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served"))
+	})
+	tests := [...]struct {
+		remoteAddr string
+		proto      string
+		hops       int
+		wantCode   int
+	}{
+		0: {remoteAddr: "10.1.2.3:4567", proto: "https", wantCode: http.StatusOK},
+		// The trusted proxy appended to the value the client made up.
+		1: {remoteAddr: "10.1.2.3:4567", proto: "HTTPS, http", wantCode: http.StatusMovedPermanently},
+		2: {remoteAddr: "10.1.2.3:4567", proto: "http", wantCode: http.StatusMovedPermanently},
+		3: {remoteAddr: "10.1.2.3:4567", wantCode: http.StatusMovedPermanently},
+
+		// Untrusted clients can't claim to have come over HTTPS.
+		4: {remoteAddr: "192.0.2.1:1234", proto: "https", wantCode: http.StatusMovedPermanently},
+
+		5: {remoteAddr: "10.1.2.3:4567", proto: "http, HTTPS", wantCode: http.StatusOK},
+
+		// With TrustedHops, the value of the proxy the client reached.
+		6: {remoteAddr: "10.1.2.3:4567", proto: "https, http", hops: 2, wantCode: http.StatusOK},
+		7: {remoteAddr: "10.1.2.3:4567", proto: "https, http, https", hops: 2, wantCode: http.StatusMovedPermanently},
+		8: {remoteAddr: "10.1.2.3:4567", proto: "https", hops: 2, wantCode: http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		h := (&Request{
+			NonHTTPSRedirectHosts: map[string]string{"foo.com": "https://foo.com"},
+			TrustedProxies:        []string{"10.0.0.0/8"},
+			TrustedHops:           tt.hops,
+		}).nonHTTPSRedirectHandler(secure)
+		r := httptest.NewRequest("GET", "http://foo.com/a", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: code got=%d want=%d", i, got, tt.wantCode)
+		}
+		if tt.wantCode == http.StatusOK && rec.Header().Get("Location") != "" {
+			t.Errorf("#%d: unexpectedly redirected to %q", i, rec.Header().Get("Location"))
+		}
+	}
+
+	if err := (&Request{TrustedProxies: []string{"10.0.0.0/33"}}).validateTrustedProxies(); err == nil {
+		t.Errorf("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := [...]struct {
+		host string
+		want string
+	}{
+		0: {host: "example.com", want: "example.com"},
+		1: {host: "example.com:8443", want: "example.com"},
+		2: {host: "Example.COM.:8443", want: "example.com"},
+		3: {host: "[::1]:8443", want: "::1"},
+		4: {host: "", want: ""},
+	}
+
+	for i, tt := range tests {
+		if got := normalizeHost(tt.host); got != tt.want {
+			t.Errorf("#%d: %q: got=%q want=%q", i, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHostForwardedWithItsPort(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Host))
+	}))
+	defer backend.Close()
+
+	// Matching hosts ignores the port, yet the
+	// backends get the Host that clients sent.
+	lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com:8443/", nil))
+	if got, want := rec.Body.String(), "example.com:8443"; got != want {
+		t.Errorf("forwarded Host got=%q want=%q", got, want)
+	}
+}
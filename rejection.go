@@ -0,0 +1,60 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Rejection describes a request that the frontend
+// refused to serve, for monitoring abuse.
+type Rejection struct {
+	Time       time.Time `json:"time"`
+	Code       int       `json:"code"`
+	Reason     string    `json:"reason"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	// ClientIP is the IP of the client, per X-Forwarded-For if
+	// RemoteAddr is one of the TrustedProxies, else that of RemoteAddr.
+	ClientIP string `json:"client_ip"`
+}
+
+// reject answers r with code and reason and logs the rejection.
+func (lp *livelyProxy) reject(w http.ResponseWriter, r *http.Request, code int, reason string) {
+	http.Error(w, reason, code)
+	lp.logRejection(&Rejection{
+		Time:       lp.clock.Now(),
+		Code:       code,
+		Reason:     reason,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   clientIP(r, lp.trustedProxies, lp.trustedHops),
+	})
+}
+
+func (lp *livelyProxy) logRejection(rej *Rejection) {
+	if lp.rejectionLog != nil {
+		lp.rejectionLog(rej)
+		return
+	}
+	blob, _ := json.Marshal(rej)
+	lp.logf("frontender: rejected: %s", blob)
+}
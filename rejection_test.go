@@ -0,0 +1,87 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectionsLogged(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	misdirected := httptest.NewRequest("GET", "https://b.example.com/users", nil)
+	misdirected.ProtoMajor = 2
+	misdirected.TLS = &tls.ConnectionState{ServerName: "a.example.com"}
+
+	disallowedOrigin := httptest.NewRequest("OPTIONS", "https://a.example.com/users", nil)
+	disallowedOrigin.Header.Set("Origin", "https://evil.example.org")
+	disallowedOrigin.Header.Set("Access-Control-Request-Method", "POST")
+
+	tests := [...]struct {
+		req        *http.Request
+		wantCode   int
+		wantReason string
+	}{
+		0: {req: misdirected, wantCode: http.StatusMisdirectedRequest, wantReason: "misdirected request"},
+		1: {req: disallowedOrigin, wantCode: http.StatusForbidden, wantReason: "origin not allowed"},
+		// Requests that are served aren't rejections.
+		2: {req: httptest.NewRequest("GET", "https://a.example.com/users", nil), wantCode: http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		var rejections []*Rejection
+		var logs []string
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.strictSNI = true
+		lp.cors = &CORSConfig{AllowedOrigins: []string{"https://a.example.com"}}
+		lp.rejectionLog = func(rej *Rejection) { rejections = append(rejections, rej) }
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, tt.req)
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+		}
+		if tt.wantReason == "" {
+			if len(rejections) != 0 {
+				t.Errorf("#%d: unexpected rejections %+v", i, rejections)
+			}
+			continue
+		}
+		if len(rejections) != 1 {
+			t.Errorf("#%d: rejections got=%d want=1", i, len(rejections))
+			continue
+		}
+		rej := rejections[0]
+		if rej.Code != tt.wantCode || rej.Reason != tt.wantReason || rej.Path != "/users" || rej.Method != tt.req.Method {
+			t.Errorf("#%d: unexpected rejection %+v", i, rej)
+		}
+
+		// Without a RejectionLog, the rejection is logged as JSON.
+		lp.rejectionLog = nil
+		lp.logfFn = func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}
+		lp.ServeHTTP(httptest.NewRecorder(), tt.req)
+		if len(logs) != 1 || !strings.HasPrefix(logs[0], "frontender: rejected: {") || !strings.Contains(logs[0], fmt.Sprintf(`"code":%d`, tt.wantCode)) {
+			t.Errorf("#%d: unexpected logs %q", i, logs)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/orijtech/frontender/lively"
+
+	"github.com/odeke-em/go-uuid"
+)
+
+var errReloadUnsupported = errors.New("reloading is not supported by this listener")
+
+// Reload updates the routing of the running frontend to that
+// of req, that is its PrefixRouter, Routes and ExactRootRoute.
+// Backends that remain in a route keep their liveliness state,
+// their requests in flight and their load balancing weights, so
+// that a reload doesn't upset the distribution of the traffic,
+// while backends that were removed stop receiving new requests.
+// Routes that were removed stop matching right away, but Reload
+// waits up to req.RouteDrainTimeout for their requests in flight
+// to complete, before their backends are reported as removed.
+// The cached proxies of backends removed from every route are
+// discarded after req.RemovedBackendGracePeriod, closing their
+// idle connections.
+// The other fields of req, such as the domains, are ignored.
+func (lc *ListenConfirmation) Reload(req *Request) error {
+	if lc.lproxy == nil {
+		return errReloadUnsupported
+	}
+
+	lc.reloadMu.Lock()
+	defer lc.reloadMu.Unlock()
+
+	resolved, err := req.withResolvedBackends()
+	if err != nil {
+		return err
+	}
+	if err := lc.apply(resolved); err != nil {
+		return err
+	}
+
+	lc.mu.Lock()
+	lc.base = req
+	lc.mu.Unlock()
+
+	return nil
+}
+
+// apply swaps in the routing of req, whose backends
+// are resolved. lc.reloadMu must be held.
+func (lc *ListenConfirmation) apply(req *Request) error {
+	if err := req.validateRouting(); err != nil {
+		return err
+	}
+
+	removed, removedRoutes, added := lc.lproxy.reload(req.normalizedPrefixRouter(), req.routes(), req.ExactRootRoute)
+	for route, primary := range added {
+		go lc.collectFeedback(route, lc.lproxy.startCycling(route, primary))
+	}
+
+	// The removed routes no longer get new requests but
+	// those in flight are given a chance to complete.
+	drainTimeout := req.RouteDrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultRouteDrainTimeout
+	}
+	for _, route := range lc.lproxy.waitRoutesDrained(removedRoutes, drainTimeout) {
+		lc.lproxy.logf("frontender: route %q removed with requests still in flight after %s", route, drainTimeout)
+	}
+
+	onBackendRemoved := req.OnBackendRemoved
+	if onBackendRemoved == nil {
+		onBackendRemoved = lc.onBackendRemoved
+	}
+	if onBackendRemoved != nil {
+		for _, rb := range removed {
+			onBackendRemoved(rb.route, rb.addr)
+		}
+	}
+
+	if len(removed) > 0 {
+		grace := req.RemovedBackendGracePeriod
+		if grace <= 0 {
+			grace = DefaultRemovedBackendGracePeriod
+		}
+		addrs := make([]string, 0, len(removed))
+		for _, rb := range removed {
+			addrs = append(addrs, rb.addr)
+		}
+		lc.lproxy.discardBackendsAfter(addrs, grace)
+	}
+
+	lc.mu.Lock()
+	if lc.config != nil {
+		config := *lc.config
+		config.PrefixRouter = req.normalizedPrefixRouter()
+		config.Routes = req.routes()
+		config.ExactRootRoute = req.ExactRootRoute
+		lc.config = &config
+	}
+	lc.mu.Unlock()
+
+	return nil
+}
+
+// removedBackend is a backend that a reload took out of a route.
+type removedBackend struct {
+	route string
+	addr  string
+}
+
+// reload swaps in the routes of pr, reusing the peers of the backends
+// that remain. It returns the backends that were removed, the routes
+// that are gone entirely, along with the primaries of the newly added
+// routes, which need to be cycled.
+func (lp *livelyProxy) reload(pr map[string][]string, routeOptions map[string]*RouteOptions, exactRootRoute bool) (removed []removedBackend, removedRoutes []string, added map[string]*lively.Peer) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	added = make(map[string]*lively.Peer)
+	primariesMap := make(map[string]*lively.Peer, len(pr))
+	secondariesMap := make(map[string]map[string]*lively.Peer, len(pr))
+	for route, addresses := range pr {
+		wanted := make(map[string]bool, len(addresses))
+		for _, addr := range addresses {
+			wanted[addr] = true
+		}
+
+		primary, ok := lp.primariesMap[route]
+		if !ok {
+			primary = &lively.Peer{
+				ID:      uuid.NewRandom().String(),
+				Primary: true,
+			}
+			lp.healthCheck.apply(primary)
+			added[route] = primary
+		}
+
+		peersMap := make(map[string]*lively.Peer)
+		present := make(map[string]bool)
+		for id, secondary := range lp.secondariesMap[route] {
+			if !wanted[secondary.Addr] || present[secondary.Addr] {
+				primary.RemovePeer(id)
+				if !wanted[secondary.Addr] {
+					removed = append(removed, removedBackend{route: route, addr: secondary.Addr})
+				}
+				continue
+			}
+			peersMap[id] = secondary
+			present[secondary.Addr] = true
+		}
+		for _, addr := range addresses {
+			if !present[addr] {
+				addSecondary(primary, peersMap, addr)
+				present[addr] = true
+			}
+		}
+
+		primariesMap[route] = primary
+		secondariesMap[route] = peersMap
+		lp.filterLiveAddressesLocked(route, wanted)
+	}
+
+	// Routes that are gone entirely.
+	for route, peersMap := range lp.secondariesMap {
+		if _, ok := pr[route]; ok {
+			continue
+		}
+		removedRoutes = append(removedRoutes, route)
+		for _, secondary := range peersMap {
+			removed = append(removed, removedBackend{route: route, addr: secondary.Addr})
+		}
+		delete(lp.liveAddresses, route)
+		delete(lp.currentWeights, route)
+		delete(lp.cycled, route)
+		delete(lp.slowStarts, route)
+		delete(lp.lastCycles, route)
+		delete(lp.affinityRings, route)
+		delete(lp.healthStates, route)
+		delete(lp.mirrors, route)
+	}
+
+	routePrefixes := make([]string, 0, len(pr))
+	for route := range pr {
+		routePrefixes = append(routePrefixes, route)
+	}
+
+	// A canary whose options changed, e.g a fixed one redeployed,
+	// starts over even if the previous one was rolled back.
+	for route := range lp.canaries {
+		var before, after *CanaryOptions
+		if opts := lp.routeOptions[route]; opts != nil {
+			before = opts.Canary
+		}
+		if opts := routeOptions[route]; opts != nil {
+			after = opts.Canary
+		}
+		if !reflect.DeepEqual(before, after) {
+			delete(lp.canaries, route)
+		}
+	}
+
+	lp.primariesMap = primariesMap
+	lp.secondariesMap = secondariesMap
+	lp.routePrefixes = newPrefixTrie(routePrefixes)
+	lp.routeOptions = routeOptions
+	lp.exactRootRoute = exactRootRoute
+
+	return removed, removedRoutes, added
+}
+
+// filterLiveAddressesLocked drops the live addresses of
+// route that aren't wanted, starting a new generation
+// if that changed the membership of the live set. The
+// backends that remain keep their round robin weights.
+func (lp *livelyProxy) filterLiveAddressesLocked(route string, wanted map[string]bool) {
+	liveAddresses := lp.liveAddresses[route]
+	var kept []string
+	for _, addr := range liveAddresses {
+		if wanted[addr] {
+			kept = append(kept, addr)
+		}
+	}
+	if len(kept) == len(liveAddresses) {
+		return
+	}
+	lp.liveAddresses[route] = kept
+	lp.generation[route] += 1
+	lp.pruneCurrentWeightsLocked(route, wanted)
+}
+
+// pruneCurrentWeightsLocked forgets the current weights of the
+// backends of route that aren't wanted, rather than resetting those
+// of all its backends, which would skew the smooth weighted round
+// robin on every reload. The remaining weights are shifted to sum
+// to 0 again, as they always do between picks.
+func (lp *livelyProxy) pruneCurrentWeightsLocked(route string, wanted map[string]bool) {
+	current := lp.currentWeights[route]
+	sum := 0.0
+	for addr, weight := range current {
+		if !wanted[addr] {
+			delete(current, addr)
+			continue
+		}
+		sum += weight
+	}
+	if len(current) == 0 {
+		delete(lp.currentWeights, route)
+		return
+	}
+	shift := sum / float64(len(current))
+	for addr := range current {
+		current[addr] -= shift
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// BackendResolver dynamically supplies backends for routes. The
+// resolved backends are added to those statically configured in
+// PrefixRouter and Routes, and are refreshed every BackendPingPeriod
+// just before the liveliness of the backends is checked.
+type BackendResolver interface {
+	// Resolve returns the current backends of each route.
+	Resolve() (map[string][]string, error)
+}
+
+// EnvBackendResolver resolves the backends of a route from an
+// environment variable or a file, as typically populated from
+// Kubernetes endpoints by a sidecar or the downward API.
+//
+// The addresses are separated by commas or whitespace and those
+// without a scheme e.g "10.0.0.7:8080" are assumed to be "http".
+// Long lists can be chunked across the variables Var, Var_0,
+// Var_1 and so forth, which are read until the first unset one.
+type EnvBackendResolver struct {
+	// Route is the route prefix that the backends
+	// are resolved for. It defaults to "/".
+	Route string `json:"route"`
+
+	// Var is the name of the environment variable.
+	Var string `json:"var"`
+
+	// File if set, is read for addresses too.
+	File string `json:"file"`
+}
+
+var _ BackendResolver = (*EnvBackendResolver)(nil)
+
+func init() {
+	// Registered so that requests using it can
+	// be embedded by GenerateBinary.
+	gob.Register(&EnvBackendResolver{})
+}
+
+var errEmptyEnvBackendResolver = errors.New("expecting at least one of Var or File to be set")
+
+func (er *EnvBackendResolver) Resolve() (map[string][]string, error) {
+	if er.Var == "" && er.File == "" {
+		return nil, errEmptyEnvBackendResolver
+	}
+
+	var chunks []string
+	if er.Var != "" {
+		chunks = append(chunks, os.Getenv(er.Var))
+		for i := 0; ; i++ {
+			chunk, ok := os.LookupEnv(fmt.Sprintf("%s_%d", er.Var, i))
+			if !ok {
+				break
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	if er.File != "" {
+		blob, err := os.ReadFile(er.File)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, string(blob))
+	}
+
+	var addresses []string
+	for _, chunk := range chunks {
+		fields := strings.FieldsFunc(chunk, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		for _, addr := range fields {
+			if !strings.Contains(addr, "://") {
+				addr = "http://" + addr
+			}
+			addresses = append(addresses, addr)
+		}
+	}
+
+	route := er.Route
+	if route == "" {
+		route = "/"
+	}
+	return map[string][]string{route: addresses}, nil
+}
+
+// withResolvedBackends returns a copy of req whose PrefixRouter
+// also contains the backends from its BackendResolver.
+func (req *Request) withResolvedBackends() (*Request, error) {
+	if req.BackendResolver == nil {
+		return req, nil
+	}
+	resolved, err := req.BackendResolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	merged := *req
+	merged.PrefixRouter = copyPrefixRouter(req.PrefixRouter)
+	if merged.PrefixRouter == nil {
+		merged.PrefixRouter = make(map[string][]string)
+	}
+	for route, addresses := range resolved {
+		merged.PrefixRouter[route] = append(merged.PrefixRouter[route], addresses...)
+	}
+	return &merged, nil
+}
+
+// refreshBackends periodically re-resolves the backends
+// until the ListenConfirmation is closed.
+func (lc *ListenConfirmation) refreshBackends(period time.Duration) {
+	for {
+		select {
+		case <-lc.done:
+			return
+		case <-time.After(period):
+		}
+
+		if err := lc.refreshOnce(); err != nil {
+			lc.lproxy.logf("frontender: refreshing backends: %v", err)
+		}
+	}
+}
+
+// refreshOnce re-resolves the backends of the last applied request
+// and applies them, unless a reload or a promotion replaced that
+// request while they were being resolved, lest they be reverted.
+func (lc *ListenConfirmation) refreshOnce() error {
+	lc.mu.Lock()
+	base := lc.base
+	lc.mu.Unlock()
+
+	if base == nil || base.BackendResolver == nil {
+		return nil
+	}
+	resolved, err := base.withResolvedBackends()
+	if err != nil {
+		return err
+	}
+
+	lc.reloadMu.Lock()
+	defer lc.reloadMu.Unlock()
+
+	lc.mu.Lock()
+	current := lc.base
+	lc.mu.Unlock()
+
+	if current != base {
+		return nil
+	}
+	return lc.apply(resolved)
+}
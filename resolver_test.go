@@ -0,0 +1,108 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/orijtech/frontender"
+)
+
+func TestEnvBackendResolverChunks(t *testing.T) {
+	t.Setenv("FRONTENDER_TEST_BACKENDS", "10.0.0.1:8080, 10.0.0.2:8080")
+	t.Setenv("FRONTENDER_TEST_BACKENDS_0", "https://10.0.0.3:8443\n10.0.0.4:8080")
+	t.Setenv("FRONTENDER_TEST_BACKENDS_1", "10.0.0.5:8080")
+	// Not read since FRONTENDER_TEST_BACKENDS_2 is unset.
+	t.Setenv("FRONTENDER_TEST_BACKENDS_3", "10.0.0.6:8080")
+
+	er := &frontender.EnvBackendResolver{Route: "/api", Var: "FRONTENDER_TEST_BACKENDS"}
+	got, err := er.Resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := map[string][]string{
+		"/api": {
+			"http://10.0.0.1:8080",
+			"http://10.0.0.2:8080",
+			"https://10.0.0.3:8443",
+			"http://10.0.0.4:8080",
+			"http://10.0.0.5:8080",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %v\nwant: %v", got, want)
+	}
+
+	if _, err := new(frontender.EnvBackendResolver).Resolve(); err == nil {
+		t.Errorf("expected an error when neither Var nor File is set")
+	}
+}
+
+func TestEnvBackendResolverRefreshesAcrossCycles(t *testing.T) {
+	endpointsFile := filepath.Join(t.TempDir(), "endpoints")
+	writeEndpoints := func(contents string) {
+		if err := os.WriteFile(endpointsFile, []byte(contents), 0600); err != nil {
+			t.Fatalf("writing endpoints: %v", err)
+		}
+	}
+	writeEndpoints("10.0.0.1:8080,10.0.0.2:8080")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	lc, err := frontender.Listen(&frontender.Request{
+		HTTP1:             true,
+		DomainsListener:   func(domains ...string) net.Listener { return ln },
+		PrefixRouter:      map[string][]string{"/static": {"http://localhost:9999"}},
+		BackendResolver:   &frontender.EnvBackendResolver{File: endpointsFile},
+		BackendPingPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	defer lc.Close()
+
+	waitForRouting := func(want map[string][]string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := lc.EffectiveConfig().PrefixRouter
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("routing never updated:\ngot:  %v\nwant: %v", got, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitForRouting(map[string][]string{
+		"/static": {"http://localhost:9999"},
+		"/":       {"http://10.0.0.1:8080", "http://10.0.0.2:8080"},
+	})
+
+	writeEndpoints("10.0.0.2:8080 10.0.0.3:8080")
+	waitForRouting(map[string][]string{
+		"/static": {"http://localhost:9999"},
+		"/":       {"http://10.0.0.2:8080", "http://10.0.0.3:8080"},
+	})
+}
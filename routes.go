@@ -0,0 +1,486 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteOptions configures how traffic matching
+// a route prefix is forwarded to its backends.
+//
+// In JSON, a route can also be given in the simple form
+// of a list of backend addresses, just like PrefixRouter e.g
+//
+//	{
+//	   "/bar": ["http://localhost:7997", "http://localhost:8888"],
+//	   "/foo": {"backends": ["http://localhost:8999"], "retries": 2}
+//	}
+type RouteOptions struct {
+	Backends []string `json:"backends"`
+
+	// Timeout if set, bounds how long a request to a backend
+	// of this route can take, except for upgraded connections.
+	Timeout time.Duration `json:"timeout"`
+
+	// Retries is the number of additional attempts made for
+	// idempotent requests, by their method or an Idempotency-Key
+	// header, each against the next live backend, when a backend
+	// can't be reached or when it responds with one of the
+	// RetryableStatusCodes of the Request.
+	// It overrides the MaxRetries of the Request. Requests
+	// whose bodies are too large to be buffered to be
+	// replayed are never retried.
+	Retries int `json:"retries"`
+
+	// NoStripPrefix if set, forwards the request path as is
+	// instead of trimming the route prefix off it.
+	NoStripPrefix bool `json:"no_strip_prefix"`
+
+	// RewritePrefix if set, replaces the route
+	// prefix of the path forwarded to the backend.
+	RewritePrefix string `json:"rewrite_prefix"`
+
+	// ShardHeader if set, names a request header whose integer
+	// value, modulo the number of live backends, picks the backend
+	// e.g "X-Shard: 3", to deterministically pin traffic such as
+	// that of load tests. Requests without a valid integer value
+	// are round robined.
+	ShardHeader string `json:"shard_header"`
+
+	// Weights maps backend addresses to their relative share
+	// of the traffic. Backends without a weight get a weight of 1.
+	// Weights can also be given along with the addresses, in
+	// Backends just like in PrefixRouter and ProxyAddresses, e.g
+	// "http://localhost:8080|weight=5". The round robin interleaves
+	// the picks of the heavier backends with those of the others.
+	Weights map[string]int `json:"weights"`
+
+	// MinLiveBackends if set, is the number of distinct backends
+	// that must be live for the route to be served at all. Below
+	// it, requests are answered with 503 Service Unavailable
+	// rather than piling onto the few surviving backends.
+	MinLiveBackends int `json:"min_live_backends"`
+
+	// SlowStart if set, is how long backends that become live
+	// again, for instance after recovering, take to ramp up to
+	// their full share of the round robined traffic, starting
+	// from none, to give them time to warm up. Requests routed
+	// by their ShardHeader aren't subject to it.
+	SlowStart time.Duration `json:"slow_start"`
+
+	// ACL if set, restricts the clients that can reach the route,
+	// the others being answered with 403 Forbidden.
+	ACL *ACL `json:"acl"`
+
+	// Canary if set, sends a share of the traffic to canary backends.
+	Canary *CanaryOptions `json:"canary"`
+
+	// Mirror if set, copies a share of the traffic
+	// to shadow backends, discarding their responses.
+	Mirror *MirrorOptions `json:"mirror"`
+
+	// GRPC if set, proxies to the backends over HTTP/2 end to end,
+	// in cleartext for "http" backends, streaming the responses and
+	// forwarding their trailers. gRPC requests aren't retried.
+	// Clients reach the frontend over HTTP/2 via TLS, or via H2C.
+	GRPC bool `json:"grpc"`
+
+	// Schedules route the traffic to other pools of backends
+	// during time windows. The first active rule wins, otherwise
+	// the traffic goes to Backends.
+	Schedules []*ScheduleRule `json:"schedules"`
+}
+
+func (ro *RouteOptions) UnmarshalJSON(b []byte) error {
+	var backends []string
+	if err := json.Unmarshal(b, &backends); err == nil {
+		*ro = RouteOptions{Backends: backends}
+		return nil
+	}
+	type plainRouteOptions RouteOptions
+	return json.Unmarshal(b, (*plainRouteOptions)(ro))
+}
+
+func (ro *RouteOptions) weightOf(addr string) int {
+	if ro == nil {
+		return 1
+	}
+	if weight, ok := ro.Weights[addr]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// forwardedPath returns the path that a request for path
+// which matched route, should be forwarded to the backend with.
+func (ro *RouteOptions) forwardedPath(route, path string) string {
+	switch {
+	case ro != nil && ro.RewritePrefix != "":
+		path = ro.RewritePrefix + strings.TrimPrefix(path, route)
+	case ro == nil || !ro.NoStripPrefix:
+		path = strings.TrimPrefix(path, route)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// matchRoute returns the longest of prefixes that path starts with,
+// along with the path to forward to the backend, that is with the
+// matched prefix stripped off, so that given the prefixes
+// * "/"
+// * "/foo"
+// * "/fo"
+// "/foo/bar" always matches "/foo" instead of "/" or "/fo"
+// however in the absence of "/foo", "/fo" matches before "/".
+// The path is cleaned before matching so that for example
+// "/foo/../admin" can't sneak past a "/admin" route via "/foo".
+func matchRoute(path string, prefixes *prefixTrie) (matched string, rewritten string) {
+	path = cleanPath(path)
+	matched = prefixes.longestPrefixOf(path)
+	return matched, (*RouteOptions)(nil).forwardedPath(matched, path)
+}
+
+// prefixTrie finds the longest route prefix of a path in time
+// proportional to the length of the path, whatever the number
+// of routes, unlike trying each prefix in turn.
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	// prefix is set on the nodes that end a prefix.
+	prefix   string
+	terminal bool
+}
+
+func newPrefixTrie(prefixes []string) *prefixTrie {
+	pt := new(prefixTrie)
+	for _, prefix := range prefixes {
+		node := &pt.root
+		for i := 0; i < len(prefix); i++ {
+			child := node.children[prefix[i]]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[byte]*trieNode)
+				}
+				child = new(trieNode)
+				node.children[prefix[i]] = child
+			}
+			node = child
+		}
+		node.prefix, node.terminal = prefix, true
+	}
+	return pt
+}
+
+// longestPrefixOf returns the longest prefix of path, or "" if none.
+func (pt *prefixTrie) longestPrefixOf(path string) string {
+	if pt == nil {
+		return ""
+	}
+	node := &pt.root
+	longest := node.prefix
+	for i := 0; i < len(path); i++ {
+		if node = node.children[path[i]]; node == nil {
+			break
+		}
+		if node.terminal {
+			longest = node.prefix
+		}
+	}
+	return longest
+}
+
+// cleanPath is like path.Clean except that it
+// preserves the trailing slash and always
+// returns a path rooted at "/".
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := pathpkg.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// routes merges PrefixRouter and Routes into one table, the
+// backends of a prefix present in both being combined.
+func (req *Request) routes() map[string]*RouteOptions {
+	if len(req.PrefixRouter) == 0 && len(req.Routes) == 0 {
+		opts := new(RouteOptions)
+		opts.addBackends(req.ProxyAddresses)
+		if len(opts.Backends) == 0 {
+			return nil
+		}
+		// The ProxyAddresses are then the catch-all route.
+		return map[string]*RouteOptions{"/": opts}
+	}
+	merged := make(map[string]*RouteOptions)
+	for route, addresses := range req.PrefixRouter {
+		opts := new(RouteOptions)
+		opts.addBackends(addresses)
+		merged[route] = opts
+	}
+	for route, opts := range req.Routes {
+		if opts == nil {
+			continue
+		}
+		copied := *opts
+		copied.Backends, copied.Weights = nil, nil
+		if simple, ok := merged[route]; ok {
+			copied.Backends = simple.Backends
+			copied.setWeights(simple.Weights)
+		}
+		copied.addBackends(opts.Backends)
+		copied.setWeights(opts.Weights)
+		copied.Schedules = compileSchedules(opts.Schedules)
+		merged[route] = &copied
+	}
+	return merged
+}
+
+// weightSeparator introduces the weight of a backend given
+// along with its address e.g "http://localhost:8080|weight=5".
+const weightSeparator = "|weight="
+
+// splitWeight separates the address of a backend from its
+// weight if it has one, otherwise the weight returned is 0.
+func splitWeight(addr string) (string, int, error) {
+	i := strings.LastIndex(addr, weightSeparator)
+	if i < 0 {
+		return addr, 0, nil
+	}
+	backend := strings.TrimSpace(addr[:i])
+	weight, err := strconv.Atoi(strings.TrimSpace(addr[i+len(weightSeparator):]))
+	if err == nil && weight <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		return backend, 0, fmt.Errorf("backend %q: invalid weight: %v", addr, err)
+	}
+	return backend, weight, nil
+}
+
+// addBackends appends addresses to the Backends of ro,
+// recording in its Weights those given along with them.
+// Invalid weights are ignored here, Validate reports them.
+func (ro *RouteOptions) addBackends(addresses []string) {
+	for _, addr := range normalizeAddresses(addresses) {
+		addr, weight, _ := splitWeight(addr)
+		ro.Backends = append(ro.Backends, addr)
+		if weight > 0 {
+			ro.setWeights(map[string]int{addr: weight})
+		}
+	}
+}
+
+// setWeights records weights in the Weights of ro.
+func (ro *RouteOptions) setWeights(weights map[string]int) {
+	for addr, weight := range weights {
+		if ro.Weights == nil {
+			ro.Weights = make(map[string]int)
+		}
+		ro.Weights[addr] = weight
+	}
+}
+
+// validateWeights ensures that the weights given along
+// with the addresses of backends are positive integers.
+func (req *Request) validateWeights() error {
+	addresses := append([]string(nil), req.ProxyAddresses...)
+	for _, backends := range req.PrefixRouter {
+		addresses = append(addresses, backends...)
+	}
+	for _, opts := range req.Routes {
+		if opts != nil {
+			addresses = append(addresses, opts.Backends...)
+		}
+	}
+	for _, addr := range addresses {
+		if _, _, err := splitWeight(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryTransport retries requests that failed to reach
+// a backend against the next live backend of the route.
+type retryTransport struct {
+	lp      *livelyProxy
+	route   string
+	addr    string
+	path    string
+	retries int
+}
+
+var _ http.RoundTripper = (*retryTransport)(nil)
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := rt.retries
+	if !isIdempotent(req) {
+		// The backend might have acted on the request before
+		// failing, so retrying could repeat its side effects.
+		retries = 0
+	}
+	if retries > 0 {
+		replayable, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		if !replayable {
+			retries = 0
+		}
+	}
+
+	tried := map[string]bool{rt.addr: true}
+	res, err := rt.lp.roundTripCounted(rt.addr, req)
+	for i := 0; i < retries && rt.shouldRetry(req, res, err); i++ {
+		if req.Context().Err() != nil {
+			break
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				break
+			}
+			req.Body = body
+		}
+		addr := rt.lp.retryAddress(rt.route, tried)
+		target, perr := url.Parse(addr)
+		if perr != nil || target.Host == "" {
+			break
+		}
+		tried[addr] = true
+		noteForwarding(req.Context(), rt.route, addr)
+		if res != nil {
+			// The response is given up on for that of the retry.
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			res.Body.Close()
+		}
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, rt.path)
+		req.URL.RawPath = ""
+		res, err = rt.lp.roundTripCounted(addr, req)
+	}
+	return res, err
+}
+
+// shouldRetry reports whether the attempt at req failed, either
+// reaching the backend or, if req is idempotent, with a response
+// whose status code is one of the retryable ones.
+func (rt *retryTransport) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if !isIdempotent(req) {
+		return false
+	}
+	return err != nil || rt.lp.retryableStatusCodes[res.StatusCode]
+}
+
+// isIdempotent reports whether req can be sent more than once, like
+// net/http does: by its method, or by an idempotency key header.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// retryAddress returns the next live backend of route, or if that
+// was already tried, another live backend that wasn't, if any.
+func (lp *livelyProxy) retryAddress(route string, tried map[string]bool) string {
+	addr := lp.roundRobinedAddress(route)
+	if !tried[addr] {
+		return addr
+	}
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for _, live := range lp.liveAddresses[route] {
+		if !tried[live] {
+			return live
+		}
+	}
+	return addr
+}
+
+// maxReplayedBodyBytes bounds the size of the request
+// bodies that are buffered so that they can be retried.
+const maxReplayedBodyBytes = 1 << 20
+
+// bufferBody buffers the body of req, unless it is larger than
+// maxReplayedBodyBytes, so that the request can be replayed.
+// It reports whether it can be.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxReplayedBodyBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if len(buf) > maxReplayedBodyBytes {
+		// Send the body as it came instead.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
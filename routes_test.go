@@ -0,0 +1,515 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutesSimpleAndRichFormsCoexist(t *testing.T) {
+	blob := []byte(`{
+		"routing": {
+			"/": ["http://localhost:7000"],
+			"/api": ["http://localhost:7001"]
+		},
+		"routes": {
+			"/api": {"backends": ["http://localhost:7002"], "retries": 2, "weights": {"http://localhost:7002": 3}},
+			"/static": ["http://localhost:7003", " "],
+			"/v2": {"backends": ["http://localhost:7004"], "rewrite_prefix": "/api/v2", "no_strip_prefix": true}
+		}
+	}`)
+
+	req := new(Request)
+	if err := json.Unmarshal(blob, req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	got := req.routes()
+	want := map[string]*RouteOptions{
+		"/": {Backends: []string{"http://localhost:7000"}},
+		"/api": {
+			Backends: []string{"http://localhost:7001", "http://localhost:7002"},
+			Retries:  2,
+			Weights:  map[string]int{"http://localhost:7002": 3},
+		},
+		"/static": {Backends: []string{"http://localhost:7003"}},
+		"/v2": {
+			Backends:      []string{"http://localhost:7004"},
+			RewritePrefix: "/api/v2",
+			NoStripPrefix: true,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotBlob, _ := json.MarshalIndent(got, "", "  ")
+		wantBlob, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("got:\n%s\nwant:\n%s", gotBlob, wantBlob)
+	}
+
+	if err := (&Request{HTTP1: true, Routes: map[string]*RouteOptions{"/": {}}}).Validate(); err == nil {
+		t.Errorf("expected an error for routes without any backends")
+	}
+	if err := (&Request{HTTP1: true, Routes: want}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRouteOptionsForwardedPath(t *testing.T) {
+	tests := [...]struct {
+		opts  *RouteOptions
+		route string
+		path  string
+		want  string
+	}{
+		0: {opts: nil, route: "/foo", path: "/foo/bar", want: "/bar"},
+		1: {opts: nil, route: "/foo", path: "/foo", want: "/"},
+		2: {opts: &RouteOptions{NoStripPrefix: true}, route: "/foo", path: "/foo/bar", want: "/foo/bar"},
+		3: {opts: &RouteOptions{RewritePrefix: "/v2"}, route: "/foo", path: "/foo/bar", want: "/v2/bar"},
+		4: {opts: &RouteOptions{RewritePrefix: "/v2", NoStripPrefix: true}, route: "/foo", path: "/foo/bar", want: "/v2/bar"},
+	}
+
+	for i, tt := range tests {
+		if got := tt.opts.forwardedPath(tt.route, tt.path); got != tt.want {
+			t.Errorf("#%d: got=%q want=%q", i, got, tt.want)
+		}
+	}
+}
+
+func TestRouteOptionsTimeoutAndRetries(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.URL.Path))
+	}))
+	defer ok.Close()
+
+	// A backend that refuses connections.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	lp := makeTestProxy(map[string][]string{
+		"/slow":  {slow.URL},
+		"/retry": {dead.URL, ok.URL},
+	})
+	lp.routeOptions = map[string]*RouteOptions{
+		"/slow":  {Timeout: 50 * time.Millisecond},
+		"/retry": {Retries: 1, RewritePrefix: "/rewritten"},
+	}
+
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+	if got, want := rec.Code, http.StatusGatewayTimeout; got != want {
+		t.Errorf("timeout: code got=%d want=%d", got, want)
+	}
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/retry/x", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("retry #%d: code got=%d want=%d", i, got, want)
+		}
+		if got, want := rec.Body.String(), "/rewritten/x"; got != want {
+			t.Errorf("retry #%d: body got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		rw.Write(body)
+	}))
+	defer healthy.Close()
+
+	// A backend that refuses connections.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	lp := makeTestProxy(map[string][]string{
+		"/flaky": {failing.URL, healthy.URL},
+		"/dead":  {dead.URL, healthy.URL},
+	})
+	lp.maxRetries = 1
+	lp.retryableStatusCodes = map[int]bool{http.StatusBadGateway: true, http.StatusServiceUnavailable: true}
+
+	tests := [...]struct {
+		method, path, body string
+		idempotencyKey     bool
+		wantCodes          []int
+	}{
+		0: {method: "GET", path: "/flaky", wantCodes: []int{http.StatusOK}},
+		1: {method: "PUT", path: "/flaky", body: "put", wantCodes: []int{http.StatusOK}},
+		2: {method: "POST", path: "/flaky", body: "keyed", idempotencyKey: true, wantCodes: []int{http.StatusOK}},
+		// Other requests aren't retried, as the backend
+		// might have acted on them nonetheless.
+		3: {method: "POST", path: "/flaky", body: "post", wantCodes: []int{http.StatusOK, http.StatusServiceUnavailable}},
+		4: {method: "POST", path: "/dead", body: "post", wantCodes: []int{http.StatusOK, http.StatusBadGateway}},
+		5: {method: "GET", path: "/dead", wantCodes: []int{http.StatusOK}},
+		6: {method: "POST", path: "/dead", body: "keyed", idempotencyKey: true, wantCodes: []int{http.StatusOK}},
+	}
+	for i, tt := range tests {
+		codes := make(map[int]int)
+		for j := 0; j < 4; j++ {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.idempotencyKey {
+				req.Header.Set("Idempotency-Key", fmt.Sprint(j))
+			}
+			rec := httptest.NewRecorder()
+			lp.ServeHTTP(rec, req)
+			codes[rec.Code] += 1
+			if rec.Code == http.StatusOK && rec.Body.String() != tt.body {
+				t.Errorf("#%d.%d: body got=%q want=%q", i, j, rec.Body.String(), tt.body)
+			}
+		}
+		if len(codes) != len(tt.wantCodes) {
+			t.Errorf("#%d: codes got=%v want=%v", i, codes, tt.wantCodes)
+		}
+		for _, code := range tt.wantCodes {
+			if codes[code] == 0 {
+				t.Errorf("#%d: codes got=%v want=%v", i, codes, tt.wantCodes)
+			}
+		}
+	}
+
+	// Too large bodies aren't buffered to be replayed.
+	big := strings.Repeat("a", maxReplayedBodyBytes+1)
+	codes := make(map[int]int)
+	for j := 0; j < 4; j++ {
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("PUT", "/flaky", strings.NewReader(big)))
+		codes[rec.Code] += 1
+		if rec.Code == http.StatusOK && rec.Body.Len() != len(big) {
+			t.Errorf("large body #%d: got %d bytes want %d", j, rec.Body.Len(), len(big))
+		}
+	}
+	if codes[http.StatusServiceUnavailable] == 0 {
+		t.Errorf("large bodies were retried: codes %v", codes)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	prefixes := newPrefixTrie([]string{"/", "/foo", "/fo", "/bar/", "/ünï"})
+
+	tests := [...]struct {
+		path          string
+		wantMatched   string
+		wantRewritten string
+	}{
+		0:  {path: "", wantMatched: "/", wantRewritten: "/"},
+		1:  {path: "/", wantMatched: "/", wantRewritten: "/"},
+		2:  {path: "//", wantMatched: "/", wantRewritten: "/"},
+		3:  {path: "/foo", wantMatched: "/foo", wantRewritten: "/"},
+		4:  {path: "/foo/bar", wantMatched: "/foo", wantRewritten: "/bar"},
+		5:  {path: "/fox", wantMatched: "/fo", wantRewritten: "/x"},
+		6:  {path: "/foo/../bar/x", wantMatched: "/bar/", wantRewritten: "/x"},
+		7:  {path: "/foo/../../etc/passwd", wantMatched: "/", wantRewritten: "/etc/passwd"},
+		8:  {path: "//foo//bar/", wantMatched: "/foo", wantRewritten: "/bar/"},
+		9:  {path: "/bar", wantMatched: "/", wantRewritten: "/bar"},
+		10: {path: "/ünïcode", wantMatched: "/ünï", wantRewritten: "/code"},
+		11: {path: "foo", wantMatched: "/foo", wantRewritten: "/"},
+	}
+
+	for i, tt := range tests {
+		matched, rewritten := matchRoute(tt.path, prefixes)
+		if matched != tt.wantMatched || rewritten != tt.wantRewritten {
+			t.Errorf("#%d: matchRoute(%q) got=(%q, %q) want=(%q, %q)",
+				i, tt.path, matched, rewritten, tt.wantMatched, tt.wantRewritten)
+		}
+	}
+
+	if matched, rewritten := matchRoute("/foo", nil); matched != "" || rewritten != "/foo" {
+		t.Errorf("no prefixes: got=(%q, %q)", matched, rewritten)
+	}
+}
+
+// linearLongestPrefix is the matcher that prefixTrie replaced:
+// it tries each prefix in turn, longest first.
+func linearLongestPrefix(path string, prefixes []string) string {
+	sorted := append([]string(nil), prefixes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	for _, prefix := range sorted {
+		if strings.HasPrefix(path, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func TestPrefixTrieMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	segments := []string{"a", "ab", "abc", "api", "v1", "v2", "ü", "x"}
+	randomPath := func() string {
+		var sb strings.Builder
+		for n := rng.Intn(5); n >= 0; n-- {
+			sb.WriteString("/" + segments[rng.Intn(len(segments))])
+		}
+		if rng.Intn(3) == 0 {
+			sb.WriteString("/")
+		}
+		// Prefixes that end within a segment, e.g "/ap",
+		// must keep matching just like with the linear scan.
+		path := sb.String()
+		return path[:1+rng.Intn(len(path))]
+	}
+
+	for round := 0; round < 50; round++ {
+		prefixes := []string{"/"}
+		for i := rng.Intn(200); i > 0; i-- {
+			prefixes = append(prefixes, randomPath())
+		}
+		pt := newPrefixTrie(prefixes)
+		for i := 0; i < 200; i++ {
+			path := randomPath()
+			if got, want := pt.longestPrefixOf(path), linearLongestPrefix(path, prefixes); got != want {
+				t.Fatalf("round #%d: longestPrefixOf(%q) got=%q want=%q", round, path, got, want)
+			}
+		}
+	}
+}
+
+func FuzzMatchRoute(f *testing.F) {
+	seeds := []string{"", "/", "//", "/foo", "/foo/bar", "/foo/../bar", "/..", "/./", "/ünïcode", "foo", "/foo//"}
+	for _, seed := range seeds {
+		f.Add(seed, "/foo")
+	}
+
+	f.Fuzz(func(t *testing.T, path, prefix string) {
+		prefixes := []string{"/", prefix, "/fo"}
+		matched, rewritten := matchRoute(path, newPrefixTrie(prefixes))
+
+		cleaned := cleanPath(path)
+		if want := linearLongestPrefix(cleaned, prefixes); matched != want {
+			t.Fatalf("%q matched %q but the linear scan matched %q", cleaned, matched, want)
+		}
+		if !strings.HasPrefix(cleaned, matched) {
+			t.Fatalf("matched %q is not a prefix of %q", matched, cleaned)
+		}
+		for _, p := range prefixes {
+			if len(p) > len(matched) && strings.HasPrefix(cleaned, p) {
+				t.Fatalf("%q matched %q but the longer %q also matches", cleaned, matched, p)
+			}
+		}
+		if !strings.HasPrefix(rewritten, "/") {
+			t.Fatalf("rewritten path %q is not rooted", rewritten)
+		}
+		if matched == "/" && rewritten != cleaned {
+			t.Fatalf("the catch-all route rewrote %q to %q", cleaned, rewritten)
+		}
+		for _, segment := range strings.Split(cleaned, "/") {
+			if segment == ".." {
+				t.Fatalf("cleaned path %q still has a %q segment", cleaned, segment)
+			}
+		}
+	})
+}
+
+func TestRootRouteHandling(t *testing.T) {
+	makeBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name + " " + req.URL.Path))
+		}))
+	}
+	root := makeBackend("root")
+	defer root.Close()
+	api := makeBackend("api")
+	defer api.Close()
+
+	withRoot := map[string][]string{"/": {root.URL}, "/api": {api.URL}}
+	withoutRoot := map[string][]string{"/api": {api.URL}}
+
+	tests := [...]struct {
+		routes    map[string][]string
+		exactRoot bool
+		path      string
+		wantCode  int
+		wantBody  string
+	}{
+		0: {routes: withRoot, path: "/", wantCode: http.StatusOK, wantBody: "root /"},
+		1: {routes: withRoot, path: "/x", wantCode: http.StatusOK, wantBody: "root /x"},
+		2: {routes: withRoot, path: "/api/x", wantCode: http.StatusOK, wantBody: "api /x"},
+		3: {routes: withRoot, path: "/api", wantCode: http.StatusOK, wantBody: "api /"},
+		4: {routes: withRoot, exactRoot: true, path: "/", wantCode: http.StatusOK, wantBody: "root /"},
+		5: {routes: withRoot, exactRoot: true, path: "/x", wantCode: http.StatusNotFound},
+		6: {routes: withRoot, exactRoot: true, path: "/api/x", wantCode: http.StatusOK, wantBody: "api /x"},
+		7: {routes: withoutRoot, path: "/", wantCode: http.StatusNotFound},
+		8: {routes: withoutRoot, path: "/x", wantCode: http.StatusNotFound},
+		9: {routes: withoutRoot, path: "/api/x", wantCode: http.StatusOK, wantBody: "api /x"},
+	}
+
+	for i, tt := range tests {
+		lp := makeTestProxy(tt.routes)
+		lp.exactRootRoute = tt.exactRoot
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got, want := rec.Code, tt.wantCode; got != want {
+			t.Errorf("#%d: code got=%d want=%d", i, got, want)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		if got, want := rec.Body.String(), tt.wantBody; got != want {
+			t.Errorf("#%d: body got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+func TestRouteOptionsShardHeader(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("backend-%d", i)
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		}))
+		defer backend.Close()
+		addresses = append(addresses, backend.URL)
+	}
+
+	// Identically configured proxies, whose cycles
+	// find the live backends in random orders.
+	var proxies []*livelyProxy
+	for i := 0; i < 10; i++ {
+		lp := makeLivelyProxy(time.Minute, map[string][]string{"/": addresses})
+		lp.routeOptions = map[string]*RouteOptions{"/": {ShardHeader: "X-Shard"}}
+		if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+			t.Fatalf("cycle: %v", err)
+		}
+		proxies = append(proxies, lp)
+	}
+	lp := proxies[0]
+
+	get := func(lp *livelyProxy, shard string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		if shard != "" {
+			req.Header.Set("X-Shard", shard)
+		}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	pinned := make(map[string]bool)
+	for shard := -3; shard < 3; shard++ {
+		first := get(lp, fmt.Sprint(shard))
+		for i := 0; i < 5; i++ {
+			if got := get(lp, fmt.Sprint(shard)); got != first {
+				t.Errorf("shard %d: got %q, previously pinned to %q", shard, got, first)
+			}
+		}
+		// Every replica pins the shard to the same backend.
+		for i, other := range proxies[1:] {
+			if got := get(other, fmt.Sprint(shard)); got != first {
+				t.Errorf("shard %d: replica #%d got %q, want %q", shard, i+1, got, first)
+			}
+		}
+		// The shard modulo the backend count picks the backend.
+		if got := get(lp, fmt.Sprint(shard+3)); got != first {
+			t.Errorf("shard %d: got %q want %q", shard+3, got, first)
+		}
+		pinned[first] = true
+	}
+	if got, want := len(pinned), len(addresses); got != want {
+		t.Errorf("shards were pinned to %d backends, want %d", got, want)
+	}
+
+	// Invalid values fall back to round robin.
+	seen := make(map[string]bool)
+	for i := 0; i < len(addresses); i++ {
+		seen[get(lp, "not-a-number")] = true
+	}
+	if got, want := len(seen), len(addresses); got != want {
+		t.Errorf("round robin fallback reached %d backends, want %d", got, want)
+	}
+}
+
+func TestInlineWeights(t *testing.T) {
+	req := &Request{
+		HTTP1: true,
+		PrefixRouter: map[string][]string{
+			"/":    {"http://localhost:7000|weight=5", "http://localhost:7001"},
+			"/api": {"http://localhost:7002|weight=2"},
+		},
+		Routes: map[string]*RouteOptions{
+			"/api": {
+				Backends: []string{"http://localhost:7003|weight=4"},
+				Weights:  map[string]int{"http://localhost:7002": 3},
+			},
+		},
+	}
+	got := req.routes()
+	want := map[string]*RouteOptions{
+		"/": {
+			Backends: []string{"http://localhost:7000", "http://localhost:7001"},
+			Weights:  map[string]int{"http://localhost:7000": 5},
+		},
+		"/api": {
+			Backends: []string{"http://localhost:7002", "http://localhost:7003"},
+			// The explicit weights win over those
+			// given along with the addresses.
+			Weights: map[string]int{"http://localhost:7002": 3, "http://localhost:7003": 4},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotBlob, _ := json.MarshalIndent(got, "", "  ")
+		wantBlob, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("got:\n%s\nwant:\n%s", gotBlob, wantBlob)
+	}
+	if err := req.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	proxyOnly := &Request{ProxyAddresses: []string{"http://localhost:7000|weight=2"}}
+	want = map[string]*RouteOptions{
+		"/": {
+			Backends: []string{"http://localhost:7000"},
+			Weights:  map[string]int{"http://localhost:7000": 2},
+		},
+	}
+	if got := proxyOnly.routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProxyAddresses: got %+v want %+v", got["/"], want["/"])
+	}
+
+	for _, addr := range []string{"http://localhost:7000|weight=0", "http://localhost:7000|weight=-1", "http://localhost:7000|weight=a"} {
+		req := &Request{HTTP1: true, PrefixRouter: map[string][]string{"/": {addr}}}
+		if err := req.Validate(); err == nil || !strings.Contains(err.Error(), "invalid weight") {
+			t.Errorf("%q: got err=%v, want an invalid weight", addr, err)
+		}
+	}
+}
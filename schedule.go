@@ -0,0 +1,204 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ScheduleRule routes the traffic of a route to its own pool
+// of backends during a daily time window e.g for business hours
+//
+//	{"backends": ["http://batch:8080"], "start": "18:00", "end": "08:00"}
+//
+// Scheduled backends aren't health checked.
+type ScheduleRule struct {
+	Backends []string `json:"backends"`
+
+	// Start and End are the "15:04" formatted times of day
+	// that the window starts at, inclusively, and ends at,
+	// exclusively. A window with an End before its Start
+	// spans midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Weekdays if set, restricts the window to those days
+	// e.g ["Mon", "Tue"]. The day is that of the Start
+	// for windows that span midnight.
+	Weekdays []string `json:"weekdays"`
+
+	// Location is the IANA name of the time zone of
+	// the window e.g "America/New_York". It defaults to UTC.
+	Location string `json:"location"`
+
+	// window is the rule parsed once the routes are
+	// configured, rather than on every request.
+	window *scheduleWindow
+}
+
+// scheduleWindow is a parsed ScheduleRule.
+type scheduleWindow struct {
+	// start and end are offsets from midnight.
+	start, end time.Duration
+	loc        *time.Location
+	// days is nil for windows open every day.
+	days map[time.Weekday]bool
+}
+
+const scheduleTimeLayout = "15:04"
+
+var weekdaysByName = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (sr *ScheduleRule) validate() error {
+	if len(normalizeAddresses(sr.Backends)) == 0 {
+		return fmt.Errorf("schedule %s-%s has no backends", sr.Start, sr.End)
+	}
+	_, err := sr.parse()
+	return err
+}
+
+// parse returns the window of the rule, in its location.
+func (sr *ScheduleRule) parse() (*scheduleWindow, error) {
+	startTime, err := time.Parse(scheduleTimeLayout, sr.Start)
+	if err != nil {
+		return nil, fmt.Errorf("schedule start: %v", err)
+	}
+	endTime, err := time.Parse(scheduleTimeLayout, sr.End)
+	if err != nil {
+		return nil, fmt.Errorf("schedule end: %v", err)
+	}
+	sw := &scheduleWindow{loc: time.UTC}
+	for _, name := range sr.Weekdays {
+		day, ok := weekdaysByName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("schedule weekday: unknown day %q", name)
+		}
+		if sw.days == nil {
+			sw.days = make(map[time.Weekday]bool)
+		}
+		sw.days[day] = true
+	}
+	if sr.Location != "" {
+		if sw.loc, err = time.LoadLocation(sr.Location); err != nil {
+			return nil, fmt.Errorf("schedule location: %v", err)
+		}
+	}
+	sw.start = time.Duration(startTime.Hour())*time.Hour + time.Duration(startTime.Minute())*time.Minute
+	sw.end = time.Duration(endTime.Hour())*time.Hour + time.Duration(endTime.Minute())*time.Minute
+	return sw, nil
+}
+
+// compileSchedules returns copies of rules carrying their parsed
+// windows. Invalid rules, which Validate rejects, are left without
+// one and are never active.
+func compileSchedules(rules []*ScheduleRule) []*ScheduleRule {
+	if rules == nil {
+		return nil
+	}
+	compiled := make([]*ScheduleRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule != nil {
+			ruleCopy := *rule
+			ruleCopy.window, _ = rule.parse()
+			rule = &ruleCopy
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled
+}
+
+// active reports whether now falls within the window.
+func (sr *ScheduleRule) active(now time.Time) bool {
+	sw := sr.window
+	if sw == nil || sw.start == sw.end {
+		return false
+	}
+	now = now.In(sw.loc)
+	sinceMidnight := time.Duration(now.Hour())*time.Hour +
+		time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+	switch {
+	case sw.start < sw.end:
+		if sinceMidnight < sw.start || sinceMidnight >= sw.end {
+			return false
+		}
+	case sinceMidnight >= sw.start:
+		// Before midnight, in a window spanning midnight.
+	case sinceMidnight < sw.end:
+		// After midnight, the window started the day before.
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return sw.days == nil || sw.days[day]
+}
+
+func (req *Request) validateSchedules() error {
+	for route, opts := range req.Routes {
+		if opts == nil {
+			continue
+		}
+		for _, rule := range opts.Schedules {
+			if rule == nil {
+				continue
+			}
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("route %q: %v", route, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scheduledAddress returns the next backend of the first schedule
+// rule of route active at the moment, or "" if there is none.
+func (lp *livelyProxy) scheduledAddress(route string, rules []*ScheduleRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	now := lp.clock.Now()
+	for i, rule := range rules {
+		if rule == nil || !rule.active(now) {
+			continue
+		}
+		if backends := normalizeAddresses(rule.Backends); len(backends) > 0 {
+			return lp.nextScheduled(fmt.Sprintf("%s#%d", route, i), backends)
+		}
+	}
+	return ""
+}
+
+func (lp *livelyProxy) nextScheduled(key string, backends []string) string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.scheduleNext == nil {
+		lp.scheduleNext = make(map[string]int)
+	}
+	next := lp.scheduleNext[key]
+	lp.scheduleNext[key] = next + 1
+	return backends[next%len(backends)]
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScheduledRouting(t *testing.T) {
+	poolServer := func(pool string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Pool", pool)
+		}))
+	}
+	regular, business, night := poolServer("regular"), poolServer("business"), poolServer("night")
+	defer regular.Close()
+	defer business.Close()
+	defer night.Close()
+
+	fc := newFakeClock()
+	lp := makeTestProxy(map[string][]string{"/": {regular.URL}})
+	lp.clock = fc
+	lp.routeOptions = map[string]*RouteOptions{
+		"/": {
+			Backends: []string{regular.URL},
+			Schedules: compileSchedules([]*ScheduleRule{
+				{Backends: []string{business.URL}, Start: "09:00", End: "17:00", Weekdays: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}},
+				{Backends: []string{night.URL}, Start: "22:00", End: "06:00"},
+			}),
+		},
+	}
+
+	tests := [...]struct {
+		now      time.Time
+		wantPool string
+	}{
+		// 2017-07-12 is a Wednesday.
+		0: {now: time.Date(2017, 7, 12, 10, 0, 0, 0, time.UTC), wantPool: "business"},
+		1: {now: time.Date(2017, 7, 12, 9, 0, 0, 0, time.UTC), wantPool: "business"},
+		2: {now: time.Date(2017, 7, 12, 17, 0, 0, 0, time.UTC), wantPool: "regular"},
+		3: {now: time.Date(2017, 7, 12, 8, 59, 59, 0, time.UTC), wantPool: "regular"},
+		// Saturday, out of the business days.
+		4: {now: time.Date(2017, 7, 15, 10, 0, 0, 0, time.UTC), wantPool: "regular"},
+		5: {now: time.Date(2017, 7, 12, 23, 0, 0, 0, time.UTC), wantPool: "night"},
+		6: {now: time.Date(2017, 7, 13, 3, 0, 0, 0, time.UTC), wantPool: "night"},
+		7: {now: time.Date(2017, 7, 13, 6, 0, 0, 0, time.UTC), wantPool: "regular"},
+		// Times in other zones are compared in the zone of the window.
+		8: {now: time.Date(2017, 7, 12, 10, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), wantPool: "regular"},
+	}
+
+	for i, tt := range tests {
+		fc.mu.Lock()
+		fc.now = tt.now
+		fc.mu.Unlock()
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got, want := rec.Header().Get("X-Pool"), tt.wantPool; got != want {
+			t.Errorf("#%d: %v: pool got=%q want=%q", i, tt.now, got, want)
+		}
+	}
+}
+
+func TestScheduleRuleActiveWeekdaysSpanningMidnight(t *testing.T) {
+	rule := compileSchedules([]*ScheduleRule{{Start: "22:00", End: "02:00", Weekdays: []string{"fri"}}})[0]
+
+	tests := [...]struct {
+		now  time.Time
+		want bool
+	}{
+		// 2017-07-14 is a Friday.
+		0: {now: time.Date(2017, 7, 14, 23, 0, 0, 0, time.UTC), want: true},
+		// Early Saturday is still within Friday's window.
+		1: {now: time.Date(2017, 7, 15, 1, 0, 0, 0, time.UTC), want: true},
+		2: {now: time.Date(2017, 7, 14, 1, 0, 0, 0, time.UTC), want: false},
+		3: {now: time.Date(2017, 7, 15, 23, 0, 0, 0, time.UTC), want: false},
+	}
+
+	for i, tt := range tests {
+		if got, want := rule.active(tt.now), tt.want; got != want {
+			t.Errorf("#%d: %v: active got=%v want=%v", i, tt.now, got, want)
+		}
+	}
+}
+
+func TestValidateSchedules(t *testing.T) {
+	tests := [...]struct {
+		rule    *ScheduleRule
+		wantErr bool
+	}{
+		0: {rule: &ScheduleRule{Backends: []string{"http://localhost:9000"}, Start: "09:00", End: "17:00"}},
+		1: {rule: &ScheduleRule{Backends: []string{"http://localhost:9000"}, Start: "9am", End: "17:00"}, wantErr: true},
+		2: {rule: &ScheduleRule{Start: "09:00", End: "17:00"}, wantErr: true},
+		3: {rule: &ScheduleRule{Backends: []string{"http://localhost:9000"}, Start: "09:00", End: "17:00", Weekdays: []string{"Funday"}}, wantErr: true},
+		4: {rule: &ScheduleRule{Backends: []string{"http://localhost:9000"}, Start: "09:00", End: "17:00", Location: "Mars/Olympus"}, wantErr: true},
+	}
+
+	for i, tt := range tests {
+		req := &Request{
+			NoAutoWWW: true,
+			Domains:   []string{"example.org"},
+			Routes: map[string]*RouteOptions{
+				"/": {Backends: []string{"http://localhost:8000"}, Schedules: []*ScheduleRule{tt.rule}},
+			},
+		}
+		err := req.Validate()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("#%d: expected a non-nil error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestRoutesParseSchedules(t *testing.T) {
+	rule := &ScheduleRule{Backends: []string{"http://localhost:9000"}, Start: "09:00", End: "17:00", Location: "America/New_York"}
+	req := &Request{
+		Routes: map[string]*RouteOptions{
+			"/": {Backends: []string{"http://localhost:8000"}, Schedules: []*ScheduleRule{rule}},
+		},
+	}
+	routes := req.routes()
+	sw := routes["/"].Schedules[0].window
+	if sw == nil {
+		t.Fatal("expected the schedule to be parsed along with the routes")
+	}
+	if got, want := sw.loc.String(), "America/New_York"; got != want {
+		t.Errorf("location got=%q want=%q", got, want)
+	}
+	if got, want := sw.start, 9*time.Hour; got != want {
+		t.Errorf("start got=%v want=%v", got, want)
+	}
+	if rule.window != nil {
+		t.Error("the rule of the request was modified")
+	}
+
+	// Copies of the routes keep the parsed windows.
+	if copyRoutes(routes)["/"].Schedules[0].window != sw {
+		t.Error("the parsed window wasn't carried over by copyRoutes")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ShutdownReport summarizes how the connections that
+// were in flight at the start of a Shutdown ended.
+type ShutdownReport struct {
+	// Drained is the number of in flight connections
+	// that completed before the shutdown deadline.
+	Drained int `json:"drained"`
+
+	// ForciblyClosed is the number of connections that
+	// were still in flight at the deadline and were closed.
+	ForciblyClosed int `json:"forcibly_closed"`
+}
+
+// connTracker keeps track of the states of the
+// connections of an http.Server via its ConnState hook.
+type connTracker struct {
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{states: make(map[net.Conn]http.ConnState)}
+}
+
+func (ct *connTracker) track(conn net.Conn, state http.ConnState) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(ct.states, conn)
+	default:
+		ct.states[conn] = state
+	}
+}
+
+// inFlight returns the number of connections that
+// are either serving a request or about to.
+func (ct *connTracker) inFlight() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	n := 0
+	for _, state := range ct.states {
+		if state == http.StateNew || state == http.StateActive {
+			n += 1
+		}
+	}
+	return n
+}
+
+// ShutdownPhase is a step of Shutdown, reported
+// in order to Request.OnShutdownPhase and logged.
+type ShutdownPhase string
+
+const (
+	// ShutdownStoppedAccepting is when the listeners are closed.
+	ShutdownStoppedAccepting ShutdownPhase = "stopped accepting"
+
+	// ShutdownUnready is when Ready starts reporting false.
+	ShutdownUnready ShutdownPhase = "unready"
+
+	// ShutdownDrained is when the in flight connections have
+	// completed, or were closed at the deadline.
+	ShutdownDrained ShutdownPhase = "drained"
+
+	// ShutdownHealthChecksStopped is when the backends are
+	// no longer health checked, the last phase.
+	ShutdownHealthChecksStopped ShutdownPhase = "health checks stopped"
+)
+
+// Shutdown gracefully stops the frontend: it stops accepting
+// connections, marks the frontend unready, then waits for in flight
+// connections to complete until ctx is done, at which point the
+// remaining ones are closed, and finally stops the health checks.
+// The returned report counts the connections in either case. The
+// error is ctx's if it expired before the health checks stopped.
+func (lc *ListenConfirmation) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return lc.shutdownFn(ctx)
+}
+
+// Ready reports whether the frontend is serving,
+// that is that it hasn't started shutting down.
+func (lc *ListenConfirmation) Ready() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return !lc.unready
+}
+
+func (lc *ListenConfirmation) markUnready() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.unready = true
+}
+
+func shutdownServer(ctx context.Context, server *http.Server, ct *connTracker) (*ShutdownReport, error) {
+	inFlight := ct.inFlight()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		return &ShutdownReport{Drained: inFlight}, nil
+	}
+
+	// The deadline was hit, so forcibly close the stragglers.
+	stuck := ct.inFlight()
+	server.Close()
+	report := &ShutdownReport{ForciblyClosed: stuck}
+	if drained := inFlight - stuck; drained > 0 {
+		report.Drained = drained
+	}
+	return report, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+)
+
+// slowStart is the ramp up of a backend that became live again.
+type slowStart struct {
+	since time.Time
+}
+
+// trackSlowStartsLocked starts ramping up those of livePeers that
+// weren't live before, unless route was never cycled, in which case
+// every backend is new. lp.mu must be held.
+func (lp *livelyProxy) trackSlowStartsLocked(route string, opts *RouteOptions, livePeers []*lively.Liveliness, wasCycled bool) {
+	if opts == nil || opts.SlowStart <= 0 {
+		delete(lp.slowStarts, route)
+		return
+	}
+
+	wasLive := make(map[string]bool, len(lp.liveAddresses[route]))
+	for _, addr := range lp.liveAddresses[route] {
+		wasLive[addr] = true
+	}
+	isLive := make(map[string]bool, len(livePeers))
+	for _, peer := range livePeers {
+		isLive[peer.Addr] = true
+	}
+
+	ramping := lp.slowStarts[route]
+	for addr := range ramping {
+		if !isLive[addr] {
+			delete(ramping, addr)
+		}
+	}
+	if !wasCycled {
+		return
+	}
+	now := lp.clock.Now()
+	for addr := range isLive {
+		if wasLive[addr] {
+			continue
+		}
+		if ramping == nil {
+			ramping = make(map[string]*slowStart)
+			if lp.slowStarts == nil {
+				lp.slowStarts = make(map[string]map[string]*slowStart)
+			}
+			lp.slowStarts[route] = ramping
+		}
+		ramping[addr] = &slowStart{since: now}
+	}
+}
+
+// slowStartFactorLocked returns the part of its weight that addr
+// gets for route: backends ramping up get a part that grows linearly
+// from 0 to 1 over the SlowStart of the route, while the others get
+// all of it. lp.mu must be held.
+func (lp *livelyProxy) slowStartFactorLocked(route, addr string, now time.Time) float64 {
+	ss := lp.slowStarts[route][addr]
+	if ss == nil {
+		return 1
+	}
+	var ramp time.Duration
+	if opts := lp.routeOptions[route]; opts != nil {
+		ramp = opts.SlowStart
+	}
+	elapsed := now.Sub(ss.since)
+	if ramp <= 0 || elapsed >= ramp {
+		delete(lp.slowStarts[route], addr)
+		return 1
+	}
+	return float64(elapsed) / float64(ramp)
+}
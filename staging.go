@@ -0,0 +1,298 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+)
+
+var (
+	errNothingStaged    = errors.New("no router has been staged")
+	errStagedNotHealthy = errors.New("the staged router is not yet healthy")
+)
+
+// StageRouter prepares pr as the complete next route to backends
+// mapping, for blue/green deploys. The staged backends are health
+// checked in the background and the mapping only takes effect once
+// promoted by PromoteStaged. Staging again replaces the staged mapping.
+// Like in the PrefixRouter of a Request, the backends can be given
+// along with their weight e.g "http://localhost:8080|weight=5", which
+// replace those of the route once promoted.
+func (lc *ListenConfirmation) StageRouter(pr map[string][]string) error {
+	if lc.lproxy == nil {
+		return errReloadUnsupported
+	}
+	stagedReq := &Request{PrefixRouter: pr}
+	if err := stagedReq.validateWeights(); err != nil {
+		return err
+	}
+	stagedRoutes := stagedReq.routes()
+	pr = stagedReq.normalizedPrefixRouter()
+	if !(&Request{PrefixRouter: pr}).hasAtLeastOneProxy() {
+		return errEmptyProxyAddress
+	}
+	if err := validateRoutePrefixes(pr); err != nil {
+		return err
+	}
+
+	lp := lc.lproxy
+	lp.mu.Lock()
+	freq := lp.cycleFreq
+	healthCheck := lp.healthCheck
+	pingLimiter := lp.pingLimiter
+	lp.mu.Unlock()
+	if freq <= 0 {
+		freq = DefaultBackendPingPeriod
+	}
+
+	staged := makeLivelyProxy(freq, pr)
+	// The staged backends are reached as they will be once
+	// promoted, e.g at their DialAddresses or over mTLS.
+	staged.setTransportOptions(lp.transportOptions())
+	staged.setHealthCheckOptions(healthCheck)
+	staged.pingLimiter = pingLimiter
+	// The staged backends are checked with the options
+	// of their routes, e.g over HTTP/2 for gRPC routes.
+	staged.routeOptions = lp.carriedRouteOptions()
+	for route, opts := range staged.routeOptions {
+		if stagedOpts, ok := stagedRoutes[route]; ok {
+			opts.Weights = stagedOpts.Weights
+		} else {
+			delete(staged.routeOptions, route)
+		}
+	}
+	for route, opts := range stagedRoutes {
+		if _, ok := staged.routeOptions[route]; !ok && len(opts.Weights) > 0 {
+			staged.routeOptions[route] = &RouteOptions{Weights: opts.Weights}
+		}
+	}
+
+	lc.mu.Lock()
+	lc.staged = staged
+	lc.mu.Unlock()
+
+	for route, primary := range staged.primariesMap {
+		go lc.checkStaged(staged, route, primary, freq)
+	}
+	return nil
+}
+
+// checkStaged cycles the liveliness of a route of staged until
+// staged is promoted, replaced or the listener is closed.
+func (lc *ListenConfirmation) checkStaged(staged *livelyProxy, route string, primary *lively.Peer, freq time.Duration) {
+	for {
+		lc.mu.Lock()
+		current := lc.staged == staged
+		lc.mu.Unlock()
+		if !current {
+			return
+		}
+
+		_, _, _ = staged.cycle(route, primary)
+
+		select {
+		case <-lc.done:
+			return
+		case <-staged.clock.After(freq):
+		}
+	}
+}
+
+// healthy reports whether every route has been
+// checked and has at least one live backend.
+func (lp *livelyProxy) healthy() bool {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	for route := range lp.primariesMap {
+		if !lp.cycled[route] || len(lp.liveAddresses[route]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PromoteStaged atomically swaps in the mapping staged by StageRouter.
+// It fails if nothing was staged or if the staged backends haven't
+// yet passed their health checks, in which case it can be retried.
+func (lc *ListenConfirmation) PromoteStaged() error {
+	lc.reloadMu.Lock()
+	defer lc.reloadMu.Unlock()
+
+	lc.mu.Lock()
+	staged := lc.staged
+	if staged == nil {
+		lc.mu.Unlock()
+		return errNothingStaged
+	}
+	if !staged.healthy() {
+		lc.mu.Unlock()
+		return errStagedNotHealthy
+	}
+	lc.staged = nil
+	lc.mu.Unlock()
+
+	removed := lc.lproxy.swapIn(staged)
+	for route, primary := range staged.primariesMap {
+		go lc.collectFeedback(route, lc.lproxy.startCycling(route, primary))
+	}
+	if lc.onBackendRemoved != nil {
+		for _, rb := range removed {
+			lc.onBackendRemoved(rb.route, rb.addr)
+		}
+	}
+
+	pr := make(map[string][]string)
+	for route, peersMap := range staged.secondariesMap {
+		for _, secondary := range peersMap {
+			pr[route] = append(pr[route], secondary.Addr)
+		}
+	}
+	// The backends now come from pr, while the other
+	// options of the routes are those carried over.
+	promoted := &Request{PrefixRouter: pr, Routes: lc.lproxy.carriedRouteOptions()}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.config != nil {
+		config := *lc.config
+		config.PrefixRouter = pr
+		config.Routes = promoted.routes()
+		lc.config = &config
+	}
+	if lc.base != nil {
+		base := *lc.base
+		base.PrefixRouter = pr
+		base.Routes = promoted.Routes
+		lc.base = &base
+	}
+	return nil
+}
+
+// carriedRouteOptions returns a copy of the options of the routes
+// without their backends, as carried over by swapIn.
+func (lp *livelyProxy) carriedRouteOptions() map[string]*RouteOptions {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	routes := copyRoutes(lp.routeOptions)
+	for _, opts := range routes {
+		opts.Backends = nil
+	}
+	return routes
+}
+
+// swapIn atomically replaces the routing state of lp with that of
+// staged and returns the backends that are no longer being routed to,
+// whose cached proxies and transports are discarded after the grace
+// period.
+func (lp *livelyProxy) swapIn(staged *livelyProxy) (removed []removedBackend) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	staged.mu.Lock()
+	defer staged.mu.Unlock()
+
+	for route, peersMap := range lp.secondariesMap {
+		kept := make(map[string]bool)
+		for _, secondary := range staged.secondariesMap[route] {
+			kept[secondary.Addr] = true
+		}
+		present := make(map[string]bool)
+		for _, secondary := range peersMap {
+			present[secondary.Addr] = true
+			if !kept[secondary.Addr] {
+				removed = append(removed, removedBackend{route: route, addr: secondary.Addr})
+			}
+		}
+		changed := !reflect.DeepEqual(present, kept)
+
+		if _, ok := staged.primariesMap[route]; !ok {
+			delete(lp.canaries, route)
+			delete(lp.affinityRings, route)
+			delete(lp.slowStarts, route)
+			delete(lp.healthStates, route)
+			delete(lp.mirrors, route)
+			delete(lp.lastCycles, route)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// The verdicts and rings from before the promotion don't
+		// apply to the new backends, while the backends that remain
+		// keep ramping up and their health transitions carry on.
+		delete(lp.canaries, route)
+		delete(lp.affinityRings, route)
+		for addr := range lp.slowStarts[route] {
+			if !kept[addr] {
+				delete(lp.slowStarts[route], addr)
+			}
+		}
+		for addr := range lp.healthStates[route] {
+			if !kept[addr] {
+				delete(lp.healthStates[route], addr)
+			}
+		}
+	}
+
+	routeOptions := make(map[string]*RouteOptions)
+	for route := range staged.primariesMap {
+		opts, ok := lp.routeOptions[route]
+		stagedOpts := staged.routeOptions[route]
+		if !ok && stagedOpts == nil {
+			continue
+		}
+		var optsCopy RouteOptions
+		if ok {
+			optsCopy = *opts
+		}
+		// The weights are keyed by the addresses of the
+		// backends, hence only the staged ones still apply.
+		optsCopy.Backends, optsCopy.Weights = nil, nil
+		if stagedOpts != nil {
+			optsCopy.Weights = stagedOpts.Weights
+		}
+		routeOptions[route] = &optsCopy
+	}
+
+	lp.primariesMap = staged.primariesMap
+	lp.secondariesMap = staged.secondariesMap
+	lp.routePrefixes = staged.routePrefixes
+	lp.routeOptions = routeOptions
+	lp.liveAddresses = staged.liveAddresses
+	lp.cycled = staged.cycled
+	lp.currentWeights = make(map[string]map[string]float64)
+	for route := range staged.primariesMap {
+		lp.generation[route] += 1
+	}
+
+	if len(removed) > 0 {
+		grace := lp.removedBackendGracePeriod
+		if grace <= 0 {
+			grace = DefaultRemovedBackendGracePeriod
+		}
+		addrs := make([]string, 0, len(removed))
+		for _, rb := range removed {
+			addrs = append(addrs, rb.addr)
+		}
+		lp.discardBackendsAfter(addrs, grace)
+	}
+	return removed
+}
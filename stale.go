@@ -0,0 +1,191 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	// maxStaleResponses bounds the number of responses
+	// kept to be served stale per ServeStaleOnError.
+	maxStaleResponses = 1024
+
+	// maxStaleBodyBytes bounds the body of the kept responses.
+	maxStaleBodyBytes = 1 << 20
+
+	staleWarning = `110 - "Response is Stale"`
+)
+
+// staleResponse is the last successful response to the
+// GET requests of a URL, kept per ServeStaleOnError.
+type staleResponse struct {
+	header http.Header
+	body   []byte
+	stored time.Time
+
+	// vary holds the values, in the request that the response was
+	// for, of the request headers named by the Vary response header.
+	vary map[string]string
+}
+
+// staleKey returns the key that the response to r is kept under, or
+// "" if it isn't to be kept. It must be called before the URL and the
+// Host of r are rewritten for the backend. The responses to requests
+// with credentials, be they headers or a client certificate, are never
+// kept, as they could be for that user only, nor are any when the
+// identity of client certificates is forwarded to the backends.
+func (lp *livelyProxy) staleKey(route string, r *http.Request) string {
+	if !lp.serveStaleOnError || r.Method != http.MethodGet || lp.forwardClientCert {
+		return ""
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return ""
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return ""
+	}
+	return route + "\x00" + r.Host + r.URL.RequestURI()
+}
+
+// storableStale reports whether res can be
+// kept and later served to other clients.
+func storableStale(res *http.Response) bool {
+	if res.StatusCode != http.StatusOK || res.ContentLength > maxStaleBodyBytes {
+		return false
+	}
+	if len(res.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	cacheControl := res.Header.Values("Cache-Control")
+	if httpguts.HeaderValuesContainsToken(cacheControl, "no-store") ||
+		httpguts.HeaderValuesContainsToken(cacheControl, "private") {
+		return false
+	}
+	return !httpguts.HeaderValuesContainsToken(res.Header.Values("Vary"), "*")
+}
+
+// recordStale arranges for res to be kept under key
+// once its body has been completely read.
+func (lp *livelyProxy) recordStale(key string, res *http.Response) {
+	if key == "" || res.Body == nil || !storableStale(res) {
+		return
+	}
+	sr := &staleResponse{header: res.Header.Clone()}
+	for _, value := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if sr.vary == nil {
+					sr.vary = make(map[string]string)
+				}
+				name = http.CanonicalHeaderKey(name)
+				sr.vary[name] = res.Request.Header.Get(name)
+			}
+		}
+	}
+	res.Body = &staleRecorder{rc: res.Body, onEOF: func(body []byte) {
+		sr.body = body
+		sr.stored = lp.clock.Now()
+		lp.storeStale(key, sr)
+	}}
+}
+
+func (lp *livelyProxy) storeStale(key string, sr *staleResponse) {
+	lp.staleMu.Lock()
+	defer lp.staleMu.Unlock()
+
+	if lp.staleResponses == nil {
+		lp.staleResponses = make(map[string]*staleResponse)
+	}
+	if _, ok := lp.staleResponses[key]; !ok && len(lp.staleResponses) >= maxStaleResponses {
+		// Make room by evicting an arbitrary response.
+		for evicted := range lp.staleResponses {
+			delete(lp.staleResponses, evicted)
+			break
+		}
+	}
+	lp.staleResponses[key] = sr
+}
+
+// serveStale serves the response kept for r, if any, with a Warning
+// header signalling that it is stale, and reports whether it did.
+func (lp *livelyProxy) serveStale(w http.ResponseWriter, r *http.Request, route string) bool {
+	key := lp.staleKey(route, r)
+	if key == "" {
+		return false
+	}
+	lp.staleMu.Lock()
+	sr := lp.staleResponses[key]
+	lp.staleMu.Unlock()
+	if sr == nil {
+		return false
+	}
+	for name, value := range sr.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	header := w.Header()
+	for name, values := range sr.header {
+		header[name] = append([]string(nil), values...)
+	}
+	// The timings are those of the original response.
+	header.Del("Server-Timing")
+	header.Add("Warning", staleWarning)
+	header.Set("Age", strconv.FormatInt(int64(lp.clock.Now().Sub(sr.stored)/time.Second), 10))
+	header.Set("Content-Length", strconv.Itoa(len(sr.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(sr.body)
+	return true
+}
+
+// staleRecorder buffers the body read from rc, handing
+// it to onEOF once rc has been completely read, unless
+// it turns out to be larger than maxStaleBodyBytes.
+type staleRecorder struct {
+	rc    io.ReadCloser
+	buf   bytes.Buffer
+	onEOF func(body []byte)
+	done  bool
+}
+
+func (sr *staleRecorder) Read(b []byte) (int, error) {
+	n, err := sr.rc.Read(b)
+	if !sr.done {
+		if sr.buf.Len()+n > maxStaleBodyBytes {
+			sr.done = true
+			sr.buf = bytes.Buffer{}
+		} else {
+			sr.buf.Write(b[:n])
+			if err == io.EOF {
+				sr.done = true
+				sr.onEOF(sr.buf.Bytes())
+			}
+		}
+	}
+	return n, err
+}
+
+func (sr *staleRecorder) Close() error {
+	return sr.rc.Close()
+}
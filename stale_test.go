@@ -0,0 +1,142 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeStaleOnError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/private":
+			rw.Header().Set("Cache-Control", "private")
+		case "/vary":
+			rw.Header().Set("Vary", "Accept-Language")
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte("fresh " + req.URL.Path + " " + req.Header.Get("Accept-Language")))
+	}))
+
+	lp := makeLivelyProxy(0, map[string][]string{"/": {backend.URL}})
+	lp.serveStaleOnError = true
+	lp.logfFn = func(string, ...interface{}) {}
+	clock := newFakeClock()
+	lp.clock = clock
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+
+	get := func(path, language string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, path := range []string{"/a", "/private", "/vary"} {
+		if rec := get(path, "fr"); rec.Code != http.StatusOK {
+			t.Fatalf("%s: code got=%d want=%d", path, rec.Code, http.StatusOK)
+		}
+	}
+
+	withCookie := httptest.NewRequest("GET", "/session", nil)
+	withCookie.AddCookie(&http.Cookie{Name: "session", Value: "alice"})
+	rec := httptest.NewRecorder()
+	lp.ServeHTTP(rec, withCookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/session: code got=%d want=%d", rec.Code, http.StatusOK)
+	}
+
+	// Drop all the backends.
+	backend.Close()
+	if _, _, err := lp.cycle("/", lp.primariesMap["/"]); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+	clock.Advance(90 * time.Second)
+
+	tests := [...]struct {
+		path     string
+		language string
+		wantCode int
+		wantBody string
+	}{
+		0: {path: "/a", wantCode: http.StatusOK, wantBody: "fresh /a fr"},
+		1: {path: "/vary", language: "fr", wantCode: http.StatusOK, wantBody: "fresh /vary fr"},
+		// The responses kept can't be served to other variants.
+		2: {path: "/vary", language: "de", wantCode: http.StatusServiceUnavailable, wantBody: "no live backends for route /"},
+		// Private responses aren't kept.
+		3: {path: "/private", wantCode: http.StatusServiceUnavailable, wantBody: "no live backends for route /"},
+		// Nor the responses to requests with cookies, which
+		// could be for that user only, to serve to others.
+		4: {path: "/session", wantCode: http.StatusServiceUnavailable, wantBody: "no live backends for route /"},
+		5: {path: "/never-fetched", wantCode: http.StatusServiceUnavailable, wantBody: "no live backends for route /"},
+	}
+	for i, tt := range tests {
+		rec := get(tt.path, tt.language)
+		if got := rec.Code; got != tt.wantCode {
+			t.Errorf("#%d: %s: code got=%d want=%d", i, tt.path, got, tt.wantCode)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+			t.Errorf("#%d: %s: body got=%q want=%q", i, tt.path, got, tt.wantBody)
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		if got, want := rec.Header().Get("Warning"), `110 - "Response is Stale"`; got != want {
+			t.Errorf("#%d: %s: Warning got=%q want=%q", i, tt.path, got, want)
+		}
+		if got, want := rec.Header().Get("Age"), "90"; got != want {
+			t.Errorf("#%d: %s: Age got=%q want=%q", i, tt.path, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Type"), "text/plain"; got != want {
+			t.Errorf("#%d: %s: Content-Type got=%q want=%q", i, tt.path, got, want)
+		}
+	}
+
+	// Without ServeStaleOnError, the 503 is served.
+	lp.serveStaleOnError = false
+	if rec := get("/a", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code got=%d want=%d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestStaleKey(t *testing.T) {
+	lp := makeTestProxy(map[string][]string{"/": {"http://127.0.0.1:1"}})
+	lp.serveStaleOnError = true
+
+	if key := lp.staleKey("/", httptest.NewRequest("GET", "/a", nil)); key == "" {
+		t.Error("the response to an anonymous request isn't kept")
+	}
+	// The responses to clients authenticated by their
+	// certificate could be for that identity only.
+	mtls := httptest.NewRequest("GET", "/a", nil)
+	mtls.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+	if key := lp.staleKey("/", mtls); key != "" {
+		t.Errorf("the response to a request with a client certificate is kept under %q", key)
+	}
+	lp.forwardClientCert = true
+	if key := lp.staleKey("/", httptest.NewRequest("GET", "/a", nil)); key != "" {
+		t.Errorf("a response is kept under %q despite ForwardClientCert", key)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/orijtech/frontender/lively"
+)
+
+// RouteStatus is the health of the backends of a route,
+// as served at the StatusAddr of the frontend.
+type RouteStatus struct {
+	Live []string `json:"live"`
+	Dead []string `json:"dead"`
+
+	// LastCycle numbers the last liveliness cycle of the
+	// route, from 1, or is 0 if it wasn't cycled yet.
+	LastCycle uint64 `json:"last_cycle"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// routeCycle is the outcome of the last liveliness cycle of a route.
+type routeCycle struct {
+	number uint64
+	dead   []string
+	err    error
+}
+
+// recordCycle records the outcome of cycle number of route,
+// unless primary no longer is the primary of route.
+func (lp *livelyProxy) recordCycle(route string, primary *lively.Peer, number uint64, nonLivePeers []*lively.Liveliness, err error) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.primariesMap[route] != primary {
+		return
+	}
+	rc := &routeCycle{number: number, err: err}
+	for _, peer := range nonLivePeers {
+		rc.dead = append(rc.dead, peer.Addr)
+	}
+	if lp.lastCycles == nil {
+		lp.lastCycles = make(map[string]*routeCycle)
+	}
+	lp.lastCycles[route] = rc
+}
+
+// status returns the status of every route.
+func (lp *livelyProxy) status() map[string]*RouteStatus {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	statuses := make(map[string]*RouteStatus, len(lp.primariesMap))
+	for route := range lp.primariesMap {
+		rs := &RouteStatus{
+			Live: distinctSorted(lp.liveAddresses[route]),
+			Dead: []string{},
+		}
+		if rc := lp.lastCycles[route]; rc != nil {
+			rs.Dead = distinctSorted(rc.dead)
+			rs.LastCycle = rc.number
+			if rc.err != nil {
+				rs.LastError = rc.err.Error()
+			}
+		}
+		statuses[route] = rs
+	}
+	return statuses
+}
+
+// distinctSorted returns a sorted copy of addrs without
+// duplicates, which is never nil to encode as a JSON array.
+func distinctSorted(addrs []string) []string {
+	seen := make(map[string]bool, len(addrs))
+	distinct := []string{}
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			distinct = append(distinct, addr)
+		}
+	}
+	sort.Strings(distinct)
+	return distinct
+}
+
+func (lp *livelyProxy) serveStatus(w http.ResponseWriter, r *http.Request) {
+	blob, err := json.MarshalIndent(lp.status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
@@ -0,0 +1,224 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+)
+
+// TCPRoute forwards the raw TCP connections accepted on Addr to
+// its backends, without any HTTP parsing, e.g for a database
+//
+//	{"addr": ":5432", "backends": ["10.0.0.7:5432", "10.0.0.8:5432"]}
+//
+// Backends are health checked like those of HTTP routes except
+// that a backend is live if a TCP connection to it can be opened.
+// Connections are round robined across the live backends.
+type TCPRoute struct {
+	Addr     string   `json:"addr"`
+	Backends []string `json:"backends"`
+}
+
+const tcpScheme = "tcp://"
+
+// tcpDialTimeout bounds connecting to a TCP
+// backend, for health checks and forwarding.
+const tcpDialTimeout = 10 * time.Second
+
+func (req *Request) validateTCPRoutes() error {
+	seen := make(map[string]bool)
+	for i, route := range req.TCPRoutes {
+		if route == nil || strings.TrimSpace(route.Addr) == "" {
+			return fmt.Errorf("tcp route #%d: expecting a non-empty address", i)
+		}
+		if seen[route.Addr] {
+			return fmt.Errorf("tcp route %q: duplicated", route.Addr)
+		}
+		seen[route.Addr] = true
+		if len(normalizeAddresses(route.Backends)) == 0 {
+			return fmt.Errorf("tcp route %q: expecting at least one backend", route.Addr)
+		}
+	}
+	return nil
+}
+
+// tcpForwarder accepts the connections of the TCP routes and
+// pipes them to live backends. Its livelyProxy has a route per
+// listening address, whose backends are "tcp://host:port".
+type tcpForwarder struct {
+	lp        *livelyProxy
+	listeners map[string]net.Listener
+
+	closeOnce sync.Once
+}
+
+// listenTCPRoutes binds the addresses of the TCP routes of req.
+// It returns nil if req has no TCP routes.
+func (req *Request) listenTCPRoutes() (*tcpForwarder, error) {
+	if len(req.TCPRoutes) == 0 {
+		return nil, nil
+	}
+
+	pr := make(map[string][]string)
+	listeners := make(map[string]net.Listener)
+	for _, route := range req.TCPRoutes {
+		ln, err := net.Listen("tcp", route.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("frontender: tcp route %q: %v", route.Addr, err)
+		}
+		listeners[route.Addr] = ln
+		for _, addr := range normalizeAddresses(route.Backends) {
+			pr[route.Addr] = append(pr[route.Addr], tcpScheme+addr)
+		}
+	}
+
+	lp := makeLivelyProxy(req.BackendPingPeriod, pr)
+	lp.logfFn = req.Logf
+	lp.transportForBackend = func(string) http.RoundTripper { return tcpDialChecker{} }
+	return &tcpForwarder{lp: lp, listeners: listeners}, nil
+}
+
+// serve starts health checking the backends and accepting connections.
+func (tf *tcpForwarder) serve() {
+	tf.lp.mu.Lock()
+	primaries := make(map[string]*lively.Peer, len(tf.lp.primariesMap))
+	for route, primary := range tf.lp.primariesMap {
+		primaries[route] = primary
+	}
+	tf.lp.mu.Unlock()
+
+	for route, primary := range primaries {
+		feedbackChan := tf.lp.startCycling(route, primary)
+		go func() {
+			for range feedbackChan {
+			}
+		}()
+	}
+	for route, ln := range tf.listeners {
+		go tf.accept(route, ln)
+	}
+}
+
+func (tf *tcpForwarder) accept(route string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			tf.lp.logf("frontender: tcp route %q: accept: %v", route, err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go tf.forward(route, conn)
+	}
+}
+
+func (tf *tcpForwarder) forward(route string, conn net.Conn) {
+	defer conn.Close()
+
+	addr := tf.lp.roundRobinedAddress(route)
+	if addr == "" {
+		tf.lp.logf("frontender: tcp route %q: no live backends", route)
+		return
+	}
+	backend, err := net.DialTimeout("tcp", strings.TrimPrefix(addr, tcpScheme), tcpDialTimeout)
+	if err != nil {
+		tf.lp.logf("frontender: tcp route %q: %v", route, err)
+		return
+	}
+	defer backend.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(backend, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(conn, backend)
+	}()
+	wg.Wait()
+}
+
+// pipe copies src to dst then signals the end of
+// the stream to dst, while src may still be read.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// closeListeners stops accepting connections. Connections
+// already being forwarded are left to complete.
+func (tf *tcpForwarder) closeListeners() error {
+	err := errAlreadyClosed
+	tf.closeOnce.Do(func() {
+		err = nil
+		for _, ln := range tf.listeners {
+			if cerr := ln.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// close stops accepting connections and health checking.
+func (tf *tcpForwarder) close() error {
+	err := tf.closeListeners()
+	tf.lp.stopHealthChecks()
+	return err
+}
+
+// tcpDialChecker answers the health check pings of TCP
+// backends by opening, then closing, a connection to them.
+type tcpDialChecker struct{}
+
+var _ http.RoundTripper = tcpDialChecker{}
+
+func (tcpDialChecker) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := net.DialTimeout("tcp", req.URL.Host, tcpDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpUpperServer is a fake TCP backend that answers
+// each line that it reads with the line upper cased.
+func tcpUpperServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, strings.ToUpper(line))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTCPRoutes(t *testing.T) {
+	backend := tcpUpperServer(t)
+	defer backend.Close()
+
+	// A backend that refuses connections is never picked.
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := deadLn.Addr().String()
+	deadLn.Close()
+
+	req := &Request{
+		BackendPingPeriod: 10 * time.Millisecond,
+		TCPRoutes: []*TCPRoute{
+			{Addr: "127.0.0.1:0", Backends: []string{backend.Addr().String(), dead}},
+		},
+	}
+	if err := req.validateTCPRoutes(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	tf, err := req.listenTCPRoutes()
+	if err != nil {
+		t.Fatalf("listenTCPRoutes: %v", err)
+	}
+	defer tf.close()
+	tf.serve()
+	frontAddr := tf.listeners["127.0.0.1:0"].Addr().String()
+
+	roundTrip := func(msg string) (string, error) {
+		conn, err := net.Dial("tcp", frontAddr)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(conn, msg+"\n"); err != nil {
+			return "", err
+		}
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	// Until the backends are health checked, connections are closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, err := roundTrip("ready?"); err == nil {
+			if want := "READY?\n"; got != want {
+				t.Fatalf("got=%q want=%q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the tcp route never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		got, err := roundTrip("hello")
+		if err != nil {
+			t.Fatalf("#%d: round trip: %v", i, err)
+		}
+		if want := "HELLO\n"; got != want {
+			t.Errorf("#%d: got=%q want=%q", i, got, want)
+		}
+	}
+
+	tf.close()
+	if _, err := roundTrip("closed"); err == nil {
+		t.Errorf("expected an error once closed")
+	}
+}
+
+func TestValidateTCPRoutes(t *testing.T) {
+	tests := [...]struct {
+		routes  []*TCPRoute
+		wantErr bool
+	}{
+		0: {routes: []*TCPRoute{{Addr: ":5432", Backends: []string{"10.0.0.7:5432"}}}},
+		1: {routes: []*TCPRoute{{Addr: "", Backends: []string{"10.0.0.7:5432"}}}, wantErr: true},
+		2: {routes: []*TCPRoute{{Addr: ":5432"}}, wantErr: true},
+		3: {
+			routes: []*TCPRoute{
+				{Addr: ":5432", Backends: []string{"10.0.0.7:5432"}},
+				{Addr: ":5432", Backends: []string{"10.0.0.8:5432"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		err := (&Request{TCPRoutes: tt.routes}).validateTCPRoutes()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("#%d: expected a non-nil error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgrade reports whether r asks to switch protocols, as WebSocket
+// handshakes do. Once its backend agrees with 101 Switching Protocols,
+// the reverse proxy hijacks the client's connection and copies the
+// bytes both ways until either side closes, so the connection sticks
+// to the backend picked for the handshake. If that backend dies, the
+// client's connection is closed too; it is up to the client to connect
+// again, to a live backend. The response timeouts, retries, response
+// body limits and coalescing don't apply to upgrades, as they'd break
+// the long lived connections.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
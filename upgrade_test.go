@@ -0,0 +1,133 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeBackend returns a backend that upgrades connections
+// to a line based echo protocol, prefixing the lines with its name.
+func newEchoUpgradeBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !isUpgrade(req) || req.Header.Get("Upgrade") != "echo" {
+			http.Error(rw, "expected an upgrade to echo", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(brw, "%s: %s", name, line)
+			brw.Flush()
+		}
+	}))
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	a, b := newEchoUpgradeBackend("a"), newEchoUpgradeBackend("b")
+	defer a.Close()
+	defer b.Close()
+
+	lp := makeTestProxy(map[string][]string{"/": {a.URL, b.URL}})
+	// None of these must get in the way of upgraded connections.
+	lp.backendResponseTimeout = 20 * time.Millisecond
+	lp.maxResponseBodyBytes = 4
+	lp.coalesceGETs = true
+	lp.routeOptions = map[string]*RouteOptions{"/": {Retries: 2}}
+	frontend := httptest.NewServer(lp)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: example.org\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got, want := res.StatusCode, http.StatusSwitchingProtocols; got != want {
+		t.Fatalf("handshake: code got=%d want=%d", got, want)
+	}
+	if got, want := res.Header.Get("Upgrade"), "echo"; got != want {
+		t.Errorf("handshake: Upgrade got=%q want=%q", got, want)
+	}
+
+	// Past the response timeout, the connection is still up and
+	// sticks to the backend that answered the handshake.
+	time.Sleep(50 * time.Millisecond)
+	var backend string
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(conn, "message %d\n", i)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("#%d: read: %v", i, err)
+		}
+		name, echoed, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		if want := fmt.Sprintf("message %d", i); echoed != want {
+			t.Errorf("#%d: echoed got=%q want=%q", i, echoed, want)
+		}
+		if i == 0 {
+			backend = name
+		} else if name != backend {
+			t.Errorf("#%d: switched from backend %q to %q", i, backend, name)
+		}
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := [...]struct {
+		upgrade, connection string
+		want                bool
+	}{
+		0: {upgrade: "websocket", connection: "Upgrade", want: true},
+		1: {upgrade: "websocket", connection: "keep-alive, upgrade", want: true},
+		2: {upgrade: "websocket", connection: "keep-alive"},
+		3: {connection: "Upgrade"},
+		4: {},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if tt.connection != "" {
+			r.Header.Set("Connection", tt.connection)
+		}
+		if got := isUpgrade(r); got != tt.want {
+			t.Errorf("#%d: got=%t want=%t", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	modulePath    = "github.com/orijtech/frontender"
+	versionHeader = "X-Frontender-Version"
+
+	// develVersion is the version of
+	// builds from a local checkout.
+	develVersion = "(devel)"
+)
+
+// Version returns the version of frontender that the running
+// binary was built with, as recorded in its build info.
+var Version = sync.OnceValue(func() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return develVersion
+	}
+	return versionFromBuildInfo(bi)
+})
+
+func versionFromBuildInfo(bi *debug.BuildInfo) string {
+	module := &bi.Main
+	if module.Path != modulePath {
+		module = nil
+		for _, dep := range bi.Deps {
+			if dep.Path == modulePath {
+				module = dep
+				break
+			}
+		}
+	}
+	if module == nil {
+		return develVersion
+	}
+	if module.Replace != nil && module.Replace.Version != "" {
+		module = module.Replace
+	}
+	if module.Version == "" {
+		return develVersion
+	}
+	return module.Version
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+func TestVersionFromBuildInfo(t *testing.T) {
+	tests := [...]struct {
+		bi   *debug.BuildInfo
+		want string
+	}{
+		// Built from a checkout of frontender.
+		0: {bi: &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: develVersion}}, want: develVersion},
+		1: {bi: &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "v0.9.1"}}, want: "v0.9.1"},
+		// Built as a dependency, say by GenerateBinary.
+		2: {
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "frontender-generated"},
+				Deps: []*debug.Module{
+					{Path: "golang.org/x/net", Version: "v0.30.0"},
+					{Path: modulePath, Version: "v0.9.1"},
+				},
+			},
+			want: "v0.9.1",
+		},
+		3: {
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "frontender-generated"},
+				Deps: []*debug.Module{{
+					Path: modulePath, Version: "v0.9.1",
+					Replace: &debug.Module{Path: "github.com/fork/frontender", Version: "v0.9.2"},
+				}},
+			},
+			want: "v0.9.2",
+		},
+		// Replaced with a local directory.
+		4: {
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "frontender-generated"},
+				Deps: []*debug.Module{{
+					Path: modulePath, Version: replacedVersion,
+					Replace: &debug.Module{Path: "../frontender"},
+				}},
+			},
+			want: replacedVersion,
+		},
+		5: {bi: &debug.BuildInfo{Main: debug.Module{Path: "example.com/other"}}, want: develVersion},
+	}
+
+	for i, tt := range tests {
+		if got := versionFromBuildInfo(tt.bi); got != tt.want {
+			t.Errorf("#%d: got=%q want=%q", i, got, tt.want)
+		}
+	}
+}
+
+func TestVersionHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	for _, version := range []string{"", "v0.9.1"} {
+		lp := makeTestProxy(map[string][]string{"/": {backend.URL}})
+		lp.version = version
+
+		rec := httptest.NewRecorder()
+		lp.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		values := rec.Header().Values(versionHeader)
+		if version == "" {
+			if len(values) != 0 {
+				t.Errorf("disabled: got %q", values)
+			}
+			continue
+		}
+		if len(values) != 1 || values[0] != version {
+			t.Errorf("got %q want %q", values, version)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 orijtech. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frontender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/orijtech/frontender/lively"
+	"github.com/orijtech/otils"
+)
+
+// The states reported in a HealthTransition.
+const (
+	HealthLive    = "live"
+	HealthNonLive = "non-live"
+)
+
+// HealthTransition is the JSON payload POSTed to
+// HealthWebhookURL when a backend changes health state.
+type HealthTransition struct {
+	Route string    `json:"route"`
+	Addr  string    `json:"addr"`
+	State string    `json:"state"`
+	Time  time.Time `json:"timestamp"`
+}
+
+var (
+	// healthWebhookAttempts is the number of times that
+	// delivering a health transition is tried.
+	healthWebhookAttempts = 3
+
+	healthWebhookBackoff = time.Second
+)
+
+var healthWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// recordHealthLocked updates the health states of the backends of
+// route and returns the transitions. The first state observed for a
+// backend isn't a transition. lp.mu must be held.
+func (lp *livelyProxy) recordHealthLocked(route string, livePeers, nonLivePeers []*lively.Liveliness) (transitions []*HealthTransition) {
+	if lp.healthStates == nil {
+		lp.healthStates = make(map[string]map[string]bool)
+	}
+	states := lp.healthStates[route]
+	if states == nil {
+		states = make(map[string]bool)
+		lp.healthStates[route] = states
+	}
+
+	now := lp.clock.Now()
+	record := func(peers []*lively.Liveliness, live bool) {
+		for _, peer := range peers {
+			prev, seen := states[peer.Addr]
+			states[peer.Addr] = live
+			if !seen || prev == live {
+				continue
+			}
+			state := HealthNonLive
+			if live {
+				state = HealthLive
+			}
+			transitions = append(transitions, &HealthTransition{
+				Route: route,
+				Addr:  peer.Addr,
+				State: state,
+				Time:  now,
+			})
+		}
+	}
+	record(livePeers, true)
+	record(nonLivePeers, false)
+	return transitions
+}
+
+// queueHealthTransitionsLocked queues transitions to be POSTed after
+// those already pending. lp.mu must be held.
+func (lp *livelyProxy) queueHealthTransitionsLocked(transitions []*HealthTransition) {
+	lp.pendingTransitions = append(lp.pendingTransitions, transitions...)
+	if !lp.postingTransitions {
+		lp.postingTransitions = true
+		go lp.postHealthTransitions(lp.healthWebhookURL)
+	}
+}
+
+// postHealthTransitions POSTs the pending transitions to the webhook
+// one at a time, each after the previous one was delivered or given up
+// on, so that the webhook ends up with the latest state of a flapping
+// backend. It returns once there are no more pending transitions.
+func (lp *livelyProxy) postHealthTransitions(webhookURL string) {
+	for {
+		lp.mu.Lock()
+		if len(lp.pendingTransitions) == 0 {
+			lp.postingTransitions = false
+			lp.mu.Unlock()
+			return
+		}
+		transition := lp.pendingTransitions[0]
+		lp.pendingTransitions = lp.pendingTransitions[1:]
+		lp.mu.Unlock()
+
+		if err := postHealthTransition(webhookURL, transition); err != nil {
+			lp.logf("frontender: health webhook: %v", err)
+		}
+	}
+}
+
+func postHealthTransition(webhookURL string, transition *HealthTransition) error {
+	blob, err := json.Marshal(transition)
+	if err != nil {
+		return err
+	}
+
+	backoff := healthWebhookBackoff
+	for i := 0; i < healthWebhookAttempts; i++ {
+		if i > 0 {
+			<-time.After(backoff)
+			backoff *= 2
+		}
+		var res *http.Response
+		res, err = healthWebhookClient.Post(webhookURL, "application/json", bytes.NewReader(blob))
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if otils.StatusOK(res.StatusCode) {
+			return nil
+		}
+		err = fmt.Errorf("%s", res.Status)
+	}
+	return fmt.Errorf("delivering %s of %q for route %q: %v", transition.State, transition.Addr, transition.Route, err)
+}